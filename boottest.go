@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// The firmwares a stick is boot tested with
+const (
+	BootUEFI = "uefi"
+	BootBIOS = "bios"
+)
+
+const (
+	// bootTestConsoleLines is how much of the serial console a failed test keeps
+	bootTestConsoleLines = 20
+	// defaultBootPattern matches the systemd welcome and the login prompt of a Kairos live boot
+	defaultBootPattern = `(?i)welcome to .*kairos|kairos.* login:`
+)
+
+// ansiEscape matches the terminal escape sequences found on a serial console
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// BootTestConfig tells where QEMU and the UEFI firmware are and what a successful boot looks like
+type BootTestConfig struct {
+	// QEMU is the qemu-system-x86_64 binary, looked up in PATH when empty
+	QEMU string `json:"qemu"`
+	// Firmware is the OVMF code file for UEFI boots, the usual install locations are searched when empty
+	Firmware string `json:"firmware"`
+	// Timeout bounds each boot, software emulation is slow
+	Timeout Duration `json:"timeout"`
+	// Pattern is the regular expression a serial console line must match for the boot to pass
+	Pattern string `json:"pattern"`
+	// Memory is the RAM of the virtual machine in MB
+	Memory int `json:"memory"`
+}
+
+// ovmfLocations are where distributions and QEMU itself install OVMF, code first and its variables
+var ovmfLocations = [][2]string{
+	{"/usr/share/OVMF/OVMF_CODE_4M.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"},
+	{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+	{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+	{"/usr/share/edk2/x64/OVMF_CODE.4m.fd", "/usr/share/edk2/x64/OVMF_VARS.4m.fd"},
+	{"/usr/share/qemu/edk2-x86_64-code.fd", "/usr/share/qemu/edk2-i386-vars.fd"},
+	{"/opt/homebrew/share/qemu/edk2-x86_64-code.fd", "/opt/homebrew/share/qemu/edk2-i386-vars.fd"},
+	{"/usr/local/share/qemu/edk2-x86_64-code.fd", "/usr/local/share/qemu/edk2-i386-vars.fd"},
+	{`C:\Program Files\qemu\share\edk2-x86_64-code.fd`, `C:\Program Files\qemu\share\edk2-i386-vars.fd`},
+}
+
+// BootTestResult is the outcome of booting a stick with one firmware
+type BootTestResult struct {
+	Firmware string `json:"firmware"`
+	Passed   bool   `json:"passed"`
+	// Banner is the console line that matched the boot pattern
+	Banner string `json:"banner,omitempty"`
+	// Console is the end of the serial output when the boot failed, to tell where it stopped
+	Console  []string      `json:"console,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (r *BootTestResult) String() string {
+	if r.Passed {
+		return fmt.Sprintf("✅ %s boot reached %q in %s", strings.ToUpper(r.Firmware), r.Banner, r.Duration.Round(time.Second))
+	}
+	return fmt.Sprintf("❌ %s boot failed: %s", strings.ToUpper(r.Firmware), r.Error)
+}
+
+// qemuPath returns the QEMU binary to boot sticks with
+func qemuPath() (string, error) {
+	if appConfig.BootTest.QEMU != "" {
+		return appConfig.BootTest.QEMU, nil
+	}
+	if path, err := exec.LookPath("qemu-system-x86_64"); err == nil {
+		return path, nil
+	}
+	if runtime.GOOS == "windows" {
+		path := `C:\Program Files\qemu\qemu-system-x86_64.exe`
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("qemu-system-x86_64 not found, install QEMU or set boot_test.qemu in the config")
+}
+
+// ovmfFirmware returns the OVMF code file and its variables template, vars is empty when none was found
+func ovmfFirmware() (code, vars string, err error) {
+	if code = appConfig.BootTest.Firmware; code != "" {
+		dir, name := filepath.Split(code)
+		for _, r := range [][2]string{{"CODE", "VARS"}, {"code", "vars"}, {"x86_64-code", "i386-vars"}} {
+			if candidate := filepath.Join(dir, strings.Replace(name, r[0], r[1], 1)); candidate != code {
+				if _, err := os.Stat(candidate); err == nil {
+					return code, candidate, nil
+				}
+			}
+		}
+		return code, "", nil
+	}
+	for _, loc := range ovmfLocations {
+		if _, err := os.Stat(loc[0]); err != nil {
+			continue
+		}
+		if _, err := os.Stat(loc[1]); err != nil {
+			return loc[0], "", nil
+		}
+		return loc[0], loc[1], nil
+	}
+	return "", "", errors.New("no OVMF firmware found for UEFI, install OVMF or set boot_test.firmware in the config")
+}
+
+// BootTestAvailable returns why sticks can't be boot tested, nil when they can
+func BootTestAvailable() error {
+	_, err := qemuPath()
+	return err
+}
+
+// BootTest boots the stick at devicePath in QEMU with the UEFI or BIOS firmware and watches its serial
+// console for the boot pattern, passing the console lines to console as they come. QEMU emulates in
+// software when KVM is not available, and writes of the booted system go to a temporary overlay so the
+// stick is left as burned. The error is for tests that could not run, a boot that fails is a result
+func BootTest(ctx context.Context, devicePath, firmware string, console func(line string)) (*BootTestResult, error) {
+	cfg := appConfig.BootTest
+	pattern, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid boot_test.pattern: %w", err)
+	}
+	qemu, err := qemuPath()
+	if err != nil {
+		return nil, err
+	}
+	devicePath = rawDevicePath(devicePath)
+
+	accel := "tcg"
+	switch runtime.GOOS {
+	case "linux":
+		accel = "kvm:tcg"
+	case "darwin":
+		accel = "hvf:tcg"
+	}
+	args := []string{
+		"-machine", "q35,accel=" + accel,
+		"-m", fmt.Sprint(cfg.Memory),
+		"-smp", "2",
+		"-display", "none",
+		"-monitor", "none",
+		"-serial", "stdio",
+		"-no-reboot",
+		// Booted as a USB stick, which also checks the initramfs finds it there
+		"-device", "qemu-xhci",
+		"-drive", "if=none,id=stick,format=raw,snapshot=on,file=" + devicePath,
+		"-device", "usb-storage,drive=stick,bootindex=0",
+	}
+	switch firmware {
+	case BootBIOS:
+	case BootUEFI:
+		code, vars, err := ovmfFirmware()
+		if err != nil {
+			return nil, err
+		}
+		if vars == "" {
+			args = append(args, "-bios", code)
+			break
+		}
+		// The variables are written to while booting, each test gets a fresh copy
+		varsCopy, err := copyToTemp(vars)
+		if err != nil {
+			return nil, fmt.Errorf("copying the UEFI variables: %w", err)
+		}
+		defer os.Remove(varsCopy)
+		args = append(args,
+			"-drive", "if=pflash,format=raw,unit=0,readonly=on,file="+code,
+			"-drive", "if=pflash,format=raw,unit=1,file="+varsCopy)
+	default:
+		return nil, fmt.Errorf("unknown firmware %q, use %s or %s", firmware, BootUEFI, BootBIOS)
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Timeout))
+	defer cancel()
+	cmd := exec.CommandContext(runCtx, qemu, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// Don't wait on processes QEMU left behind holding its output
+	cmd.WaitDelay = 5 * time.Second
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdout.Close()
+	cmd.Stdout = w
+	started := time.Now()
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("starting QEMU: %w", err)
+	}
+	// Unblocks reading the console when the test times out or is cancelled
+	go func() {
+		<-runCtx.Done()
+		stdout.Close()
+	}()
+
+	result := &BootTestResult{Firmware: firmware}
+	var lines []string
+	var line []byte
+	buf := make([]byte, 4096)
+	for !result.Passed {
+		n, readErr := stdout.Read(buf)
+		for _, b := range buf[:n] {
+			switch b {
+			case '\n':
+				text := cleanConsoleLine(line)
+				line = line[:0]
+				if text == "" {
+					continue
+				}
+				if console != nil {
+					console(text)
+				}
+				if lines = append(lines, text); len(lines) > bootTestConsoleLines {
+					lines = lines[1:]
+				}
+				if pattern.MatchString(text) {
+					result.Passed, result.Banner = true, text
+				}
+			case '\r':
+			default:
+				line = append(line, b)
+			}
+		}
+		// Login prompts wait on the same line, without a newline
+		if text := cleanConsoleLine(line); !result.Passed && text != "" && pattern.MatchString(text) {
+			result.Passed, result.Banner = true, text
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	result.Duration = time.Since(started)
+	cancel()
+	waitErr := cmd.Wait()
+
+	if result.Passed {
+		return result, nil
+	}
+	result.Console = lines
+	switch {
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded):
+		result.Error = fmt.Sprintf("no boot banner within %s", time.Duration(cfg.Timeout))
+	case stderr.Len() > 0:
+		result.Error = "QEMU: " + lastLine(stderr.String())
+	case waitErr != nil:
+		result.Error = "QEMU: " + waitErr.Error()
+	default:
+		result.Error = "the machine powered off before the boot banner"
+	}
+	return result, nil
+}
+
+// cleanConsoleLine returns a serial console line without terminal escapes and surrounding spaces
+func cleanConsoleLine(line []byte) string {
+	return strings.TrimSpace(ansiEscape.ReplaceAllString(string(line), ""))
+}
+
+// lastLine returns the last non-empty line of s
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// copyToTemp copies the file at path to a temporary file and returns its path
+func copyToTemp(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp("", "kairos-boot-test-*"+filepath.Ext(path))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), dst.Close()
+}
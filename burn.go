@@ -1,67 +1,213 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/diamondburned/gotk4/pkg/glib/v2"
 	"github.com/diamondburned/gotk4/pkg/gtk/v4"
 	"io"
 	"os"
-	"strings"
+	"path/filepath"
 )
 
 const (
 	BufferSize = 4 * 1024 * 1024 // 4MB buffer
 )
 
-// Burn writes the ISO file to the USB device with progress updates
-func Burn(isoPath, drive string, progress *gtk.ProgressBar, status *gtk.Label, exitBtn *gtk.Button) {
-	// Get the global variables containing selected ISO and drive
+// BurnOptions is what Burn writes to a drive
+type BurnOptions struct {
+	ISO string
+	// CloudConfig is written to a config partition after the image, see InjectCloudConfig, or inside a
+	// remastered copy of the ISO when EmbedCloudConfig is set, see RemasterISO
+	CloudConfig      string
+	EmbedCloudConfig bool
+	// Mode BurnFAT32 copies the files of the ISO to a FAT32 partition, see WriteFAT32Layout
+	Mode BurnMode
+	// Persistence adds a persistent partition last, see AddPersistentPartition
+	Persistence Persistence
+	// Device is the drive to write to, like /dev/sdb, or a loop device or a regular file to test burns
+	// without a drive, see targetKind
+	Device string
+	// TargetSize is the size a regular file target is made, 0 keeps an existing file and makes a missing
+	// one just big enough for the image
+	TargetSize int64
+}
 
-	// Validate paths
-	if isoPath == "" || drive == "" {
-		glib.IdleAdd(func() {
-			status.SetLabel("Error: No ISO or drive selected")
-			exitBtn.SetSensitive(true)
-		})
-		return
+// RunBurn writes the image to the drive as opts say. report is told each step and, when known, the
+// fraction of it done, -1 otherwise. The steps also go to the event stream, if any
+func RunBurn(opts BurnOptions, report func(status string, fraction float64)) (err error) {
+	events := appEvents.job("burn", opts.Device)
+	defer func() {
+		if err != nil {
+			events.Error(err)
+		} else {
+			events.Done("burned " + filepath.Base(opts.ISO))
+		}
+	}()
+	// phaseSize is the bytes of the current step, to turn fractions into throughput
+	var phaseSize int64
+	ui := report
+	report = func(status string, fraction float64) {
+		if fraction >= 0 {
+			events.Fraction(fraction, phaseSize)
+		}
+		ui(status, fraction)
 	}
 
-	// Extract raw device path from the drive string (which might include description)
-	devicePath := strings.Fields(drive)[0]
-
-	// Format the drive with GPT before burning
-	glib.IdleAdd(func() {
-		status.SetLabel("Formatting drive...")
-	})
-	err := FormatDriveGPT(devicePath)
-	if err != nil {
-		reportError(status, exitBtn, fmt.Sprintf("Error formatting drive: %v", err))
-		return
+	if opts.ISO == "" || opts.Device == "" {
+		return errors.New("no ISO or drive selected")
+	}
+	if err := opts.Persistence.Validate(); err != nil {
+		return err
+	}
+	isoPath, cloudConfigPath, devicePath := opts.ISO, opts.CloudConfig, opts.Device
+
+	var extra []fatFile
+	if cloudConfigPath != "" && opts.EmbedCloudConfig && opts.Mode == BurnFAT32 {
+		// The files are copied anyway, the config goes along without remastering
+		cloudConfig, err := os.ReadFile(cloudConfigPath)
+		if err != nil {
+			return fmt.Errorf("embedding the cloud-config: %w", err)
+		}
+		extra = append(extra, fatFile{Name: remasterConfigName, Data: cloudConfig})
+		cloudConfigPath = ""
+	} else if cloudConfigPath != "" && opts.EmbedCloudConfig {
+		events.Phase("remaster", "embedding the cloud-config in a copy of the ISO")
+		if info, err := os.Stat(isoPath); err == nil {
+			phaseSize = info.Size()
+		}
+		remastered, err := remasterForBurn(isoPath, cloudConfigPath, report)
+		if err != nil {
+			return fmt.Errorf("embedding the cloud-config: %w", err)
+		}
+		defer os.Remove(remastered)
+		isoPath, cloudConfigPath = remastered, ""
 	}
 
-	// Get file size for progress calculation
-	fileInfo, err := os.Stat(isoPath)
+	kind, err := targetKind(devicePath)
 	if err != nil {
-		reportError(status, exitBtn, fmt.Sprintf("Error accessing ISO: %v", err))
-		return
+		return err
+	}
+	var totalSize, required int64
+	if opts.Mode == BurnImage {
+		fileInfo, err := os.Stat(isoPath)
+		if err != nil {
+			return fmt.Errorf("accessing ISO: %w", err)
+		}
+		totalSize = fileInfo.Size()
+		required = RequiredDriveSize(totalSize, cloudConfigPath != "", opts.Persistence)
+	}
+	if kind == TargetFile {
+		if err := createFileTarget(devicePath, opts.TargetSize, required); err != nil {
+			return err
+		}
+	}
+	// Refuse drives that are too small before touching them, rather than fail partway through
+	if required > 0 {
+		if err := checkDriveCapacity(devicePath, required); err != nil {
+			return err
+		}
 	}
 
-	totalSize := fileInfo.Size()
+	// Format the drive with GPT before burning
+	events.Phase("format", "wiping the partition tables")
+	report("Formatting drive...", -1)
+	if err := prepareTarget(devicePath); err != nil {
+		return fmt.Errorf("formatting drive: %w", err)
+	}
 
-	err = reallyBurn(isoPath, devicePath, totalSize, progress, status)
-	// Handle result
-	if err != nil {
-		reportError(status, exitBtn, fmt.Sprintf("Error during burn: %v", err))
+	if opts.Mode == BurnFAT32 {
+		events.Phase("copy", "copying the files of the ISO to FAT32")
+		phaseSize = 0
+		lastPercent := int64(-1)
+		var err error
+		totalSize, err = WriteFAT32Layout(isoPath, devicePath, extra, func(done, total int64) {
+			if percent := done * 100 / total; percent != lastPercent {
+				lastPercent = percent
+				report(fmt.Sprintf("Copying files to FAT32... %d%%", percent), float64(percent)/100)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("during burn: %w", err)
+		}
 	} else {
+		events.Phase("write", "writing the image")
+		phaseSize = totalSize
+		if err := reallyBurn(isoPath, devicePath, totalSize, report); err != nil {
+			return fmt.Errorf("during burn: %w", err)
+		}
+	}
+
+	if cloudConfigPath != "" {
+		events.Phase("cloud-config", "adding the cloud-config partition")
+		report("Writing cloud-config...", -1)
+		cloudConfig, err := os.ReadFile(cloudConfigPath)
+		if err == nil {
+			err = InjectCloudConfig(devicePath, totalSize, cloudConfig)
+		}
+		if err != nil {
+			return fmt.Errorf("the ISO was burned but writing the cloud-config failed: %w", err)
+		}
+	}
+
+	if opts.Persistence.Enabled() {
+		events.Phase("persistence", "adding the persistent partition")
+		report("Creating the persistent partition...", -1)
+		if err := AddPersistentPartition(devicePath, totalSize, opts.Persistence); err != nil {
+			return fmt.Errorf("the ISO was burned but creating the persistent partition failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// Burn runs RunBurn showing its progress in the burn screen, exitBtn is enabled once it is over
+func Burn(opts BurnOptions, progress *gtk.ProgressBar, status *gtk.Label, exitBtn *gtk.Button) error {
+	err := RunBurn(opts, func(message string, fraction float64) {
 		glib.IdleAdd(func() {
-			status.SetLabel("Burn complete! 🔥")
-			exitBtn.SetSensitive(true)
+			if fraction >= 0 {
+				progress.SetFraction(fraction)
+			}
+			status.SetLabel(message)
 		})
+	})
+	if err != nil {
+		reportError(status, exitBtn, "Error: "+err.Error())
+		return err
+	}
+	glib.IdleAdd(func() {
+		status.SetLabel("Burn complete! 🔥")
+		exitBtn.SetSensitive(true)
+	})
+	return nil
+}
+
+// remasterForBurn writes a copy of the ISO with the cloud-config embedded to the cache directory and
+// returns its path, the caller removes it after burning
+func remasterForBurn(isoPath, cloudConfigPath string, report func(status string, fraction float64)) (string, error) {
+	cloudConfig, err := os.ReadFile(cloudConfigPath)
+	if err != nil {
+		return "", err
+	}
+	dir, err := userCacheDir()
+	if err != nil {
+		return "", err
 	}
+	if err := mkdirUserDir(dir); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, "remastered-"+filepath.Base(isoPath))
+	lastPercent := -1
+	err = RemasterISOFile(isoPath, dst, remasterConfigName, cloudConfig, func(done, total int64) {
+		if percent := int(done * 100 / total); percent != lastPercent {
+			lastPercent = percent
+			report(fmt.Sprintf("Embedding cloud-config... %d%%", percent), float64(percent)/100)
+		}
+	})
+	return dst, err
 }
 
 // copyWithProgress copies data from src to dst with progress updates
-func copyWithProgress(src io.Reader, dst io.Writer, totalSize int64, progress *gtk.ProgressBar, status *gtk.Label) error {
+func copyWithProgress(src io.Reader, dst io.Writer, totalSize int64, report func(status string, fraction float64)) error {
 	buf := make([]byte, BufferSize)
 	written := int64(0)
 
@@ -84,15 +230,9 @@ func copyWithProgress(src io.Reader, dst io.Writer, totalSize int64, progress *g
 		percent := float64(written) / float64(totalSize)
 		percentInt := int(percent * 100)
 		if percentInt >= 100 {
-			glib.IdleAdd(func() {
-				progress.SetFraction(percent)
-				status.SetLabel("Finalizing...")
-			})
+			report("Finalizing...", percent)
 		} else {
-			glib.IdleAdd(func() {
-				progress.SetFraction(percent)
-				status.SetLabel(fmt.Sprintf("Burning... %d%%", percentInt))
-			})
+			report(fmt.Sprintf("Burning... %d%%", percentInt), percent)
 		}
 
 	}
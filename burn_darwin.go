@@ -4,14 +4,12 @@ package main
 
 import (
 	"fmt"
-	"github.com/diamondburned/gotk4/pkg/gtk/v4"
 	"os"
 	"os/exec"
-	"strings"
 	"syscall"
 )
 
-func reallyBurn(isoPath, devicePath string, totalSize int64, progress *gtk.ProgressBar, status *gtk.Label) error {
+func reallyBurn(isoPath, devicePath string, totalSize int64, report func(status string, fraction float64)) error {
 	// Open ISO file for reading
 	isoFile, err := os.Open(isoPath)
 	if err != nil {
@@ -22,7 +20,7 @@ func reallyBurn(isoPath, devicePath string, totalSize int64, progress *gtk.Progr
 	// Open device file for writing
 	// Write to rdisk. disk goes through the OS cache, rdisk writes directly to the device, its more like a raw block device
 	// This speeds up the process significantly
-	devicePath = strings.Replace(devicePath, "disk", "rdisk", 1)
+	devicePath = rawDevicePath(devicePath)
 	deviceFile, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
 	if err != nil {
 		return fmt.Errorf("failed to open device %s: %w", devicePath, err)
@@ -30,7 +28,7 @@ func reallyBurn(isoPath, devicePath string, totalSize int64, progress *gtk.Progr
 	defer deviceFile.Close()
 
 	// Copy with progress tracking
-	return copyWithProgress(isoFile, deviceFile, totalSize, progress, status)
+	return copyWithProgress(isoFile, deviceFile, totalSize, report)
 }
 
 func Sync() {
@@ -4,12 +4,11 @@ package main
 
 import (
 	"fmt"
-	"github.com/diamondburned/gotk4/pkg/gtk/v4"
 	"os"
 	"syscall"
 )
 
-func reallyBurn(isoPath, devicePath string, totalSize int64, progress *gtk.ProgressBar, status *gtk.Label) error {
+func reallyBurn(isoPath, devicePath string, totalSize int64, report func(status string, fraction float64)) error {
 	// Open ISO file for reading
 	isoFile, err := os.Open(isoPath)
 	if err != nil {
@@ -25,14 +24,25 @@ func reallyBurn(isoPath, devicePath string, totalSize int64, progress *gtk.Progr
 	defer deviceFile.Close()
 
 	// Copy with progress tracking
-	return copyWithProgress(isoFile, deviceFile, totalSize, progress, status)
+	return copyWithProgress(isoFile, deviceFile, totalSize, report)
 }
 
 func Sync() {
 	syscall.Sync()
 }
 
+// FormatDriveGPT wipes the partition tables of the drive, the image brings its own. The old tables are
+// cleared so a stale backup GPT at the end of the drive isn't mistaken for the image's
 func FormatDriveGPT(deviceID string) error {
-	panic("Implement!")
+	device, err := os.OpenFile(deviceID, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open device %s: %w", deviceID, err)
+	}
+	defer device.Close()
+	if err := wipePartitionTables(device); err != nil {
+		return fmt.Errorf("failed to wipe %s: %w", deviceID, err)
+	}
+	// Best effort, the partitions of the image are read again after it is written
+	_ = rereadPartitions(device)
 	return nil
 }
@@ -4,8 +4,6 @@ package main
 
 import (
 	"fmt"
-	"github.com/diamondburned/gotk4/pkg/glib/v2"
-	"github.com/diamondburned/gotk4/pkg/gtk/v4"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,9 +11,9 @@ import (
 	"time"
 )
 
-func reallyBurn(isoPath, devicePath string, totalSize int64, progress *gtk.ProgressBar, status *gtk.Label) error {
+func reallyBurn(isoPath, devicePath string, totalSize int64, report func(status string, fraction float64)) error {
 	// Format device path for Windows (e.g., "\\.\PHYSICALDRIVE1")
-	fmt.Println("Device Path:", devicePath)
+	logln("Device Path:", devicePath)
 
 	// Open ISO file for reading
 	isoFile, err := os.Open(isoPath)
@@ -23,28 +21,26 @@ func reallyBurn(isoPath, devicePath string, totalSize int64, progress *gtk.Progr
 		return fmt.Errorf("failed to open ISO file: %w", err)
 	}
 	defer isoFile.Close()
-	fmt.Println("ISO File:", isoPath)
+	logln("ISO File:", isoPath)
 	// Open device for writing
 	deviceFile, err := os.OpenFile(devicePath, os.O_WRONLY, 0)
 	if err != nil {
 		// Fallback to using PowerShell commands
-		return burnWithPowerShell(isoPath, devicePath, totalSize, progress, status)
+		return burnWithPowerShell(isoPath, devicePath, totalSize, report)
 	}
 	defer deviceFile.Close()
-	fmt.Println("burning")
-	glib.IdleAdd(func() {
-		status.SetLabel("Starting burn...")
-	})
+	logln("burning")
+	report("Starting burn...", -1)
 
 	// Copy with progress
-	return copyWithProgress(isoFile, deviceFile, totalSize, progress, status)
+	return copyWithProgress(isoFile, deviceFile, totalSize, report)
 }
 
 // burnWithPowerShell is a fallback method for Windows when direct access fails
 // This path is not really tested...
-func burnWithPowerShell(isoPath, devicePath string, totalSize int64, progress *gtk.ProgressBar, status *gtk.Label) error {
+func burnWithPowerShell(isoPath, devicePath string, totalSize int64, report func(status string, fraction float64)) error {
 	// PowerShell command to write ISO to disk
-	fmt.Println("burning with powershell")
+	logln("burning with powershell")
 	psCmd := fmt.Sprintf(
 		"$bytes = [System.IO.File]::ReadAllBytes('%s'); "+
 			"$file = [System.IO.File]::OpenWrite('%s'); "+
@@ -67,11 +63,7 @@ func burnWithPowerShell(isoPath, devicePath string, totalSize int64, progress *g
 
 			time.Sleep(time.Duration(totalSize/int64(100*BufferSize)) * time.Millisecond)
 
-			percent := float64(i) / 100.0
-			glib.IdleAdd(func() {
-				progress.SetFraction(percent)
-				status.SetLabel(fmt.Sprintf("Burning... %d%%", i))
-			})
+			report(fmt.Sprintf("Burning... %d%%", i), float64(i)/100.0)
 		}
 	}()
 
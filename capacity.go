@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"os"
+	"time"
+)
+
+const (
+	// capacityBlockSize is the size of each sample written to the drive
+	capacityBlockSize = 1024 * 1024
+	// capacityMinSamples is the fewest samples spread over a drive, more on drives that aren't a power of two
+	capacityMinSamples = 128
+)
+
+// capacityMagic starts every sample, followed by the run nonce and the offset of the sample
+var capacityMagic = []byte("KAIROSCAPACITY\x00\x00")
+
+// CapacityReport is the result of ProbeCapacity on a drive
+type CapacityReport struct {
+	Device string `json:"device"`
+	// Reported is the size the drive claims
+	Reported int64 `json:"reported"`
+	// Usable is where the samples start failing for good, the real capacity is at most this
+	Usable  int64 `json:"usable"`
+	Samples int   `json:"samples"`
+	// BadSamples failed below Usable, a sign of bad blocks rather than a fake capacity
+	BadSamples int       `json:"bad_samples"`
+	Tested     time.Time `json:"tested"`
+}
+
+// Fake tells if the drive holds less than it claims
+func (r *CapacityReport) Fake() bool {
+	return r.Usable < r.Reported
+}
+
+func (r *CapacityReport) String() string {
+	gb := func(n int64) float64 { return float64(n) / (1024 * 1024 * 1024) }
+	switch {
+	case r.Fake() && r.BadSamples > 0:
+		return fmt.Sprintf("❌ Fake capacity: the drive claims %.2f GB but holds at most %.2f GB, and %d samples below that failed", gb(r.Reported), gb(r.Usable), r.BadSamples)
+	case r.Fake():
+		return fmt.Sprintf("❌ Fake capacity: the drive claims %.2f GB but holds at most %.2f GB", gb(r.Reported), gb(r.Usable))
+	case r.BadSamples > 0:
+		return fmt.Sprintf("⚠ The %.2f GB capacity is real but %d of %d samples failed, the drive has bad blocks", gb(r.Reported), r.BadSamples, r.Samples)
+	}
+	return fmt.Sprintf("✅ Real capacity of %.2f GB, all %d samples read back", gb(r.Reported), r.Samples)
+}
+
+// ProbeDriveCapacity checks the real capacity of the drive at devicePath, destroying its data, see ProbeCapacity
+func ProbeDriveCapacity(devicePath string, full bool, progress func(done, total int64)) (*CapacityReport, error) {
+	devicePath = rawDevicePath(devicePath)
+	device, err := os.OpenFile(devicePath, os.O_RDWR|os.O_SYNC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %s: %w", devicePath, err)
+	}
+	defer device.Close()
+	size, err := deviceSize(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the size of %s: %w", devicePath, err)
+	}
+	report, err := ProbeCapacity(device, size, full, func() error { return dropDeviceCache(device) }, progress)
+	if report != nil {
+		report.Device = devicePath
+	}
+	return report, err
+}
+
+// ProbeCapacity finds how much of a drive of size bytes really holds data, like f3probe. Counterfeit
+// drives wrap writes past their real capacity onto lower addresses, or drop them. Samples tagged with
+// their offset are written from the end of the drive down, so the genuine low samples are written last
+// and overwrite the aliases of the high ones. The samples are a power of two apart, where fakes wrap,
+// or cover the whole drive when full is set, which takes as long as filling it. flush must make the
+// reads that follow come from the drive rather than a cache. Every sample is then read back, the usable
+// size is from where most samples fail
+func ProbeCapacity(dev interface {
+	io.ReaderAt
+	io.WriterAt
+}, size int64, full bool, flush func() error, progress func(done, total int64)) (*CapacityReport, error) {
+	if size < capacityBlockSize {
+		return nil, fmt.Errorf("drive of %d bytes is too small to test", size)
+	}
+	// A power of two step lands the aliases of wrapped writes on other samples
+	step := int64(capacityBlockSize)
+	for !full && size/(step*2) >= capacityMinSamples {
+		step *= 2
+	}
+	var offsets []int64
+	for off := int64(0); off+capacityBlockSize <= size; off += step {
+		offsets = append(offsets, off)
+	}
+
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	total := int64(2 * len(offsets))
+	done := int64(0)
+	report := progress
+	if report == nil {
+		report = func(done, total int64) {}
+	}
+
+	// Failed writes are failed samples, fakes may reject writes past their capacity
+	failed := make([]bool, len(offsets))
+	block := make([]byte, capacityBlockSize)
+	for i := len(offsets) - 1; i >= 0; i-- {
+		capacitySample(block, nonce, offsets[i])
+		if _, err := dev.WriteAt(block, offsets[i]); err != nil {
+			failed[i] = true
+		}
+		done++
+		report(done, total)
+	}
+	if err := flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush the drive: %w", err)
+	}
+	expected := make([]byte, capacityBlockSize)
+	for i, off := range offsets {
+		if !failed[i] {
+			capacitySample(expected, nonce, off)
+			n, _ := dev.ReadAt(block, off)
+			failed[i] = n != len(block) || !bytes.Equal(block, expected)
+		}
+		done++
+		report(done, total)
+	}
+
+	// Past the real capacity samples fail, except the odd alias that landed between samples. A single
+	// failure at the end is a bad block like any other
+	r := &CapacityReport{Reported: size, Usable: size, Samples: len(offsets), Tested: time.Now()}
+	failures := 0
+	for i := len(offsets) - 1; i >= 0; i-- {
+		if failed[i] {
+			failures++
+			if failures >= 2 && failures*2 >= len(offsets)-i {
+				r.Usable = offsets[i]
+			}
+		}
+	}
+	for i, off := range offsets {
+		if failed[i] && off < r.Usable {
+			r.BadSamples++
+		}
+	}
+	return r, nil
+}
+
+// capacitySample fills block with the sample for offset: the magic, the nonce of the run, the offset,
+// then pseudo-random bytes seeded by both so no two samples are alike
+func capacitySample(block []byte, nonce [8]byte, offset int64) {
+	copy(block, capacityMagic)
+	copy(block[16:], nonce[:])
+	binary.LittleEndian.PutUint64(block[24:], uint64(offset))
+	rng := mathrand.NewPCG(binary.LittleEndian.Uint64(nonce[:]), uint64(offset))
+	for i := 32; i+8 <= len(block); i += 8 {
+		binary.LittleEndian.PutUint64(block[i:], rng.Uint64())
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// testDrive is a drive in memory holding real bytes of the size it claims. Past real, writes wrap
+// around onto lower addresses like most counterfeit sticks, or are dropped, or fail. The probe only
+// writes and reads whole blocks, which are kept by offset
+type testDrive struct {
+	real       int64
+	wrap       bool
+	failWrites bool
+	// bad is the offset of a block reading back corrupted, -1 for none
+	bad    int64
+	blocks map[int64][]byte
+}
+
+func (d *testDrive) WriteAt(p []byte, off int64) (int, error) {
+	if off >= d.real {
+		switch {
+		case d.failWrites:
+			return 0, errors.New("write error")
+		case !d.wrap:
+			return len(p), nil
+		}
+		off %= d.real
+	}
+	d.blocks[off] = append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (d *testDrive) ReadAt(p []byte, off int64) (int, error) {
+	if d.wrap {
+		off %= d.real
+	}
+	clear(p)
+	if off < d.real {
+		copy(p, d.blocks[off])
+	}
+	if off == d.bad {
+		p[100] ^= 0xFF
+	}
+	return len(p), nil
+}
+
+func TestProbeCapacity(t *testing.T) {
+	const mib = 1024 * 1024
+	tests := []struct {
+		name        string
+		size        int64
+		drive       testDrive
+		full        bool
+		wantUsable  int64
+		wantSamples int
+		wantBad     int
+		wantErr     bool
+	}{
+		{name: "honest", size: 64 * mib, drive: testDrive{real: 64 * mib, bad: -1}, wantUsable: 64 * mib, wantSamples: 64},
+		{name: "honest full", size: 8 * mib, drive: testDrive{real: 8 * mib, bad: -1}, full: true, wantUsable: 8 * mib, wantSamples: 8},
+		// The samples are spread a power of two apart, 4MiB on a 512MiB drive
+		{name: "honest large", size: 512 * mib, drive: testDrive{real: 512 * mib, bad: -1}, wantUsable: 512 * mib, wantSamples: 128},
+		{name: "bad block", size: 64 * mib, drive: testDrive{real: 64 * mib, bad: 8 * mib}, wantUsable: 64 * mib, wantSamples: 64, wantBad: 1},
+		{name: "bad last block", size: 64 * mib, drive: testDrive{real: 64 * mib, bad: 63 * mib}, wantUsable: 64 * mib, wantSamples: 64, wantBad: 1},
+		{name: "wraps", size: 64 * mib, drive: testDrive{real: 16 * mib, wrap: true, bad: -1}, wantUsable: 16 * mib, wantSamples: 64},
+		{name: "wraps large", size: 512 * mib, drive: testDrive{real: 64 * mib, wrap: true, bad: -1}, wantUsable: 64 * mib, wantSamples: 128},
+		{name: "wraps full", size: 32 * mib, drive: testDrive{real: 24 * mib, wrap: true, bad: -1}, full: true, wantUsable: 24 * mib, wantSamples: 32},
+		{name: "wraps with a bad block", size: 64 * mib, drive: testDrive{real: 48 * mib, wrap: true, bad: 4 * mib}, wantUsable: 48 * mib, wantSamples: 64, wantBad: 1},
+		{name: "drops writes", size: 64 * mib, drive: testDrive{real: 16 * mib, bad: -1}, wantUsable: 16 * mib, wantSamples: 64},
+		{name: "fails writes", size: 64 * mib, drive: testDrive{real: 16 * mib, failWrites: true, bad: -1}, wantUsable: 16 * mib, wantSamples: 64},
+		{name: "too small", size: mib / 2, drive: testDrive{real: mib / 2, bad: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drive := tt.drive
+			drive.blocks = make(map[int64][]byte)
+			flushed := false
+			var lastDone, lastTotal int64
+			report, err := ProbeCapacity(&drive, tt.size, tt.full, func() error {
+				flushed = true
+				return nil
+			}, func(done, total int64) {
+				lastDone, lastTotal = done, total
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ProbeCapacity() = %+v, want an error", report)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !flushed {
+				t.Error("the drive wasn't flushed before reading back")
+			}
+			if lastTotal != int64(2*tt.wantSamples) || lastDone != lastTotal {
+				t.Errorf("progress ended at %d of %d, want %d", lastDone, lastTotal, 2*tt.wantSamples)
+			}
+			if report.Reported != tt.size || report.Usable != tt.wantUsable || report.Samples != tt.wantSamples || report.BadSamples != tt.wantBad {
+				t.Errorf("ProbeCapacity() = %+v, want %d usable of %d, %d samples, %d bad", report, tt.wantUsable, tt.size, tt.wantSamples, tt.wantBad)
+			}
+			if report.Fake() != (tt.wantUsable < tt.size) {
+				t.Errorf("Fake() = %v", report.Fake())
+			}
+		})
+	}
+}
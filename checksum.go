@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// checksumAssetFor returns the checksum asset published next to asset, if any.
+// Kairos publishes a <name>.sha256 for each artifact
+func checksumAssetFor(asset ReleaseAsset, assets []ReleaseAsset) (ReleaseAsset, bool) {
+	for _, a := range assets {
+		if a.Version == asset.Version && a.Name == asset.Name+".sha256" {
+			return a, true
+		}
+	}
+	return ReleaseAsset{}, false
+}
+
+// fetchChecksum downloads the checksum file at url and returns the sha256 for name
+func fetchChecksum(ctx context.Context, url, name string) (string, error) {
+	data, err := fetchSmallFile(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	return parseChecksumFile(data, name)
+}
+
+// fetchSmallFile downloads a checksum or signature file into memory
+func fetchSmallFile(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	// These files are tiny, anything bigger is not what we expect
+	return io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+}
+
+// parseChecksumFile finds the sha256 for name in the output of sha256sum (one "<hash>  <file>" per line).
+// A file with a single hash and no name, as in some .sha256 files, matches any name
+func parseChecksumFile(data []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var single string
+	lines := 0
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		lines++
+		if !isSHA256(fields[0]) {
+			continue
+		}
+		if len(fields) == 1 {
+			single = fields[0]
+			continue
+		}
+		// sha256sum marks binary mode with a leading '*'
+		file := strings.TrimPrefix(fields[1], "*")
+		if file == name || filepath.Base(file) == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if single != "" && lines == 1 {
+		return strings.ToLower(single), nil
+	}
+	return "", fmt.Errorf("no checksum for %s found", name)
+}
+
+func isSHA256(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
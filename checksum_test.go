@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseChecksumFile(t *testing.T) {
+	const (
+		hashA = "3a7bd3e2360a3d29eea436fcfb7e44c735d117c42d1c1835420b6b9942dd4f1b"
+		hashB = "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"
+	)
+	tests := []struct {
+		name    string
+		data    string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{name: "sha256sum", data: hashA + "  kairos.iso\n" + hashB + "  kairos.iso.sig\n", file: "kairos.iso", want: hashA},
+		{name: "second line", data: hashA + "  kairos.iso\n" + hashB + "  kairos.iso.sig\n", file: "kairos.iso.sig", want: hashB},
+		{name: "binary mode", data: hashA + " *kairos.iso\n", file: "kairos.iso", want: hashA},
+		{name: "path", data: hashA + "  build/out/kairos.iso\n", file: "kairos.iso", want: hashA},
+		{name: "upper case", data: strings.ToUpper(hashA) + "  kairos.iso\n", file: "kairos.iso", want: hashA},
+		{name: "comments and blank lines", data: "# release v3.1.0\n\n" + hashA + "  kairos.iso\n", file: "kairos.iso", want: hashA},
+		{name: "crlf", data: hashA + "  kairos.iso\r\n", file: "kairos.iso", want: hashA},
+		{name: "hash only", data: hashA + "\n", file: "kairos.iso", want: hashA},
+		{name: "hash only with others", data: hashA + "\n" + hashB + "  other.iso\n", file: "kairos.iso", wantErr: true},
+		{name: "other file", data: hashA + "  other.iso\n", file: "kairos.iso", wantErr: true},
+		{name: "prefix of the name", data: hashA + "  kairos.iso.sig\n", file: "kairos.iso", wantErr: true},
+		{name: "not a sha256", data: "d41d8cd98f00b204e9800998ecf8427e  kairos.iso\n", file: "kairos.iso", wantErr: true},
+		{name: "not hex", data: strings.Repeat("z", 64) + "  kairos.iso\n", file: "kairos.iso", wantErr: true},
+		{name: "empty", data: "", file: "kairos.iso", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseChecksumFile([]byte(tt.data), tt.file)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseChecksumFile() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("parseChecksumFile() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChecksumAssetFor(t *testing.T) {
+	assets := []ReleaseAsset{
+		{Version: "v3.1.0", Name: "kairos.iso"},
+		{Version: "v3.0.0", Name: "kairos.iso.sha256", URL: "old"},
+		{Version: "v3.1.0", Name: "kairos.iso.sha256", URL: "new"},
+		{Version: "v3.1.0", Name: "other.iso"},
+	}
+	tests := []struct {
+		name    string
+		asset   ReleaseAsset
+		wantURL string
+		wantOK  bool
+	}{
+		{"same version", ReleaseAsset{Version: "v3.1.0", Name: "kairos.iso"}, "new", true},
+		{"older version", ReleaseAsset{Version: "v3.0.0", Name: "kairos.iso"}, "old", true},
+		{"not published", ReleaseAsset{Version: "v3.1.0", Name: "other.iso"}, "", false},
+		{"other release", ReleaseAsset{Version: "v2.0.0", Name: "kairos.iso"}, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := checksumAssetFor(tt.asset, assets)
+		if ok != tt.wantOK || got.URL != tt.wantURL {
+			t.Errorf("%s: checksumAssetFor() = %+v, %v, want %q, %v", tt.name, got, ok, tt.wantURL, tt.wantOK)
+		}
+	}
+}
+
+func TestFetchChecksum(t *testing.T) {
+	const hash = "3a7bd3e2360a3d29eea436fcfb7e44c735d117c42d1c1835420b6b9942dd4f1b"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/kairos.iso.sha256" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(hash + "  kairos.iso\n"))
+	}))
+	defer server.Close()
+
+	got, err := fetchChecksum(context.Background(), server.URL+"/kairos.iso.sha256", "kairos.iso")
+	if err != nil || got != hash {
+		t.Errorf("fetchChecksum() = %q, %v, want %q", got, err, hash)
+	}
+	var statusErr *httpStatusError
+	if _, err := fetchChecksum(context.Background(), server.URL+"/missing.sha256", "kairos.iso"); !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotFound {
+		t.Errorf("fetchChecksum() of a missing file = %v, want a 404", err)
+	}
+}
@@ -0,0 +1,893 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// cliCommand is a subcommand that runs without the GUI
+type cliCommand struct {
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+// Errors of the burn command before anything is written, with their own event codes
+var (
+	errNotConfirmed       = errors.New("not confirmed")
+	errDeviceMounted      = errors.New("the drive is mounted")
+	errInvalidCloudConfig = errors.New("invalid cloud-config")
+)
+
+// cliCommands are dispatched by runCLI, anything else on the command line goes to GTK
+var cliCommands map[string]cliCommand
+
+// The commands are set in init as their usage refers back to the table
+func init() {
+	cliCommands = map[string]cliCommand{
+		"burn": {
+			usage:   "burn -yes [-profile name] [-iso file] [-config file] [-embed] [-fat32] [-persistence ext4] [-persistence-size size] [-verify policy] [-boot-test] [-size size] [-dry-run [-json]] [-events dest] <device or file>",
+			summary: "Burn an ISO or a burn profile from the config to a drive, a loop device or an image file, the options override the profile",
+			run:     cliBurn,
+		},
+		"boottest": {
+			usage:   "boottest [-firmware uefi|bios|both] [-console] [-json] <device>",
+			summary: "Boot a burned drive in QEMU and watch its serial console for the Kairos boot banner",
+			run:     cliBootTest,
+		},
+		"capacity": {
+			usage:   "capacity -yes [-full] [-json] <device>",
+			summary: "Check a drive for a fake capacity, erasing it, -full writes the whole drive",
+			run:     cliCapacity,
+		},
+		"download": {
+			usage:   "download [-version v] [-o dir] [-limit rate] [-events dest] <asset name or regex>...",
+			summary: "Download release assets into the library, type a new rate and Enter to change the limit",
+			run:     cliDownload,
+		},
+		"health": {
+			usage:   "health -yes [-thorough] [-json] <device>",
+			summary: "Test a drive for bad sectors and measure its speeds, erasing it, -thorough runs four patterns",
+			run:     cliHealth,
+		},
+		"inspect": {
+			usage:   "inspect [-json] <iso>...",
+			summary: "Show the volume label, boot entries, partitions and os-release of ISOs",
+			run:     cliInspect,
+		},
+		"mirror": {
+			usage:   "mirror [-dir d] [-versions regex] [-latest n] [-flavors regex]",
+			summary: "Copy releases and their ISOs into a directory or drive to use offline with release_source \"mirror\"",
+			run:     cliMirror,
+		},
+		"profiles": {
+			usage:   "profiles [-json]",
+			summary: "List the burn profiles of the config",
+			run:     cliProfiles,
+		},
+		"remaster": {
+			usage:   "remaster -config file -o out.iso [-name config.yaml] <iso>",
+			summary: "Write a copy of an ISO with a cloud-config embedded, keeping it bootable",
+			run:     cliRemaster,
+		},
+		"validate": {
+			usage:   "validate <cloud-config file>...",
+			summary: "Check cloud-configs against the Kairos schema, - reads from stdin",
+			run:     cliValidate,
+		},
+	}
+}
+
+// runCLI runs the subcommand in args, if any. It returns false when args are not a subcommand
+func runCLI(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		cliUsage()
+		return 0, true
+	}
+	cmd, ok := cliCommands[args[0]]
+	if !ok {
+		return 0, false
+	}
+	switch err := cmd.run(args[1:]); {
+	case errors.Is(err, context.Canceled):
+		// Interrupted with Ctrl-C, no error to print, with the status shells give SIGINT
+		return 130, true
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1, true
+	}
+	return 0, true
+}
+
+func cliUsage() {
+	logln("Usage: kairos-must-burn [command] [options]")
+	logln("Without a command the GUI is started.")
+	logln()
+	names := make([]string, 0, len(cliCommands))
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		logf("  %s\n      %s\n", cliCommands[name].usage, cliCommands[name].summary)
+	}
+}
+
+// newFlagSet returns a flag set for the command name that prints its usage line on errors
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: kairos-must-burn", cliCommands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// latestVersion returns the highest semver among the assets
+func latestVersion(assets []ReleaseAsset) string {
+	var latest *semver.Version
+	for _, a := range assets {
+		if v, err := semver.NewVersion(a.Version); err == nil && (latest == nil || v.GreaterThan(latest)) {
+			latest = v
+		}
+	}
+	if latest == nil {
+		return ""
+	}
+	return latest.Original()
+}
+
+// matchAssets returns the assets of version named like one of patterns, exactly or as a regex
+func matchAssets(assets []ReleaseAsset, version string, patterns []string) ([]ReleaseAsset, error) {
+	var matched []ReleaseAsset
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		found := false
+		for _, a := range assets {
+			if a.Version != version {
+				continue
+			}
+			if a.Name == pattern || (strings.HasSuffix(a.Name, ".iso") && re.MatchString(a.Name)) {
+				matched = append(matched, a)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no asset of %s matches %q", version, pattern)
+		}
+	}
+	return matched, nil
+}
+
+func cliDownload(args []string) error {
+	fs := newFlagSet("download")
+	version := fs.String("version", "", "release to download from, the latest by default")
+	dir := fs.String("o", "", "directory to save into, the library by default")
+	limit := fs.String("limit", "", "bandwidth limit like 500K or 10M per second, 0 for unlimited")
+	events := fs.String("events", appConfig.EventStream, "write JSON events to stdout, unix:/path or tcp:host:port")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	stopEvents, err := startEventStream(*events)
+	if err != nil {
+		return err
+	}
+	defer stopEvents()
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no asset given")
+	}
+	if *limit != "" {
+		rate, err := parseByteRate(*limit)
+		if err != nil {
+			return err
+		}
+		downloadLimiter.SetRate(rate)
+	}
+	if *dir == "" {
+		libDir, err := libraryDir()
+		if err != nil {
+			return err
+		}
+		*dir = libDir
+	}
+	if err := mkdirUserDir(*dir); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	assets, err := GetCachedReleaseAssets(ctx, "kairos-io", "kairos", nil)
+	if err != nil {
+		return fmt.Errorf("loading releases: %s", describeHTTPError(err))
+	}
+	if *version == "" {
+		*version = latestVersion(assets)
+	}
+	selected, err := matchAssets(assets, *version, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	var items []*DownloadItem
+	for _, asset := range selected {
+		item, err := downloadManager.Add(asset, assets, filepath.Join(*dir, asset.Name))
+		if err != nil {
+			return err
+		}
+		logln("Queued", asset.Name)
+		items = append(items, item)
+	}
+
+	// The limit can be changed while downloading by typing a new one
+	logf("Bandwidth limit: %s. Type a new limit and Enter to change it\n", formatByteRate(downloadLimiter.Rate()))
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			rate, err := parseByteRate(scanner.Text())
+			if err != nil {
+				logln(err)
+				continue
+			}
+			downloadLimiter.SetRate(rate)
+			logln("Bandwidth limit:", formatByteRate(rate))
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Keep the partial files so running the same command again resumes
+			for _, item := range items {
+				downloadManager.Pause(item)
+			}
+			for _, item := range items {
+				downloadManager.Wait(item)
+			}
+			logln("\nInterrupted, run the same command again to resume")
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		var progress []string
+		pending := false
+		for _, item := range items {
+			st := item.Status()
+			switch {
+			case st.State == DownloadRunning && st.Total > 0:
+				progress = append(progress, fmt.Sprintf("%s %d%%", item.Asset.Name, st.Done*100/st.Total))
+			case !st.State.finished():
+				progress = append(progress, fmt.Sprintf("%s %s", item.Asset.Name, st.State))
+			}
+			pending = pending || !st.State.finished()
+		}
+		if !pending {
+			break
+		}
+		logf("\r%s  ", strings.Join(progress, " | "))
+	}
+	logln()
+
+	failed := 0
+	for _, item := range items {
+		st := item.Status()
+		switch {
+		case st.State == DownloadDone && st.Signature.Status == SignatureFailed:
+			failed++
+			logf("%s: signature verification failed: %v\n", item.Dest, st.Signature.Err)
+		case st.State == DownloadDone:
+			logln("Saved", item.Dest)
+		case st.Err != nil:
+			failed++
+			logf("%s: %s\n", item.Asset.Name, describeHTTPError(st.Err))
+		default:
+			failed++
+			logf("%s: %s\n", item.Asset.Name, st.State)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", failed, len(items))
+	}
+	return nil
+}
+
+func cliMirror(args []string) error {
+	fs := newFlagSet("mirror")
+	defaultDir, err := mirrorDir()
+	if err != nil {
+		return err
+	}
+	opts := MirrorOptions{}
+	fs.StringVar(&opts.Dir, "dir", defaultDir, "directory to mirror into, e.g. a mounted USB drive")
+	fs.StringVar(&opts.Versions, "versions", "", "regex on the release versions to mirror, all by default")
+	fs.IntVar(&opts.Latest, "latest", 1, "how many of the newest matching versions to mirror, 0 for all")
+	fs.StringVar(&opts.Flavors, "flavors", "", "regex on the ISO names to mirror, e.g. ubuntu-24.04-standard, all by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	last := ""
+	lastPercent := int64(-1)
+	err = SyncMirror(ctx, opts, func(name string, done, total int64) {
+		if name != last {
+			if last != "" {
+				logln()
+			}
+			last, lastPercent = name, -1
+		}
+		if total > 0 && done*100/total != lastPercent {
+			lastPercent = done * 100 / total
+			logf("\r%s %d%%", name, lastPercent)
+		}
+	})
+	if last != "" {
+		logln()
+	}
+	if errors.Is(err, context.Canceled) {
+		logln("Interrupted, run the same command again to resume")
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w, run the same command again to resume", err)
+	}
+	logln("Mirror up to date in", opts.Dir)
+	return nil
+}
+
+func cliValidate(args []string) error {
+	fs := newFlagSet("validate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no file given")
+	}
+	invalid := 0
+	for _, name := range fs.Args() {
+		var data []byte
+		var err error
+		if name == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return err
+		}
+		problems := ValidateCloudConfig(data)
+		for _, p := range problems {
+			logf("%s:%s\n", name, p)
+		}
+		if CloudConfigErrors(problems) > 0 {
+			invalid++
+		} else {
+			logf("%s: valid\n", name)
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d cloud-configs are invalid", invalid, fs.NArg())
+	}
+	return nil
+}
+
+func cliRemaster(args []string) error {
+	fs := newFlagSet("remaster")
+	configPath := fs.String("config", "", "cloud-config to embed")
+	out := fs.String("o", "", "path of the new ISO")
+	name := fs.String("name", remasterConfigName, "name of the file in the root of the ISO")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *configPath == "" || *out == "" {
+		fs.Usage()
+		return fmt.Errorf("an ISO, -config and -o are required")
+	}
+	cloudConfig, err := os.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+	problems := ValidateCloudConfig(cloudConfig)
+	for _, p := range problems {
+		logf("%s:%s\n", *configPath, p)
+	}
+	if CloudConfigErrors(problems) > 0 {
+		return fmt.Errorf("%s is not a valid cloud-config", *configPath)
+	}
+
+	lastPercent := int64(-1)
+	err = RemasterISOFile(fs.Arg(0), *out, *name, cloudConfig, func(done, total int64) {
+		if done*100/total != lastPercent {
+			lastPercent = done * 100 / total
+			logf("\rCopying %d%%", lastPercent)
+		}
+	})
+	logln()
+	if err != nil {
+		return err
+	}
+	logln("Saved", *out)
+	return nil
+}
+
+func cliInspect(args []string) error {
+	fs := newFlagSet("inspect")
+	asJSON := fs.Bool("json", false, "print the details as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no ISO given")
+	}
+	var infos []*ISOInfo
+	for _, path := range fs.Args() {
+		info, err := InspectISO(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		infos = append(infos, info)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(logOutput)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+	for i, info := range infos {
+		if i > 0 {
+			logln()
+		}
+		logf("%s\n  %s\n", info.Path, info.Summary())
+		logf("  Label: %s\n  Size: %d bytes\n", info.VolumeID, info.Size)
+		if !info.Created.IsZero() {
+			logf("  Created: %s\n", info.Created.Format(time.RFC3339))
+		}
+		if info.Publisher != "" {
+			logf("  Publisher: %s\n", info.Publisher)
+		}
+		for _, e := range info.Boot {
+			logf("  Boot: %s, bootable %t, %s, %d sectors at %d\n", e.Platform, e.Bootable, e.Media, e.Sectors, e.LoadLBA)
+		}
+		for _, p := range info.MBR {
+			logf("  MBR %d: %s, %d bytes at %d\n", p.Number, p.Type, p.Size, p.Start)
+		}
+		for _, p := range info.GPT {
+			logf("  GPT %d: %s %q, %d bytes at %d\n", p.Number, p.Type, p.Name, p.Size, p.Start)
+		}
+		if info.OSRelease == nil {
+			logf("  os-release not found: %s\n", info.OSReleaseError)
+			continue
+		}
+		keys := make([]string, 0, len(info.OSRelease))
+		for key := range info.OSRelease {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			logf("  %s=%s\n", key, info.OSRelease[key])
+		}
+	}
+	return nil
+}
+
+func cliCapacity(args []string) error {
+	fs := newFlagSet("capacity")
+	yes := fs.Bool("yes", false, "confirm the drive may be erased")
+	full := fs.Bool("full", false, "write the whole drive rather than samples")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a device is required")
+	}
+	if !*yes {
+		return fmt.Errorf("the test erases %s, pass -yes to go ahead", fs.Arg(0))
+	}
+	lastPercent := int64(-1)
+	report, err := ProbeDriveCapacity(fs.Arg(0), *full, func(done, total int64) {
+		if done*100/total != lastPercent {
+			lastPercent = done * 100 / total
+			fmt.Fprintf(os.Stderr, "\rTesting %d%%", lastPercent)
+		}
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(logOutput).Encode(report)
+	}
+	logln(report)
+	if report.Fake() {
+		return fmt.Errorf("%s holds at most %d of the %d bytes it claims", fs.Arg(0), report.Usable, report.Reported)
+	}
+	return nil
+}
+
+func cliHealth(args []string) error {
+	fs := newFlagSet("health")
+	yes := fs.Bool("yes", false, "confirm the drive may be erased")
+	thorough := fs.Bool("thorough", false, "write the four patterns of badblocks rather than one random pass")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a device is required")
+	}
+	if !*yes {
+		return fmt.Errorf("the test erases %s, pass -yes to go ahead", fs.Arg(0))
+	}
+	// The report is kept under the serial, which only detection knows
+	drive := USBDrive{Path: fs.Arg(0)}
+	if drives, err := ListUSBDrives(); err == nil {
+		for _, d := range drives {
+			if d.Path == drive.Path {
+				drive = d
+			}
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	lastPercent := int64(-1)
+	report, err := TestDriveHealth(ctx, drive, *thorough, func(phase string, done, total int64) {
+		if done*100/total != lastPercent {
+			lastPercent = done * 100 / total
+			fmt.Fprintf(os.Stderr, "\r%s %d%%   ", phase, lastPercent)
+		}
+	})
+	fmt.Fprintln(os.Stderr)
+	if report == nil {
+		return err
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to save the report:", err)
+	}
+	if *asJSON {
+		return json.NewEncoder(logOutput).Encode(report)
+	}
+	logln(report)
+	for _, sector := range report.BadSectors {
+		logf("  bad sector %d\n", sector)
+	}
+	if !report.Healthy() {
+		return fmt.Errorf("%s has %d bad sectors", fs.Arg(0), report.BadSectorCount)
+	}
+	return nil
+}
+
+func cliProfiles(args []string) error {
+	fs := newFlagSet("profiles")
+	asJSON := fs.Bool("json", false, "print the profiles as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	profiles := BurnProfiles()
+	if *asJSON {
+		enc := json.NewEncoder(logOutput)
+		enc.SetIndent("", "  ")
+		return enc.Encode(profiles)
+	}
+	if len(profiles) == 0 {
+		logln("No burn profiles, add them to \"profiles\" in the config file")
+	}
+	for _, p := range profiles {
+		logf("%s\n  %s\n", p.Name, p.Summary())
+	}
+	return nil
+}
+
+func cliBurn(args []string) (err error) {
+	fs := newFlagSet("burn")
+	yes := fs.Bool("yes", false, "confirm the drive may be erased")
+	profileName := fs.String("profile", "", "burn profile from the config to start from")
+	iso := fs.String("iso", "", "ISO to burn")
+	cloudConfig := fs.String("config", "", "cloud-config to write to the drive")
+	embed := fs.Bool("embed", false, "embed the cloud-config in a remastered copy of the ISO rather than a partition")
+	fat32 := fs.Bool("fat32", false, "copy the files of the ISO to a FAT32 partition that boots with UEFI")
+	persistenceFS := fs.String("persistence", "", "add a persistent partition with this filesystem, ext4")
+	persistenceSize := fs.String("persistence-size", "", "size of the persistent partition like 8G, the rest of the drive by default")
+	verify := fs.String("verify", "", "checksum, signature or none, checksum by default")
+	bootTest := fs.Bool("boot-test", false, "boot the drive in QEMU with UEFI and BIOS once it is burned")
+	targetSize := fs.String("size", "", "size like 8G to make an image file, just big enough for the image by default")
+	dryRun := fs.Bool("dry-run", false, "print what the burn would do and exit without writing anything")
+	asJSON := fs.Bool("json", false, "print the dry-run plan as JSON")
+	events := fs.String("events", appConfig.EventStream, "write JSON events to stdout, unix:/path or tcp:host:port")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a device is required")
+	}
+	device := fs.Arg(0)
+	if !*dryRun {
+		stopEvents, err := startEventStream(*events)
+		if err != nil {
+			return err
+		}
+		defer stopEvents()
+	}
+	// Failures before RunBurn are told to the event stream here, RunBurn reports its own
+	burning := false
+	defer func() {
+		if err != nil && !burning {
+			appEvents.job("burn", device).Error(err)
+		}
+	}()
+
+	profile := BurnProfile{Name: "command line"}
+	if *profileName != "" {
+		if profile, err = FindBurnProfile(*profileName); err != nil {
+			return err
+		}
+	}
+	var sizeErr error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "iso":
+			profile.Image, profile.Release = *iso, nil
+		case "config":
+			profile.CloudConfig = *cloudConfig
+		case "embed":
+			profile.EmbedCloudConfig = *embed
+		case "fat32":
+			profile.FAT32 = *fat32
+		case "persistence":
+			profile.Persistence.Filesystem = *persistenceFS
+		case "persistence-size":
+			if profile.Persistence.Filesystem == "" {
+				profile.Persistence.Filesystem = PersistenceExt4
+			}
+			if profile.Persistence.Size, sizeErr = parseByteRate(*persistenceSize); sizeErr != nil {
+				sizeErr = fmt.Errorf("invalid persistent partition size %q, use a number with an optional K, M or G suffix", *persistenceSize)
+			}
+		case "verify":
+			profile.Verify = *verify
+		}
+	})
+	if sizeErr != nil {
+		return sizeErr
+	}
+	var fileSize int64
+	if *targetSize != "" {
+		var err error
+		if fileSize, err = parseByteRate(*targetSize); err != nil || fileSize <= 0 {
+			return fmt.Errorf("invalid size %q, use a number with an optional K, M or G suffix", *targetSize)
+		}
+		if kind, err := targetKind(device); err != nil || kind != TargetFile {
+			return fmt.Errorf("-size only applies to image files, %s is a device", device)
+		}
+	}
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	opts := BurnOptions{
+		CloudConfig:      profile.CloudConfig,
+		EmbedCloudConfig: profile.EmbedCloudConfig,
+		Mode:             profile.Mode(),
+		Persistence:      profile.Persistence,
+		Device:           device,
+		TargetSize:       fileSize,
+	}
+	if *dryRun {
+		return cliBurnPlan(profile, opts, *bootTest, *asJSON)
+	}
+	if !*yes {
+		return fmt.Errorf("%w: burning erases %s, pass -yes to go ahead", errNotConfirmed, device)
+	}
+	if mounted, err := IsDeviceMounted(device); err == nil && len(mounted) > 0 {
+		return fmt.Errorf("%w, unmount these partitions first: %s", errDeviceMounted, strings.Join(mounted, ", "))
+	}
+	if profile.CloudConfig != "" {
+		data, err := os.ReadFile(profile.CloudConfig)
+		if err != nil {
+			return err
+		}
+		if problems := ValidateCloudConfig(data); CloudConfigErrors(problems) > 0 {
+			for _, p := range problems {
+				fmt.Fprintf(os.Stderr, "%s:%s\n", profile.CloudConfig, p)
+			}
+			return fmt.Errorf("%w: %s has errors, Kairos would ignore it", errInvalidCloudConfig, profile.CloudConfig)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	lastPercent := int64(-1)
+	percent := func(action string) func(done, total int64) {
+		return func(done, total int64) {
+			if done*100/total != lastPercent {
+				lastPercent = done * 100 / total
+				fmt.Fprintf(os.Stderr, "\r%s %d%%", action, lastPercent)
+			}
+		}
+	}
+	isoPath, err := profile.ResolveImage(ctx, percent("Downloading"))
+	if lastPercent >= 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+	lastPercent = -1
+	err = CheckImageVerification(isoPath, profile.VerifyPolicy(), percent("Verifying "+filepath.Base(isoPath)))
+	if lastPercent >= 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+	if info, err := InspectISO(isoPath); err == nil && !info.Hybrid() && !profile.FAT32 {
+		fmt.Fprintf(os.Stderr, "⚠ %s has no MBR or GPT partition table, written as it is the stick won't boot. -fat32 makes it boot with UEFI\n", filepath.Base(isoPath))
+	}
+
+	last := ""
+	opts.ISO = isoPath
+	burning = true
+	err = RunBurn(opts, func(status string, fraction float64) {
+		if status != last {
+			last = status
+			fmt.Fprintf(os.Stderr, "\r%-60s", status)
+		}
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+	logf("Burned %s to %s\n", filepath.Base(isoPath), device)
+	if *bootTest {
+		firmwares := []string{BootUEFI, BootBIOS}
+		if profile.FAT32 {
+			// The FAT32 copy only boots with UEFI
+			firmwares = firmwares[:1]
+		}
+		return runBootTests(ctx, device, firmwares, false, false)
+	}
+	return nil
+}
+
+// cliBurnPlan prints what burning profile with opts would do, resolving the image without downloading it
+func cliBurnPlan(profile BurnProfile, opts BurnOptions, bootTest, asJSON bool) error {
+	isoPath, asset, _, err := profile.locateImage(context.Background())
+	if err != nil {
+		return err
+	}
+	download := isoPath == ""
+	if download {
+		dir, err := libraryDir()
+		if err != nil {
+			return err
+		}
+		isoPath = filepath.Join(dir, asset.Name)
+	}
+	opts.ISO = isoPath
+	plan, err := PlanBurn(opts, profile.VerifyPolicy())
+	if err != nil {
+		return err
+	}
+	if download {
+		steps := []string{fmt.Sprintf("Download %s of %s into the library", asset.Name, asset.Version)}
+		if policy := profile.VerifyPolicy(); policy != VerifyNone {
+			steps = append(steps, fmt.Sprintf("Verify the download, verify %q", policy))
+		}
+		plan.Steps = append(steps, plan.Steps...)
+	}
+	if len(plan.Unmount) > 0 {
+		plan.Problems = append(plan.Problems, "the burn command doesn't unmount partitions, unmount "+strings.Join(plan.Unmount, ", ")+" first")
+	}
+	if bootTest {
+		firmwares := "UEFI and BIOS"
+		if profile.FAT32 {
+			firmwares = "UEFI"
+		}
+		plan.Steps = append(plan.Steps, fmt.Sprintf("Boot %s in QEMU with %s", opts.Device, firmwares))
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(logOutput)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(plan); err != nil {
+			return err
+		}
+	} else {
+		logln(plan)
+	}
+	if !plan.OK() {
+		return fmt.Errorf("burning %s would fail", opts.Device)
+	}
+	return nil
+}
+
+func cliBootTest(args []string) error {
+	fs := newFlagSet("boottest")
+	firmware := fs.String("firmware", "both", "uefi, bios or both")
+	showConsole := fs.Bool("console", false, "print the serial console while booting")
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a device is required")
+	}
+	firmwares := []string{*firmware}
+	if *firmware == "both" {
+		firmwares = []string{BootUEFI, BootBIOS}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return runBootTests(ctx, fs.Arg(0), firmwares, *showConsole, *asJSON)
+}
+
+// runBootTests boots device with each firmware in turn and prints the results, failing if any boot failed
+func runBootTests(ctx context.Context, device string, firmwares []string, showConsole, asJSON bool) error {
+	var results []*BootTestResult
+	failed := 0
+	for _, firmware := range firmwares {
+		fmt.Fprintf(os.Stderr, "Booting %s with %s in QEMU...\n", device, strings.ToUpper(firmware))
+		result, err := BootTest(ctx, device, firmware, func(line string) {
+			if showConsole {
+				fmt.Fprintln(os.Stderr, "  |", line)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+		outcome := "passed"
+		if !result.Passed {
+			failed++
+			outcome = "failed"
+		}
+		appEvents.job("boottest", device).Verification(firmware, outcome, result.String())
+		if !asJSON {
+			logln(result)
+			if !result.Passed && !showConsole {
+				for _, line := range result.Console {
+					logln("  |", line)
+				}
+			}
+		}
+	}
+	if asJSON {
+		if err := json.NewEncoder(logOutput).Encode(results); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%s failed %d of %d boot tests", device, failed, len(results))
+	}
+	return nil
+}
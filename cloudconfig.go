@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// cloudConfigPartitionSize is plenty for a cloud-config, and the smallest size FAT32 allows with 512 byte clusters
+	cloudConfigPartitionSize = 64 * 1024 * 1024
+	// cloudConfigLabel is the NoCloud datasource label Kairos looks for
+	cloudConfigLabel = "cidata"
+)
+
+// InjectCloudConfig adds a partition labeled cidata after the image burned to devicePath and writes
+// cloudConfig to it as user-data, so Kairos picks it up on first boot as a NoCloud datasource.
+// imageSize is the size of the burned image, the partition goes in the free space after it
+func InjectCloudConfig(devicePath string, imageSize int64, cloudConfig []byte) error {
+	// Raw disk, the buffered one reads stale sectors right after the burn
+	devicePath = rawDevicePath(devicePath)
+	device, err := os.OpenFile(devicePath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open device %s: %w", devicePath, err)
+	}
+	defer device.Close()
+
+	diskSize, err := targetSize(device)
+	if err != nil {
+		return fmt.Errorf("failed to get the size of %s: %w", devicePath, err)
+	}
+	start, _, err := AppendPartition(device, diskSize, imageSize, PartitionSpec{
+		Size:    cloudConfigPartitionSize,
+		MBRType: mbrTypeFAT32,
+		GPTType: gptTypeBasicData,
+		Name:    cloudConfigLabel,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add the config partition: %w", err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	files := []fatFile{
+		{Name: "user-data", Data: cloudConfig},
+		{Name: "meta-data", Data: []byte("instance-id: kairos-" + hex.EncodeToString(id) + "\n")},
+	}
+	if err := formatFAT32(device, start, cloudConfigPartitionSize, uint32(start/sectorSize), cloudConfigLabel, files); err != nil {
+		return fmt.Errorf("failed to format the config partition: %w", err)
+	}
+	if err := device.Sync(); err != nil {
+		return err
+	}
+	// Best effort, the new partition shows up on the next plug in anyway
+	_ = rereadPartitions(device)
+	return nil
+}
+
+//go:embed Resources/cloud-config.schema.json
+var cloudConfigSchemaData []byte
+
+// configSchema is the subset of JSON schema used by the bundled cloud-config schema
+type configSchema struct {
+	Ref                  string                   `json:"$ref"`
+	Type                 string                   `json:"type"`
+	Properties           map[string]*configSchema `json:"properties"`
+	AdditionalProperties *additionalProperties    `json:"additionalProperties"`
+	Items                *configSchema            `json:"items"`
+	Required             []string                 `json:"required"`
+	Enum                 []string                 `json:"enum"`
+	Definitions          map[string]*configSchema `json:"definitions"`
+}
+
+// additionalProperties is either false, to reject keys not in properties, or the schema of their values
+type additionalProperties struct {
+	Forbidden bool
+	Schema    *configSchema
+}
+
+func (a *additionalProperties) UnmarshalJSON(data []byte) error {
+	var allowed bool
+	if err := json.Unmarshal(data, &allowed); err == nil {
+		a.Forbidden = !allowed
+		return nil
+	}
+	return json.Unmarshal(data, &a.Schema)
+}
+
+// CloudConfigProblem is an error or a warning found by ValidateCloudConfig, Line and Column start at 1
+type CloudConfigProblem struct {
+	Line    int
+	Column  int
+	Message string
+	Warning bool
+}
+
+func (p CloudConfigProblem) String() string {
+	kind := "error"
+	if p.Warning {
+		kind = "warning"
+	}
+	return fmt.Sprintf("%d:%d: %s: %s", p.Line, p.Column, kind, p.Message)
+}
+
+// yamlErrorLine finds the line in the errors of the YAML parser, like "yaml: line 3: mapping values are not allowed"
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// ValidateCloudConfig checks a cloud-config: the #cloud-config header, the YAML syntax and the known
+// Kairos keys against the bundled schema. Unknown keys are warnings as the schema doesn't list them all,
+// the config can be used as long as there is no error. Problems are sorted by line
+func ValidateCloudConfig(data []byte) []CloudConfigProblem {
+	var problems []CloudConfigProblem
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+	if strings.TrimSpace(string(firstLine)) != "#cloud-config" {
+		problems = append(problems, CloudConfigProblem{Line: 1, Column: 1, Message: "the first line must be #cloud-config, Kairos ignores the file otherwise"})
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		problem := CloudConfigProblem{Line: 1, Column: 1, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			problem.Line, _ = strconv.Atoi(m[1])
+			problem.Message = m[2]
+		}
+		return append(problems, problem)
+	}
+	if len(doc.Content) == 0 {
+		return append(problems, CloudConfigProblem{Line: 1, Column: 1, Message: "the cloud-config is empty"})
+	}
+
+	var schema configSchema
+	if err := json.Unmarshal(cloudConfigSchemaData, &schema); err != nil {
+		panic("invalid bundled cloud-config schema: " + err.Error())
+	}
+	v := &configValidator{definitions: schema.Definitions}
+	v.validate(doc.Content[0], &schema, "")
+	problems = append(problems, v.problems...)
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Column < problems[j].Column
+	})
+	return problems
+}
+
+// CloudConfigErrors counts the problems that are not warnings
+func CloudConfigErrors(problems []CloudConfigProblem) int {
+	n := 0
+	for _, p := range problems {
+		if !p.Warning {
+			n++
+		}
+	}
+	return n
+}
+
+type configValidator struct {
+	definitions map[string]*configSchema
+	problems    []CloudConfigProblem
+}
+
+func (v *configValidator) report(node *yaml.Node, warning bool, format string, args ...any) {
+	v.problems = append(v.problems, CloudConfigProblem{
+		Line:    node.Line,
+		Column:  node.Column,
+		Message: fmt.Sprintf(format, args...),
+		Warning: warning,
+	})
+}
+
+// validate checks node against schema, path is the dotted key of node for messages
+func (v *configValidator) validate(node *yaml.Node, schema *configSchema, path string) {
+	if schema.Ref != "" {
+		ref, ok := v.definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+		if !ok {
+			panic("unknown reference in the bundled cloud-config schema: " + schema.Ref)
+		}
+		schema = ref
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	name := path
+	if name == "" {
+		name = "the cloud-config"
+	}
+	if !yamlNodeIs(node, schema.Type) {
+		v.report(node, false, "%s must be %s, not %s", name, schemaTypeName(schema.Type), yamlNodeTypeName(node))
+		return
+	}
+	if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, node.Value) {
+		v.report(node, false, "%s must be one of %s", name, strings.Join(schema.Enum, ", "))
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		seen := make(map[string]bool)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				continue
+			}
+			if seen[key.Value] {
+				v.report(key, false, "%s is set more than once", joinConfigPath(path, key.Value))
+			}
+			seen[key.Value] = true
+			child := joinConfigPath(path, key.Value)
+			if s, ok := schema.Properties[key.Value]; ok {
+				v.validate(value, s, child)
+				continue
+			}
+			switch {
+			case schema.AdditionalProperties != nil && schema.AdditionalProperties.Schema != nil:
+				v.validate(value, schema.AdditionalProperties.Schema, child)
+			case schema.AdditionalProperties != nil && schema.AdditionalProperties.Forbidden:
+				v.report(key, true, "unknown key %s%s", child, suggestConfigKey(key.Value, schema.Properties))
+			default:
+				// Other keys are fine, but one close to a known key is likely a typo
+				if hint := suggestConfigKey(key.Value, schema.Properties); hint != "" {
+					v.report(key, true, "unknown key %s%s", child, hint)
+				}
+			}
+		}
+		for _, required := range schema.Required {
+			if !seen[required] {
+				v.report(node, false, "%s is missing %s", name, required)
+			}
+		}
+	case yaml.SequenceNode:
+		if schema.Items != nil {
+			for i, item := range node.Content {
+				v.validate(item, schema.Items, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// yamlNodeIs tells if node has the JSON schema type t, any scalar is accepted as a string
+func yamlNodeIs(node *yaml.Node, t string) bool {
+	switch t {
+	case "":
+		return true
+	case "object":
+		return node.Kind == yaml.MappingNode
+	case "array":
+		return node.Kind == yaml.SequenceNode
+	case "string":
+		return node.Kind == yaml.ScalarNode && node.Tag != "!!null"
+	case "boolean":
+		return node.Kind == yaml.ScalarNode && node.Tag == "!!bool"
+	case "integer":
+		return node.Kind == yaml.ScalarNode && node.Tag == "!!int"
+	case "number":
+		return node.Kind == yaml.ScalarNode && (node.Tag == "!!int" || node.Tag == "!!float")
+	}
+	return false
+}
+
+func schemaTypeName(t string) string {
+	switch t {
+	case "object":
+		return "a mapping"
+	case "array":
+		return "a list"
+	case "boolean":
+		return "true or false"
+	case "integer":
+		return "a whole number"
+	}
+	return "a " + t
+}
+
+func yamlNodeTypeName(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	switch node.Tag {
+	case "!!null":
+		return "empty"
+	case "!!bool":
+		return node.Value
+	case "!!int", "!!float":
+		return "the number " + node.Value
+	}
+	return strconv.Quote(node.Value)
+}
+
+// suggestConfigKey returns ", did you mean x?" when a known key is a few edits away from key,
+// one edit per three letters so short keys like ssh don't look like k3s
+func suggestConfigKey(key string, known map[string]*configSchema) string {
+	best, bestDistance := "", 0
+	for k := range known {
+		limit := max(len(k)/3, 1)
+		d := editDistance(strings.ToLower(key), k)
+		if d > limit {
+			continue
+		}
+		if best == "" || d < bestDistance || d == bestDistance && k < best {
+			best, bestDistance = k, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
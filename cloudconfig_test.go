@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestValidateCloudConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		want       []string
+		wantErrors int
+	}{
+		{
+			name: "valid",
+			data: "#cloud-config\ninstall:\n  device: auto\n  auto: true\nusers:\n- name: kairos\n  groups: [admin]\nk3s:\n  enabled: true\nstages:\n  boot:\n  - commands: [\"true\"]\n",
+		},
+		{name: "header with spaces", data: "#cloud-config  \r\nhostname: edge\n"},
+		{
+			name:       "missing header",
+			data:       "install:\n  device: auto\n",
+			want:       []string{"1:1: error: the first line must be #cloud-config, Kairos ignores the file otherwise"},
+			wantErrors: 1,
+		},
+		{
+			name:       "header not first",
+			data:       "# my config\n#cloud-config\n",
+			want:       []string{"1:1: error: the first line must be #cloud-config, Kairos ignores the file otherwise", "1:1: error: the cloud-config is empty"},
+			wantErrors: 2,
+		},
+		{
+			name:       "invalid yaml",
+			data:       "#cloud-config\ninstall:\n  device: auto\n   auto: true\n",
+			want:       []string{"4:1: error: mapping values are not allowed in this context"},
+			wantErrors: 1,
+		},
+		{
+			name:       "invalid yaml without header",
+			data:       "users: [kairos\n",
+			want:       []string{"1:1: error: the first line must be #cloud-config, Kairos ignores the file otherwise", "1:1: error: did not find expected ',' or ']'"},
+			wantErrors: 2,
+		},
+		{
+			name:       "empty",
+			data:       "#cloud-config\n",
+			want:       []string{"1:1: error: the cloud-config is empty"},
+			wantErrors: 1,
+		},
+		{
+			name:       "not a mapping",
+			data:       "#cloud-config\n- install\n",
+			want:       []string{"2:1: error: the cloud-config must be a mapping, not a list"},
+			wantErrors: 1,
+		},
+		{
+			name:       "wrong types",
+			data:       "#cloud-config\ninstall:\n  auto: yes please\n  bind_mounts: /var/lib\n",
+			want:       []string{`3:9: error: install.auto must be true or false, not "yes please"`, `4:16: error: install.bind_mounts must be a list, not "/var/lib"`},
+			wantErrors: 2,
+		},
+		{
+			name:       "enum",
+			data:       "#cloud-config\np2p:\n  role: leader\n",
+			want:       []string{"3:9: error: p2p.role must be one of master, worker, none"},
+			wantErrors: 1,
+		},
+		{
+			name:       "required",
+			data:       "#cloud-config\nusers:\n- passwd: kairos\n",
+			want:       []string{"3:3: error: users[0] is missing name"},
+			wantErrors: 1,
+		},
+		{
+			name:       "duplicate key",
+			data:       "#cloud-config\nhostname: a\nhostname: b\n",
+			want:       []string{"3:1: error: hostname is set more than once"},
+			wantErrors: 1,
+		},
+		{
+			name: "typos",
+			data: "#cloud-config\ninstal:\n  device: auto\ninstall:\n  devise: auto\n",
+			want: []string{"2:1: warning: unknown key instal, did you mean install?", "5:3: warning: unknown key install.devise, did you mean device?"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := ValidateCloudConfig([]byte(tt.data))
+			var got []string
+			for _, p := range problems {
+				got = append(got, p.String())
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("ValidateCloudConfig() = %q, want %q", got, tt.want)
+			}
+			if n := CloudConfigErrors(problems); n != tt.wantErrors {
+				t.Errorf("CloudConfigErrors() = %d, want %d", n, tt.wantErrors)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/diamondburned/gotk4/pkg/gio/v2"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// cloudConfigTemplate is what a new cloud-config starts with
+const cloudConfigTemplate = `#cloud-config
+
+install:
+  auto: true
+  device: auto
+  reboot: true
+
+users:
+- name: kairos
+  passwd: kairos
+  groups:
+  - admin
+`
+
+// showCloudConfigEditor opens an editor for the cloud-config at path, or a new one when path is empty.
+// The config is validated as it is typed and problem lines are highlighted. onSave is called with the
+// path the config was saved to
+func showCloudConfigEditor(parent *gtk.Window, path string, onSave func(path string)) {
+	editorWin := gtk.NewWindow()
+	editorWin.SetTransientFor(parent)
+	editorWin.SetModal(true)
+	editorWin.SetDefaultSize(700, 600)
+	setTitle := func() {
+		if path == "" {
+			editorWin.SetTitle("Cloud-config editor - new file")
+		} else {
+			editorWin.SetTitle("Cloud-config editor - " + filepath.Base(path))
+		}
+	}
+	setTitle()
+
+	vbox := gtk.NewBox(gtk.OrientationVertical, 10)
+	vbox.SetMarginTop(20)
+	vbox.SetMarginBottom(20)
+	vbox.SetMarginStart(20)
+	vbox.SetMarginEnd(20)
+
+	textView := gtk.NewTextView()
+	textView.SetMonospace(true)
+	textView.SetVExpand(true)
+	buffer := textView.Buffer()
+	errorTag := gtk.NewTextTag("error")
+	errorTag.SetObjectProperty("background", "rgba(224, 27, 36, 0.25)")
+	warningTag := gtk.NewTextTag("warning")
+	warningTag.SetObjectProperty("background", "rgba(229, 165, 10, 0.25)")
+	buffer.TagTable().Add(errorTag)
+	buffer.TagTable().Add(warningTag)
+
+	scrolled := gtk.NewScrolledWindow()
+	scrolled.SetChild(textView)
+	scrolled.SetVExpand(true)
+	vbox.Append(scrolled)
+
+	statusLabel := gtk.NewLabel("")
+	statusLabel.SetHAlign(gtk.AlignStart)
+	vbox.Append(statusLabel)
+
+	problemList := gtk.NewListBox()
+	problemScrolled := gtk.NewScrolledWindow()
+	problemScrolled.SetChild(problemList)
+	problemScrolled.SetMinContentHeight(100)
+	vbox.Append(problemScrolled)
+
+	openBtn := gtk.NewButtonWithLabel("Open...")
+	saveAsBtn := gtk.NewButtonWithLabel("Save as...")
+	saveBtn := gtk.NewButtonWithLabel("Save and use")
+	saveBtn.SetTooltipText("Save the cloud-config and write it to the stick when burning")
+	closeBtn := gtk.NewButtonWithLabel("Close")
+	buttonBox := gtk.NewBox(gtk.OrientationHorizontal, 5)
+	buttonBox.SetHAlign(gtk.AlignEnd)
+	buttonBox.Append(openBtn)
+	buttonBox.Append(saveAsBtn)
+	buttonBox.Append(closeBtn)
+	buttonBox.Append(saveBtn)
+	vbox.Append(buttonBox)
+	editorWin.SetChild(vbox)
+
+	text := func() string {
+		start, end := buffer.Bounds()
+		return buffer.Text(start, end, false)
+	}
+
+	var problems []CloudConfigProblem
+	validate := func() {
+		problems = ValidateCloudConfig([]byte(text()))
+		start, end := buffer.Bounds()
+		buffer.RemoveTag(errorTag, start, end)
+		buffer.RemoveTag(warningTag, start, end)
+		problemList.RemoveAll()
+		for _, p := range problems {
+			tag := errorTag
+			if p.Warning {
+				tag = warningTag
+			}
+			if lineStart, ok := buffer.IterAtLine(p.Line - 1); ok {
+				lineEnd := lineStart.Copy()
+				lineEnd.ForwardToLineEnd()
+				buffer.ApplyTag(tag, lineStart, lineEnd)
+			}
+			label := gtk.NewLabel(fmt.Sprintf("Line %s", p))
+			label.SetHAlign(gtk.AlignStart)
+			label.SetWrap(true)
+			problemList.Append(label)
+		}
+		errors := CloudConfigErrors(problems)
+		switch {
+		case len(problems) == 0:
+			statusLabel.SetLabel("✅ Valid cloud-config")
+		case errors == 0:
+			statusLabel.SetLabel(fmt.Sprintf("✅ Valid cloud-config, %d warnings", len(problems)))
+		default:
+			statusLabel.SetLabel(fmt.Sprintf("❌ %d errors, %d warnings", errors, len(problems)-errors))
+		}
+	}
+
+	// Clicking a problem moves the cursor to its line
+	problemList.ConnectRowActivated(func(row *gtk.ListBoxRow) {
+		if i := row.Index(); i >= 0 && i < len(problems) {
+			if iter, ok := buffer.IterAtLine(problems[i].Line - 1); ok {
+				buffer.PlaceCursor(iter)
+				textView.ScrollToIter(iter, 0.1, false, 0, 0)
+				textView.GrabFocus()
+			}
+		}
+	})
+
+	// Validate once typing pauses rather than on every key
+	var pending glib.SourceHandle
+	buffer.ConnectChanged(func() {
+		if pending != 0 {
+			glib.SourceRemove(pending)
+		}
+		pending = glib.TimeoutAdd(300, func() bool {
+			pending = 0
+			validate()
+			return false
+		})
+	})
+	editorWin.ConnectDestroy(func() {
+		if pending != 0 {
+			glib.SourceRemove(pending)
+		}
+	})
+
+	load := func(p string) {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			statusLabel.SetLabel(fmt.Sprintf("❌ Can't read %s: %v", p, err))
+			return
+		}
+		path = p
+		setTitle()
+		buffer.SetText(string(data))
+		validate()
+	}
+	if path != "" {
+		load(path)
+	} else {
+		buffer.SetText(cloudConfigTemplate)
+		validate()
+	}
+
+	save := func(p string) {
+		validate()
+		if err := writeUserFile(p, []byte(text())); err != nil {
+			statusLabel.SetLabel(fmt.Sprintf("❌ Can't save %s: %v", p, err))
+			return
+		}
+		path = p
+		setTitle()
+		if CloudConfigErrors(problems) > 0 {
+			statusLabel.SetLabel("Saved, but fix the errors before burning")
+			return
+		}
+		if onSave != nil {
+			onSave(p)
+		}
+		editorWin.Close()
+	}
+
+	yamlFilter := gtk.NewFileFilter()
+	yamlFilter.SetName("YAML files")
+	yamlFilter.AddPattern("*.yaml")
+	yamlFilter.AddPattern("*.yml")
+	newDialog := func(title string) *gtk.FileDialog {
+		dialog := gtk.NewFileDialog()
+		dialog.SetTitle(title)
+		dialog.SetModal(true)
+		dialog.SetDefaultFilter(yamlFilter)
+		if path != "" {
+			dialog.SetInitialFolder(gio.NewFileForPath(filepath.Dir(path)))
+		} else if homeDir, err := getHomeDirectory(); err == nil && homeDir != "" {
+			dialog.SetInitialFolder(gio.NewFileForPath(homeDir))
+		}
+		return dialog
+	}
+	saveAs := func() {
+		dialog := newDialog("Save cloud-config")
+		dialog.SetInitialName("cloud-config.yaml")
+		dialog.Save(context.Background(), editorWin, func(res gio.AsyncResulter) {
+			if file, err := dialog.SaveFinish(res); err == nil && file != nil {
+				save(file.Path())
+			}
+		})
+	}
+
+	openBtn.ConnectClicked(func() {
+		dialog := newDialog("Open cloud-config")
+		dialog.Open(context.Background(), editorWin, func(res gio.AsyncResulter) {
+			if file, err := dialog.OpenFinish(res); err == nil && file != nil {
+				load(file.Path())
+			}
+		})
+	})
+	saveAsBtn.ConnectClicked(saveAs)
+	saveBtn.ConnectClicked(func() {
+		if path == "" {
+			saveAs()
+			return
+		}
+		save(path)
+	})
+	closeBtn.ConnectClicked(editorWin.Close)
+
+	editorWin.Present()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config holds the user tunable settings. It is read from config.json in the user's config directory,
+// any missing value falls back to defaultConfig
+type Config struct {
+	// ReleaseCacheTTL is how long the cached release list is served without asking GitHub again
+	ReleaseCacheTTL Duration `json:"release_cache_ttl"`
+	// DownloadSegments is how many connections are used to download big files, 1 disables segmented downloads
+	DownloadSegments int `json:"download_segments"`
+	// MaxConcurrentDownloads is how many queued downloads run at the same time
+	MaxConcurrentDownloads int `json:"max_concurrent_downloads"`
+	// DownloadRateLimit caps the bandwidth of all downloads together in bytes per second, 0 is unlimited
+	DownloadRateLimit int64 `json:"download_rate_limit"`
+	// SegmentedMinSize is the smallest file size in bytes that is downloaded in segments
+	SegmentedMinSize int64 `json:"segmented_min_size"`
+	// HTTPConnectTimeout bounds connecting to a server, including the TLS handshake
+	HTTPConnectTimeout Duration `json:"http_connect_timeout"`
+	// HTTPIdleTimeout aborts a request when the server sends nothing for this long
+	HTTPIdleTimeout Duration `json:"http_idle_timeout"`
+	// HTTPRetries is how many times a failed request is retried, with exponential backoff
+	HTTPRetries int `json:"http_retries"`
+	// Proxy overrides the HTTP_PROXY/HTTPS_PROXY environment variables, which sudo usually drops
+	Proxy string `json:"proxy"`
+	// CABundle is a PEM file with extra CA certificates to trust, e.g. for an intercepting proxy
+	CABundle string `json:"ca_bundle"`
+	// LibraryDir is where downloaded and imported images are kept, empty uses the user's data directory
+	LibraryDir string `json:"library_dir"`
+	// LibraryMaxSize is the disk usage in bytes above which old versions are pruned from the library, 0 disables it
+	LibraryMaxSize int64 `json:"library_max_size"`
+	// MirrorDir is where the mirror command copies releases to, empty uses the user's data directory
+	MirrorDir string `json:"mirror_dir"`
+	// ReleaseSource is "github", the default, or "mirror" to read releases and assets from MirrorDir offline
+	ReleaseSource string `json:"release_source"`
+	// Signature is the trust policy for release signatures, verification is off until a key or trust root is set
+	Signature SignatureConfig `json:"signature"`
+	// Profiles are the named burn profiles offered in the main window and by the burn command
+	Profiles []BurnProfile `json:"profiles"`
+	// BootTest is how burned sticks are booted in QEMU to check them
+	BootTest BootTestConfig `json:"boot_test"`
+	// EventStream is where burn, download and verification events go as JSON lines: stdout,
+	// unix:/path or tcp:host:port. Empty disables them
+	EventStream string `json:"event_stream"`
+}
+
+// defaultConfig is used when there is no config file or it doesn't set a value
+var defaultConfig = Config{
+	ReleaseCacheTTL:        Duration(6 * time.Hour),
+	DownloadSegments:       4,
+	MaxConcurrentDownloads: 2,
+	SegmentedMinSize:       64 * 1024 * 1024,
+	HTTPConnectTimeout:     Duration(30 * time.Second),
+	HTTPIdleTimeout:        Duration(60 * time.Second),
+	HTTPRetries:            3,
+	Signature: SignatureConfig{
+		Identity: "^https://github.com/kairos-io/",
+		Issuer:   "https://token.actions.githubusercontent.com",
+	},
+	BootTest: BootTestConfig{
+		Timeout: Duration(10 * time.Minute),
+		Pattern: defaultBootPattern,
+		Memory:  2048,
+	},
+}
+
+// appConfig is the configuration in use, loaded at startup
+var appConfig = defaultConfig
+
+// Duration is a time.Duration that reads and writes as a string like "1h30m" in json
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1h30m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// configPath returns where the config file lives for the real user
+func configPath() (string, error) {
+	dir, err := userConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// LoadConfig reads the config file on top of the defaults. A missing file is not an error
+func LoadConfig() (Config, error) {
+	cfg := defaultConfig
+	path, err := configPath()
+	if err != nil {
+		return cfg, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return defaultConfig, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
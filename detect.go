@@ -3,33 +3,35 @@
 package main
 
 import (
-	"fmt"
 	"github.com/jaypipes/ghw/pkg/block"
+	"github.com/jaypipes/ghw/pkg/util"
 	"path/filepath"
 	"strings"
 )
 
-func ListUSBDrives() []string {
-	var drives []string
+// ListUSBDrives returns the drives on a USB bus with their exact size
+func ListUSBDrives() ([]USBDrive, error) {
+	var drives []USBDrive
 	b, err := block.New()
 	if err != nil {
-		fmt.Println("Error detecting block devices:", err)
-		return []string{"No USB devices found"}
+		return nil, err
 	}
 	for _, d := range b.Disks {
 		if strings.Contains(d.BusPath, "usb") {
 			// Check if the disk is a USB drive
 			if d.Name != "" {
-				// Format the drive name and size
-				size := d.SizeBytes / (1024 * 1024 * 1024) // Convert to GB
-				formattedSize := fmt.Sprintf("%.2f GB", float64(size))
-				drives = append(drives, fmt.Sprintf("%s (%s)", filepath.Join("/dev", d.Name), formattedSize))
+				drive := USBDrive{
+					Path:  filepath.Join("/dev", d.Name),
+					Model: strings.TrimSpace(strings.ReplaceAll(d.Model, "_", " ")),
+					Size:  int64(d.SizeBytes),
+				}
+				if d.SerialNumber != util.UNKNOWN {
+					drive.Serial = d.SerialNumber
+				}
+				drives = append(drives, drive)
 			}
 		}
 
 	}
-	if len(drives) == 0 {
-		return []string{"No USB devices found"}
-	}
-	return append([]string{"🖴 Select a USB device"}, drives...)
+	return drives, nil
 }
@@ -5,35 +5,41 @@ package main
 import (
 	"fmt"
 	"github.com/bi-zone/wmi"
+	"os"
 	"strings"
 )
 
-func ListUSBDrives() []string {
+// ListUSBDrives returns the USB and removable drives with their exact size
+func ListUSBDrives() ([]USBDrive, error) {
 	type Win32Diskdrive struct {
 		DeviceID      string
 		Model         string
 		InterfaceType string
 		MediaType     string
+		SerialNumber  string
 		Size          uint64
 	}
 
-	var drives []string
+	var drives []USBDrive
 	var dst []Win32Diskdrive
-	err := wmi.Query("SELECT DeviceID, Model, InterfaceType, MediaType, Size, MediaType FROM Win32_DiskDrive", &dst)
+	err := wmi.Query("SELECT DeviceID, Model, InterfaceType, MediaType, SerialNumber, Size FROM Win32_DiskDrive", &dst)
 	if err != nil {
-		return []string{"Error querying WMI: " + err.Error()}
+		return nil, fmt.Errorf("error querying WMI: %w", err)
 	}
 
 	for _, d := range dst {
 		if d.InterfaceType == "USB" || strings.Contains(strings.ToLower(d.MediaType), "external") || d.MediaType == "Removable Media" {
-			fmt.Println("Found USB drive:", d)
-			formattedSize := fmt.Sprintf("%.2f GB", float64(d.Size/(1024*1024*1024))) // Convert to GB
-			drives = append(drives, fmt.Sprintf("%s (%s %s)", d.DeviceID, d.Model, formattedSize))
+			logln("Found USB drive:", d)
+			drive := USBDrive{Path: d.DeviceID, Model: d.Model, Serial: strings.TrimSpace(d.SerialNumber), Size: int64(d.Size)}
+			// WMI computes the size from the geometry, a few MB short of the capacity, the drive knows better
+			if f, err := os.Open(d.DeviceID); err == nil {
+				if size, err := deviceSize(f); err == nil {
+					drive.Size = size
+				}
+				f.Close()
+			}
+			drives = append(drives, drive)
 		}
 	}
-
-	if len(drives) == 0 {
-		return []string{"No USB devices found"}
-	}
-	return append([]string{"🖴 Select a USB device"}, drives...)
+	return drives, nil
 }
@@ -0,0 +1,37 @@
+//go:build darwin
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dkiocGetBlockSize  = 0x40046418 // DKIOCGETBLOCKSIZE
+	dkiocGetBlockCount = 0x40086419 // DKIOCGETBLOCKCOUNT
+)
+
+// deviceSize returns the size in bytes of the disk open in f, seeking to the end doesn't work on raw disks
+func deviceSize(f *os.File) (int64, error) {
+	blockSize, err := unix.IoctlGetInt(int(f.Fd()), dkiocGetBlockSize)
+	if err != nil {
+		return 0, err
+	}
+	blockCount, err := unix.IoctlGetInt(int(f.Fd()), dkiocGetBlockCount)
+	if err != nil {
+		return 0, err
+	}
+	return int64(blockSize) * int64(blockCount), nil
+}
+
+// rereadPartitions is not needed on macOS, disk arbitration notices the new table on its own
+func rereadPartitions(f *os.File) error {
+	return nil
+}
+
+// dropDeviceCache only syncs, raw disks are not cached
+func dropDeviceCache(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceSize returns the size in bytes of the block device open in f
+func deviceSize(f *os.File) (int64, error) {
+	return f.Seek(0, io.SeekEnd)
+}
+
+// rereadPartitions asks the kernel to pick up the new partition table of the device open in f
+func rereadPartitions(f *os.File) error {
+	return unix.IoctlSetInt(int(f.Fd()), unix.BLKRRPART, 0)
+}
+
+// dropDeviceCache writes back and forgets the cached pages of the device open in f, so the next reads
+// come from the device itself
+func dropDeviceCache(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := unix.IoctlSetInt(int(f.Fd()), unix.BLKFLSBUF, 0); err == nil {
+		return nil
+	}
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
@@ -0,0 +1,35 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	ioctlDiskGetLengthInfo    = 0x0007405C // IOCTL_DISK_GET_LENGTH_INFO
+	ioctlDiskUpdateProperties = 0x00070140 // IOCTL_DISK_UPDATE_PROPERTIES
+)
+
+// deviceSize returns the size in bytes of the physical drive open in f
+func deviceSize(f *os.File) (int64, error) {
+	var length int64
+	var returned uint32
+	err := windows.DeviceIoControl(windows.Handle(f.Fd()), ioctlDiskGetLengthInfo, nil, 0,
+		(*byte)(unsafe.Pointer(&length)), uint32(unsafe.Sizeof(length)), &returned, nil)
+	return length, err
+}
+
+// rereadPartitions makes Windows read the new partition table of the drive open in f
+func rereadPartitions(f *os.File) error {
+	var returned uint32
+	return windows.DeviceIoControl(windows.Handle(f.Fd()), ioctlDiskUpdateProperties, nil, 0, nil, 0, &returned, nil)
+}
+
+// dropDeviceCache only flushes, physical drive handles are not cached
+func dropDeviceCache(f *os.File) error {
+	return f.Sync()
+}
@@ -2,16 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Masterminds/semver/v3"
 	"github.com/diamondburned/gotk4/pkg/gio/v2"
 	"github.com/diamondburned/gotk4/pkg/glib/v2"
 	"github.com/diamondburned/gotk4/pkg/gtk/v4"
-	"io"
-	"net/http"
-	"os"
+	"github.com/diamondburned/gotk4/pkg/pango"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 )
@@ -22,6 +22,27 @@ var saveFilePath string           // Store the path to save the downloaded file
 
 func getDownloadWindow(onDownloaded func(string)) *gtk.Button {
 	downloadBtn := gtk.NewButtonWithLabel("Download ISOs")
+
+	// Finished downloads are picked for burning even if the download window was closed meanwhile.
+	// The button shows how many downloads are still going
+	announced := make(map[int]bool)
+	downloadManager.Subscribe(func(item *DownloadItem) {
+		glib.IdleAdd(func() {
+			if active := downloadManager.Active(); active > 0 {
+				downloadBtn.SetLabel(fmt.Sprintf("Download ISOs (%d in progress)", active))
+			} else {
+				downloadBtn.SetLabel("Download ISOs")
+			}
+			if item.Status().State == DownloadDone && !announced[item.ID] {
+				announced[item.ID] = true
+				// Unless it can't be burned anyway
+				if CheckBurnSignature(item.Dest) == nil {
+					onDownloaded(item.Dest)
+				}
+			}
+		})
+	})
+
 	downloadBtn.ConnectClicked(func() {
 		// Open a new window for ISO downloads
 		downloadWin := gtk.NewWindow()
@@ -108,15 +129,34 @@ func getDownloadWindow(onDownloaded func(string)) *gtk.Button {
 		assetDownloadBtn.SetMarginTop(0)
 		assetDownloadBtn.SetMarginBottom(0)
 		assetDownloadBtn.SetSensitive(true)
+
+		// Bandwidth limit for all downloads, changing it applies to the ones in progress
+		limitLabel := gtk.NewLabel("Limit (MB/s, 0 = unlimited):")
+		limitSpin := gtk.NewSpinButtonWithRange(0, 1000, 0.5)
+		limitSpin.SetDigits(1)
+		limitSpin.SetValue(float64(downloadLimiter.Rate()) / (1024 * 1024))
+		limitSpin.ConnectValueChanged(func() {
+			downloadLimiter.SetRate(int64(limitSpin.Value() * 1024 * 1024))
+		})
+		buttonBox.Append(limitLabel)
+		buttonBox.Append(limitSpin)
 		buttonBox.Append(assetDownloadBtn)
 		vbox.Append(buttonBox)
 
+		queueView, unsubscribe := downloadQueueView(onDownloaded)
+		vbox.Append(queueView)
+		downloadWin.ConnectDestroy(unsubscribe)
+
 		// Move refreshCacheBtn to the bottom of the vbox
 		refreshCacheBtn := gtk.NewButtonWithLabel("Refresh Releases")
 		refreshCacheBtn.SetHAlign(gtk.AlignCenter)
 		refreshCacheBtn.SetMarginTop(10)
 		refreshCacheBtn.SetVExpand(false)
 
+		var releaseAssets []ReleaseAsset         // Store assets for dropdown logic
+		var releaseNotes map[string]ReleaseNotes // Notes by version, loaded from the release cache
+		var showReleaseNotes func(version string)
+
 		assetDownloadBtn.ConnectClicked(func() {
 			selectedIdx := assetDropdown.Selected()
 			if selectedIdx < 0 || int(selectedIdx) >= len(filteredAssets) {
@@ -124,15 +164,17 @@ func getDownloadWindow(onDownloaded func(string)) *gtk.Button {
 			}
 			selectedAsset := filteredAssets[selectedIdx]
 
-			fmt.Printf("Downloading asset: %s (ID: %d) for version: %s\n", selectedAsset.Name, selectedAsset.ID, selectedAsset.Version)
+			logf("Downloading asset: %s (ID: %d) for version: %s\n", selectedAsset.Name, selectedAsset.ID, selectedAsset.Version)
 			// Here you would implement the actual download logic using selectedAsset.ID
 			// Open a file dialog to choose save location
 			fileDialog := gtk.NewFileDialog()
 			fileDialog.SetTitle("Save ISO File")
 			fileDialog.SetAcceptLabel("Save")
 			fileDialog.SetModal(true)
-			homeDir, err := getHomeDirectory()
-			if err == nil && homeDir != "" {
+			// Save into the library by default so downloads don't get scattered around
+			if libDir, err := libraryDir(); err == nil && mkdirUserDir(libDir) == nil {
+				fileDialog.SetInitialFile(gio.NewFileForPath(filepath.Join(libDir, selectedAsset.Name)))
+			} else if homeDir, err := getHomeDirectory(); err == nil && homeDir != "" {
 				fileDialog.SetInitialFile(gio.NewFileForPath(filepath.Join(homeDir, selectedAsset.Name)))
 			} else {
 				fileDialog.SetInitialFile(gio.NewFileForPath(selectedAsset.Name))
@@ -146,190 +188,33 @@ func getDownloadWindow(onDownloaded func(string)) *gtk.Button {
 				if file == nil {
 					return
 				}
-
-				// Remove all children from vbox (Gtk4 doesn't have ForEach, use Remove on each child)
-				for {
-					child := vbox.FirstChild()
-					if child == nil {
-						break
-					}
-					vbox.Remove(child)
+				// Downloads run in the background queue, the window can be closed at any time
+				if _, err := downloadManager.Add(selectedAsset, releaseAssets, file.Path()); err != nil {
+					loadingLabel.SetText(err.Error())
 				}
-
-				// Create a new box for download progress
-				progressBox := gtk.NewBox(gtk.OrientationVertical, 10)
-				progressBox.SetHAlign(gtk.AlignCenter)
-				progressBox.SetVAlign(gtk.AlignCenter)
-				progressBox.SetMarginTop(40)
-				progressBox.SetMarginBottom(40)
-				progressBox.SetMarginStart(40)
-				progressBox.SetMarginEnd(40)
-
-				spinnerDownload := gtk.NewSpinner()
-				spinnerDownload.SetHAlign(gtk.AlignCenter)
-				spinnerDownload.SetVAlign(gtk.AlignCenter)
-				spinnerDownload.Start()
-				progressBox.Append(spinnerDownload)
-
-				progress := gtk.NewProgressBar()
-				progress.SetVExpand(true)
-				progress.SetHExpand(true)
-				progress.SetMarginBottom(10)
-
-				progress.SetShowText(true) // Set a fixed height for the progress bar
-				progressBox.Append(progress)
-
-				assetDownloadText := fmt.Sprintf("Downloading asset %s", selectedAsset.Name)
-				downloadLabel := gtk.NewLabel(assetDownloadText)
-				downloadLabel.SetHAlign(gtk.AlignCenter)
-				progressBox.Append(downloadLabel)
-
-				vbox.Append(progressBox)
-
-				// Run download in a goroutine so the dialog closes immediately
-				go func() {
-					resp, err := http.Get(selectedAsset.URL)
-					if err != nil {
-						glib.IdleAdd(func() {
-							spinnerDownload.Stop()
-							downloadLabel.SetText("Failed to download asset: " + err.Error())
-							progressBox.Append(goBackButton(downloadWin))
-						})
-						return
-					}
-
-					defer resp.Body.Close()
-					if resp.StatusCode != http.StatusOK {
-						glib.IdleAdd(func() {
-							spinnerDownload.Stop()
-							downloadLabel.SetText("Failed to download asset: " + resp.Status)
-							progressBox.Append(goBackButton(downloadWin))
-						})
-						return
-					}
-
-					// Check for redirects
-					redirect := resp.Header.Get("Location")
-					if redirect != "" && redirect != selectedAsset.URL {
-						glib.IdleAdd(func() {
-							spinnerDownload.Stop()
-							downloadLabel.SetText("Redirected to another URL: " + redirect)
-							progressBox.Append(goBackButton(downloadWin))
-						})
-						return
-					}
-
-					// get the size
-					contentLength := resp.ContentLength
-					// Read the response body
-					read := resp.Body
-
-					if err != nil {
-						glib.IdleAdd(func() {
-							spinnerDownload.Stop()
-							downloadLabel.SetText("Failed to download asset")
-							progress.SetText("Error: " + err.Error())
-							progressBox.Append(goBackButton(downloadWin))
-						})
-						return
-					}
-					defer read.Close()
-					if redirect != "" {
-						glib.IdleAdd(func() {
-							spinnerDownload.Stop()
-							downloadLabel.SetText("Redirected to another URL")
-							progress.SetText("Redirect: " + redirect)
-							progressBox.Append(goBackButton(downloadWin))
-						})
-						return
-					}
-
-					// now write the file
-					fileWriter, err := os.Create(file.Path())
-					if err != nil {
-						glib.IdleAdd(func() {
-							spinnerDownload.Stop()
-							downloadLabel.SetText("Failed to create file")
-							progress.SetText("Error: " + err.Error())
-							progressBox.Append(goBackButton(downloadWin))
-						})
-						return
-					}
-					defer fileWriter.Close()
-
-					// copy from read to fileWriter with progress
-					progress.SetFraction(0)
-					progress.SetText("Downloading...")
-					buf := make([]byte, 32*1024) // 32KB buffer
-					totalBytes := int64(0)
-					for {
-						n, err := read.Read(buf)
-						if n > 0 {
-							// Write to file
-							if _, err := fileWriter.Write(buf[:n]); err != nil {
-								glib.IdleAdd(func() {
-									spinnerDownload.Stop()
-									downloadLabel.SetText("Failed to write file")
-									progress.SetText("Error: " + err.Error())
-									progressBox.Append(goBackButton(downloadWin))
-								})
-								return
-							}
-							totalBytes += int64(n)
-							glib.IdleAdd(func() {
-								progress.SetFraction(float64(totalBytes) / float64(contentLength))
-								// set the downloaded size in Mb
-								totalBytesMb := totalBytes / (1024 * 1024)
-								// Set the final image size in Mb
-								contentLengthMb := contentLength / (1024 * 1024)
-								// Update the text with the current download size and total size
-								progress.SetText(fmt.Sprintf("Downloading... %d/%d MB", totalBytesMb, contentLengthMb))
-							})
-						}
-						if err != nil {
-							if err == io.EOF {
-								break // Download complete
-							}
-							glib.IdleAdd(func() {
-								spinnerDownload.Stop()
-								downloadLabel.SetText("Failed to read data")
-								progress.SetText("Error: " + err.Error())
-								progressBox.Append(goBackButton(downloadWin))
-							})
-							return
-						}
-					}
-
-					glib.IdleAdd(func() {
-						spinnerDownload.Stop()
-						downloadLabel.SetText("Download complete!")
-						progress.SetText("Done!")
-
-						// Show the full path of the ISO file
-						filePathLabel := gtk.NewLabel(fmt.Sprintf("ISO saved to: %s", file.Path()))
-						filePathLabel.SetHAlign(gtk.AlignCenter)
-						filePathLabel.SetMarginTop(20)
-						progressBox.Append(filePathLabel)
-						progressBox.Append(goBackButton(downloadWin))
-
-						// Call the callback to set the ISO path in the main window
-						onDownloaded(file.Path())
-					})
-				}()
 			})
 		})
 
 		// Helper to update dropdowns after fetching assets
-		var releaseAssets []ReleaseAsset // Store assets for dropdown logic
 		// Update lastVersionList after fetching versions
 		updateReleaseDropdowns := func(assets []ReleaseAsset, err error) {
 			spinner.Stop()
-			if err != nil || len(assets) == 0 {
+			if err != nil {
+				loadingLabel.SetText("Failed to load releases: " + describeHTTPError(err))
+				return
+			}
+			if len(assets) == 0 {
 				loadingLabel.SetText("Failed to load releases or no assets found.")
 				return
 			}
 			loadingLabel.SetText("")
+			if useMirror() {
+				if dir, err := mirrorDir(); err == nil {
+					loadingLabel.SetText("Offline mode, releases from the mirror in " + dir)
+				}
+			}
 			releaseAssets = assets // Save for later use
+			releaseNotes = nil     // Reloaded from the cache on next use
 			versionSet := make(map[string]struct{})
 			for _, a := range assets {
 				versionSet[a.Version] = struct{}{}
@@ -367,6 +252,7 @@ func getDownloadWindow(onDownloaded func(string)) *gtk.Button {
 				assetDropdown.SetSensitive(true)
 				// Set the number in the label
 				versionLabel.SetText(fmt.Sprintf("Versions (%d):", len(versions)))
+				showReleaseNotes(latestVersion)
 			}
 		}
 
@@ -511,13 +397,42 @@ func getDownloadWindow(onDownloaded func(string)) *gtk.Button {
 			}
 		})
 
-		// Remove previous vbox.Append(refreshCacheBtn)
-		// Instead, add a spacer and then append the button
-		spacer := gtk.NewBox(gtk.OrientationVertical, 0)
-		spacer.SetVExpand(true)
-		vbox.Append(spacer)
+		// Release notes of the selected version, the scrolled window takes the free space
+		notesLabel := gtk.NewLabel("")
+		notesLabel.SetHAlign(gtk.AlignStart)
+		notesLabel.SetVAlign(gtk.AlignStart)
+		notesLabel.SetWrap(true)
+		notesLabel.SetSelectable(true)
+		notesLabel.SetMarginStart(4)
+		notesLabel.SetMarginEnd(4)
+		notesScroll := gtk.NewScrolledWindow()
+		notesScroll.SetPolicy(gtk.PolicyNever, gtk.PolicyAutomatic)
+		notesScroll.SetVExpand(true)
+		notesScroll.SetChild(notesLabel)
+		vbox.Append(notesScroll)
 		vbox.Append(refreshCacheBtn)
 
+		// Show the notes for the selected version
+		showReleaseNotes = func(version string) {
+			if releaseNotes == nil {
+				releaseNotes = CachedReleaseNotes("kairos-io", "kairos")
+			}
+			notes, ok := releaseNotes[version]
+			if !ok {
+				notesLabel.SetText("No release notes available for " + version)
+				return
+			}
+			notesLabel.SetMarkup(releaseNotesMarkup(notes, releaseAssets))
+		}
+		versionDropdown.Connect("notify::selected", func() {
+			selectedObj := versionDropdown.Model().Item(versionDropdown.Selected())
+			selectedStr, ok := selectedObj.Cast().(*gtk.StringObject)
+			if !ok {
+				return
+			}
+			showReleaseNotes(selectedStr.String())
+		})
+
 		// Helper to set button sensitivity during fetch
 		setRefreshBtnActive := func(active bool) {
 			refreshCacheBtn.SetSensitive(active)
@@ -531,9 +446,7 @@ func getDownloadWindow(onDownloaded func(string)) *gtk.Button {
 			assetDropdown.SetSensitive(false)
 			go func() {
 				ctx := context.Background()
-				cacheFile := filepath.Join(os.TempDir(), "kairos_releases_cache.json")
-				_ = os.Remove(cacheFile)
-				assets, err := GetCachedReleaseAssets(ctx, "kairos-io", "kairos")
+				assets, err := RefreshReleaseAssets(ctx, "kairos-io", "kairos")
 				glib.IdleAdd(func() {
 					updateReleaseDropdowns(assets, err)
 					setRefreshBtnActive(true)
@@ -545,7 +458,12 @@ func getDownloadWindow(onDownloaded func(string)) *gtk.Button {
 		setRefreshBtnActive(false)
 		go func() {
 			ctx := context.Background()
-			assets, err := GetCachedReleaseAssets(ctx, "kairos-io", "kairos")
+			// Stale releases are shown right away and swapped once GitHub tells us they changed
+			assets, err := GetCachedReleaseAssets(ctx, "kairos-io", "kairos", func(updated []ReleaseAsset) {
+				glib.IdleAdd(func() {
+					updateReleaseDropdowns(updated, nil)
+				})
+			})
 			glib.IdleAdd(func() {
 				updateReleaseDropdowns(assets, err)
 				setRefreshBtnActive(true)
@@ -558,13 +476,162 @@ func getDownloadWindow(onDownloaded func(string)) *gtk.Button {
 	return downloadBtn
 }
 
-func goBackButton(window *gtk.Window) *gtk.Button {
-	goBackBtn := gtk.NewButtonWithLabel("Go Back")
-	goBackBtn.SetHAlign(gtk.AlignCenter)
-	goBackBtn.SetMarginTop(20)
+// downloadQueueView lists the downloads of downloadManager with their progress and controls.
+// The returned func stops updating the view and must be called when its window goes away
+func downloadQueueView(onUse func(string)) (*gtk.ScrolledWindow, func()) {
+	list := gtk.NewBox(gtk.OrientationVertical, 6)
+	scrolled := gtk.NewScrolledWindow()
+	scrolled.SetPolicy(gtk.PolicyNever, gtk.PolicyAutomatic)
+	scrolled.SetMinContentHeight(120)
+	scrolled.SetChild(list)
+
+	rows := make(map[int]*downloadRow)
+	syncRow := func(item *DownloadItem) {
+		row, ok := rows[item.ID]
+		if !slices.Contains(downloadManager.Items(), item) {
+			if ok {
+				list.Remove(row.box)
+				delete(rows, item.ID)
+			}
+			return
+		}
+		if !ok {
+			row = newDownloadRow(item, onUse)
+			rows[item.ID] = row
+			list.Append(row.box)
+		}
+		row.update()
+	}
+	for _, item := range downloadManager.Items() {
+		syncRow(item)
+	}
+	closed := false
+	unsubscribe := downloadManager.Subscribe(func(item *DownloadItem) {
+		glib.IdleAdd(func() {
+			if !closed {
+				syncRow(item)
+			}
+		})
+	})
+	return scrolled, func() {
+		closed = true
+		unsubscribe()
+	}
+}
+
+// downloadRow shows a queued download
+type downloadRow struct {
+	item      *DownloadItem
+	box       *gtk.Box
+	progress  *gtk.ProgressBar
+	status    *gtk.Label
+	pauseBtn  *gtk.Button
+	cancelBtn *gtk.Button
+	removeBtn *gtk.Button
+	useBtn    *gtk.Button
+}
 
-	goBackBtn.ConnectClicked(func() {
-		window.Close()
+func newDownloadRow(item *DownloadItem, onUse func(string)) *downloadRow {
+	row := &downloadRow{item: item}
+	row.box = gtk.NewBox(gtk.OrientationHorizontal, 10)
+	row.box.SetMarginTop(4)
+	row.box.SetMarginBottom(4)
+
+	info := gtk.NewBox(gtk.OrientationVertical, 4)
+	info.SetHExpand(true)
+	name := gtk.NewLabel(item.Asset.Name)
+	name.SetHAlign(gtk.AlignStart)
+	name.SetEllipsize(pango.EllipsizeMiddle)
+	name.SetTooltipText(item.Dest)
+	info.Append(name)
+	row.progress = gtk.NewProgressBar()
+	row.progress.SetShowText(true)
+	info.Append(row.progress)
+	row.status = gtk.NewLabel("")
+	row.status.SetHAlign(gtk.AlignStart)
+	row.status.SetWrap(true)
+	info.Append(row.status)
+	row.box.Append(info)
+
+	row.pauseBtn = gtk.NewButtonWithLabel("Pause")
+	row.pauseBtn.SetVAlign(gtk.AlignCenter)
+	row.pauseBtn.ConnectClicked(func() {
+		switch item.Status().State {
+		case DownloadRunning, DownloadQueued:
+			downloadManager.Pause(item)
+		case DownloadPaused, DownloadFailed:
+			downloadManager.Resume(item)
+		}
+	})
+	row.cancelBtn = gtk.NewButtonWithLabel("Cancel")
+	row.cancelBtn.SetVAlign(gtk.AlignCenter)
+	row.cancelBtn.ConnectClicked(func() {
+		downloadManager.Cancel(item)
+	})
+	row.useBtn = gtk.NewButtonWithLabel("Use")
+	row.useBtn.SetVAlign(gtk.AlignCenter)
+	row.useBtn.SetCSSClasses([]string{"suggested-action"})
+	row.useBtn.ConnectClicked(func() {
+		onUse(item.Dest)
+	})
+	row.removeBtn = gtk.NewButtonWithLabel("✕")
+	row.removeBtn.SetVAlign(gtk.AlignCenter)
+	row.removeBtn.SetTooltipText("Remove from the list")
+	row.removeBtn.ConnectClicked(func() {
+		downloadManager.Remove(item)
 	})
-	return goBackBtn
+	row.box.Append(row.pauseBtn)
+	row.box.Append(row.cancelBtn)
+	row.box.Append(row.useBtn)
+	row.box.Append(row.removeBtn)
+	return row
+}
+
+// update refreshes the row from the state of its download
+func (r *downloadRow) update() {
+	st := r.item.Status()
+	if st.Total > 0 {
+		r.progress.SetFraction(float64(st.Done) / float64(st.Total))
+	}
+	r.progress.SetText(fmt.Sprintf("%d/%d MB", st.Done/(1024*1024), st.Total/(1024*1024)))
+
+	r.pauseBtn.SetVisible(!st.State.finished() || st.State == DownloadFailed)
+	r.pauseBtn.SetLabel("Pause")
+	r.cancelBtn.SetVisible(!st.State.finished() || st.State == DownloadFailed)
+	r.useBtn.SetVisible(st.State == DownloadDone)
+	r.removeBtn.SetVisible(st.State.finished())
+
+	switch st.State {
+	case DownloadQueued:
+		r.status.SetText("Waiting for a free slot...")
+	case DownloadRunning:
+		r.status.SetText("Downloading...")
+	case DownloadPaused:
+		r.status.SetText("Paused")
+		r.pauseBtn.SetLabel("Resume")
+	case DownloadCancelled:
+		r.status.SetText("Cancelled")
+	case DownloadFailed:
+		r.pauseBtn.SetLabel("Retry")
+		if errors.Is(st.Err, ErrChecksumMismatch) {
+			r.status.SetText("❌ Downloaded file is corrupt, please download it again")
+		} else {
+			// The partial file is kept, retrying resumes it
+			r.status.SetText("❌ " + describeHTTPError(st.Err))
+		}
+	case DownloadDone:
+		r.progress.SetFraction(1)
+		r.progress.SetText("Done!")
+		switch st.Signature.Status {
+		case SignatureVerified:
+			r.status.SetText("✅ Signed by " + st.Signature.Signer)
+		case SignatureUnsigned:
+			r.status.SetText("⚠️ This image is not signed")
+		case SignatureFailed:
+			r.status.SetText("❌ Signature verification failed, this image can't be burned: " + st.Signature.Err.Error())
+			r.useBtn.SetVisible(false)
+		default:
+			r.status.SetText("Saved to " + r.item.Dest)
+		}
+	}
 }
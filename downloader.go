@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// partialDownload is stored next to the .part file so an interrupted download can be resumed
+// only against the very same remote file
+type partialDownload struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size"`
+	// Segments is set for segmented downloads, see downloadSegmented
+	Segments []downloadSegment `json:"segments,omitempty"`
+}
+
+// DownloadProgress is called while downloading with the bytes on disk so far and the total size,
+// total is -1 if the server didn't tell us
+type DownloadProgress func(done, total int64)
+
+// ErrChecksumMismatch is returned when the downloaded file doesn't match the expected checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+func partPath(dest string) string     { return dest + ".part" }
+func partMetaPath(dest string) string { return dest + ".part.json" }
+
+// DownloadFile downloads url into dest. The data is written to dest.part first and a previous
+// interrupted download of the same url is resumed with a Range request. Big files are fetched in
+// several segments at once when the server supports ranges. If expectedSHA256 is set the
+// complete file is checked against it before being renamed into place.
+func DownloadFile(ctx context.Context, url, dest, expectedSHA256 string, progress DownloadProgress) error {
+	meta := readPartialDownload(dest)
+	if meta != nil && len(meta.Segments) > 0 && !segmentsOnDisk(dest, meta) {
+		// The finished segments are gone with their .part file, what the metadata says is done isn't
+		_ = os.Remove(partMetaPath(dest))
+		meta = nil
+	}
+	if meta != nil && meta.URL == url && len(meta.Segments) > 0 {
+		return downloadSegmented(ctx, url, dest, expectedSHA256, meta, progress)
+	}
+	if meta == nil && appConfig.DownloadSegments > 1 {
+		probe, err := probeRanges(ctx, url)
+		if err != nil {
+			return err
+		}
+		if probe != nil && probe.Size >= int64(appConfig.SegmentedMinSize) {
+			probe.Segments = splitSegments(probe.Size, appConfig.DownloadSegments)
+			return downloadSegmented(ctx, url, dest, expectedSHA256, probe, progress)
+		}
+	}
+	return downloadSingle(ctx, url, dest, expectedSHA256, meta, progress)
+}
+
+// downloadSingle downloads url over a single connection, resuming from meta if it matches
+func downloadSingle(ctx context.Context, url, dest, expectedSHA256 string, meta *partialDownload, progress DownloadProgress) error {
+	part := partPath(dest)
+	var offset int64
+	if meta != nil && meta.URL == url {
+		if info, err := os.Stat(part); err == nil {
+			offset = info.Size()
+		}
+	} else {
+		meta = nil
+	}
+
+	h := sha256.New()
+	if offset > 0 && expectedSHA256 != "" {
+		// Hash what we already have so the checksum covers the whole file. Done before the request,
+		// a big .part takes longer than the server waits for us to read the body
+		if err := hashInto(h, part, offset); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// If-Range makes the server send the whole file if it changed since we started
+		if meta.ETag != "" {
+			req.Header.Set("If-Range", meta.ETag)
+		} else if meta.LastModified != "" {
+			req.Header.Set("If-Range", meta.LastModified)
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var total int64
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		total = offset + resp.ContentLength
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && meta.Size == offset:
+		// We already had everything, the process died before the rename
+		total = offset
+	case resp.StatusCode == http.StatusOK:
+		// Either a fresh download or the server ignored the range, start over
+		offset = 0
+		h.Reset()
+		total = resp.ContentLength
+	default:
+		return &httpStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	if resp.ContentLength < 0 {
+		total = -1
+	}
+
+	if offset == 0 {
+		meta = &partialDownload{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Size:         total,
+		}
+		if err := writePartialDownload(dest, meta); err != nil {
+			return err
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if offset > 0 {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	out, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		err = copyDownload(io.MultiWriter(out, h), newRateLimitedReader(ctx, resp.Body), offset, total, progress)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Keep the .part file around so the next attempt can resume
+		return err
+	}
+
+	if expectedSHA256 != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, expectedSHA256) {
+			// A corrupt partial file is useless for resuming, drop it
+			_ = os.Remove(part)
+			_ = os.Remove(partMetaPath(dest))
+			return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expectedSHA256, sum)
+		}
+	}
+
+	if err := os.Rename(part, dest); err != nil {
+		return err
+	}
+	_ = os.Remove(partMetaPath(dest))
+	return nil
+}
+
+// copyDownload copies src into dst reporting progress, done starts at offset
+func copyDownload(dst io.Writer, src io.Reader, offset, total int64, progress DownloadProgress) error {
+	buf := make([]byte, 32*1024) // 32KB buffer
+	done := offset
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			done += int64(n)
+			if progress != nil {
+				progress(done, total)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if total > 0 && done != total {
+		return fmt.Errorf("download incomplete: got %d of %d bytes", done, total)
+	}
+	return nil
+}
+
+// hashInto feeds the first n bytes of path into h
+func hashInto(h hash.Hash, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(h, f, n)
+	return err
+}
+
+func readPartialDownload(dest string) *partialDownload {
+	data, err := os.ReadFile(partMetaPath(dest))
+	if err != nil {
+		return nil
+	}
+	var meta partialDownload
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+func writePartialDownload(dest string, meta *partialDownload) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(partMetaPath(dest), data, 0644)
+}
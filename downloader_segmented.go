@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloadSegment is a byte range [Start, End] of the remote file, Done bytes of it are already on disk
+type downloadSegment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+func (s downloadSegment) size() int64 { return s.End - s.Start + 1 }
+
+// errRemoteChanged is returned when the server stops honoring our ranges, usually because the file changed
+var errRemoteChanged = errors.New("remote file changed during download")
+
+// probeRanges checks if the server supports range requests for url. It returns the remote file
+// details when it does and nil when the download has to be done in a single stream
+func probeRanges(ctx context.Context, url string) (*partialDownload, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, nil
+	}
+	// Content-Range: bytes 0-0/12345
+	contentRange := resp.Header.Get("Content-Range")
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return nil, nil
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil || size <= 0 {
+		return nil, nil
+	}
+	return &partialDownload{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         size,
+	}, nil
+}
+
+// splitSegments splits size bytes into n ranges of about the same size
+func splitSegments(size int64, n int) []downloadSegment {
+	if int64(n) > size {
+		n = int(size)
+	}
+	segments := make([]downloadSegment, 0, n)
+	chunk := size / int64(n)
+	var start int64
+	for i := 0; i < n; i++ {
+		end := start + chunk - 1
+		if i == n-1 {
+			end = size - 1
+		}
+		segments = append(segments, downloadSegment{Start: start, End: end})
+		start = end + 1
+	}
+	return segments
+}
+
+// segmentsOnDisk tells if the .part file of a segmented download is still there with the size it was
+// preallocated to, without it the progress saved in meta can't be trusted
+func segmentsOnDisk(dest string, meta *partialDownload) bool {
+	info, err := os.Stat(partPath(dest))
+	return err == nil && info.Mode().IsRegular() && info.Size() == meta.Size
+}
+
+// downloadSegmented fetches all the segments in meta concurrently into a preallocated dest.part.
+// Progress of each segment is saved in the metadata file so it can be resumed like a single stream download
+func downloadSegmented(ctx context.Context, url, dest, expectedSHA256 string, meta *partialDownload, progress DownloadProgress) error {
+	part := partPath(dest)
+	out, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if info, err := out.Stat(); err != nil {
+		return err
+	} else if info.Size() != meta.Size {
+		// Preallocate so every segment can write at its offset
+		if err := out.Truncate(meta.Size); err != nil {
+			return err
+		}
+	}
+	if err := writePartialDownload(dest, meta); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex // guards meta and the progress callback
+	var done int64
+	for _, s := range meta.Segments {
+		done += s.Done
+	}
+	lastSave := time.Now()
+	update := func(i int, n int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		meta.Segments[i].Done += n
+		done += n
+		if progress != nil {
+			progress(done, meta.Size)
+		}
+		if time.Since(lastSave) > 2*time.Second {
+			_ = writePartialDownload(dest, meta)
+			lastSave = time.Now()
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(meta.Segments))
+	for i := range meta.Segments {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			// Requests are already retried by httpClient, this covers connections dropping mid transfer
+			for attempt := 0; attempt <= appConfig.HTTPRetries; attempt++ {
+				if attempt > 0 {
+					select {
+					case <-ctx.Done():
+						errs <- ctx.Err()
+						return
+					case <-time.After(backoff(attempt - 1)):
+					}
+				}
+				mu.Lock()
+				seg := meta.Segments[i]
+				mu.Unlock()
+				err = fetchSegment(ctx, out, meta, seg, func(n int64) { update(i, n) })
+				if err == nil || errors.Is(err, errRemoteChanged) || ctx.Err() != nil {
+					break
+				}
+				logf("Segment %d failed (attempt %d): %v\n", i, attempt+1, err)
+			}
+			if err != nil {
+				cancel()
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	mu.Lock()
+	_ = writePartialDownload(dest, meta)
+	mu.Unlock()
+
+	for err := range errs {
+		if errors.Is(err, errRemoteChanged) {
+			// What we have belongs to another file, start from scratch next time
+			_ = os.Remove(part)
+			_ = os.Remove(partMetaPath(dest))
+			return err
+		}
+		if !errors.Is(err, context.Canceled) || ctx.Err() == nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if expectedSHA256 != "" {
+		h := sha256.New()
+		if err := hashInto(h, part, meta.Size); err != nil {
+			return err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, expectedSHA256) {
+			_ = os.Remove(part)
+			_ = os.Remove(partMetaPath(dest))
+			return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expectedSHA256, sum)
+		}
+	}
+
+	if err := os.Rename(part, dest); err != nil {
+		return err
+	}
+	_ = os.Remove(partMetaPath(dest))
+	return nil
+}
+
+// fetchSegment downloads what is missing of seg and writes it at its offset in out
+func fetchSegment(ctx context.Context, out io.WriterAt, meta *partialDownload, seg downloadSegment, written func(int64)) error {
+	if seg.Done >= seg.size() {
+		return nil
+	}
+	start := seg.Start + seg.Done
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, seg.End))
+	if meta.ETag != "" {
+		req.Header.Set("If-Range", meta.ETag)
+	} else if meta.LastModified != "" {
+		req.Header.Set("If-Range", meta.LastModified)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// If-Range failed, the server sends the whole new file
+		return errRemoteChanged
+	default:
+		return &httpStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	body := newRateLimitedReader(ctx, resp.Body)
+	buf := make([]byte, 32*1024)
+	offset := start
+	for offset <= seg.End {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if remaining := seg.End - offset + 1; int64(n) > remaining {
+				n = int(remaining)
+			}
+			if _, werr := out.WriteAt(buf[:n], offset); werr != nil {
+				return werr
+			}
+			offset += int64(n)
+			written(int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if offset <= seg.End {
+		return fmt.Errorf("segment ended early at byte %d of %d", offset, seg.End)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadFile(t *testing.T) {
+	content := make([]byte, 3000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	// The server answers ranges like a CDN does, unless noRanges is set. It records the Range header
+	// of every request
+	var mu sync.Mutex
+	var requested []string
+	noRanges := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		if noRanges {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content)
+			return
+		}
+		http.ServeContent(w, r, "kairos.iso", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	url := server.URL + "/kairos.iso"
+
+	defer func(c Config) { appConfig = c }(appConfig)
+	appConfig.DownloadSegments = 4
+
+	// partial leaves an interrupted download of the first n bytes, in segments when segments is set
+	partial := func(dest string, n int64, etag string, segments []downloadSegment) {
+		data := content[:n]
+		if segments != nil {
+			// The .part of a segmented download is preallocated, the missing bytes are zeros
+			data = make([]byte, len(content))
+			for _, s := range segments {
+				copy(data[s.Start:s.Start+s.Done], content[s.Start:])
+			}
+		}
+		if err := os.WriteFile(partPath(dest), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writePartialDownload(dest, &partialDownload{URL: url, ETag: etag, Size: int64(len(content)), Segments: segments}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resumed := []downloadSegment{{0, 749, 750}, {750, 1499, 100}, {1500, 2249, 0}, {2250, 2999, 0}}
+	allSegments := []string{"bytes=0-0", "bytes=0-749", "bytes=750-1499", "bytes=1500-2249", "bytes=2250-2999"}
+
+	tests := []struct {
+		name     string
+		noRanges bool
+		minSize  int64
+		setup    func(dest string)
+		checksum string
+		want     []string
+		wantErr  error
+	}{
+		{name: "segmented", minSize: 1000, checksum: checksum, want: allSegments},
+		{name: "no range support", noRanges: true, minSize: 1000, checksum: checksum, want: []string{"bytes=0-0", ""}},
+		{name: "below the segmented size", minSize: 4000, checksum: checksum, want: []string{"bytes=0-0", ""}},
+		{
+			name:     "resume segments",
+			minSize:  1000,
+			setup:    func(dest string) { partial(dest, 0, `"v1"`, slices.Clone(resumed)) },
+			checksum: checksum,
+			want:     []string{"bytes=850-1499", "bytes=1500-2249", "bytes=2250-2999"},
+		},
+		{
+			// The finished segments went with the .part file, the download starts over
+			name:     "segments without their part file",
+			minSize:  1000,
+			setup:    func(dest string) { partial(dest, 0, `"v1"`, slices.Clone(resumed)); os.Remove(partPath(dest)) },
+			checksum: checksum,
+			want:     allSegments,
+		},
+		{
+			name:     "resume single stream",
+			minSize:  1000,
+			setup:    func(dest string) { partial(dest, 1000, `"v1"`, nil) },
+			checksum: checksum,
+			want:     []string{"bytes=1000-"},
+		},
+		{
+			// The server sends the whole file, which replaces the .part
+			name:     "resume without range support",
+			noRanges: true,
+			minSize:  1000,
+			setup:    func(dest string) { partial(dest, 1000, `"v1"`, nil) },
+			checksum: checksum,
+			want:     []string{"bytes=1000-"},
+		},
+		{
+			// A single segment is left, others would be cancelled before they ask
+			name:    "remote changed",
+			minSize: 1000,
+			setup: func(dest string) {
+				partial(dest, 0, `"v0"`, []downloadSegment{{0, 749, 750}, {750, 1499, 750}, {1500, 2249, 750}, {2250, 2999, 0}})
+			},
+			want:    []string{"bytes=2250-2999"},
+			wantErr: errRemoteChanged,
+		},
+		{name: "checksum mismatch", minSize: 1000, checksum: checksum[1:] + "0", want: allSegments, wantErr: ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "kairos.iso")
+			if tt.setup != nil {
+				tt.setup(dest)
+			}
+			noRanges = tt.noRanges
+			appConfig.SegmentedMinSize = tt.minSize
+			requested = nil
+			var lastDone int64
+			err := DownloadFile(context.Background(), url, dest, tt.checksum, func(done, total int64) { lastDone = done })
+
+			// The segments are requested concurrently
+			slices.Sort(requested)
+			want := slices.Sorted(slices.Values(tt.want))
+			if !slices.Equal(requested, want) {
+				t.Errorf("requested ranges %q, want %q", requested, want)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("DownloadFile() = %v, want %v", err, tt.wantErr)
+				}
+				// What is on disk is no use to resume
+				if _, err := os.Stat(partPath(dest)); !os.IsNotExist(err) {
+					t.Errorf("the .part file was kept: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := os.ReadFile(dest); err != nil || !bytes.Equal(got, content) {
+				t.Errorf("downloaded %d bytes, %v, want the %d of the remote file", len(got), err, len(content))
+			}
+			if lastDone != int64(len(content)) {
+				t.Errorf("progress ended at %d bytes", lastDone)
+			}
+			for _, path := range []string{partPath(dest), partMetaPath(dest)} {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("%s was left behind: %v", filepath.Base(path), err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DownloadState is where a queued download is in its life
+type DownloadState string
+
+const (
+	DownloadQueued    DownloadState = "queued"
+	DownloadRunning   DownloadState = "running"
+	DownloadPaused    DownloadState = "paused"
+	DownloadDone      DownloadState = "done"
+	DownloadFailed    DownloadState = "failed"
+	DownloadCancelled DownloadState = "cancelled"
+)
+
+// finished tells if the download won't make progress without the user starting it again
+func (s DownloadState) finished() bool {
+	return s == DownloadDone || s == DownloadFailed || s == DownloadCancelled
+}
+
+// DownloadItem is an asset in the download queue
+type DownloadItem struct {
+	ID    int
+	Asset ReleaseAsset
+	Dest  string
+	// assets of the release, to find the checksum and signature of Asset
+	assets []ReleaseAsset
+
+	mu         sync.Mutex
+	state      DownloadState
+	done       int64
+	total      int64
+	err        error
+	signature  SignatureResult
+	cancel     context.CancelFunc
+	lastNotify time.Time
+	// exited is closed when the goroutine of the last run returns, a resumed download waits for it
+	// so two runs never write the same file
+	exited chan struct{}
+}
+
+// DownloadStatus is a snapshot of a DownloadItem, safe to read from the UI
+type DownloadStatus struct {
+	State     DownloadState
+	Done      int64
+	Total     int64
+	Err       error
+	Signature SignatureResult
+}
+
+// Status returns the current state and progress of the download
+func (d *DownloadItem) Status() DownloadStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DownloadStatus{State: d.state, Done: d.done, Total: d.total, Err: d.err, Signature: d.signature}
+}
+
+// DownloadManager runs the queued downloads in the background, a few at a time. It outlives the
+// download window so closing it doesn't stop anything
+type DownloadManager struct {
+	mu        sync.Mutex
+	items     []*DownloadItem
+	nextID    int
+	listeners map[int]func(*DownloadItem)
+	nextSub   int
+}
+
+// downloadManager is the queue shared by every download window
+var downloadManager = &DownloadManager{listeners: make(map[int]func(*DownloadItem))}
+
+// Subscribe registers fn to be called whenever an item is added, removed or makes progress.
+// fn runs on the download goroutines. The returned func unregisters it
+func (m *DownloadManager) Subscribe(fn func(*DownloadItem)) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextSub
+	m.nextSub++
+	m.listeners[id] = fn
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.listeners, id)
+	}
+}
+
+func (m *DownloadManager) notify(item *DownloadItem) {
+	m.mu.Lock()
+	listeners := make([]func(*DownloadItem), 0, len(m.listeners))
+	for _, fn := range m.listeners {
+		listeners = append(listeners, fn)
+	}
+	m.mu.Unlock()
+	for _, fn := range listeners {
+		fn(item)
+	}
+}
+
+// Items returns the downloads in the order they were added
+func (m *DownloadManager) Items() []*DownloadItem {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*DownloadItem(nil), m.items...)
+}
+
+// Active returns how many downloads are queued or running
+func (m *DownloadManager) Active() int {
+	active := 0
+	for _, item := range m.Items() {
+		if s := item.Status().State; s == DownloadQueued || s == DownloadRunning {
+			active++
+		}
+	}
+	return active
+}
+
+// Add queues asset to be saved at dest. assets is the release it belongs to
+func (m *DownloadManager) Add(asset ReleaseAsset, assets []ReleaseAsset, dest string) (*DownloadItem, error) {
+	m.mu.Lock()
+	for _, item := range m.items {
+		if item.Dest == dest && !item.Status().State.finished() {
+			m.mu.Unlock()
+			return nil, fmt.Errorf("%s is already being downloaded", dest)
+		}
+	}
+	m.nextID++
+	item := &DownloadItem{ID: m.nextID, Asset: asset, Dest: dest, assets: assets, state: DownloadQueued}
+	m.items = append(m.items, item)
+	m.mu.Unlock()
+
+	m.notify(item)
+	m.schedule()
+	return item, nil
+}
+
+// schedule starts queued downloads while there are free slots
+func (m *DownloadManager) schedule() {
+	limit := max(appConfig.MaxConcurrentDownloads, 1)
+	var started []*DownloadItem
+	m.mu.Lock()
+	running := 0
+	for _, item := range m.items {
+		if item.Status().State == DownloadRunning {
+			running++
+		}
+	}
+	for _, item := range m.items {
+		if running >= limit {
+			break
+		}
+		item.mu.Lock()
+		if item.state == DownloadQueued {
+			ctx, cancel := context.WithCancel(context.Background())
+			item.state = DownloadRunning
+			item.err = nil
+			item.cancel = cancel
+			prev, exited := item.exited, make(chan struct{})
+			item.exited = exited
+			running++
+			started = append(started, item)
+			go func() {
+				defer close(exited)
+				if prev != nil {
+					<-prev
+				}
+				m.run(ctx, item)
+			}()
+		}
+		item.mu.Unlock()
+	}
+	m.mu.Unlock()
+	for _, item := range started {
+		m.notify(item)
+	}
+}
+
+// Pause stops a download keeping what was downloaded so far, Resume continues it from there
+func (m *DownloadManager) Pause(item *DownloadItem) {
+	item.mu.Lock()
+	switch item.state {
+	case DownloadRunning:
+		item.state = DownloadPaused
+		item.cancel()
+	case DownloadQueued:
+		item.state = DownloadPaused
+	}
+	item.mu.Unlock()
+	m.notify(item)
+}
+
+// Resume queues a paused or failed download again
+func (m *DownloadManager) Resume(item *DownloadItem) {
+	item.mu.Lock()
+	if item.state == DownloadPaused || item.state == DownloadFailed {
+		item.state = DownloadQueued
+	}
+	item.mu.Unlock()
+	m.notify(item)
+	m.schedule()
+}
+
+// Wait blocks until the download of item stops running, e.g. after Pause when the partial file must be
+// saved before exiting
+func (m *DownloadManager) Wait(item *DownloadItem) {
+	item.mu.Lock()
+	exited := item.exited
+	item.mu.Unlock()
+	if exited != nil {
+		<-exited
+	}
+}
+
+// Cancel stops a download and deletes its partial file
+func (m *DownloadManager) Cancel(item *DownloadItem) {
+	item.mu.Lock()
+	if item.state.finished() && item.state != DownloadFailed {
+		item.mu.Unlock()
+		return
+	}
+	running := item.state == DownloadRunning
+	item.state = DownloadCancelled
+	if running {
+		item.cancel()
+	}
+	item.mu.Unlock()
+	// A running download cleans up once it notices the cancellation
+	if !running {
+		removePartialDownload(item.Dest)
+	}
+	m.notify(item)
+}
+
+// Remove drops a finished download from the list
+func (m *DownloadManager) Remove(item *DownloadItem) {
+	if !item.Status().State.finished() {
+		return
+	}
+	m.mu.Lock()
+	for i, it := range m.items {
+		if it == item {
+			m.items = append(m.items[:i], m.items[i+1:]...)
+			break
+		}
+	}
+	m.mu.Unlock()
+	m.notify(item)
+}
+
+// removePartialDownload deletes the leftovers of an abandoned download
+func removePartialDownload(dest string) {
+	for _, path := range []string{partPath(dest), partMetaPath(dest)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logln("Error removing partial download:", err)
+		}
+	}
+}
+
+// run downloads item, verifying it against the published checksum and signature if there are,
+// and adds it to the library once done
+func (m *DownloadManager) run(ctx context.Context, item *DownloadItem) {
+	defer m.schedule()
+	asset := item.Asset
+
+	var checksum string
+	var signature SignatureResult
+	var err error
+	if checksumAsset, ok := checksumAssetFor(asset, item.assets); ok {
+		var checksumFile []byte
+		checksumFile, err = fetchSmallFile(ctx, checksumAsset.URL)
+		if err == nil {
+			checksum, err = parseChecksumFile(checksumFile, asset.Name)
+		}
+		if err != nil {
+			// The download fails rather than going unverified, resuming it tries the checksum again
+			err = fmt.Errorf("fetching the checksum: %w", err)
+		} else {
+			signature = VerifyReleaseSignature(ctx, asset, item.assets, checksumFile)
+		}
+	} else if appConfig.Signature.configured() {
+		signature = SignatureResult{Status: SignatureUnsigned}
+	}
+	if signature.Err != nil {
+		logln("Signature check:", signature.Err)
+	}
+	item.mu.Lock()
+	item.signature = signature
+	item.mu.Unlock()
+
+	if err == nil {
+		err = DownloadFile(ctx, asset.URL, item.Dest, checksum, func(done, total int64) {
+			item.mu.Lock()
+			item.done, item.total = done, total
+			// Progress comes for every read, the UI doesn't need that many updates
+			throttled := time.Since(item.lastNotify) < 200*time.Millisecond && done != total
+			if !throttled {
+				item.lastNotify = time.Now()
+			}
+			item.mu.Unlock()
+			if !throttled {
+				m.notify(item)
+			}
+		})
+	}
+
+	if err != nil {
+		item.mu.Lock()
+		state := item.state
+		if state == DownloadRunning {
+			item.state = DownloadFailed
+			item.err = err
+		}
+		item.mu.Unlock()
+		switch {
+		case state == DownloadCancelled:
+			removePartialDownload(item.Dest)
+		case errors.Is(err, ErrChecksumMismatch):
+			// The corrupt file can't be resumed
+			removePartialDownload(item.Dest)
+		}
+		m.notify(item)
+		return
+	}
+
+	if err := RecordDownload(item.Dest, asset, checksum, signature); err != nil {
+		logln("Error adding download to the library:", err)
+	}
+	if checksum != "" {
+		if err := recordVerifiedDownload(item.Dest, checksum, checksumAssetURL(asset, item.assets)); err != nil {
+			logln("Error saving verification result:", err)
+		}
+	}
+	if pruned, err := PruneLibrary(item.Dest); err != nil {
+		logln("Error pruning the library:", err)
+	} else {
+		for _, e := range pruned {
+			logln("Pruned from the library:", e.Name)
+		}
+	}
+
+	item.mu.Lock()
+	// A cancel while recording the download stays cancelled, the file is kept as it is complete
+	if item.state == DownloadRunning {
+		item.state = DownloadDone
+	}
+	item.mu.Unlock()
+	m.notify(item)
+}
+
+// checksumAssetURL returns where the checksum of asset was published
+func checksumAssetURL(asset ReleaseAsset, assets []ReleaseAsset) string {
+	if checksumAsset, ok := checksumAssetFor(asset, assets); ok {
+		return checksumAsset.URL
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// USBDrive is a removable drive found by ListUSBDrives
+type USBDrive struct {
+	// Path is the device to write to, like /dev/sdb or \\.\PHYSICALDRIVE1
+	Path   string
+	Model  string
+	Serial string
+	// Size is the capacity in bytes
+	Size int64
+}
+
+// Key identifies the drive across plugs and ports, by its serial when it reports one
+func (d USBDrive) Key() string {
+	if d.Serial != "" {
+		return d.Serial
+	}
+	return fmt.Sprintf("%s %d", d.Model, d.Size)
+}
+
+// Label is how the drive is shown in the drive list, the device path comes first
+func (d USBDrive) Label() string {
+	size := fmt.Sprintf("%.2f GB", float64(d.Size)/(1024*1024*1024))
+	if d.Model == "" {
+		return fmt.Sprintf("%s (%s)", d.Path, size)
+	}
+	return fmt.Sprintf("%s (%s %s)", d.Path, d.Model, size)
+}
+
+// RequiredDriveSize is the capacity needed to burn an image of imageSize bytes, with room for the
+// cloud-config partition InjectCloudConfig adds after it when withConfigPartition is set and for the
+// persistent partition, at least its minimum size when it takes the rest of the drive
+func RequiredDriveSize(imageSize int64, withConfigPartition bool, persistence Persistence) int64 {
+	if !withConfigPartition && !persistence.Enabled() {
+		return imageSize
+	}
+	end := (imageSize + partitionAlign - 1) / partitionAlign * partitionAlign
+	if withConfigPartition {
+		end += cloudConfigPartitionSize
+	}
+	// The backup GPT takes the last 33 sectors of the disk
+	return end + persistence.reserved() + 34*sectorSize
+}
+
+// driveTooSmallErr is returned for drives that can't hold the burn
+type driveTooSmallErr struct {
+	Path       string
+	Need, Have int64
+}
+
+func (e *driveTooSmallErr) Error() string {
+	return fmt.Sprintf("%s is too small: the image needs %d bytes (%.2f GB) but the drive holds %d bytes (%.2f GB)",
+		e.Path, e.Need, float64(e.Need)/(1024*1024*1024), e.Have, float64(e.Have)/(1024*1024*1024))
+}
+
+// driveTooSmallError tells how much space is missing, sizes are exact so close calls are clear
+func driveTooSmallError(path string, need, have int64) error {
+	return &driveTooSmallErr{Path: path, Need: need, Have: have}
+}
+
+// checkDriveCapacity returns an error when the device at devicePath holds less than need bytes. The
+// size is read from the device itself rather than what detection reported
+func checkDriveCapacity(devicePath string, need int64) error {
+	devicePath = rawDevicePath(devicePath)
+	device, err := os.Open(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to open device %s: %w", devicePath, err)
+	}
+	defer device.Close()
+	size, err := targetSize(device)
+	if err != nil {
+		return fmt.Errorf("failed to get the size of %s: %w", devicePath, err)
+	}
+	if size < need {
+		return driveTooSmallError(devicePath, need, size)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// capacityReports are the capacity checks run since the start, by device path
+var capacityReports = make(map[string]*CapacityReport)
+
+// showDriveTestWindow lets the user check the real capacity and the health of one of drives. The tests
+// erase the drive
+func showDriveTestWindow(parent *gtk.Window, drives []USBDrive) {
+	testWin := gtk.NewWindow()
+	testWin.SetTitle("Test USB drive")
+	testWin.SetTransientFor(parent)
+	testWin.SetModal(true)
+	testWin.SetDefaultSize(600, 400)
+
+	vbox := gtk.NewBox(gtk.OrientationVertical, 10)
+	vbox.SetMarginTop(20)
+	vbox.SetMarginBottom(20)
+	vbox.SetMarginStart(20)
+	vbox.SetMarginEnd(20)
+
+	intro := gtk.NewLabel("Counterfeit drives claim more space than they have and silently corrupt what is written past it. " +
+		"The capacity check writes tagged blocks over the drive and reads them back. The health test writes the whole drive " +
+		"and reads it back to find bad sectors and measure the sustained speeds. ⚠ Both erase everything on the drive.")
+	intro.SetWrap(true)
+	intro.SetHAlign(gtk.AlignStart)
+	vbox.Append(intro)
+
+	labels := make([]string, len(drives))
+	for i, d := range drives {
+		labels[i] = d.Label()
+	}
+	driveDropdown := gtk.NewDropDown(gtk.NewStringList(labels), nil)
+	vbox.Append(driveDropdown)
+
+	fullCheck := gtk.NewCheckButtonWithLabel("Full test, writes the whole drive and takes as long as filling it")
+	fullCheck.SetTooltipText("The quick test samples the drive where fakes usually wrap around, the full test leaves nothing out")
+	vbox.Append(fullCheck)
+
+	thoroughCheck := gtk.NewCheckButtonWithLabel("Thorough health test, four passes with the patterns of badblocks")
+	thoroughCheck.SetTooltipText("The quick health test writes random data once, the thorough one catches stuck bits but takes eight times as long as filling the drive")
+	vbox.Append(thoroughCheck)
+
+	progress := gtk.NewProgressBar()
+	progress.SetShowText(true)
+	progress.SetText("")
+	vbox.Append(progress)
+
+	statusLabel := gtk.NewLabel("")
+	statusLabel.SetHAlign(gtk.AlignStart)
+	statusLabel.SetWrap(true)
+	statusLabel.SetSelectable(true)
+	vbox.Append(statusLabel)
+
+	resultList := gtk.NewListBox()
+	resultList.SetSelectionMode(gtk.SelectionNone)
+	resultScrolled := gtk.NewScrolledWindow()
+	resultScrolled.SetChild(resultList)
+	resultScrolled.SetVExpand(true)
+	vbox.Append(resultScrolled)
+	showResults := func() {
+		resultList.RemoveAll()
+		for _, d := range drives {
+			var lines []string
+			if r, ok := capacityReports[d.Path]; ok {
+				lines = append(lines, r.String())
+			}
+			if reports := DriveHealthReports(d.Key()); len(reports) > 0 {
+				r := reports[0]
+				kind := "Quick"
+				if r.Thorough {
+					kind = "Thorough"
+				}
+				lines = append(lines, fmt.Sprintf("%s (%s health test of %s)", r, kind, r.Started.Local().Format("2006-01-02 15:04")))
+			}
+			if len(lines) > 0 {
+				label := gtk.NewLabel(d.Label() + "\n" + strings.Join(lines, "\n"))
+				label.SetHAlign(gtk.AlignStart)
+				label.SetWrap(true)
+				label.SetSelectable(true)
+				resultList.Append(label)
+			}
+		}
+	}
+	showResults()
+
+	buttonBox := gtk.NewBox(gtk.OrientationHorizontal, 10)
+	buttonBox.SetHAlign(gtk.AlignEnd)
+	closeBtn := gtk.NewButtonWithLabel("Close")
+	closeBtn.ConnectClicked(testWin.Close)
+	buttonBox.Append(closeBtn)
+	capacityBtn := gtk.NewButtonWithLabel("Erase and check capacity")
+	capacityBtn.SetCSSClasses([]string{"destructive-action"})
+	capacityBtn.SetSensitive(len(drives) > 0)
+	buttonBox.Append(capacityBtn)
+	healthBtn := gtk.NewButtonWithLabel("Erase and test health")
+	healthBtn.SetCSSClasses([]string{"destructive-action"})
+	healthBtn.SetSensitive(len(drives) > 0)
+	buttonBox.Append(healthBtn)
+	cancelBtn := gtk.NewButtonWithLabel("Cancel test")
+	cancelBtn.SetVisible(false)
+	buttonBox.Append(cancelBtn)
+	vbox.Append(buttonBox)
+	testWin.SetChild(vbox)
+
+	setBusy := func(busy bool) {
+		capacityBtn.SetSensitive(!busy)
+		healthBtn.SetSensitive(!busy)
+		closeBtn.SetSensitive(!busy)
+		driveDropdown.SetSensitive(!busy)
+	}
+	// selectedDrive returns the drive to test, nil when it is mounted or none is selected
+	selectedDrive := func() *USBDrive {
+		index := int(driveDropdown.Selected())
+		if index < 0 || index >= len(drives) {
+			return nil
+		}
+		d := drives[index]
+		if mounted, err := IsDeviceMounted(d.Path); err == nil && len(mounted) > 0 {
+			statusLabel.SetLabel("Unmount the drive first, these partitions are in use:\n" + strings.Join(mounted, "\n"))
+			return nil
+		}
+		return &d
+	}
+
+	capacityBtn.ConnectClicked(func() {
+		d := selectedDrive()
+		if d == nil {
+			return
+		}
+		setBusy(true)
+		statusLabel.SetLabel("Checking " + d.Path + "...")
+		go func() {
+			lastPercent := int64(-1)
+			report, err := ProbeDriveCapacity(d.Path, fullCheck.Active(), func(done, total int64) {
+				if percent := done * 100 / total; percent != lastPercent {
+					lastPercent = percent
+					writing := done*2 <= total
+					glib.IdleAdd(func() {
+						progress.SetFraction(float64(percent) / 100)
+						if writing {
+							progress.SetText(fmt.Sprintf("Writing %d%%", percent))
+						} else {
+							progress.SetText(fmt.Sprintf("Reading back %d%%", percent))
+						}
+					})
+				}
+			})
+			glib.IdleAdd(func() {
+				setBusy(false)
+				if err != nil {
+					statusLabel.SetLabel(fmt.Sprintf("❌ Test failed: %v", err))
+					return
+				}
+				capacityReports[d.Path] = report
+				statusLabel.SetLabel(report.String())
+				showResults()
+			})
+		}()
+	})
+
+	var cancelTest context.CancelFunc
+	cancelBtn.ConnectClicked(func() {
+		cancelBtn.SetSensitive(false)
+		cancelTest()
+	})
+	healthBtn.ConnectClicked(func() {
+		d := selectedDrive()
+		if d == nil {
+			return
+		}
+		setBusy(true)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelTest = cancel
+		cancelBtn.SetVisible(true)
+		cancelBtn.SetSensitive(true)
+		statusLabel.SetLabel("Testing " + d.Path + ", this takes as long as filling the drive twice per pass...")
+		go func() {
+			defer cancel()
+			lastPercent := int64(-1)
+			report, err := TestDriveHealth(ctx, *d, thoroughCheck.Active(), func(phase string, done, total int64) {
+				if percent := done * 100 / total; percent != lastPercent {
+					lastPercent = percent
+					glib.IdleAdd(func() {
+						progress.SetFraction(float64(percent) / 100)
+						progress.SetText(fmt.Sprintf("%s %d%%", phase, percent))
+					})
+				}
+			})
+			glib.IdleAdd(func() {
+				setBusy(false)
+				cancelBtn.SetVisible(false)
+				switch {
+				case errors.Is(err, context.Canceled):
+					progress.SetText("")
+					progress.SetFraction(0)
+					statusLabel.SetLabel("Health test cancelled, the drive is partly erased")
+				case report == nil:
+					statusLabel.SetLabel(fmt.Sprintf("❌ Test failed: %v", err))
+				case err != nil:
+					statusLabel.SetLabel(fmt.Sprintf("%s\n⚠ The report couldn't be saved: %v", report, err))
+				default:
+					statusLabel.SetLabel(report.String())
+					showResults()
+				}
+			})
+		}()
+	})
+
+	testWin.Present()
+}
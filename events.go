@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The types of events in the event stream
+const (
+	EventPhase        = "phase"
+	EventProgress     = "progress"
+	EventVerification = "verification"
+	EventError        = "error"
+	EventDone         = "done"
+)
+
+const (
+	// eventProgressInterval spaces progress events, the dashboards reading them don't need more
+	eventProgressInterval = 500 * time.Millisecond
+	// eventRedialInterval is how often a lost socket is dialed again, events in between are dropped
+	eventRedialInterval = 5 * time.Second
+	// eventWriteTimeout bounds writing an event and flushing the stream on Close
+	eventWriteTimeout = 2 * time.Second
+	// eventBuffer is how many events wait for a slow reader before new ones are dropped
+	eventBuffer = 256
+)
+
+// Event is a line of the event stream, machine-readable progress of burns, downloads and verifications
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Job is "burn", "download", "verify" or "boottest", Target the device, asset or image it works on
+	Job     string `json:"job"`
+	Target  string `json:"target"`
+	Phase   string `json:"phase,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Done and Total are in bytes, when only the fraction of the phase is known Total is 0
+	Done     int64   `json:"done,omitempty"`
+	Total    int64   `json:"total,omitempty"`
+	Fraction float64 `json:"fraction,omitempty"`
+	// Rate is the throughput in bytes per second
+	Rate float64 `json:"rate,omitempty"`
+	// Check is what a verification checked, "checksum", "signature" or the boot test firmware, and
+	// Result its outcome
+	Check  string `json:"check,omitempty"`
+	Result string `json:"result,omitempty"`
+	// Code classifies errors, see eventErrorCode
+	Code string `json:"code,omitempty"`
+}
+
+// EventStream writes events as newline-delimited JSON to stdout or a socket. Emit only queues them, a
+// goroutine writes them so a slow or gone reader doesn't hold up burns and downloads. A nil stream
+// drops them
+type EventStream struct {
+	dest  string
+	lines chan []byte
+	// done is closed once the writer is through the queue
+	done chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+
+	// Owned by the writer: out is stdout, conn the socket, nil while it is lost
+	out      io.Writer
+	conn     net.Conn
+	lastDial time.Time
+}
+
+// appEvents is where events go, nil unless event_stream is set or a command was given -events
+var appEvents *EventStream
+
+// OpenEventStream opens the stream dest names: "-" or "stdout", "unix:/path/to.sock" or
+// "tcp:host:port". An empty dest returns a nil stream. On stdout the stream replaces the messages
+// printed there, which go to stderr until the stream is closed
+func OpenEventStream(dest string) (*EventStream, error) {
+	s := &EventStream{dest: dest, lines: make(chan []byte, eventBuffer), done: make(chan struct{})}
+	switch {
+	case dest == "":
+		return nil, nil
+	case dest == "-" || dest == "stdout":
+		s.out = os.Stdout
+		logOutput = os.Stderr
+	case strings.HasPrefix(dest, "unix:") || strings.HasPrefix(dest, "tcp:"):
+		if err := s.dial(); err != nil {
+			return nil, fmt.Errorf("opening the event stream: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown event stream %q, use stdout, unix:/path or tcp:host:port", dest)
+	}
+	go s.write()
+	return s, nil
+}
+
+// dial connects the socket of the stream, called by the writer or before it starts
+func (s *EventStream) dial() error {
+	s.lastDial = time.Now()
+	network, address, _ := strings.Cut(s.dest, ":")
+	conn, err := net.DialTimeout(network, address, eventRedialInterval)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// write writes the queued events until the stream is closed. A socket that fails is dialed again
+// later, the events until then are dropped
+func (s *EventStream) write() {
+	defer close(s.done)
+	for line := range s.lines {
+		if s.out != nil {
+			_, _ = s.out.Write(line)
+			continue
+		}
+		if s.conn == nil && (time.Since(s.lastDial) < eventRedialInterval || s.dial() != nil) {
+			continue
+		}
+		_ = s.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := s.conn.Write(line); err != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// Emit queues e for the stream, stamping its time. Events are dropped while the queue is full
+func (s *EventStream) Emit(e Event) {
+	if s == nil {
+		return
+	}
+	e.Time = time.Now()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.lines <- append(line, '\n'):
+	default:
+	}
+}
+
+// Close writes the events still queued, waiting eventWriteTimeout at most, and closes the socket of
+// the stream
+func (s *EventStream) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.lines)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+	case <-time.After(eventWriteTimeout):
+	}
+	if s.out != nil {
+		logOutput = os.Stdout
+	}
+}
+
+// eventJob emits the events of one burn, download or verification and works out its throughput. A
+// nil job, from a nil stream, drops them
+type eventJob struct {
+	stream *EventStream
+	job    string
+	target string
+
+	mu       sync.Mutex
+	phase    string
+	lastEmit time.Time
+	lastDone int64
+	rate     float64
+}
+
+func (s *EventStream) job(job, target string) *eventJob {
+	if s == nil {
+		return nil
+	}
+	return &eventJob{stream: s, job: job, target: target}
+}
+
+func (j *eventJob) emit(e Event) {
+	e.Job, e.Target, e.Phase = j.job, j.target, j.phase
+	j.stream.Emit(e)
+}
+
+// Phase starts a phase of the job
+func (j *eventJob) Phase(phase, message string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.phase, j.lastEmit, j.lastDone, j.rate = phase, time.Time{}, 0, 0
+	j.mu.Unlock()
+	j.emit(Event{Type: EventPhase, Message: message})
+}
+
+// Progress reports done of total bytes of the phase
+func (j *eventJob) Progress(done, total int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	now := time.Now()
+	elapsed := now.Sub(j.lastEmit)
+	if elapsed < eventProgressInterval && done != total {
+		j.mu.Unlock()
+		return
+	}
+	if !j.lastEmit.IsZero() && done >= j.lastDone {
+		// Smoothed, single intervals jump around with caches and retries
+		rate := float64(done-j.lastDone) / elapsed.Seconds()
+		if j.rate == 0 {
+			j.rate = rate
+		} else {
+			j.rate = 0.7*j.rate + 0.3*rate
+		}
+	}
+	j.lastEmit, j.lastDone = now, done
+	e := Event{Type: EventProgress, Done: done, Total: total, Rate: j.rate}
+	j.mu.Unlock()
+	if total > 0 {
+		e.Fraction = float64(done) / float64(total)
+	}
+	j.emit(e)
+}
+
+// Fraction reports the progress of a phase of size bytes from the fraction done, size is 0 when unknown
+func (j *eventJob) Fraction(fraction float64, size int64) {
+	if j == nil {
+		return
+	}
+	if size > 0 {
+		j.Progress(int64(fraction*float64(size)), size)
+		return
+	}
+	j.mu.Lock()
+	throttled := time.Since(j.lastEmit) < eventProgressInterval && fraction < 1
+	if !throttled {
+		j.lastEmit = time.Now()
+	}
+	j.mu.Unlock()
+	if !throttled {
+		j.emit(Event{Type: EventProgress, Fraction: fraction})
+	}
+}
+
+// Verification reports the result of a check, like "checksum" and "verified"
+func (j *eventJob) Verification(check, result, message string) {
+	if j == nil {
+		return
+	}
+	j.emit(Event{Type: EventVerification, Check: check, Result: result, Message: message})
+}
+
+// Error reports that the job failed with err
+func (j *eventJob) Error(err error) {
+	if j == nil {
+		return
+	}
+	j.emit(Event{Type: EventError, Code: eventErrorCode(err), Message: err.Error()})
+}
+
+// Done reports that the job completed
+func (j *eventJob) Done(message string) {
+	if j == nil {
+		return
+	}
+	j.emit(Event{Type: EventDone, Message: message})
+}
+
+// eventErrorCode classifies err for automation, the message is for humans and changes
+func eventErrorCode(err error) string {
+	var tooSmall *driveTooSmallErr
+	var sigErr signatureError
+	var statusErr *httpStatusError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errStalled):
+		return "timeout"
+	case errors.Is(err, ErrChecksumMismatch):
+		return "checksum_mismatch"
+	case errors.As(err, &sigErr):
+		return "signature"
+	case errors.As(err, &tooSmall):
+		return "drive_too_small"
+	case errors.Is(err, errNoEFILoader):
+		return "no_efi_loader"
+	case errors.Is(err, errNotConfirmed):
+		return "not_confirmed"
+	case errors.Is(err, errDeviceMounted):
+		return "device_mounted"
+	case errors.Is(err, errInvalidCloudConfig):
+		return "invalid_cloud_config"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission_denied"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not_found"
+	case errors.As(err, &statusErr):
+		return fmt.Sprintf("http_%d", statusErr.Code)
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "failed"
+}
+
+// startEventStream opens the event stream at dest as appEvents, with the downloads of the queue in it.
+// The returned func closes it, nothing is done when dest is empty
+func startEventStream(dest string) (func(), error) {
+	s, err := OpenEventStream(dest)
+	if err != nil || s == nil {
+		return func() {}, err
+	}
+	appEvents = s
+	stop := streamDownloadEvents(s)
+	return func() {
+		stop()
+		s.Close()
+	}, nil
+}
+
+// streamDownloadEvents emits the state changes, progress and verification of every download of the
+// queue to the stream. The returned func stops it
+func streamDownloadEvents(s *EventStream) func() {
+	if s == nil {
+		return func() {}
+	}
+	var mu sync.Mutex
+	jobs := make(map[*DownloadItem]*eventJob)
+	states := make(map[*DownloadItem]DownloadState)
+	return downloadManager.Subscribe(func(item *DownloadItem) {
+		st := item.Status()
+		mu.Lock()
+		j, ok := jobs[item]
+		if !ok {
+			j = s.job("download", item.Asset.Name)
+			jobs[item] = j
+		}
+		changed := states[item] != st.State
+		states[item] = st.State
+		mu.Unlock()
+
+		if !changed {
+			if st.State == DownloadRunning && st.Total > 0 {
+				j.Progress(st.Done, st.Total)
+			}
+			return
+		}
+		switch st.State {
+		case DownloadDone:
+			if record, ok := CachedVerification(item.Dest); ok && record.Matches() {
+				j.Verification("checksum", "verified", record.Origin)
+			} else {
+				j.Verification("checksum", "unknown", "no checksum was published")
+			}
+			if st.Signature.Status != "" {
+				message := st.Signature.Signer
+				if st.Signature.Err != nil {
+					message = st.Signature.Err.Error()
+				}
+				j.Verification("signature", st.Signature.Status, message)
+			}
+			j.Done(item.Dest)
+		case DownloadFailed:
+			j.Error(st.Err)
+		case DownloadCancelled:
+			j.Error(context.Canceled)
+		default:
+			j.Phase(string(st.State), "")
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// listenEvents opens an event stream to a local socket and returns it with a channel of the decoded
+// events read from it, closed once the stream is
+func listenEvents(t *testing.T) (*EventStream, <-chan map[string]any) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	events := make(chan map[string]any, 100)
+	go func() {
+		defer close(events)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			// Decoded loosely, so fields renamed or added by mistake show up
+			var e map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Errorf("invalid event line %q: %v", scanner.Text(), err)
+				continue
+			}
+			events <- e
+		}
+	}()
+	s, err := OpenEventStream("tcp:" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, events
+}
+
+func TestEventStream(t *testing.T) {
+	s, events := listenEvents(t)
+	started := time.Now()
+	j := s.job("burn", "/dev/sdb")
+	j.Phase("write", "Writing kairos.iso")
+	j.Progress(0, 1000)
+	// Within the progress interval, only the last update of the phase gets through
+	j.Progress(500, 1000)
+	j.Fraction(0.6, 1000)
+	time.Sleep(10 * time.Millisecond)
+	j.Progress(1000, 1000)
+	j.Phase("sync", "")
+	j.Fraction(0.5, 0)
+	j.Fraction(0.7, 0)
+	j.Fraction(1, 0)
+	j.Verification("checksum", "verified", "kairos.iso.sha256")
+	j.Error(fmt.Errorf("writing: %w", ErrChecksumMismatch))
+	s.job("download", "kairos.iso").Done("/srv/kairos.iso")
+	s.Close()
+	// Closed streams drop events
+	s.Emit(Event{Type: EventDone})
+
+	want := []map[string]any{
+		{"type": "phase", "job": "burn", "target": "/dev/sdb", "phase": "write", "message": "Writing kairos.iso"},
+		{"type": "progress", "job": "burn", "target": "/dev/sdb", "phase": "write", "total": 1000.0},
+		{"type": "progress", "job": "burn", "target": "/dev/sdb", "phase": "write", "done": 1000.0, "total": 1000.0, "fraction": 1.0},
+		{"type": "phase", "job": "burn", "target": "/dev/sdb", "phase": "sync"},
+		{"type": "progress", "job": "burn", "target": "/dev/sdb", "phase": "sync", "fraction": 0.5},
+		{"type": "progress", "job": "burn", "target": "/dev/sdb", "phase": "sync", "fraction": 1.0},
+		{"type": "verification", "job": "burn", "target": "/dev/sdb", "phase": "sync", "check": "checksum", "result": "verified", "message": "kairos.iso.sha256"},
+		{"type": "error", "job": "burn", "target": "/dev/sdb", "phase": "sync", "code": "checksum_mismatch", "message": "writing: " + ErrChecksumMismatch.Error()},
+		{"type": "done", "job": "download", "target": "kairos.iso", "message": "/srv/kairos.iso"},
+	}
+	var got []map[string]any
+	for e := range events {
+		got = append(got, e)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(got), len(want), got)
+	}
+	for i, e := range got {
+		stamp, err := time.Parse(time.RFC3339Nano, fmt.Sprint(e["time"]))
+		if err != nil || stamp.Before(started.Add(-time.Second)) || stamp.After(time.Now()) {
+			t.Errorf("event %d: time %v", i, e["time"])
+		}
+		delete(e, "time")
+		// The rate depends on the timing, it is only checked to be there once bytes were counted
+		if rate, ok := e["rate"].(float64); ok {
+			if i != 2 || rate <= 0 {
+				t.Errorf("event %d: rate %v", i, rate)
+			}
+			delete(e, "rate")
+		} else if i == 2 {
+			t.Errorf("event %d has no rate", i)
+		}
+		if fmt.Sprint(e) != fmt.Sprint(want[i]) {
+			t.Errorf("event %d = %v, want %v", i, e, want[i])
+		}
+	}
+}
+
+func TestEventStreamNil(t *testing.T) {
+	s, err := OpenEventStream("")
+	if s != nil || err != nil {
+		t.Fatalf("OpenEventStream(\"\") = %v, %v, want a nil stream", s, err)
+	}
+	// Everything is dropped without a stream
+	j := s.job("burn", "/dev/sdb")
+	j.Phase("write", "")
+	j.Progress(1, 2)
+	j.Fraction(0.5, 0)
+	j.Verification("checksum", "verified", "")
+	j.Error(errors.New("failed"))
+	j.Done("")
+	s.Emit(Event{Type: EventDone})
+	s.Close()
+
+	for _, dest := range []string{"file:/tmp/events", "unix"} {
+		if _, err := OpenEventStream(dest); err == nil {
+			t.Errorf("OpenEventStream(%q) succeeded, want an error", dest)
+		}
+	}
+}
+
+func TestEventErrorCode(t *testing.T) {
+	_, notFound := os.Open("/nonexistent/kairos.iso")
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("burning: %w", context.Canceled), "cancelled"},
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("downloading: %w", errStalled), "timeout"},
+		{fmt.Errorf("verifying: %w", ErrChecksumMismatch), "checksum_mismatch"},
+		{signatureError{errors.New("signature verification failed")}, "signature"},
+		{fmt.Errorf("checking: %w", driveTooSmallError("/dev/sdb", 2, 1)), "drive_too_small"},
+		{errNoEFILoader, "no_efi_loader"},
+		{fmt.Errorf("%w: pass -yes", errNotConfirmed), "not_confirmed"},
+		{fmt.Errorf("%w, unmount it", errDeviceMounted), "device_mounted"},
+		{fmt.Errorf("%w: errors", errInvalidCloudConfig), "invalid_cloud_config"},
+		{&fs.PathError{Op: "open", Path: "/dev/sdb", Err: fs.ErrPermission}, "permission_denied"},
+		{notFound, "not_found"},
+		{fmt.Errorf("fetching: %w", &httpStatusError{Code: 404, Status: "404 Not Found"}), "http_404"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, "network"},
+		{errors.New("something else"), "failed"},
+	}
+	for _, tt := range tests {
+		if got := eventErrorCode(tt.err); got != tt.want {
+			t.Errorf("eventErrorCode(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
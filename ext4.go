@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	ext4BlockSize      = 4096
+	ext4BlocksPerGroup = 8 * ext4BlockSize
+	ext4InodeSize      = 256
+	// ext4InodeRatio is the bytes per inode, the mke2fs default
+	ext4InodeRatio = 16384
+	ext4DescSize   = 32
+	ext4FirstInode = 11
+	ext4RootInode  = 2
+	// ext4JournalInode and ext4LostFoundInode are the inodes mke2fs uses
+	ext4JournalInode   = 8
+	ext4LostFoundInode = 11
+	ext4MinBlocks      = 4096
+	ext4ExtentsFlag    = 0x80000
+	ext4ExtraISize     = 32
+
+	ext4CompatHasJournal  = 0x4
+	ext4CompatExtAttr     = 0x8
+	ext4CompatDirIndex    = 0x20
+	ext4IncompatFiletype  = 0x2
+	ext4IncompatExtents   = 0x40
+	ext4RoCompatSparse    = 0x1
+	ext4RoCompatLargeFile = 0x2
+	ext4RoCompatGDTCsum   = 0x10
+	ext4RoCompatDirNlink  = 0x20
+	ext4RoCompatExtraSize = 0x40
+
+	ext4GroupInodeUninit  = 0x1
+	ext4GroupItableZeroed = 0x4
+)
+
+// ext4Layout is where formatExt4 puts everything, in blocks from the start of the volume
+type ext4Layout struct {
+	blocks, groups, inodesPerGroup, itableBlocks, gdtBlocks int64
+	rootBlock, lostFoundBlock, journalStart, journalBlocks  int64
+}
+
+// ext4HasSuper tells if a block group holds a backup of the superblock, with sparse_super those are
+// groups 0, 1 and the powers of 3, 5 and 7
+func ext4HasSuper(group int64) bool {
+	if group <= 1 {
+		return true
+	}
+	for _, base := range []int64{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+// groupStart returns the first block of group and its number of blocks
+func (l *ext4Layout) groupStart(group int64) (int64, int64) {
+	start := group * ext4BlocksPerGroup
+	return start, min(ext4BlocksPerGroup, l.blocks-start)
+}
+
+// bitmapBlock returns the block bitmap of group, the inode bitmap and the inode table follow it
+func (l *ext4Layout) bitmapBlock(group int64) int64 {
+	start, _ := l.groupStart(group)
+	if ext4HasSuper(group) {
+		start += 1 + l.gdtBlocks
+	}
+	return start
+}
+
+// overhead is the number of blocks of group taken by the superblock, descriptors, bitmaps and inode table
+func (l *ext4Layout) overhead(group int64) int64 {
+	start, _ := l.groupStart(group)
+	return l.bitmapBlock(group) + 2 + l.itableBlocks - start
+}
+
+// newExt4Layout lays out a volume of size bytes like mke2fs does without flex_bg
+func newExt4Layout(size int64) (*ext4Layout, error) {
+	l := &ext4Layout{blocks: size / ext4BlockSize}
+	if l.blocks < ext4MinBlocks {
+		return nil, fmt.Errorf("partition of %d MB is too small for ext4", size/(1024*1024))
+	}
+	for {
+		l.groups = (l.blocks + ext4BlocksPerGroup - 1) / ext4BlocksPerGroup
+		inodes := l.blocks * ext4BlockSize / ext4InodeRatio
+		// Whole blocks of inodes in each group
+		perBlock := int64(ext4BlockSize / ext4InodeSize)
+		l.inodesPerGroup = min((inodes+l.groups-1)/l.groups+perBlock-1, 8*ext4BlockSize) / perBlock * perBlock
+		l.itableBlocks = l.inodesPerGroup / perBlock
+		l.gdtBlocks = (l.groups*ext4DescSize + ext4BlockSize - 1) / ext4BlockSize
+		// A last group too small to hold its own metadata and some data is left out
+		_, last := l.groupStart(l.groups - 1)
+		if l.groups > 1 && last < l.overhead(l.groups-1)+256 {
+			l.blocks -= last
+			continue
+		}
+		break
+	}
+
+	// The journal follows the root and lost+found directories in the first group, sized like mke2fs
+	// up to what a group can hold in one extent
+	l.rootBlock = l.overhead(0)
+	l.lostFoundBlock = l.rootBlock + 1
+	l.journalStart = l.lostFoundBlock + 1
+	switch {
+	case l.blocks < 32768:
+		l.journalBlocks = 1024
+	case l.blocks < 256*1024:
+		l.journalBlocks = 4096
+	case l.blocks < 512*1024:
+		l.journalBlocks = 8192
+	default:
+		l.journalBlocks = 16384
+	}
+	_, first := l.groupStart(0)
+	if l.journalStart+l.journalBlocks > first {
+		return nil, fmt.Errorf("partition of %d MB is too small for ext4", size/(1024*1024))
+	}
+	return l, nil
+}
+
+// formatExt4 creates an empty ext4 filesystem of size bytes at offset in w, with a journal and a
+// lost+found directory. Like mke2fs with lazy_itable_init, only the inode table of the first group is
+// cleared, the kernel clears the others in the background after the first mount
+func formatExt4(w io.WriterAt, offset, size int64, label string) error {
+	l, err := newExt4Layout(size)
+	if err != nil {
+		return err
+	}
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return err
+	}
+	uuid[6] = uuid[6]&0x0F | 0x40 // version 4
+	uuid[8] = uuid[8]&0x3F | 0x80
+	var hashSeed [16]byte
+	if _, err := rand.Read(hashSeed[:]); err != nil {
+		return err
+	}
+	now := uint32(time.Now().Unix())
+	writeBlock := func(block int64, data []byte) error {
+		_, err := w.WriteAt(data, offset+block*ext4BlockSize)
+		return err
+	}
+
+	// Bitmaps and group descriptors
+	gdt := make([]byte, l.gdtBlocks*ext4BlockSize)
+	var freeBlocks, freeInodes int64
+	for g := int64(0); g < l.groups; g++ {
+		_, count := l.groupStart(g)
+		used := l.overhead(g)
+		usedInodes := int64(0)
+		flags := uint16(ext4GroupInodeUninit)
+		dirs := 0
+		if g == 0 {
+			used += 2 + l.journalBlocks
+			usedInodes = ext4FirstInode
+			flags = ext4GroupItableZeroed
+			dirs = 2
+		}
+
+		blockBitmap := make([]byte, ext4BlockSize)
+		ext4SetBits(blockBitmap, 0, used)
+		// Blocks past the end of the last group are marked in use
+		ext4SetBits(blockBitmap, count, 8*ext4BlockSize)
+		inodeBitmap := make([]byte, ext4BlockSize)
+		ext4SetBits(inodeBitmap, 0, usedInodes)
+		ext4SetBits(inodeBitmap, l.inodesPerGroup, 8*ext4BlockSize)
+		bitmap := l.bitmapBlock(g)
+		if err := writeBlock(bitmap, blockBitmap); err != nil {
+			return err
+		}
+		if err := writeBlock(bitmap+1, inodeBitmap); err != nil {
+			return err
+		}
+
+		d := gdt[g*ext4DescSize : (g+1)*ext4DescSize]
+		binary.LittleEndian.PutUint32(d[0:], uint32(bitmap))
+		binary.LittleEndian.PutUint32(d[4:], uint32(bitmap+1))
+		binary.LittleEndian.PutUint32(d[8:], uint32(bitmap+2))
+		binary.LittleEndian.PutUint16(d[12:], uint16(count-used))
+		binary.LittleEndian.PutUint16(d[14:], uint16(l.inodesPerGroup-usedInodes))
+		binary.LittleEndian.PutUint16(d[16:], uint16(dirs))
+		binary.LittleEndian.PutUint16(d[18:], flags)
+		binary.LittleEndian.PutUint16(d[28:], uint16(l.inodesPerGroup-usedInodes))
+		var group [4]byte
+		binary.LittleEndian.PutUint32(group[:], uint32(g))
+		crc := ext4CRC16(ext4CRC16(ext4CRC16(0xFFFF, uuid[:]), group[:]), d[:30])
+		binary.LittleEndian.PutUint16(d[30:], crc)
+		freeBlocks += count - used
+		freeInodes += l.inodesPerGroup - usedInodes
+	}
+
+	// Inodes of the first group: root, journal and lost+found
+	itable := make([]byte, l.itableBlocks*ext4BlockSize)
+	inode := func(number int64, mode uint16, links uint16, start, blocks int64) []byte {
+		in := itable[(number-1)*ext4InodeSize : number*ext4InodeSize]
+		binary.LittleEndian.PutUint16(in[0:], mode)
+		binary.LittleEndian.PutUint32(in[4:], uint32(blocks*ext4BlockSize))
+		for _, at := range []int{8, 12, 16} {
+			binary.LittleEndian.PutUint32(in[at:], now)
+		}
+		binary.LittleEndian.PutUint16(in[26:], links)
+		binary.LittleEndian.PutUint32(in[28:], uint32(blocks*ext4BlockSize/sectorSize))
+		binary.LittleEndian.PutUint32(in[32:], ext4ExtentsFlag)
+		// Extent header then a single extent covering the blocks
+		binary.LittleEndian.PutUint16(in[40:], 0xF30A)
+		binary.LittleEndian.PutUint16(in[42:], 1)
+		binary.LittleEndian.PutUint16(in[44:], 4)
+		binary.LittleEndian.PutUint32(in[52:], 0)
+		binary.LittleEndian.PutUint16(in[56:], uint16(blocks))
+		binary.LittleEndian.PutUint32(in[60:], uint32(start))
+		binary.LittleEndian.PutUint16(in[128:], ext4ExtraISize)
+		binary.LittleEndian.PutUint32(in[144:], now)
+		return in
+	}
+	inode(ext4RootInode, 0o40755, 3, l.rootBlock, 1)
+	inode(ext4LostFoundInode, 0o40700, 2, l.lostFoundBlock, 1)
+	journal := inode(ext4JournalInode, 0o100600, 1, l.journalStart, l.journalBlocks)
+	if err := writeBlock(l.bitmapBlock(0)+2, itable); err != nil {
+		return err
+	}
+
+	root := make([]byte, ext4BlockSize)
+	pos := ext4DirEntry(root, 0, ext4RootInode, ".", 12)
+	pos = ext4DirEntry(root, pos, ext4RootInode, "..", 12)
+	ext4DirEntry(root, pos, ext4LostFoundInode, "lost+found", ext4BlockSize-pos)
+	if err := writeBlock(l.rootBlock, root); err != nil {
+		return err
+	}
+	lostFound := make([]byte, ext4BlockSize)
+	pos = ext4DirEntry(lostFound, 0, ext4LostFoundInode, ".", 12)
+	ext4DirEntry(lostFound, pos, ext4RootInode, "..", ext4BlockSize-pos)
+	if err := writeBlock(l.lostFoundBlock, lostFound); err != nil {
+		return err
+	}
+
+	// The journal is cleared so stale blocks can't be replayed, then gets its superblock. jbd2 is big endian
+	zero := make([]byte, 256*ext4BlockSize)
+	for block := int64(0); block < l.journalBlocks; block += 256 {
+		if err := writeBlock(l.journalStart+block, zero[:min(256, l.journalBlocks-block)*ext4BlockSize]); err != nil {
+			return err
+		}
+	}
+	jsb := make([]byte, ext4BlockSize)
+	binary.BigEndian.PutUint32(jsb[0:], 0xC03B3998)
+	binary.BigEndian.PutUint32(jsb[4:], 4) // superblock v2
+	binary.BigEndian.PutUint32(jsb[12:], ext4BlockSize)
+	binary.BigEndian.PutUint32(jsb[16:], uint32(l.journalBlocks))
+	binary.BigEndian.PutUint32(jsb[20:], 1) // first log block
+	binary.BigEndian.PutUint32(jsb[24:], 1) // first sequence
+	copy(jsb[48:], uuid[:])
+	binary.BigEndian.PutUint32(jsb[64:], 1) // users
+	if err := writeBlock(l.journalStart, jsb); err != nil {
+		return err
+	}
+
+	sb := make([]byte, 1024)
+	binary.LittleEndian.PutUint32(sb[0:], uint32(l.groups*l.inodesPerGroup))
+	binary.LittleEndian.PutUint32(sb[4:], uint32(l.blocks))
+	binary.LittleEndian.PutUint32(sb[12:], uint32(freeBlocks))
+	binary.LittleEndian.PutUint32(sb[16:], uint32(freeInodes))
+	binary.LittleEndian.PutUint32(sb[24:], 2) // 1024 << 2
+	binary.LittleEndian.PutUint32(sb[28:], 2)
+	binary.LittleEndian.PutUint32(sb[32:], ext4BlocksPerGroup)
+	binary.LittleEndian.PutUint32(sb[36:], ext4BlocksPerGroup)
+	binary.LittleEndian.PutUint32(sb[40:], uint32(l.inodesPerGroup))
+	binary.LittleEndian.PutUint32(sb[48:], now)
+	binary.LittleEndian.PutUint16(sb[54:], 0xFFFF) // no forced checks
+	binary.LittleEndian.PutUint16(sb[56:], 0xEF53)
+	binary.LittleEndian.PutUint16(sb[58:], 1) // clean
+	binary.LittleEndian.PutUint16(sb[60:], 1) // continue on errors
+	binary.LittleEndian.PutUint32(sb[64:], now)
+	binary.LittleEndian.PutUint32(sb[76:], 1) // dynamic inode sizes
+	binary.LittleEndian.PutUint32(sb[84:], ext4FirstInode)
+	binary.LittleEndian.PutUint16(sb[88:], ext4InodeSize)
+	binary.LittleEndian.PutUint32(sb[92:], ext4CompatHasJournal|ext4CompatExtAttr|ext4CompatDirIndex)
+	binary.LittleEndian.PutUint32(sb[96:], ext4IncompatFiletype|ext4IncompatExtents)
+	binary.LittleEndian.PutUint32(sb[100:], ext4RoCompatSparse|ext4RoCompatLargeFile|ext4RoCompatGDTCsum|ext4RoCompatDirNlink|ext4RoCompatExtraSize)
+	copy(sb[104:120], uuid[:])
+	copy(sb[120:136], label)
+	binary.LittleEndian.PutUint32(sb[224:], ext4JournalInode)
+	copy(sb[236:252], hashSeed[:])
+	sb[252] = 1 // half MD4 directory hashes
+	sb[253] = 1 // s_jnl_blocks holds a copy of the journal inode blocks
+	binary.LittleEndian.PutUint32(sb[264:], now)
+	copy(sb[268:328], journal[40:100])
+	binary.LittleEndian.PutUint32(sb[332:], uint32(l.journalBlocks*ext4BlockSize))
+	binary.LittleEndian.PutUint16(sb[348:], ext4ExtraISize)
+	binary.LittleEndian.PutUint16(sb[350:], ext4ExtraISize)
+	binary.LittleEndian.PutUint32(sb[352:], 0x2) // unsigned directory hashes
+
+	// The primary superblock is 1024 bytes into the volume, its backups start their group. Both are
+	// written as whole blocks, which also clears the boot sector of what the partition held before
+	for g := int64(0); g < l.groups; g++ {
+		if !ext4HasSuper(g) {
+			continue
+		}
+		start, _ := l.groupStart(g)
+		block := make([]byte, ext4BlockSize)
+		at := 0
+		if g == 0 {
+			at = 1024
+		}
+		copy(block[at:], sb)
+		binary.LittleEndian.PutUint16(block[at+90:], uint16(g))
+		if err := writeBlock(start, block); err != nil {
+			return err
+		}
+		if err := writeBlock(start+1, gdt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ext4SetBits sets the bits from first up to end of a bitmap
+func ext4SetBits(bitmap []byte, first, end int64) {
+	for bit := first; bit < end; bit++ {
+		bitmap[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// ext4DirEntry writes the directory entry of name at pos in block, taking recLen bytes, and returns
+// where the next entry goes
+func ext4DirEntry(block []byte, pos int, inode uint32, name string, recLen int) int {
+	binary.LittleEndian.PutUint32(block[pos:], inode)
+	binary.LittleEndian.PutUint16(block[pos+4:], uint16(recLen))
+	block[pos+6] = byte(len(name))
+	block[pos+7] = 2 // directory
+	copy(block[pos+8:], name)
+	return pos + recLen
+}
+
+// ext4CRC16 is the CRC16 of the group descriptors with uninit_bg, the ANSI polynomial reflected
+func ext4CRC16(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
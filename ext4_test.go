@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// ext4Block reads block n of the volume in r
+func ext4Block(t *testing.T, r io.ReaderAt, n int64) []byte {
+	t.Helper()
+	b := make([]byte, ext4BlockSize)
+	if _, err := r.ReadAt(b, n*ext4BlockSize); err != nil {
+		t.Fatalf("reading block %d: %v", n, err)
+	}
+	return b
+}
+
+// ext4FreeBits counts the clear bits of a bitmap below end
+func ext4FreeBits(bitmap []byte, end int64) int64 {
+	var used int64
+	for _, b := range bitmap[:end/8] {
+		used += int64(bits.OnesCount8(b))
+	}
+	return end - used
+}
+
+// ext4InodeExtent returns the mode of an inode of the first group and the single extent formatExt4 gives it
+func ext4InodeExtent(t *testing.T, r io.ReaderAt, itable, number int64) (mode uint16, start, blocks int64) {
+	t.Helper()
+	raw := make([]byte, ext4InodeSize)
+	if _, err := r.ReadAt(raw, itable*ext4BlockSize+(number-1)*ext4InodeSize); err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(raw[32:])&ext4ExtentsFlag == 0 || binary.LittleEndian.Uint16(raw[40:]) != 0xF30A {
+		t.Fatalf("inode %d has no extents", number)
+	}
+	return binary.LittleEndian.Uint16(raw), int64(binary.LittleEndian.Uint32(raw[60:])), int64(binary.LittleEndian.Uint16(raw[56:]))
+}
+
+// ext4DirNames returns the entries of a directory block by name
+func ext4DirNames(block []byte) map[string]uint32 {
+	names := make(map[string]uint32)
+	for pos := 0; pos+8 <= len(block); {
+		recLen := int(binary.LittleEndian.Uint16(block[pos+4:]))
+		if recLen < 8 {
+			break
+		}
+		names[string(block[pos+8:pos+8+int(block[pos+6])])] = binary.LittleEndian.Uint32(block[pos:])
+		pos += recLen
+	}
+	return names
+}
+
+func TestFormatExt4(t *testing.T) {
+	const mib = 1024 * 1024
+	tests := []struct {
+		name       string
+		size       int64
+		wantBlocks int64
+		wantGroups int64
+		wantErr    bool
+	}{
+		{name: "smallest", size: 16 * mib, wantBlocks: 4096, wantGroups: 1},
+		{name: "one group", size: 128 * mib, wantBlocks: 32768, wantGroups: 1},
+		// The 100 blocks past the first group can't hold a group of their own
+		{name: "short last group", size: 128*mib + 100*ext4BlockSize, wantBlocks: 32768, wantGroups: 1},
+		{name: "two groups", size: 200 * mib, wantBlocks: 51200, wantGroups: 2},
+		{name: "sparse superblocks", size: 1200 * mib, wantBlocks: 307200, wantGroups: 10},
+		{name: "too small", size: 8 * mib, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The volume sits after a partition table whose sector must be left alone
+			const offset = mib
+			path := filepath.Join(t.TempDir(), "disk.img")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err := f.Truncate(offset + tt.size); err != nil {
+				t.Fatal(err)
+			}
+			mbr := bytes.Repeat([]byte{0x55}, sectorSize)
+			if _, err := f.WriteAt(mbr, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			err = formatExt4(f, offset, tt.size, "COS_PERSISTENT")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("formatExt4() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			head := make([]byte, sectorSize)
+			if _, err := f.ReadAt(head, 0); err != nil || !bytes.Equal(head, mbr) {
+				t.Error("formatExt4() wrote before the volume")
+			}
+
+			r := io.NewSectionReader(f, offset, tt.size)
+			first := ext4Block(t, r, 0)
+			sb := first[1024:2048]
+			if got := binary.LittleEndian.Uint16(sb[56:]); got != 0xEF53 {
+				t.Fatalf("superblock magic %#x", got)
+			}
+			if got := string(bytes.TrimRight(sb[120:136], "\x00")); got != "COS_PERSISTENT" {
+				t.Errorf("label %q", got)
+			}
+			blocks := int64(binary.LittleEndian.Uint32(sb[4:]))
+			inodesPerGroup := int64(binary.LittleEndian.Uint32(sb[40:]))
+			groups := (blocks + ext4BlocksPerGroup - 1) / ext4BlocksPerGroup
+			if blocks != tt.wantBlocks || groups != tt.wantGroups {
+				t.Errorf("%d blocks in %d groups, want %d in %d", blocks, groups, tt.wantBlocks, tt.wantGroups)
+			}
+			if got := int64(binary.LittleEndian.Uint32(sb[0:])); got != groups*inodesPerGroup {
+				t.Errorf("%d inodes, want %d", got, groups*inodesPerGroup)
+			}
+			gdt := ext4Block(t, r, 1)
+
+			var freeBlocks, freeInodes int64
+			uuid := sb[104:120]
+			for g := range groups {
+				d := gdt[g*ext4DescSize : (g+1)*ext4DescSize]
+				var group [4]byte
+				binary.LittleEndian.PutUint32(group[:], uint32(g))
+				if got, want := binary.LittleEndian.Uint16(d[30:]), ext4CRC16(ext4CRC16(ext4CRC16(0xFFFF, uuid), group[:]), d[:30]); got != want {
+					t.Errorf("group %d: descriptor CRC %#x, want %#x", g, got, want)
+				}
+
+				start := g * ext4BlocksPerGroup
+				count := min(ext4BlocksPerGroup, blocks-start)
+				bitmap := int64(binary.LittleEndian.Uint32(d[0:]))
+				if ext4HasSuper(g) {
+					if g > 0 {
+						backup := ext4Block(t, r, start)
+						if got := binary.LittleEndian.Uint16(backup[90:]); got != uint16(g) {
+							t.Errorf("group %d: backup superblock of group %d", g, got)
+						}
+						binary.LittleEndian.PutUint16(backup[90:], 0)
+						if !bytes.Equal(backup[:1024], sb) {
+							t.Errorf("group %d: the backup superblock differs", g)
+						}
+						if !bytes.Equal(ext4Block(t, r, start+1), gdt) {
+							t.Errorf("group %d: the backup descriptors differ", g)
+						}
+					}
+				} else if bitmap != start {
+					t.Errorf("group %d without a superblock has its bitmap at %d, want %d", g, bitmap, start)
+				}
+
+				free := ext4FreeBits(ext4Block(t, r, bitmap), count)
+				if got := int64(binary.LittleEndian.Uint16(d[12:])); got != free {
+					t.Errorf("group %d: %d free blocks, the bitmap has %d", g, got, free)
+				}
+				freeBlocks += free
+				inodes := int64(binary.LittleEndian.Uint32(d[4:]))
+				free = ext4FreeBits(ext4Block(t, r, inodes), inodesPerGroup)
+				if got := int64(binary.LittleEndian.Uint16(d[14:])); got != free {
+					t.Errorf("group %d: %d free inodes, the bitmap has %d", g, got, free)
+				}
+				freeInodes += free
+			}
+			if got := int64(binary.LittleEndian.Uint32(sb[12:])); got != freeBlocks {
+				t.Errorf("superblock counts %d free blocks, the groups %d", got, freeBlocks)
+			}
+			if got := int64(binary.LittleEndian.Uint32(sb[16:])); got != freeInodes {
+				t.Errorf("superblock counts %d free inodes, the groups %d", got, freeInodes)
+			}
+
+			itable := int64(binary.LittleEndian.Uint32(gdt[8:]))
+			mode, start, _ := ext4InodeExtent(t, r, itable, ext4RootInode)
+			root := ext4DirNames(ext4Block(t, r, start))
+			if mode&0o170000 != 0o40000 || root["."] != ext4RootInode || root[".."] != ext4RootInode || root["lost+found"] != ext4LostFoundInode {
+				t.Errorf("root directory %o with %v", mode, root)
+			}
+			mode, start, _ = ext4InodeExtent(t, r, itable, ext4LostFoundInode)
+			lostFound := ext4DirNames(ext4Block(t, r, start))
+			if mode&0o170000 != 0o40000 || lostFound["."] != ext4LostFoundInode || lostFound[".."] != ext4RootInode {
+				t.Errorf("lost+found directory %o with %v", mode, lostFound)
+			}
+			_, start, count := ext4InodeExtent(t, r, itable, ext4JournalInode)
+			jsb := ext4Block(t, r, start)
+			if binary.BigEndian.Uint32(jsb) != 0xC03B3998 || int64(binary.BigEndian.Uint32(jsb[16:])) != count {
+				t.Errorf("journal superblock %x for %d blocks", jsb[:20], count)
+			}
+
+			if _, err := exec.LookPath("e2fsck"); err != nil {
+				return
+			}
+			if msg, err := exec.Command("e2fsck", "-fn", path+"?offset="+strconv.Itoa(offset)).CombinedOutput(); err != nil {
+				t.Errorf("e2fsck: %v\n%s", err, msg)
+			}
+		})
+	}
+}
+
+func TestExt4HasSuper(t *testing.T) {
+	var got []int64
+	for g := range int64(100) {
+		if ext4HasSuper(g) {
+			got = append(got, g)
+		}
+	}
+	want := []int64{0, 1, 3, 5, 7, 9, 25, 27, 49, 81}
+	if !slices.Equal(got, want) {
+		t.Errorf("groups with superblocks %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 512
+	// fat32MinClusters is the smallest cluster count a FAT32 volume may have, below it readers assume FAT16
+	fat32MinClusters = 65525
+	// fat32MinSize is a round size above the smallest FAT32 volume, 65525 clusters of 512 bytes
+	fat32MinSize     = 64 * 1024 * 1024
+	fatReserved      = 32
+	fatCopies        = 2
+	fatEndOfChain    = 0x0FFFFFFF
+	fatAttrLabel     = 0x08
+	fatAttrDirectory = 0x10
+	fatAttrArchive   = 0x20
+	fatAttrLongName  = 0x0F
+	fatDirEntrySize  = 32
+	// fatMaxFileSize is the largest file FAT32 can hold, sizes are 32 bits
+	fatMaxFileSize = 1<<32 - 1
+)
+
+// fatFile is a file or directory written to a new FAT volume
+type fatFile struct {
+	Name string
+	Data []byte
+	// Content is read instead of Data when set, for files too large to hold in memory
+	Content io.ReaderAt
+	Size    int64
+	// Dir makes the entry a directory holding Files
+	Dir   bool
+	Files []fatFile
+}
+
+func (f fatFile) size() int64 {
+	if f.Content != nil {
+		return f.Size
+	}
+	return int64(len(f.Data))
+}
+
+// fatSectorsPerCluster picks the cluster size Microsoft's format uses for a FAT32 volume of that many sectors
+func fatSectorsPerCluster(sectors int64) int64 {
+	size := sectors * sectorSize
+	switch {
+	case size <= 260*1024*1024:
+		return 1
+	case size <= 8<<30:
+		return 8
+	case size <= 16<<30:
+		return 16
+	case size <= 32<<30:
+		return 32
+	}
+	return 64
+}
+
+// formatFAT32 creates a FAT32 filesystem of size bytes at offset in w holding files and their directories.
+// hiddenSectors is the LBA of the partition on the disk, firmware booting from the volume needs it.
+// Only the metadata and the files are written, the rest of the partition is left as it was
+func formatFAT32(w io.WriterAt, offset, size int64, hiddenSectors uint32, label string, files []fatFile) error {
+	sectors := size / sectorSize
+	spc := fatSectorsPerCluster(sectors)
+	// FAT size from the FAT32 spec, slightly larger than needed which is fine
+	tmp1 := sectors - fatReserved
+	tmp2 := (256*spc + fatCopies) / 2
+	fatSectors := (tmp1 + tmp2 - 1) / tmp2
+	dataStart := fatReserved + fatCopies*fatSectors
+	clusters := (sectors - dataStart) / spc
+	if clusters < fat32MinClusters {
+		return fmt.Errorf("partition of %d MB is too small for FAT32", size/(1024*1024))
+	}
+	clusterSize := spc * sectorSize
+	label = fatLabel(label)
+
+	// Lay out the root directory first, then each file in consecutive clusters
+	fat := []uint32{0x0FFFFFF8, fatEndOfChain}
+	allocate := func(n int64) uint32 {
+		if n == 0 {
+			return 0
+		}
+		first := uint32(len(fat))
+		for i := int64(1); i < n; i++ {
+			fat = append(fat, uint32(len(fat))+1)
+		}
+		fat = append(fat, fatEndOfChain)
+		return first
+	}
+	clustersFor := func(n int64) int64 { return (n + clusterSize - 1) / clusterSize }
+
+	now := time.Now()
+	type placed struct {
+		cluster uint32
+		data    []byte
+		content io.ReaderAt
+		size    int64
+	}
+	var placements []placed
+	// layout allocates the clusters of a directory then those of its files, parent is 0 for the root
+	var layout func(files []fatFile, parent uint32, root bool) (uint32, error)
+	layout = func(files []fatFile, parent uint32, root bool) (uint32, error) {
+		usedShort := make(map[string]bool)
+		var entries [][]byte
+		dirLen := int64(2 * fatDirEntrySize)
+		if root {
+			dirLen = 0
+			if strings.TrimSpace(label) != "" {
+				dirLen = fatDirEntrySize
+			}
+		}
+		for _, f := range files {
+			if f.size() > fatMaxFileSize {
+				return 0, fmt.Errorf("%s is larger than the 4 GB FAT32 allows", f.Name)
+			}
+			short := fatShortName(f.Name, usedShort)
+			var entry []byte
+			if fatShortDisplay(short) != f.Name {
+				entry = append(entry, fatLongNameEntries(f.Name, short)...)
+			}
+			attr := byte(fatAttrArchive)
+			if f.Dir {
+				attr = fatAttrDirectory
+			}
+			entry = append(entry, fatDirEntry(short, attr, 0, uint32(f.size()), now)...)
+			entries = append(entries, entry)
+			dirLen += int64(len(entry))
+		}
+		self := allocate(max(clustersFor(dirLen), 1))
+		if int64(len(fat)) > clusters+2 {
+			return 0, fmt.Errorf("too many files for the partition")
+		}
+		var dir []byte
+		switch {
+		case !root:
+			dir = append(fatDirEntry(".          ", fatAttrDirectory, self, 0, now), fatDirEntry("..         ", fatAttrDirectory, parent, 0, now)...)
+		case strings.TrimSpace(label) != "":
+			dir = fatDirEntry(label, fatAttrLabel, 0, 0, now)
+		}
+		childParent := self
+		if root {
+			childParent = 0
+		}
+		for i, f := range files {
+			var cluster uint32
+			if f.Dir {
+				var err error
+				if cluster, err = layout(f.Files, childParent, false); err != nil {
+					return 0, err
+				}
+			} else {
+				cluster = allocate(clustersFor(f.size()))
+				if int64(len(fat)) > clusters+2 {
+					return 0, fmt.Errorf("files don't fit in the partition")
+				}
+				if cluster != 0 {
+					placements = append(placements, placed{cluster, f.Data, f.Content, f.Size})
+				}
+			}
+			// The first cluster goes in the short entry, the last 32 bytes of the entries of the file
+			sfn := entries[i][len(entries[i])-fatDirEntrySize:]
+			binary.LittleEndian.PutUint16(sfn[20:], uint16(cluster>>16))
+			binary.LittleEndian.PutUint16(sfn[26:], uint16(cluster))
+			dir = append(dir, entries[i]...)
+		}
+		placements = append(placements, placed{cluster: self, data: dir})
+		return self, nil
+	}
+	rootCluster, err := layout(files, 0, true)
+	if err != nil {
+		return err
+	}
+
+	// Boot sector, FSInfo and their backups at sectors 6 and 7
+	boot := make([]byte, sectorSize)
+	copy(boot, []byte{0xEB, 0x58, 0x90})
+	copy(boot[3:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(boot[11:], sectorSize)
+	boot[13] = byte(spc)
+	binary.LittleEndian.PutUint16(boot[14:], fatReserved)
+	boot[16] = fatCopies
+	boot[21] = 0xF8 // fixed disk
+	binary.LittleEndian.PutUint16(boot[24:], 63)
+	binary.LittleEndian.PutUint16(boot[26:], 255)
+	binary.LittleEndian.PutUint32(boot[28:], hiddenSectors)
+	binary.LittleEndian.PutUint32(boot[32:], uint32(sectors))
+	binary.LittleEndian.PutUint32(boot[36:], uint32(fatSectors))
+	binary.LittleEndian.PutUint32(boot[44:], rootCluster)
+	binary.LittleEndian.PutUint16(boot[48:], 1) // FSInfo sector
+	binary.LittleEndian.PutUint16(boot[50:], 6) // backup boot sector
+	boot[64] = 0x80
+	boot[66] = 0x29
+	binary.LittleEndian.PutUint32(boot[67:], rand.Uint32())
+	copy(boot[71:82], label)
+	copy(boot[82:90], "FAT32   ")
+	boot[510], boot[511] = 0x55, 0xAA
+
+	fsinfo := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(fsinfo[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(fsinfo[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(fsinfo[488:], uint32(clusters+2-int64(len(fat))))
+	binary.LittleEndian.PutUint32(fsinfo[492:], uint32(len(fat)))
+	binary.LittleEndian.PutUint32(fsinfo[508:], 0xAA550000)
+
+	// Stale data in the reserved area and FATs would be read as allocated clusters, clear them
+	zero := make([]byte, 1024*1024)
+	for pos, end := int64(0), dataStart*sectorSize; pos < end; pos += int64(len(zero)) {
+		n := min(int64(len(zero)), end-pos)
+		if _, err := w.WriteAt(zero[:n], offset+pos); err != nil {
+			return err
+		}
+	}
+	for _, s := range []struct {
+		sector int64
+		data   []byte
+	}{{0, boot}, {1, fsinfo}, {6, boot}, {7, fsinfo}} {
+		if _, err := w.WriteAt(s.data, offset+s.sector*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	fatBytes := make([]byte, (len(fat)*4+sectorSize-1)/sectorSize*sectorSize)
+	for i, v := range fat {
+		binary.LittleEndian.PutUint32(fatBytes[i*4:], v)
+	}
+	for i := int64(0); i < fatCopies; i++ {
+		if _, err := w.WriteAt(fatBytes, offset+(fatReserved+i*fatSectors)*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, BufferSize)
+	for _, p := range placements {
+		pos := offset + (dataStart+int64(p.cluster-2)*spc)*sectorSize
+		if p.content == nil {
+			// Whole clusters, so the last one doesn't keep old data and writes stay sector aligned
+			data := make([]byte, max(clustersFor(int64(len(p.data))), 1)*clusterSize)
+			copy(data, p.data)
+			if _, err := w.WriteAt(data, pos); err != nil {
+				return err
+			}
+			continue
+		}
+		for done := int64(0); done < p.size; done += int64(len(buf)) {
+			n := min(int64(len(buf)), p.size-done)
+			chunk := buf[:clustersFor(n)*clusterSize]
+			clear(chunk[n:])
+			if read, err := p.content.ReadAt(chunk[:n], done); int64(read) < n {
+				return err
+			}
+			if _, err := w.WriteAt(chunk, pos+done); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fatSizeFor returns a volume size, a multiple of partitionAlign, holding files with slack bytes to spare
+func fatSizeFor(files []fatFile, slack int64) int64 {
+	var clustersIn func(files []fatFile, clusterSize int64) int64
+	clustersIn = func(files []fatFile, clusterSize int64) int64 {
+		// Directories count a long name entry per 13 characters on top of each short entry
+		dirLen := int64(2 * fatDirEntrySize)
+		var n int64
+		for _, f := range files {
+			dirLen += int64(fatDirEntrySize * (2 + len(f.Name)/13))
+			if f.Dir {
+				n += clustersIn(f.Files, clusterSize)
+			} else {
+				n += (f.size() + clusterSize - 1) / clusterSize
+			}
+		}
+		return n + (dirLen+clusterSize-1)/clusterSize
+	}
+	size := int64(fat32MinSize)
+	for {
+		clusterSize := fatSectorsPerCluster(size/sectorSize) * sectorSize
+		clusters := clustersIn(files, clusterSize)
+		need := clusters*clusterSize + fatCopies*clusters*4 + fatReserved*sectorSize + slack
+		need = (need + partitionAlign - 1) / partitionAlign * partitionAlign
+		if need <= size {
+			return size
+		}
+		size = need
+	}
+}
+
+// fatLabel returns label as a volume label: upper case, 11 bytes padded with spaces
+func fatLabel(label string) string {
+	label = strings.ToUpper(label)
+	if len(label) > 11 {
+		label = label[:11]
+	}
+	return fmt.Sprintf("%-11s", label)
+}
+
+// fatShortName returns a unique 8.3 name for name, in the 11 byte directory form
+func fatShortName(name string, used map[string]bool) string {
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			if r < 128 && (r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'()-@^_`{}~", r)) {
+				b.WriteRune(r)
+			}
+		}
+		return b.String()
+	}
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base, ext = clean(base), clean(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	short := fmt.Sprintf("%-8s%-3s", base, ext)
+	if len(base) > 8 || len(base) == 0 || used[short] || fatShortDisplay(short) != strings.ToUpper(name) {
+		for n := 1; ; n++ {
+			tail := fmt.Sprintf("~%d", n)
+			b := base
+			if len(b) > 8-len(tail) {
+				b = b[:8-len(tail)]
+			}
+			short = fmt.Sprintf("%-8s%-3s", b+tail, ext)
+			if !used[short] {
+				break
+			}
+		}
+	}
+	used[short] = true
+	return short
+}
+
+// fatShortDisplay turns an 11 byte short name back into NAME.EXT
+func fatShortDisplay(short string) string {
+	base, ext := strings.TrimRight(short[:8], " "), strings.TrimRight(short[8:], " ")
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// fatDirEntry builds a short directory entry
+func fatDirEntry(short string, attr byte, cluster, size uint32, t time.Time) []byte {
+	e := make([]byte, fatDirEntrySize)
+	copy(e, short)
+	e[11] = attr
+	date := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	clock := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	binary.LittleEndian.PutUint16(e[14:], clock)
+	binary.LittleEndian.PutUint16(e[16:], date)
+	binary.LittleEndian.PutUint16(e[18:], date)
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[22:], clock)
+	binary.LittleEndian.PutUint16(e[24:], date)
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], size)
+	return e
+}
+
+// fatLongNameEntries returns the VFAT long name entries for name, in the order they go on disk
+func fatLongNameEntries(name, short string) []byte {
+	var sum byte
+	for i := 0; i < 11; i++ {
+		sum = (sum&1)<<7 + sum>>1 + short[i]
+	}
+	chars := utf16.Encode([]rune(name))
+	// Names filling the last entry exactly have no terminator
+	if len(chars)%13 != 0 {
+		chars = append(chars, 0)
+	}
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xFFFF)
+	}
+	count := len(chars) / 13
+	var out []byte
+	for seq := count; seq >= 1; seq-- {
+		e := make([]byte, fatDirEntrySize)
+		e[0] = byte(seq)
+		if seq == count {
+			e[0] |= 0x40
+		}
+		e[11] = fatAttrLongName
+		e[13] = sum
+		part := chars[(seq-1)*13 : seq*13]
+		offsets := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+		for i, c := range part {
+			binary.LittleEndian.PutUint16(e[offsets[i]:], c)
+		}
+		out = append(out, e...)
+	}
+	return out
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// memDisk is a disk in memory for the filesystem, partition and remaster tests
+type memDisk []byte
+
+func (d memDisk) ReadAt(p []byte, off int64) (int, error) { return copy(p, d[off:]), nil }
+
+func (d memDisk) WriteAt(p []byte, off int64) (int, error) { return copy(d[off:], p), nil }
+
+// fatVolume reads back the volumes formatFAT32 writes
+type fatVolume struct {
+	t           *testing.T
+	d           memDisk
+	clusterSize int64
+	dataStart   int64
+	fat         []uint32
+	rootCluster uint32
+}
+
+func readFATVolume(t *testing.T, d memDisk) *fatVolume {
+	t.Helper()
+	boot := d[:sectorSize]
+	if boot[510] != 0x55 || boot[511] != 0xAA || string(boot[82:90]) != "FAT32   " {
+		t.Fatal("no FAT32 boot sector")
+	}
+	if !bytes.Equal(d[6*sectorSize:7*sectorSize], boot) {
+		t.Error("the backup boot sector differs")
+	}
+	spc := int64(boot[13])
+	reserved := int64(binary.LittleEndian.Uint16(boot[14:]))
+	copies := int64(boot[16])
+	fatSectors := int64(binary.LittleEndian.Uint32(boot[36:]))
+	sectors := int64(binary.LittleEndian.Uint32(boot[32:]))
+	if got := int64(len(d)) / sectorSize; sectors != got {
+		t.Errorf("%d sectors in the boot sector, want %d", sectors, got)
+	}
+	v := &fatVolume{
+		t:           t,
+		d:           d,
+		clusterSize: spc * sectorSize,
+		dataStart:   (reserved + copies*fatSectors) * sectorSize,
+		rootCluster: binary.LittleEndian.Uint32(boot[44:]),
+	}
+	clusters := (sectors*sectorSize - v.dataStart) / v.clusterSize
+	if clusters < fat32MinClusters {
+		t.Errorf("%d clusters, too few for FAT32", clusters)
+	}
+
+	first := d[reserved*sectorSize : (reserved+fatSectors)*sectorSize]
+	for i := int64(1); i < copies; i++ {
+		start := (reserved + i*fatSectors) * sectorSize
+		if !bytes.Equal(d[start:start+fatSectors*sectorSize], first) {
+			t.Errorf("FAT copy %d differs from the first", i)
+		}
+	}
+	v.fat = make([]uint32, clusters+2)
+	free := 0
+	for i := range v.fat {
+		v.fat[i] = binary.LittleEndian.Uint32(first[i*4:]) & 0x0FFFFFFF
+		if i >= 2 && v.fat[i] == 0 {
+			free++
+		}
+	}
+
+	fsinfo := d[sectorSize : 2*sectorSize]
+	if binary.LittleEndian.Uint32(fsinfo) != 0x41615252 || binary.LittleEndian.Uint32(fsinfo[484:]) != 0x61417272 {
+		t.Error("no FSInfo sector")
+	}
+	if got := binary.LittleEndian.Uint32(fsinfo[488:]); got != uint32(free) {
+		t.Errorf("FSInfo counts %d free clusters, the FAT %d", got, free)
+	}
+	return v
+}
+
+// chain returns the content of the clusters from first on
+func (v *fatVolume) chain(first uint32) []byte {
+	var data []byte
+	for c, n := first, 0; c >= 2 && c < 0x0FFFFFF8; c, n = v.fat[c], n+1 {
+		if n > len(v.fat) {
+			v.t.Fatalf("the cluster chain from %d loops", first)
+		}
+		pos := v.dataStart + int64(c-2)*v.clusterSize
+		data = append(data, v.d[pos:pos+v.clusterSize]...)
+	}
+	return data
+}
+
+// files returns the files under the directory at cluster by path, directories end with a slash, and
+// checks the "." and ".." entries and the long names
+func (v *fatVolume) files(cluster, parent uint32, prefix string, out map[string]string) {
+	dir := v.chain(cluster)
+	if cluster != v.rootCluster {
+		if string(dir[:11]) != ".          " || fatEntryCluster(dir) != cluster {
+			v.t.Errorf("%s: . is %q to cluster %d, want %d", prefix, dir[:11], fatEntryCluster(dir), cluster)
+		}
+		if string(dir[32:43]) != "..         " || fatEntryCluster(dir[32:]) != parent {
+			v.t.Errorf("%s: .. is %q to cluster %d, want %d", prefix, dir[32:43], fatEntryCluster(dir[32:]), parent)
+		}
+		dir = dir[64:]
+	}
+	var long []uint16
+	var sum byte
+	for ; len(dir) >= fatDirEntrySize && dir[0] != 0; dir = dir[fatDirEntrySize:] {
+		e := dir[:fatDirEntrySize]
+		switch {
+		case e[11] == fatAttrLongName:
+			if e[0]&0x40 != 0 {
+				long = nil
+			}
+			var part []uint16
+			for _, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				part = append(part, binary.LittleEndian.Uint16(e[off:]))
+			}
+			long, sum = append(part, long...), e[13]
+			continue
+		case e[11]&fatAttrLabel != 0:
+			out["label"] = string(e[:11])
+			continue
+		}
+		name := fatShortDisplay(string(e[:11]))
+		if long != nil {
+			var check byte
+			for i := 0; i < 11; i++ {
+				check = (check&1)<<7 + check>>1 + e[i]
+			}
+			if check != sum {
+				v.t.Errorf("%s%s: long name checksum %#x, want %#x", prefix, name, sum, check)
+			}
+			if i := slices.Index(long, 0); i >= 0 {
+				long = long[:i]
+			}
+			name = string(utf16.Decode(long))
+			long = nil
+		}
+		if e[11]&fatAttrDirectory != 0 {
+			out[prefix+name+"/"] = ""
+			self := cluster
+			if cluster == v.rootCluster {
+				self = 0
+			}
+			v.files(fatEntryCluster(e), self, prefix+name+"/", out)
+			continue
+		}
+		size := binary.LittleEndian.Uint32(e[28:])
+		data := v.chain(fatEntryCluster(e))
+		if int64(len(data)) != (int64(size)+v.clusterSize-1)/v.clusterSize*v.clusterSize {
+			v.t.Errorf("%s%s: %d bytes in its clusters for a size of %d", prefix, name, len(data), size)
+		}
+		out[prefix+name] = string(data[:size])
+	}
+}
+
+func fatEntryCluster(e []byte) uint32 {
+	return uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:]))
+}
+
+func TestFormatFAT32(t *testing.T) {
+	big := strings.Repeat("0123456789abcdef", 1000)
+	tests := []struct {
+		name    string
+		size    int64
+		label   string
+		files   []fatFile
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "cloud config",
+			size:  fat32MinSize,
+			label: "cos_oem",
+			files: []fatFile{{Name: "99_custom.yaml", Data: []byte("#cloud-config\n")}},
+			want: map[string]string{
+				"label":          "COS_OEM    ",
+				"99_custom.yaml": "#cloud-config\n",
+			},
+		},
+		{
+			name:  "tree",
+			size:  fat32MinSize,
+			label: "KAIROS",
+			files: []fatFile{
+				{Name: "EFI", Dir: true, Files: []fatFile{
+					{Name: "BOOT", Dir: true, Files: []fatFile{
+						{Name: "BOOTX64.EFI", Content: strings.NewReader(big), Size: int64(len(big))},
+						{Name: "grub.cfg", Data: []byte("set timeout=5\n")},
+					}},
+				}},
+				{Name: "README", Data: []byte("readme\n")},
+				{Name: "empty", Data: nil},
+				// 26 characters, the long name entries end without a terminator
+				{Name: "exactly-twenty-six-chars.x", Data: []byte("x")},
+				{Name: "Config.yaml", Data: []byte("a")},
+				{Name: "config.yml", Data: []byte("b")},
+			},
+			want: map[string]string{
+				"label":                      "KAIROS     ",
+				"EFI/":                       "",
+				"EFI/BOOT/":                  "",
+				"EFI/BOOT/BOOTX64.EFI":       big,
+				"EFI/BOOT/grub.cfg":          "set timeout=5\n",
+				"README":                     "readme\n",
+				"empty":                      "",
+				"exactly-twenty-six-chars.x": "x",
+				"Config.yaml":                "a",
+				"config.yml":                 "b",
+			},
+		},
+		{
+			name:  "no label",
+			size:  fat32MinSize,
+			files: []fatFile{{Name: "A.TXT", Data: []byte("a")}},
+			want:  map[string]string{"A.TXT": "a"},
+		},
+		{
+			name:    "too small",
+			size:    32 * 1024 * 1024,
+			wantErr: true,
+		},
+		{
+			name:    "file too large",
+			size:    fat32MinSize,
+			files:   []fatFile{{Name: "huge.img", Content: strings.NewReader(""), Size: fatMaxFileSize + 1}},
+			wantErr: true,
+		},
+		{
+			name:    "files don't fit",
+			size:    fat32MinSize,
+			files:   []fatFile{{Name: "big.img", Content: strings.NewReader(""), Size: fat32MinSize}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Leftovers of a previous filesystem must not show up as allocated clusters
+			d := make(memDisk, tt.size)
+			for i := range d {
+				d[i] = 0xAA
+			}
+			err := formatFAT32(d, 0, tt.size, 2048, tt.label, tt.files)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("formatFAT32() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := binary.LittleEndian.Uint32(d[28:]); got != 2048 {
+				t.Errorf("%d hidden sectors, want 2048", got)
+			}
+			v := readFATVolume(t, d)
+			got := make(map[string]string)
+			v.files(v.rootCluster, 0, "", got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("files %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFATShortName(t *testing.T) {
+	used := make(map[string]bool)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"README", "README     "},
+		{"BOOTX64.EFI", "BOOTX64 EFI"},
+		{"grub.cfg", "GRUB    CFG"},
+		{"GRUB.CFG", "GRUB~1  CFG"},
+		{"grub.cfg.bak", "GRUBCF~1BAK"},
+		{"a very long name.yaml", "AVERYL~1YAM"},
+		{"a very long name2.yaml", "AVERYL~2YAM"},
+		{".hidden", "HIDDEN~1   "},
+	}
+	for _, tt := range tests {
+		if got := fatShortName(tt.name, used); got != tt.want {
+			t.Errorf("fatShortName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFATSizeFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []fatFile
+		slack int64
+		want  int64
+	}{
+		{"empty", nil, 0, fat32MinSize},
+		{"small", []fatFile{{Name: "a", Data: make([]byte, 1024)}}, 1024 * 1024, fat32MinSize},
+		{"large", []fatFile{{Name: "a.img", Content: strings.NewReader(""), Size: 300 * 1024 * 1024}}, 0, 305 * 1024 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fatSizeFor(tt.files, tt.slack)
+			if got != tt.want {
+				t.Errorf("fatSizeFor() = %d, want %d", got, tt.want)
+			}
+			if got%partitionAlign != 0 {
+				t.Errorf("fatSizeFor() = %d, not a multiple of %d", got, partitionAlign)
+			}
+		})
+	}
+}
+
+func TestHasEFILoader(t *testing.T) {
+	loader := []fatFile{{Name: "bootx64.efi"}}
+	tests := []struct {
+		name  string
+		files []fatFile
+		want  bool
+	}{
+		{"loader", []fatFile{{Name: "EFI", Dir: true, Files: []fatFile{{Name: "BOOT", Dir: true, Files: loader}}}}, true},
+		{"lower case", []fatFile{{Name: "efi", Dir: true, Files: []fatFile{{Name: "boot", Dir: true, Files: loader}}}}, true},
+		{"no loader", []fatFile{{Name: "EFI", Dir: true, Files: []fatFile{{Name: "BOOT", Dir: true, Files: []fatFile{{Name: "grub.cfg"}}}}}}, false},
+		{"no BOOT", []fatFile{{Name: "EFI", Dir: true, Files: []fatFile{{Name: "kairos", Dir: true, Files: loader}}}}, false},
+		{"file named EFI", []fatFile{{Name: "EFI"}}, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if got := hasEFILoader(tt.files); got != tt.want {
+			t.Errorf("%s: hasEFILoader() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
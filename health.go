@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// healthChunkSize is how much is written and read at once, failing chunks are checked sector by sector
+	healthChunkSize = 4 * 1024 * 1024
+	// healthMaxBadSectors bounds the sectors listed in a report, dying drives have millions
+	healthMaxBadSectors = 1024
+	// healthMaxReports is how many reports are kept per drive
+	healthMaxReports = 20
+)
+
+// healthPatterns are the passes of the thorough test, those of badblocks -w. The quick test writes
+// pseudo-random data once, nil here
+var healthPatterns = [][]byte{{0xAA}, {0x55}, {0xFF}, {0x00}}
+
+var healthReportsMu sync.Mutex
+
+// HealthReport is the result of TestDriveHealth
+type HealthReport struct {
+	Drive    string `json:"drive"`
+	Device   string `json:"device"`
+	Model    string `json:"model,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Size     int64  `json:"size"`
+	Thorough bool   `json:"thorough"`
+	// BadSectors are the first failing 512 byte sectors, BadSectorCount counts them all
+	BadSectors     []int64 `json:"bad_sectors,omitempty"`
+	BadSectorCount int64   `json:"bad_sector_count"`
+	// WriteSpeed and ReadSpeed are the sustained sequential speeds in bytes per second
+	WriteSpeed float64       `json:"write_speed"`
+	ReadSpeed  float64       `json:"read_speed"`
+	Started    time.Time     `json:"started"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Healthy tells if every sector read back what was written
+func (r *HealthReport) Healthy() bool {
+	return r.BadSectorCount == 0
+}
+
+func (r *HealthReport) String() string {
+	speeds := fmt.Sprintf("write %.1f MB/s, read %.1f MB/s", r.WriteSpeed/(1024*1024), r.ReadSpeed/(1024*1024))
+	if r.Healthy() {
+		return fmt.Sprintf("✅ Healthy, %s", speeds)
+	}
+	return fmt.Sprintf("❌ %d bad sectors, %s", r.BadSectorCount, speeds)
+}
+
+// TestDriveHealth writes test patterns over the whole drive and reads them back, timing both to measure
+// the sustained speeds. It destroys the data on the drive. The thorough test runs the four patterns of
+// badblocks, the quick one a single pseudo-random pass. The report is remembered under the drive key
+func TestDriveHealth(ctx context.Context, drive USBDrive, thorough bool, progress func(phase string, done, total int64)) (*HealthReport, error) {
+	devicePath := rawDevicePath(drive.Path)
+	device, err := os.OpenFile(devicePath, os.O_RDWR|os.O_SYNC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device %s: %w", devicePath, err)
+	}
+	defer device.Close()
+	size, err := deviceSize(device)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the size of %s: %w", devicePath, err)
+	}
+
+	report := &HealthReport{Drive: drive.Key(), Device: drive.Path, Model: drive.Model, Serial: drive.Serial, Size: size, Thorough: thorough, Started: time.Now()}
+	patterns := [][]byte{nil}
+	if thorough {
+		patterns = healthPatterns
+	}
+	if progress == nil {
+		progress = func(string, int64, int64) {}
+	}
+	total := int64(len(patterns)) * 2 * size
+	done := int64(0)
+	bad := make(map[int64]bool)
+	var writeTime, readTime time.Duration
+
+	buf := make([]byte, healthChunkSize)
+	expected := make([]byte, healthChunkSize)
+	for i, pattern := range patterns {
+		phase := fmt.Sprintf("pass %d of %d", i+1, len(patterns))
+		start := time.Now()
+		for off := int64(0); off < size; off += healthChunkSize {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			chunk := buf[:min(healthChunkSize, size-off)]
+			healthFill(chunk, pattern, off)
+			// Sectors that don't take the write show up when reading back
+			_, _ = device.WriteAt(chunk, off)
+			done += int64(len(chunk))
+			progress("Writing, "+phase, done, total)
+		}
+		if err := dropDeviceCache(device); err != nil {
+			return nil, fmt.Errorf("failed to flush the drive: %w", err)
+		}
+		writeTime += time.Since(start)
+
+		start = time.Now()
+		for off := int64(0); off < size; off += healthChunkSize {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			chunk := buf[:min(healthChunkSize, size-off)]
+			want := expected[:len(chunk)]
+			healthFill(want, pattern, off)
+			if n, err := device.ReadAt(chunk, off); n != len(chunk) || err != nil && err != io.EOF || !bytes.Equal(chunk, want) {
+				healthCheckSectors(device, chunk, want, off, bad)
+			}
+			done += int64(len(chunk))
+			progress("Reading back, "+phase, done, total)
+		}
+		readTime += time.Since(start)
+	}
+
+	report.Duration = time.Since(report.Started)
+	passBytes := float64(int64(len(patterns)) * size)
+	if writeTime > 0 {
+		report.WriteSpeed = passBytes / writeTime.Seconds()
+	}
+	if readTime > 0 {
+		report.ReadSpeed = passBytes / readTime.Seconds()
+	}
+	report.BadSectorCount = int64(len(bad))
+	for sector := range bad {
+		report.BadSectors = append(report.BadSectors, sector)
+	}
+	slices.Sort(report.BadSectors)
+	if len(report.BadSectors) > healthMaxBadSectors {
+		report.BadSectors = report.BadSectors[:healthMaxBadSectors]
+	}
+	return report, rememberHealthReport(report)
+}
+
+// healthFill fills chunk at offset off of the drive with pattern, or with pseudo-random data derived
+// from the offset when pattern is nil so reading back can compute it again
+func healthFill(chunk, pattern []byte, off int64) {
+	if pattern != nil {
+		for i := range chunk {
+			chunk[i] = pattern[i%len(pattern)]
+		}
+		return
+	}
+	rng := mathrand.NewPCG(uint64(off), 0x4B4149524F53)
+	for i := 0; i+8 <= len(chunk); i += 8 {
+		binary.LittleEndian.PutUint64(chunk[i:], rng.Uint64())
+	}
+}
+
+// healthCheckSectors finds the sectors of a chunk that failed, reading them one by one when the chunk
+// couldn't be read as a whole
+func healthCheckSectors(device io.ReaderAt, chunk, want []byte, off int64, bad map[int64]bool) {
+	sector := make([]byte, sectorSize)
+	for pos := 0; pos < len(want); pos += sectorSize {
+		n, err := device.ReadAt(sector, off+int64(pos))
+		if n != sectorSize || err != nil && err != io.EOF || !bytes.Equal(sector, want[pos:pos+sectorSize]) {
+			bad[(off+int64(pos))/sectorSize] = true
+		}
+	}
+}
+
+func healthReportsPath() (string, error) {
+	dir, err := userDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "drive-health.json"), nil
+}
+
+func readHealthReports() map[string][]*HealthReport {
+	reports := make(map[string][]*HealthReport)
+	path, err := healthReportsPath()
+	if err != nil {
+		return reports
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return reports
+	}
+	if err := json.Unmarshal(data, &reports); err != nil {
+		logln("Ignoring invalid drive health reports:", err)
+		return make(map[string][]*HealthReport)
+	}
+	return reports
+}
+
+// DriveHealthReports returns the reports of the drive with key, see USBDrive.Key, newest first
+func DriveHealthReports(key string) []*HealthReport {
+	healthReportsMu.Lock()
+	defer healthReportsMu.Unlock()
+	reports := readHealthReports()[key]
+	slices.Reverse(reports)
+	return reports
+}
+
+// rememberHealthReport adds report to the history of its drive, keeping the latest healthMaxReports
+func rememberHealthReport(report *HealthReport) error {
+	healthReportsMu.Lock()
+	defer healthReportsMu.Unlock()
+	reports := readHealthReports()
+	history := append(reports[report.Drive], report)
+	if len(history) > healthMaxReports {
+		history = history[len(history)-healthMaxReports:]
+	}
+	reports[report.Drive] = history
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	path, err := healthReportsPath()
+	if err != nil {
+		return err
+	}
+	return writeUserFile(path, data)
+}
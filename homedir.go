@@ -5,9 +5,13 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 )
 
+// appDirName is the name of the per-user directories we keep config and cache in
+const appDirName = "kairos-must-burn"
+
 // getHomeDirectory attempts to get the real user's home directory even when running with elevated permissions
 func getHomeDirectory() (string, error) {
 	// Try the standard way first
@@ -166,3 +170,114 @@ func getWindowsHomeDir() (string, error) {
 	// If all else fails
 	return filepath.Join(os.Getenv("SystemDrive")+"\\", "Users"), nil
 }
+
+// userCacheDir returns the cache directory of the real user, following the XDG base directory spec
+// on Linux and the platform conventions elsewhere. The environment of a sudo session belongs to root,
+// so XDG variables are only honored when we are not running through sudo.
+func userCacheDir() (string, error) {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" && os.Getenv("SUDO_USER") == "" && filepath.IsAbs(dir) {
+		return filepath.Join(dir, appDirName), nil
+	}
+	homeDir, err := getHomeDirectory()
+	if err != nil {
+		return "", err
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(homeDir, "Library", "Caches", appDirName), nil
+	case "windows":
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, appDirName, "cache"), nil
+		}
+		return filepath.Join(homeDir, "AppData", "Local", appDirName, "cache"), nil
+	}
+	return filepath.Join(homeDir, ".cache", appDirName), nil
+}
+
+// userConfigDir returns the configuration directory of the real user, with the same rules as userCacheDir
+func userConfigDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" && os.Getenv("SUDO_USER") == "" && filepath.IsAbs(dir) {
+		return filepath.Join(dir, appDirName), nil
+	}
+	homeDir, err := getHomeDirectory()
+	if err != nil {
+		return "", err
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(homeDir, "Library", "Application Support", appDirName), nil
+	case "windows":
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, appDirName), nil
+		}
+		return filepath.Join(homeDir, "AppData", "Roaming", appDirName), nil
+	}
+	return filepath.Join(homeDir, ".config", appDirName), nil
+}
+
+// userDataDir returns the data directory of the real user, with the same rules as userCacheDir
+func userDataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" && os.Getenv("SUDO_USER") == "" && filepath.IsAbs(dir) {
+		return filepath.Join(dir, appDirName), nil
+	}
+	homeDir, err := getHomeDirectory()
+	if err != nil {
+		return "", err
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(homeDir, "Library", "Application Support", appDirName), nil
+	case "windows":
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, appDirName), nil
+		}
+		return filepath.Join(homeDir, "AppData", "Local", appDirName), nil
+	}
+	return filepath.Join(homeDir, ".local", "share", appDirName), nil
+}
+
+// mkdirUserDir creates dir (and its parents) private to the real user.
+// When running through sudo the directory is handed back to the invoking user so their own
+// unprivileged runs can still read and write it.
+func mkdirUserDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	chownToRealUser(dir)
+	return nil
+}
+
+// chownToRealUser gives path to the user that invoked sudo, if any. Errors are ignored as this is best effort
+// and not supported on every platform.
+func chownToRealUser(path string) {
+	uid, errUID := strconv.Atoi(os.Getenv("SUDO_UID"))
+	gid, errGID := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if errUID != nil || errGID != nil {
+		return
+	}
+	_ = os.Chown(path, uid, gid)
+}
+
+// writeUserFile atomically writes data to path with permissions only for the real user
+func writeUserFile(path string, data []byte) error {
+	if err := mkdirUserDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	chownToRealUser(tmp.Name())
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/google/go-github/v55/github"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// httpClient is shared by the release listing and the asset downloads, see setupHTTPClient
+var httpClient = http.DefaultClient
+
+// setupHTTPClient builds httpClient from the config. When the proxy or the CA bundle is invalid the
+// error is returned and httpClient is built without them, keeping the timeouts, retries and mirror
+func setupHTTPClient(cfg Config) error {
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		cfg.Proxy, cfg.CABundle = "", ""
+		if client, ferr := newHTTPClient(cfg); ferr == nil {
+			httpClient = client
+		}
+		return err
+	}
+	httpClient = client
+	return nil
+}
+
+// newHTTPClient returns a client with the timeouts, proxy, CA bundle and retries from cfg.
+// There is no overall timeout as downloading an ISO can take a long time, instead a transfer that
+// doesn't receive any data for HTTPIdleTimeout is aborted
+func newHTTPClient(cfg Config) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", cfg.Proxy, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	connectTimeout := time.Duration(cfg.HTTPConnectTimeout)
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: time.Duration(cfg.HTTPIdleTimeout),
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   cfg.DownloadSegments + 2,
+		ForceAttemptHTTP2:     true,
+	}
+	// Assets of the offline mirror are served from disk, with ranges so resuming works the same
+	if cfg.MirrorDir != "" {
+		transport.RegisterProtocol(mirrorScheme, http.NewFileTransport(http.Dir(cfg.MirrorDir)))
+	} else if dir, err := mirrorDir(); err == nil {
+		transport.RegisterProtocol(mirrorScheme, http.NewFileTransport(http.Dir(dir)))
+	}
+	return &http.Client{
+		Transport: &retryTransport{
+			next:        transport,
+			retries:     cfg.HTTPRetries,
+			idleTimeout: time.Duration(cfg.HTTPIdleTimeout),
+		},
+	}, nil
+}
+
+// retryTransport retries idempotent requests that failed with a network error or a server side
+// status, waiting with exponential backoff in between. It also aborts bodies that stall
+type retryTransport struct {
+	next        http.RoundTripper
+	retries     int
+	idleTimeout time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retry := req.Method == http.MethodGet || req.Method == http.MethodHead
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithCancel(req.Context())
+		resp, err := t.next.RoundTrip(req.WithContext(ctx))
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			if t.idleTimeout > 0 {
+				resp.Body = newIdleTimeoutBody(resp.Body, t.idleTimeout, cancel)
+			} else {
+				resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			}
+			return resp, nil
+		}
+		if !retry || attempt >= t.retries || req.Context().Err() != nil {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		wait := backoff(attempt)
+		if err == nil {
+			if after := retryAfter(resp); after > 0 {
+				wait = after
+			}
+			// Drain so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			logf("Request to %s failed with %s, retrying in %s\n", req.URL.Host, resp.Status, wait)
+		} else {
+			logf("Request to %s failed: %v, retrying in %s\n", req.URL.Host, err, wait)
+		}
+		cancel()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryableStatus tells if a response status is worth trying again
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout ||
+		code == http.StatusInternalServerError
+}
+
+// backoff returns the wait before retry attempt+1: 1s, 2s, 4s... capped at 30s with some jitter
+func backoff(attempt int) time.Duration {
+	wait := time.Second << attempt
+	if wait > 30*time.Second || wait <= 0 {
+		wait = 30 * time.Second
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait/4)+1))
+}
+
+// retryAfter reads the Retry-After header in its seconds form
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	if seconds > 120 {
+		seconds = 120
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cancelBody releases the request context once the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// errStalled is returned when no data arrived for the idle timeout
+var errStalled = errors.New("transfer stalled")
+
+// idleTimeoutBody cancels the request when no data is read for a while, so a hung connection
+// doesn't block a download forever
+type idleTimeoutBody struct {
+	io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	stalled bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, cancel: cancel, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.mu.Lock()
+		b.stalled = true
+		b.mu.Unlock()
+		cancel()
+	})
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Reset(b.timeout)
+	if err != nil && err != io.EOF {
+		b.mu.Lock()
+		stalled := b.stalled
+		b.mu.Unlock()
+		if stalled {
+			return n, fmt.Errorf("%w: no data received for %s", errStalled, b.timeout)
+		}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// httpStatusError is returned when a server answers with an unexpected status
+type httpStatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *httpStatusError) Error() string {
+	return "unexpected response: " + e.Status
+}
+
+// describeHTTPError turns a network error into a short message for the UI
+func describeHTTPError(err error) string {
+	var statusErr *httpStatusError
+	var rateErr *github.RateLimitError
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		return "The downloaded file is corrupt (checksum mismatch)"
+	case errors.Is(err, errRemoteChanged):
+		return "The file changed on the server while downloading, please try again"
+	case errors.Is(err, errStalled):
+		return "The download stalled, no data was received for a while"
+	case errors.As(err, &rateErr):
+		return fmt.Sprintf("GitHub API rate limit reached, try again after %s", rateErr.Rate.Reset.Format("15:04"))
+	case errors.As(err, &statusErr):
+		switch statusErr.Code {
+		case http.StatusNotFound:
+			return "The file was not found on the server"
+		case http.StatusForbidden, http.StatusTooManyRequests:
+			return "The server refused the request, you may be rate limited. Try again later"
+		case http.StatusProxyAuthRequired:
+			return "The proxy requires authentication"
+		}
+		return "The server answered with an error: " + statusErr.Status
+	case errors.As(err, &dnsErr):
+		return "Could not resolve " + dnsErr.Name + ", check your network connection or proxy settings"
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority):
+		return "The server certificate is not trusted. If you are behind an intercepting proxy set ca_bundle in the config"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "The connection timed out, check your network connection or proxy settings"
+	case errors.Is(err, context.Canceled):
+		return "The download was cancelled"
+	}
+	return "Network error: " + err.Error()
+}
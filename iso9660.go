@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	isoSectorSize = 2048
+	// isoFirstDescriptor is the sector of the first volume descriptor, after the system area
+	isoFirstDescriptor = 16
+	isoBootRecord      = 0
+	isoPrimary         = 1
+	isoSupplementary   = 2
+	isoTerminator      = 255
+	isoFlagDirectory   = 0x02
+	isoFlagMultiExtent = 0x80
+	// isoMaxDirectory bounds the directories we read, real ones are a few sectors
+	isoMaxDirectory = 16 * 1024 * 1024
+)
+
+// isoVolumeDescriptor is a volume descriptor of an ISO9660 image
+type isoVolumeDescriptor struct {
+	// LBA is the sector of the descriptor in the image
+	LBA int64
+	Raw []byte
+}
+
+func (d *isoVolumeDescriptor) Type() byte {
+	return d.Raw[0]
+}
+
+// Joliet tells if d is the supplementary descriptor of a Joliet tree, whose names are UCS-2
+func (d *isoVolumeDescriptor) Joliet() bool {
+	return d.Type() == isoSupplementary && d.Raw[88] == '%' && d.Raw[89] == '/' && bytes.IndexByte([]byte("@CE"), d.Raw[90]) >= 0
+}
+
+// Root returns the directory record of the root directory
+func (d *isoVolumeDescriptor) Root() isoDirRecord {
+	rec, _ := parseISODirRecord(d.Raw[156:190])
+	return rec
+}
+
+// VolumeSpaceSize is the size of the volume in sectors
+func (d *isoVolumeDescriptor) VolumeSpaceSize() uint32 {
+	return binary.LittleEndian.Uint32(d.Raw[80:])
+}
+
+// readISOVolumeDescriptors reads the descriptors of the volume starting at sector base of the image,
+// 0 for the image itself. Hybrid images may hold a second volume at the start of a partition
+func readISOVolumeDescriptors(r io.ReaderAt, base int64) ([]*isoVolumeDescriptor, error) {
+	var descriptors []*isoVolumeDescriptor
+	primary := false
+	for i := int64(0); i < 64; i++ {
+		lba := base + isoFirstDescriptor + i
+		raw := make([]byte, isoSectorSize)
+		if _, err := r.ReadAt(raw, lba*isoSectorSize); err != nil {
+			return nil, err
+		}
+		if string(raw[1:6]) != "CD001" {
+			return nil, errors.New("not an ISO9660 image")
+		}
+		d := &isoVolumeDescriptor{LBA: lba, Raw: raw}
+		if d.Type() == isoTerminator {
+			if !primary {
+				return nil, errors.New("ISO9660 image without a primary volume descriptor")
+			}
+			return descriptors, nil
+		}
+		primary = primary || d.Type() == isoPrimary
+		descriptors = append(descriptors, d)
+	}
+	return nil, errors.New("ISO9660 volume descriptors are not terminated")
+}
+
+// isoDirRecord is an entry of an ISO9660 directory
+type isoDirRecord struct {
+	Raw        []byte
+	Extent     uint32
+	Size       uint32
+	Flags      byte
+	Identifier []byte
+	// SystemUse holds the SUSP entries of Rock Ridge
+	SystemUse []byte
+}
+
+func (r isoDirRecord) IsDir() bool {
+	return r.Flags&isoFlagDirectory != 0
+}
+
+// parseISODirRecord parses the record at the start of raw
+func parseISODirRecord(raw []byte) (isoDirRecord, bool) {
+	if len(raw) < 34 || int(raw[0]) < 34 || int(raw[0]) > len(raw) {
+		return isoDirRecord{}, false
+	}
+	raw = raw[:raw[0]]
+	idLen := int(raw[32])
+	if 33+idLen > len(raw) {
+		return isoDirRecord{}, false
+	}
+	suStart := 33 + idLen
+	if idLen%2 == 0 {
+		suStart++
+	}
+	rec := isoDirRecord{
+		Raw:        raw,
+		Extent:     binary.LittleEndian.Uint32(raw[2:]),
+		Size:       binary.LittleEndian.Uint32(raw[10:]),
+		Flags:      raw[25],
+		Identifier: raw[33 : 33+idLen],
+	}
+	if suStart < len(raw) {
+		rec.SystemUse = raw[suStart:]
+	}
+	return rec, true
+}
+
+// readISODirectory returns the records of the directory rec, in a volume starting at sector base
+func readISODirectory(r io.ReaderAt, base int64, rec isoDirRecord) ([]isoDirRecord, error) {
+	if rec.Size > isoMaxDirectory {
+		return nil, fmt.Errorf("directory of %d bytes is too large", rec.Size)
+	}
+	data := make([]byte, rec.Size)
+	if _, err := r.ReadAt(data, (base+int64(rec.Extent))*isoSectorSize); err != nil {
+		return nil, err
+	}
+	var records []isoDirRecord
+	for pos := 0; pos < len(data); {
+		if data[pos] == 0 {
+			// Records don't cross sectors, the rest of this one is padding
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		end := min((pos/isoSectorSize+1)*isoSectorSize, len(data))
+		record, ok := parseISODirRecord(data[pos:end])
+		if !ok {
+			return nil, fmt.Errorf("invalid directory record at sector %d", base+int64(rec.Extent)+int64(pos/isoSectorSize))
+		}
+		records = append(records, record)
+		pos += len(record.Raw)
+	}
+	if len(records) < 2 {
+		return nil, errors.New("directory without . and .. records")
+	}
+	return records, nil
+}
+
+// susp returns the System Use Sharing Protocol entries of su by signature, e.g. "NM" or "PX"
+func susp(su []byte) map[string][][]byte {
+	entries := make(map[string][][]byte)
+	for len(su) >= 4 {
+		length := int(su[2])
+		if length < 4 || length > len(su) {
+			break
+		}
+		sig := string(su[:2])
+		entries[sig] = append(entries[sig], su[:length])
+		su = su[length:]
+	}
+	return entries
+}
+
+// isoRecordName returns the name of rec as seen when mounted: the Rock Ridge name if there is one,
+// the Joliet name in Joliet trees, the ISO9660 name otherwise, without the ";1" version
+func isoRecordName(rec isoDirRecord, joliet bool) string {
+	var name string
+	switch {
+	case joliet:
+		units := make([]uint16, len(rec.Identifier)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(rec.Identifier[i*2:])
+		}
+		name = string(utf16.Decode(units))
+	default:
+		name = string(rec.Identifier)
+		var nm []byte
+		for _, entry := range susp(rec.SystemUse)["NM"] {
+			// The name follows the flags byte, shorter entries of a damaged image are skipped
+			if len(entry) > 5 {
+				nm = append(nm, entry[5:]...)
+			}
+		}
+		if nm != nil {
+			return string(nm)
+		}
+	}
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// isoFileIdentifier turns name into an ISO9660 level 1 style identifier, NAME.EXT;1 with only d-characters
+func isoFileIdentifier(name string) []byte {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(name) {
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	id := b.String()
+	if !strings.Contains(id, ".") {
+		id += "."
+	}
+	return []byte(id + ";1")
+}
+
+// newISODirRecord builds a directory record for a file
+func newISODirRecord(identifier []byte, extent, size uint32, systemUse []byte, t time.Time) []byte {
+	length := 33 + len(identifier)
+	if len(identifier)%2 == 0 {
+		length++
+	}
+	suStart := length
+	length += len(systemUse)
+	length += length % 2
+	raw := make([]byte, length)
+	raw[0] = byte(length)
+	putBothEndian32(raw[2:], extent)
+	putBothEndian32(raw[10:], size)
+	t = t.UTC()
+	copy(raw[18:25], []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0})
+	putBothEndian16(raw[28:], 1) // volume sequence number
+	raw[32] = byte(len(identifier))
+	copy(raw[33:], identifier)
+	copy(raw[suStart:], systemUse)
+	return raw
+}
+
+// putBothEndian32 writes v little endian then big endian, as ISO9660 stores most numbers
+func putBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func putBothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// findISOFile returns the record of the file at path, like "/etc/os-release", in the tree of d.
+// Names are compared ignoring case, as plain ISO9660 names are upper case
+func findISOFile(r io.ReaderAt, d *isoVolumeDescriptor, path string) (isoDirRecord, error) {
+	rec := d.Root()
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if !rec.IsDir() {
+			return isoDirRecord{}, fmt.Errorf("%s not found", path)
+		}
+		records, err := readISODirectory(r, 0, rec)
+		if err != nil {
+			return isoDirRecord{}, err
+		}
+		found := false
+		for _, child := range records[2:] {
+			if strings.EqualFold(isoRecordName(child, d.Joliet()), part) {
+				rec, found = child, true
+				break
+			}
+		}
+		if !found {
+			return isoDirRecord{}, fmt.Errorf("%s not found", path)
+		}
+	}
+	if rec.Flags&isoFlagMultiExtent != 0 {
+		return isoDirRecord{}, fmt.Errorf("%s is split in several extents", path)
+	}
+	return rec, nil
+}
+
+// findISOFileInAnyTree looks for path in the primary tree, then in the Joliet one which keeps long names
+// when the image has no Rock Ridge
+func findISOFileInAnyTree(r io.ReaderAt, descriptors []*isoVolumeDescriptor, path string) (isoDirRecord, error) {
+	err := fmt.Errorf("%s not found", path)
+	for _, d := range descriptors {
+		if d.Type() != isoPrimary && !d.Joliet() {
+			continue
+		}
+		var rec isoDirRecord
+		if rec, err = findISOFile(r, d, path); err == nil {
+			return rec, nil
+		}
+	}
+	return isoDirRecord{}, err
+}
+
+// isoHasRockRidge tells if the tree of d has Rock Ridge names, announced by an SP entry in the root
+func isoHasRockRidge(r io.ReaderAt, d *isoVolumeDescriptor) bool {
+	records, err := readISODirectory(r, 0, d.Root())
+	return err == nil && len(susp(records[0].SystemUse)["SP"]) > 0
+}
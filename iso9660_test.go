@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestISORecordName(t *testing.T) {
+	nm := func(name string) []byte {
+		return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+	}
+	tests := []struct {
+		name       string
+		identifier []byte
+		systemUse  []byte
+		joliet     bool
+		want       string
+	}{
+		{name: "iso9660", identifier: []byte("CONFIG.YAM;1"), want: "CONFIG.YAM"},
+		{name: "no extension", identifier: []byte("README.;1"), want: "README"},
+		{name: "directory", identifier: []byte("BOOT"), want: "BOOT"},
+		{name: "joliet", identifier: []byte{0, 'c', 0, 'o', 0, 'n', 0, 'f', 0, 'i', 0, 'g', 0, ';', 0, '1'}, joliet: true, want: "config"},
+		{name: "rock ridge", identifier: []byte("CONFIG.YAM;1"), systemUse: nm("config.yaml"), want: "config.yaml"},
+		{name: "rock ridge continued", identifier: []byte("LONG_NAM.;1"), systemUse: append(nm("long_"), nm("name.yaml")...), want: "long_name.yaml"},
+		// A truncated entry holds no name, the ISO9660 one is used
+		{name: "rock ridge without a name", identifier: []byte("CONFIG.YAM;1"), systemUse: []byte{'N', 'M', 4, 1}, want: "CONFIG.YAM"},
+		{name: "rock ridge flags only", identifier: []byte("CONFIG.YAM;1"), systemUse: []byte{'N', 'M', 5, 1, 0}, want: "CONFIG.YAM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := newISODirRecord(tt.identifier, 30, 100, tt.systemUse, time.Now())
+			rec, ok := parseISODirRecord(raw)
+			if !ok {
+				t.Fatal("parseISODirRecord() failed")
+			}
+			if got := isoRecordName(rec, tt.joliet); got != tt.want {
+				t.Errorf("isoRecordName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
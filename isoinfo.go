@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// isoSquashfsPaths are where live ISOs keep their root filesystem, Kairos first
+var isoSquashfsPaths = []string{"/rootfs.squashfs", "/LiveOS/squashfs.img", "/casper/filesystem.squashfs", "/live/filesystem.squashfs"}
+
+// gptTypeNames are the partition types found on hybrid ISOs
+var gptTypeNames = map[[16]byte]string{
+	mustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B"): "EFI system",
+	gptTypeBasicData: "Basic data",
+	gptTypeLinuxData: "Linux filesystem",
+	mustParseGUID("48465300-0000-11AA-AA11-00306543ECAC"): "HFS+",
+	mustParseGUID("21686148-6449-6E6F-744E-656564454649"): "BIOS boot",
+}
+
+// mbrTypeNames are the MBR partition types found on hybrid ISOs
+var mbrTypeNames = map[byte]string{
+	0x0B: "FAT32",
+	0x0C: "FAT32",
+	0x17: "ISO9660",
+	0x83: "Linux",
+	0xCD: "ISO9660",
+	0xEE: "GPT protective",
+	0xEF: "EFI system",
+}
+
+// ISOInfo is what InspectISO finds in an image, to check it is the expected build before burning
+type ISOInfo struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	VolumeID    string    `json:"volume_id"`
+	SystemID    string    `json:"system_id,omitempty"`
+	Publisher   string    `json:"publisher,omitempty"`
+	Preparer    string    `json:"preparer,omitempty"`
+	Application string    `json:"application,omitempty"`
+	Created     time.Time `json:"created"`
+	RockRidge   bool      `json:"rock_ridge"`
+	Joliet      bool      `json:"joliet"`
+	// EFIDirectory tells if the image has /EFI/BOOT, which a FAT32 copy of its files needs to boot
+	EFIDirectory bool `json:"efi_directory"`
+	// Boot are the El Torito boot catalog entries
+	Boot []ElToritoEntry `json:"boot"`
+	// MBR and GPT are the partitions of the hybrid boot structures, nil when there is none
+	MBR []PartitionInfo `json:"mbr"`
+	GPT []PartitionInfo `json:"gpt"`
+	// OSRelease is /etc/os-release of the image, found in its root filesystem
+	OSRelease      map[string]string `json:"os_release,omitempty"`
+	OSReleaseError string            `json:"os_release_error,omitempty"`
+}
+
+// ElToritoEntry is a boot image of the El Torito catalog
+type ElToritoEntry struct {
+	Platform string `json:"platform"`
+	Bootable bool   `json:"bootable"`
+	Media    string `json:"media"`
+	LoadLBA  uint32 `json:"load_lba"`
+	Sectors  uint16 `json:"sectors"`
+}
+
+// PartitionInfo is a partition of the MBR or GPT of a hybrid image
+type PartitionInfo struct {
+	Number int    `json:"number"`
+	Type   string `json:"type"`
+	Name   string `json:"name,omitempty"`
+	Start  int64  `json:"start"`
+	Size   int64  `json:"size"`
+}
+
+// Hybrid tells if the image has a partition table, so it boots from a USB stick and not only from a CD
+func (info *ISOInfo) Hybrid() bool {
+	return len(info.MBR) > 0 || len(info.GPT) > 0
+}
+
+// Platforms returns the firmware the image boots on, like "BIOS, UEFI"
+func (info *ISOInfo) Platforms() string {
+	var platforms []string
+	for _, e := range info.Boot {
+		if e.Bootable && !slices.Contains(platforms, e.Platform) {
+			platforms = append(platforms, e.Platform)
+		}
+	}
+	if len(platforms) == 0 {
+		return "not bootable"
+	}
+	return strings.Join(platforms, ", ")
+}
+
+// Summary is a one line description of the image, its OS name if found
+func (info *ISOInfo) Summary() string {
+	name := info.OSRelease["PRETTY_NAME"]
+	if name == "" {
+		name = info.VolumeID
+	}
+	parts := []string{name}
+	if flavor := info.OSRelease["KAIROS_FLAVOR"]; flavor != "" {
+		parts = append(parts, strings.TrimSpace(flavor+" "+info.OSRelease["KAIROS_FLAVOR_RELEASE"]))
+	}
+	if !info.Created.IsZero() {
+		parts = append(parts, "built "+info.Created.Format("2006-01-02"))
+	}
+	parts = append(parts, info.Platforms())
+	if !info.Hybrid() {
+		parts = append(parts, "not hybrid")
+	}
+	return strings.Join(parts, " · ")
+}
+
+// InspectISO reads the metadata of the image at path: the primary volume descriptor, the El Torito boot
+// catalog, the hybrid partition tables and the os-release of the root filesystem
+func InspectISO(path string) (*ISOInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	descriptors, err := readISOVolumeDescriptors(f, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ISOInfo{Path: path, Size: stat.Size()}
+	for _, d := range descriptors {
+		switch {
+		case d.Type() == isoPrimary:
+			info.VolumeID = isoString(d.Raw[40:72])
+			info.SystemID = isoString(d.Raw[8:40])
+			info.Publisher = isoString(d.Raw[318:446])
+			info.Preparer = isoString(d.Raw[446:574])
+			info.Application = isoString(d.Raw[574:702])
+			info.Created = isoDate(d.Raw[813:830])
+			info.RockRidge = isoHasRockRidge(f, d)
+		case d.Joliet():
+			info.Joliet = true
+		case d.Type() == isoBootRecord && strings.HasPrefix(string(d.Raw[7:39]), "EL TORITO SPECIFICATION"):
+			if info.Boot, err = readElTorito(f, binary.LittleEndian.Uint32(d.Raw[71:])); err != nil {
+				return nil, fmt.Errorf("invalid El Torito boot catalog: %w", err)
+			}
+		}
+	}
+
+	if mbr, err := readMBR(f); err == nil {
+		for i, p := range mbr {
+			if p.Type == 0 {
+				continue
+			}
+			info.MBR = append(info.MBR, PartitionInfo{
+				Number: i + 1,
+				Type:   partitionTypeName(mbrTypeNames[p.Type], fmt.Sprintf("0x%02X", p.Type)),
+				Start:  int64(p.StartLBA) * sectorSize,
+				Size:   int64(p.Sectors) * sectorSize,
+			})
+		}
+		if gpt, err := readGPT(f); err == nil && gpt != nil {
+			for i := 0; i+gptEntrySize <= len(gpt.entries); i += gptEntrySize {
+				e := gpt.entries[i : i+gptEntrySize]
+				var guid [16]byte
+				copy(guid[:], e)
+				if guid == [16]byte{} {
+					continue
+				}
+				first, last := binary.LittleEndian.Uint64(e[32:]), binary.LittleEndian.Uint64(e[40:])
+				info.GPT = append(info.GPT, PartitionInfo{
+					Number: i/gptEntrySize + 1,
+					Type:   partitionTypeName(gptTypeNames[guid], formatGUID(guid)),
+					Name:   gptPartitionName(e[56:128]),
+					Start:  int64(first) * sectorSize,
+					Size:   int64(last-first+1) * sectorSize,
+				})
+			}
+		}
+	}
+
+	if rec, err := findISOFileInAnyTree(f, descriptors, "/EFI/BOOT"); err == nil && rec.IsDir() {
+		info.EFIDirectory = true
+	}
+
+	if osRelease, err := readISOOSRelease(f, descriptors); err != nil {
+		info.OSReleaseError = err.Error()
+	} else {
+		info.OSRelease = osRelease
+	}
+	return info, nil
+}
+
+// readElTorito parses the boot catalog at sector lba: the default entry and those of each section
+func readElTorito(r io.ReaderAt, lba uint32) ([]ElToritoEntry, error) {
+	catalog := make([]byte, isoSectorSize)
+	if _, err := r.ReadAt(catalog, int64(lba)*isoSectorSize); err != nil {
+		return nil, err
+	}
+	if catalog[0] != 1 || catalog[30] != 0x55 || catalog[31] != 0xAA {
+		return nil, errors.New("no validation entry")
+	}
+	entry := func(platform byte, e []byte) ElToritoEntry {
+		return ElToritoEntry{
+			Platform: elToritoPlatform(platform),
+			Bootable: e[0] == 0x88,
+			Media:    elToritoMedia(e[1] & 0x0F),
+			Sectors:  binary.LittleEndian.Uint16(e[6:]),
+			LoadLBA:  binary.LittleEndian.Uint32(e[8:]),
+		}
+	}
+	entries := []ElToritoEntry{entry(catalog[1], catalog[32:64])}
+	for pos := 64; pos+32 <= len(catalog); {
+		header := catalog[pos : pos+32]
+		if header[0] != 0x90 && header[0] != 0x91 {
+			break
+		}
+		platform, count := header[1], int(binary.LittleEndian.Uint16(header[2:]))
+		pos += 32
+		for i := 0; i < count && pos+32 <= len(catalog); pos += 32 {
+			// Extension entries continue the previous entry's selection criteria
+			if catalog[pos] == 0x44 {
+				continue
+			}
+			entries = append(entries, entry(platform, catalog[pos:pos+32]))
+			i++
+		}
+		if header[0] == 0x91 {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func elToritoPlatform(id byte) string {
+	switch id {
+	case 0x00:
+		return "BIOS"
+	case 0x01:
+		return "PowerPC"
+	case 0x02:
+		return "Mac"
+	case 0xEF:
+		return "UEFI"
+	}
+	return fmt.Sprintf("platform 0x%02X", id)
+}
+
+func elToritoMedia(media byte) string {
+	switch media {
+	case 0:
+		return "no emulation"
+	case 1:
+		return "1.2M floppy"
+	case 2:
+		return "1.44M floppy"
+	case 3:
+		return "2.88M floppy"
+	case 4:
+		return "hard disk"
+	}
+	return fmt.Sprintf("media %d", media)
+}
+
+// readISOOSRelease finds os-release in the ISO itself or in the squashfs root filesystem of live images
+func readISOOSRelease(r io.ReaderAt, descriptors []*isoVolumeDescriptor) (map[string]string, error) {
+	for _, p := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		if rec, err := findISOFileInAnyTree(r, descriptors, p); err == nil && rec.Size <= squashfsMaxFileSize {
+			data := make([]byte, rec.Size)
+			if _, err := r.ReadAt(data, int64(rec.Extent)*isoSectorSize); err != nil {
+				return nil, err
+			}
+			return parseOSRelease(data), nil
+		}
+	}
+	for _, p := range isoSquashfsPaths {
+		rec, err := findISOFileInAnyTree(r, descriptors, p)
+		if err != nil {
+			continue
+		}
+		fs, err := openSquashfs(io.NewSectionReader(r, int64(rec.Extent)*isoSectorSize, int64(rec.Size)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		data, err := fs.ReadFile("/etc/os-release")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		return parseOSRelease(data), nil
+	}
+	return nil, errors.New("no os-release or root filesystem found")
+}
+
+// parseOSRelease reads the KEY=value lines of an os-release file
+func parseOSRelease(data []byte) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// isoString trims the space padding of a descriptor text field
+func isoString(b []byte) string {
+	return strings.TrimRight(strings.TrimRight(string(b), "\x00"), " ")
+}
+
+// isoDate parses a descriptor date, "YYYYMMDDHHMMSScc" digits and a timezone offset in 15 minute steps.
+// Unset dates are all zeros and return the zero time
+func isoDate(b []byte) time.Time {
+	t, err := time.Parse("20060102150405", string(b[:14]))
+	if err != nil || t.Year() == 0 {
+		return time.Time{}
+	}
+	return t.Add(-time.Duration(int8(b[16])) * 15 * time.Minute).UTC()
+}
+
+func partitionTypeName(name, fallback string) string {
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// formatGUID is the reverse of mustParseGUID
+func formatGUID(g [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X", binary.LittleEndian.Uint32(g[0:]), binary.LittleEndian.Uint16(g[4:]),
+		binary.LittleEndian.Uint16(g[6:]), g[8:10], g[10:])
+}
+
+func gptPartitionName(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u := binary.LittleEndian.Uint16(b[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
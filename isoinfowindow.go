@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// osReleaseKeys are the os-release fields shown first, the rest follow sorted
+var osReleaseKeys = []string{"PRETTY_NAME", "VERSION", "KAIROS_VERSION", "KAIROS_FLAVOR", "KAIROS_FLAVOR_RELEASE", "KAIROS_MODEL", "KAIROS_VARIANT", "KAIROS_ARTIFACT"}
+
+// showISOInfoWindow shows what InspectISO finds in the image at path, so the user can check it is the
+// build they expect before burning it
+func showISOInfoWindow(parent *gtk.Window, path string) {
+	infoWin := gtk.NewWindow()
+	infoWin.SetTitle("ISO details - " + filepath.Base(path))
+	infoWin.SetTransientFor(parent)
+	infoWin.SetModal(true)
+	infoWin.SetDefaultSize(600, 500)
+
+	vbox := gtk.NewBox(gtk.OrientationVertical, 10)
+	vbox.SetMarginTop(20)
+	vbox.SetMarginBottom(20)
+	vbox.SetMarginStart(20)
+	vbox.SetMarginEnd(20)
+
+	statusLabel := gtk.NewLabel("Reading " + filepath.Base(path) + "...")
+	statusLabel.SetHAlign(gtk.AlignStart)
+	statusLabel.SetWrap(true)
+	vbox.Append(statusLabel)
+
+	grid := gtk.NewGrid()
+	grid.SetRowSpacing(4)
+	grid.SetColumnSpacing(15)
+	scrolled := gtk.NewScrolledWindow()
+	scrolled.SetChild(grid)
+	scrolled.SetVExpand(true)
+	vbox.Append(scrolled)
+
+	closeBtn := gtk.NewButtonWithLabel("Close")
+	closeBtn.SetHAlign(gtk.AlignEnd)
+	closeBtn.ConnectClicked(infoWin.Close)
+	vbox.Append(closeBtn)
+	infoWin.SetChild(vbox)
+
+	row := 0
+	addSection := func(title string) {
+		label := gtk.NewLabel("")
+		label.SetMarkup("<b>" + glib.MarkupEscapeText(title) + "</b>")
+		label.SetHAlign(gtk.AlignStart)
+		if row > 0 {
+			label.SetMarginTop(10)
+		}
+		grid.Attach(label, 0, row, 2, 1)
+		row++
+	}
+	addRow := func(key, value string) {
+		keyLabel := gtk.NewLabel(key)
+		keyLabel.SetHAlign(gtk.AlignStart)
+		keyLabel.SetVAlign(gtk.AlignStart)
+		keyLabel.SetCSSClasses([]string{"dim-label"})
+		valueLabel := gtk.NewLabel(value)
+		valueLabel.SetHAlign(gtk.AlignStart)
+		valueLabel.SetWrap(true)
+		valueLabel.SetSelectable(true)
+		grid.Attach(keyLabel, 0, row, 1, 1)
+		grid.Attach(valueLabel, 1, row, 1, 1)
+		row++
+	}
+
+	go func() {
+		info, err := InspectISO(path)
+		glib.IdleAdd(func() {
+			if err != nil {
+				statusLabel.SetLabel(fmt.Sprintf("❌ Can't read the ISO: %v", err))
+				return
+			}
+			statusLabel.SetLabel(info.Summary())
+
+			addSection("Volume")
+			addRow("Label", info.VolumeID)
+			addRow("Size", fmt.Sprintf("%.2f GB (%d bytes)", float64(info.Size)/(1024*1024*1024), info.Size))
+			if !info.Created.IsZero() {
+				addRow("Created", info.Created.Local().Format("2006-01-02 15:04:05"))
+			}
+			for _, field := range [][2]string{{"Publisher", info.Publisher}, {"Preparer", info.Preparer}, {"Application", info.Application}, {"System", info.SystemID}} {
+				if field[1] != "" {
+					addRow(field[0], field[1])
+				}
+			}
+			var extensions []string
+			if info.RockRidge {
+				extensions = append(extensions, "Rock Ridge")
+			}
+			if info.Joliet {
+				extensions = append(extensions, "Joliet")
+			}
+			if len(extensions) > 0 {
+				addRow("Extensions", strings.Join(extensions, ", "))
+			}
+
+			addSection("Boot")
+			if len(info.Boot) == 0 {
+				addRow("El Torito", "No boot catalog, the image is not bootable")
+			}
+			for i, e := range info.Boot {
+				state := "bootable"
+				if !e.Bootable {
+					state = "not bootable"
+				}
+				addRow(fmt.Sprintf("Entry %d", i+1), fmt.Sprintf("%s, %s, %s, %d sectors at %d", e.Platform, state, e.Media, e.Sectors, e.LoadLBA))
+			}
+			if !info.Hybrid() {
+				addRow("USB boot", "⚠ No partition table, the image only boots from a CD")
+			}
+			for _, p := range info.MBR {
+				addRow(fmt.Sprintf("MBR %d", p.Number), fmt.Sprintf("%s, %d MB at %d", p.Type, p.Size/(1024*1024), p.Start))
+			}
+			for _, p := range info.GPT {
+				addRow(fmt.Sprintf("GPT %d", p.Number), strings.TrimSuffix(fmt.Sprintf("%s, %d MB at %d, %s", p.Type, p.Size/(1024*1024), p.Start, p.Name), ", "))
+			}
+
+			addSection("Operating system")
+			if info.OSRelease == nil {
+				addRow("os-release", "Not found: "+info.OSReleaseError)
+				return
+			}
+			keys := make([]string, 0, len(info.OSRelease))
+			for key := range info.OSRelease {
+				if !slices.Contains(osReleaseKeys, key) {
+					keys = append(keys, key)
+				}
+			}
+			slices.Sort(keys)
+			for _, key := range append(slices.Clone(osReleaseKeys), keys...) {
+				if value, ok := info.OSRelease[key]; ok {
+					addRow(key, value)
+				}
+			}
+		})
+	}()
+
+	infoWin.Present()
+}
+
+// checkBootableBeforeBurn warns about images that don't boot from a USB stick written byte for byte as
+// they have no MBR/GPT, and offers to copy their files to a FAT32 partition UEFI firmware boots from.
+// proceed is called with the mode chosen, right away for hybrid images
+func checkBootableBeforeBurn(parent *gtk.Window, path string, proceed func(mode BurnMode)) {
+	go func() {
+		info, err := InspectISO(path)
+		glib.IdleAdd(func() {
+			// Images we can't read are burned as they are, like before the check existed
+			if err != nil || info.Hybrid() {
+				proceed(BurnImage)
+				return
+			}
+
+			warnWin := gtk.NewWindow()
+			warnWin.SetTitle("ISO not bootable from USB")
+			warnWin.SetTransientFor(parent)
+			warnWin.SetModal(true)
+			warnWin.SetDefaultSize(500, -1)
+
+			vbox := gtk.NewBox(gtk.OrientationVertical, 10)
+			vbox.SetMarginTop(20)
+			vbox.SetMarginBottom(20)
+			vbox.SetMarginStart(20)
+			vbox.SetMarginEnd(20)
+			msg := fmt.Sprintf("⚠ %s has no MBR or GPT partition table, it only boots from a CD. Written as it is, the stick won't boot.", filepath.Base(path))
+			if info.EFIDirectory {
+				msg += "\n\nIts files can be copied to a FAT32 partition instead, which boots on UEFI machines but not with a legacy BIOS."
+			}
+			label := gtk.NewLabel(msg)
+			label.SetWrap(true)
+			label.SetHAlign(gtk.AlignStart)
+			vbox.Append(label)
+
+			buttonBox := gtk.NewBox(gtk.OrientationHorizontal, 10)
+			buttonBox.SetHAlign(gtk.AlignEnd)
+			cancelBtn := gtk.NewButtonWithLabel("Cancel")
+			cancelBtn.ConnectClicked(warnWin.Close)
+			buttonBox.Append(cancelBtn)
+			rawBtn := gtk.NewButtonWithLabel("Write as it is")
+			rawBtn.ConnectClicked(func() {
+				warnWin.Close()
+				proceed(BurnImage)
+			})
+			buttonBox.Append(rawBtn)
+			if info.EFIDirectory {
+				fatBtn := gtk.NewButtonWithLabel("Copy files to FAT32 (UEFI)")
+				fatBtn.SetCSSClasses([]string{"suggested-action"})
+				fatBtn.ConnectClicked(func() {
+					warnWin.Close()
+					proceed(BurnFAT32)
+				})
+				buttonBox.Append(fatBtn)
+			}
+			vbox.Append(buttonBox)
+			warnWin.SetChild(vbox)
+			warnWin.Present()
+		})
+	}()
+}
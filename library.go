@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LibraryEntry is an image tracked by the local ISO library
+type LibraryEntry struct {
+	Path      string    `json:"path"`
+	Name      string    `json:"name"`
+	Version   string    `json:"version,omitempty"`
+	Flavor    string    `json:"flavor,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	SourceURL string    `json:"source_url,omitempty"`
+	Size      int64     `json:"size"`
+	AddedAt   time.Time `json:"added_at"`
+	// Signature is the result of the signature check at download time, see SignatureResult
+	Signature      string `json:"signature,omitempty"`
+	Signer         string `json:"signer,omitempty"`
+	SignatureError string `json:"signature_error,omitempty"`
+}
+
+// Library is the index of images kept in the library directory
+type Library struct {
+	Dir     string         `json:"-"`
+	Entries []LibraryEntry `json:"entries"`
+}
+
+// libraryMu serializes changes to the library index, downloads finish in their own goroutines
+var libraryMu sync.Mutex
+
+// kairosVersionRe matches the Kairos version in an artifact name, e.g. -v3.4.2- or -v3.4.2.iso
+var kairosVersionRe = regexp.MustCompile(`-(v\d+\.\d+\.\d+(?:-[0-9A-Za-z.]+?)?)(?:-k3s|-k0s|\.iso|$)`)
+
+// kairosFlavorRe matches the flavor and its release in names like kairos-ubuntu-24.04-standard-amd64-generic-v3.4.2.iso
+var kairosFlavorRe = regexp.MustCompile(`^kairos-(.+?)-(?:core|standard)-`)
+
+// parseKairosImageName extracts the flavor and version from a Kairos artifact name. Both are empty if
+// the name doesn't follow the Kairos naming
+func parseKairosImageName(name string) (flavor, version string) {
+	if m := kairosFlavorRe.FindStringSubmatch(name); m != nil {
+		flavor = m[1]
+	}
+	if m := kairosVersionRe.FindStringSubmatch(name); m != nil {
+		version = m[1]
+	}
+	return flavor, version
+}
+
+// libraryDir returns the configured library directory or the default one in the user's data directory
+func libraryDir() (string, error) {
+	if appConfig.LibraryDir != "" {
+		return appConfig.LibraryDir, nil
+	}
+	dir, err := userDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "library"), nil
+}
+
+// OpenLibrary reads the library index, an empty library is returned if there is none yet
+func OpenLibrary() (*Library, error) {
+	dir, err := libraryDir()
+	if err != nil {
+		return nil, err
+	}
+	lib := &Library{Dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, "library.json"))
+	if os.IsNotExist(err) {
+		return lib, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, lib); err != nil {
+		return nil, fmt.Errorf("invalid library index: %w", err)
+	}
+	return lib, nil
+}
+
+func (l *Library) save() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeUserFile(filepath.Join(l.Dir, "library.json"), data)
+}
+
+// updateLibrary loads the library, applies fn and saves it back
+func updateLibrary(fn func(l *Library) error) error {
+	libraryMu.Lock()
+	defer libraryMu.Unlock()
+	lib, err := OpenLibrary()
+	if err != nil {
+		return err
+	}
+	if err := fn(lib); err != nil {
+		return err
+	}
+	return lib.save()
+}
+
+// contains tells if path is inside the library directory. Only those files are ever deleted by pruning
+func (l *Library) contains(path string) bool {
+	rel, err := filepath.Rel(l.Dir, path)
+	return err == nil && !strings.HasPrefix(rel, "..") && !filepath.IsAbs(rel)
+}
+
+// put adds entry replacing any previous entry for the same path
+func (l *Library) put(entry LibraryEntry) {
+	for i := range l.Entries {
+		if l.Entries[i].Path == entry.Path {
+			l.Entries[i] = entry
+			return
+		}
+	}
+	l.Entries = append(l.Entries, entry)
+}
+
+// TotalSize returns the disk usage of the images stored in the library directory
+func (l *Library) TotalSize() int64 {
+	var total int64
+	for _, e := range l.Entries {
+		if l.contains(e.Path) {
+			total += e.Size
+		}
+	}
+	return total
+}
+
+// RecordDownload adds a downloaded image to the library index with the result of its signature check.
+// The checksum may be empty if the release didn't publish one, in which case it is computed
+func RecordDownload(path string, asset ReleaseAsset, checksum string, signature SignatureResult) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if checksum == "" {
+		if checksum, err = sha256File(path, nil); err != nil {
+			return err
+		}
+	}
+	flavor, _ := parseKairosImageName(asset.Name)
+	entry := LibraryEntry{
+		Path:      path,
+		Name:      asset.Name,
+		Version:   asset.Version,
+		Flavor:    flavor,
+		SHA256:    strings.ToLower(checksum),
+		SourceURL: asset.URL,
+		Size:      info.Size(),
+		AddedAt:   time.Now(),
+		Signature: signature.Status,
+		Signer:    signature.Signer,
+	}
+	if signature.Err != nil {
+		entry.SignatureError = signature.Err.Error()
+	}
+	return updateLibrary(func(l *Library) error {
+		if l.contains(path) {
+			chownToRealUser(path)
+		}
+		l.put(entry)
+		return nil
+	})
+}
+
+// ImportImage copies the image at src into the library directory and records it
+func ImportImage(src string, progress func(done, total int64)) (LibraryEntry, error) {
+	var entry LibraryEntry
+	in, err := os.Open(src)
+	if err != nil {
+		return entry, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return entry, err
+	}
+	dir, err := libraryDir()
+	if err != nil {
+		return entry, err
+	}
+	if err := mkdirUserDir(dir); err != nil {
+		return entry, err
+	}
+	dest := filepath.Join(dir, filepath.Base(src))
+	if _, err := os.Stat(dest); err == nil {
+		return entry, fmt.Errorf("%s is already in the library", filepath.Base(src))
+	}
+
+	tmp := dest + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return entry, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), &progressReader{r: in, total: info.Size(), progress: progress})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return entry, err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return entry, err
+	}
+	chownToRealUser(dest)
+
+	flavor, version := parseKairosImageName(filepath.Base(src))
+	entry = LibraryEntry{
+		Path:      dest,
+		Name:      filepath.Base(src),
+		Version:   version,
+		Flavor:    flavor,
+		SHA256:    hex.EncodeToString(h.Sum(nil)),
+		SourceURL: "file://" + filepath.ToSlash(src),
+		Size:      info.Size(),
+		AddedAt:   time.Now(),
+	}
+	return entry, updateLibrary(func(l *Library) error {
+		l.put(entry)
+		return nil
+	})
+}
+
+// VerifyLibraryEntry recomputes the checksum of the image and compares it with the recorded one
+func VerifyLibraryEntry(entry LibraryEntry, progress func(done, total int64)) error {
+	if entry.SHA256 == "" {
+		return fmt.Errorf("no checksum recorded for %s", entry.Name)
+	}
+	sum, err := sha256File(entry.Path, progress)
+	if err != nil {
+		return err
+	}
+	if sum != entry.SHA256 {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, entry.SHA256, sum)
+	}
+	return nil
+}
+
+// findLibraryEntry returns the library entry for the image at path
+func findLibraryEntry(path string) (LibraryEntry, bool) {
+	libraryMu.Lock()
+	defer libraryMu.Unlock()
+	lib, err := OpenLibrary()
+	if err != nil {
+		return LibraryEntry{}, false
+	}
+	for _, e := range lib.Entries {
+		if e.Path == path {
+			return e, true
+		}
+	}
+	return LibraryEntry{}, false
+}
+
+// RemoveLibraryEntry forgets the image and deletes it if it lives in the library directory
+func RemoveLibraryEntry(entry LibraryEntry) error {
+	return updateLibrary(func(l *Library) error {
+		if l.contains(entry.Path) {
+			if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		for i := range l.Entries {
+			if l.Entries[i].Path == entry.Path {
+				l.Entries = append(l.Entries[:i], l.Entries[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// PruneLibrary deletes the oldest versions until the library fits in the configured size.
+// The newest image of each flavor and the images in protect are always kept, and entries whose
+// file is gone are dropped
+func PruneLibrary(protect ...string) ([]LibraryEntry, error) {
+	var pruned []LibraryEntry
+	err := updateLibrary(func(l *Library) error {
+		kept := l.Entries[:0]
+		for _, e := range l.Entries {
+			if _, err := os.Stat(e.Path); err == nil {
+				kept = append(kept, e)
+			}
+		}
+		l.Entries = kept
+
+		limit := int64(appConfig.LibraryMaxSize)
+		if limit <= 0 || l.TotalSize() <= limit {
+			return nil
+		}
+
+		newest := make(map[string]int)
+		for i, e := range l.Entries {
+			if j, ok := newest[e.Flavor]; !ok || compareEntries(e, l.Entries[j]) > 0 {
+				newest[e.Flavor] = i
+			}
+		}
+		var candidates []int
+		for i, e := range l.Entries {
+			if l.contains(e.Path) && newest[e.Flavor] != i && !slices.Contains(protect, e.Path) {
+				candidates = append(candidates, i)
+			}
+		}
+		// Oldest first
+		sort.Slice(candidates, func(a, b int) bool {
+			return compareEntries(l.Entries[candidates[a]], l.Entries[candidates[b]]) < 0
+		})
+
+		remove := make(map[int]bool)
+		total := l.TotalSize()
+		for _, i := range candidates {
+			if total <= limit {
+				break
+			}
+			if err := os.Remove(l.Entries[i].Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			remove[i] = true
+			total -= l.Entries[i].Size
+			pruned = append(pruned, l.Entries[i])
+		}
+		kept = nil
+		for i, e := range l.Entries {
+			if !remove[i] {
+				kept = append(kept, e)
+			}
+		}
+		l.Entries = kept
+		return nil
+	})
+	return pruned, err
+}
+
+// compareEntries orders entries by version, falling back to when they were added
+func compareEntries(a, b LibraryEntry) int {
+	va, errA := semver.NewVersion(a.Version)
+	vb, errB := semver.NewVersion(b.Version)
+	if errA == nil && errB == nil {
+		if c := va.Compare(vb); c != 0 {
+			return c
+		}
+	}
+	return a.AddedAt.Compare(b.AddedAt)
+}
+
+// sha256File returns the hex sha256 of the file at path, reporting progress if not nil
+func sha256File(path string, progress func(done, total int64)) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, &progressReader{r: f, total: info.Size(), progress: progress}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// progressReader reports how much was read from r
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress func(done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if p.progress != nil && n > 0 {
+		p.progress(p.done, p.total)
+	}
+	return n, err
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/diamondburned/gotk4/pkg/gio/v2"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// getLibraryWindow returns the button that opens the ISO library. onSelected is called with the path
+// of the image the user picks to burn
+func getLibraryWindow(onSelected func(string)) *gtk.Button {
+	libraryBtn := gtk.NewButtonWithLabel("📚 ISO Library")
+	libraryBtn.ConnectClicked(func() {
+		libraryWin := gtk.NewWindow()
+		libraryWin.SetTitle("ISO Library")
+		libraryWin.SetDefaultSize(800, 600)
+
+		vbox := gtk.NewBox(gtk.OrientationVertical, 10)
+		vbox.SetMarginTop(20)
+		vbox.SetMarginBottom(20)
+		vbox.SetMarginStart(20)
+		vbox.SetMarginEnd(20)
+
+		usageLabel := gtk.NewLabel("")
+		usageLabel.SetHAlign(gtk.AlignStart)
+		usageLabel.SetWrap(true)
+		vbox.Append(usageLabel)
+
+		list := gtk.NewListBox()
+		list.SetSelectionMode(gtk.SelectionNone)
+		scrolled := gtk.NewScrolledWindow()
+		scrolled.SetPolicy(gtk.PolicyNever, gtk.PolicyAutomatic)
+		scrolled.SetVExpand(true)
+		scrolled.SetChild(list)
+		vbox.Append(scrolled)
+
+		statusLabel := gtk.NewLabel("")
+		statusLabel.SetHAlign(gtk.AlignStart)
+		statusLabel.SetWrap(true)
+		vbox.Append(statusLabel)
+
+		buttonBox := gtk.NewBox(gtk.OrientationHorizontal, 10)
+		buttonBox.SetHAlign(gtk.AlignEnd)
+		importBtn := gtk.NewButtonWithLabel("Import ISO...")
+		pruneBtn := gtk.NewButtonWithLabel("Prune old versions")
+		buttonBox.Append(pruneBtn)
+		buttonBox.Append(importBtn)
+		vbox.Append(buttonBox)
+
+		// refresh rebuilds the list from the library index
+		var refresh func()
+		refresh = func() {
+			for {
+				child := list.FirstChild()
+				if child == nil {
+					break
+				}
+				list.Remove(child)
+			}
+			lib, err := OpenLibrary()
+			if err != nil {
+				usageLabel.SetText("Failed to open library: " + err.Error())
+				return
+			}
+			limit := "no size limit"
+			if appConfig.LibraryMaxSize > 0 {
+				limit = fmt.Sprintf("limit %.2f GB", float64(appConfig.LibraryMaxSize)/(1024*1024*1024))
+			}
+			usageLabel.SetText(fmt.Sprintf("%s\n%d images, %.2f GB used (%s)", lib.Dir, len(lib.Entries), float64(lib.TotalSize())/(1024*1024*1024), limit))
+			if len(lib.Entries) == 0 {
+				empty := gtk.NewLabel("No images yet. Download one or import an existing ISO.")
+				empty.SetMarginTop(20)
+				list.Append(empty)
+				return
+			}
+			for _, entry := range lib.Entries {
+				list.Append(libraryRow(entry, statusLabel, refresh, func(path string) {
+					onSelected(path)
+					libraryWin.Close()
+				}))
+			}
+		}
+
+		importBtn.ConnectClicked(func() {
+			dialog := gtk.NewFileDialog()
+			dialog.SetTitle("Import ISO File")
+			dialog.SetModal(true)
+			filter := gtk.NewFileFilter()
+			filter.SetName("ISO files")
+			filter.AddPattern("*.iso")
+			filter.AddMIMEType("application/x-iso9660-image")
+			dialog.SetDefaultFilter(filter)
+			dialog.Open(context.Background(), libraryWin, func(res gio.AsyncResulter) {
+				file, err := dialog.OpenFinish(res)
+				if err != nil || file == nil {
+					return
+				}
+				src := file.Path()
+				importBtn.SetSensitive(false)
+				go func() {
+					_, err := ImportImage(src, func(done, total int64) {
+						glib.IdleAdd(func() {
+							statusLabel.SetText(fmt.Sprintf("Importing... %d%%", done*100/max(total, 1)))
+						})
+					})
+					glib.IdleAdd(func() {
+						importBtn.SetSensitive(true)
+						if err != nil {
+							statusLabel.SetText("Import failed: " + err.Error())
+							return
+						}
+						statusLabel.SetText("Imported " + src)
+						refresh()
+					})
+				}()
+			})
+		})
+
+		pruneBtn.ConnectClicked(func() {
+			pruned, err := PruneLibrary()
+			if err != nil {
+				statusLabel.SetText("Prune failed: " + err.Error())
+			} else if len(pruned) == 0 {
+				statusLabel.SetText("Nothing to prune")
+			} else {
+				statusLabel.SetText(fmt.Sprintf("Pruned %d old images", len(pruned)))
+			}
+			refresh()
+		})
+
+		refresh()
+		libraryWin.SetChild(vbox)
+		libraryWin.SetVisible(true)
+	})
+	return libraryBtn
+}
+
+// libraryRow builds the list row for entry with its Use, Verify and Delete buttons
+func libraryRow(entry LibraryEntry, statusLabel *gtk.Label, refresh func(), onUse func(string)) *gtk.Box {
+	row := gtk.NewBox(gtk.OrientationHorizontal, 10)
+	row.SetMarginTop(6)
+	row.SetMarginBottom(6)
+
+	details := entry.AddedAt.Format("2006-01-02")
+	if entry.Version != "" {
+		details = entry.Version + " · " + details
+	}
+	if entry.Flavor != "" {
+		details = entry.Flavor + " · " + details
+	}
+	tooltip := entry.Path + "\n" + entry.SourceURL
+	switch entry.Signature {
+	case SignatureVerified:
+		details = "✅ " + details
+		tooltip += "\nSigned by " + entry.Signer
+	case SignatureFailed:
+		details = "❌ " + details
+		tooltip += "\nSignature verification failed: " + entry.SignatureError
+	case SignatureUnsigned:
+		tooltip += "\nNot signed"
+	}
+	label := gtk.NewLabel(fmt.Sprintf("%s\n%s · %.2f GB", entry.Name, details, float64(entry.Size)/(1024*1024*1024)))
+	label.SetHAlign(gtk.AlignStart)
+	label.SetHExpand(true)
+	label.SetWrap(true)
+	label.SetTooltipText(tooltip)
+	row.Append(label)
+
+	useBtn := gtk.NewButtonWithLabel("Use")
+	useBtn.SetCSSClasses([]string{"suggested-action"})
+	useBtn.ConnectClicked(func() {
+		onUse(entry.Path)
+	})
+
+	verifyBtn := gtk.NewButtonWithLabel("Verify")
+	verifyBtn.ConnectClicked(func() {
+		verifyBtn.SetSensitive(false)
+		go func() {
+			err := VerifyLibraryEntry(entry, func(done, total int64) {
+				glib.IdleAdd(func() {
+					statusLabel.SetText(fmt.Sprintf("Verifying %s... %d%%", entry.Name, done*100/max(total, 1)))
+				})
+			})
+			glib.IdleAdd(func() {
+				verifyBtn.SetSensitive(true)
+				if err != nil {
+					statusLabel.SetText("❌ " + entry.Name + ": " + err.Error())
+				} else {
+					statusLabel.SetText("✅ " + entry.Name + " matches its checksum")
+				}
+			})
+		}()
+	})
+
+	// Deleting needs a second click to confirm
+	deleteBtn := gtk.NewButtonWithLabel("Delete")
+	confirming := false
+	deleteBtn.ConnectClicked(func() {
+		if !confirming {
+			confirming = true
+			deleteBtn.SetLabel("Confirm delete")
+			deleteBtn.SetCSSClasses([]string{"destructive-action"})
+			return
+		}
+		if err := RemoveLibraryEntry(entry); err != nil {
+			statusLabel.SetText("Delete failed: " + err.Error())
+			return
+		}
+		statusLabel.SetText("Deleted " + entry.Name)
+		refresh()
+	})
+
+	row.Append(useBtn)
+	row.Append(verifyBtn)
+	row.Append(deleteBtn)
+	return row
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// logOutput is where messages for the user are printed, stdout unless the event stream writes there
+var logOutput io.Writer = os.Stdout
+
+// logf prints a message for the user like fmt.Printf
+func logf(format string, a ...any) {
+	fmt.Fprintf(logOutput, format, a...)
+}
+
+// logln prints a message for the user like fmt.Println
+func logln(a ...any) {
+	fmt.Fprintln(logOutput, a...)
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	_ "embed"
+	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 
+	coreglib "github.com/diamondburned/gotk4/pkg/core/glib"
 	"github.com/diamondburned/gotk4/pkg/gio/v2"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
 	"github.com/diamondburned/gotk4/pkg/gtk/v4"
 )
 
@@ -15,8 +19,29 @@ import (
 var logoData []byte
 var lastVersionList []string
 var isoPath string // Make isoPath package-level
+var cloudConfigPath string
+var embedCloudConfig bool
+var persistence Persistence
 
 func main() {
+	cfg, err := LoadConfig()
+	if err != nil {
+		logln("Error loading config, using defaults:", err)
+	}
+	appConfig = cfg
+	downloadLimiter.SetRate(appConfig.DownloadRateLimit)
+	if err := setupHTTPClient(appConfig); err != nil {
+		logln("Error setting up HTTP client, ignoring the proxy and CA bundle:", err)
+	}
+	if code, ok := runCLI(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+	stopEvents, err := startEventStream(appConfig.EventStream)
+	if err != nil {
+		logln("Error opening the event stream, events are off:", err)
+	}
+	defer stopEvents()
+
 	f, err := os.CreateTemp("", "logo.png")
 	if err != nil {
 		panic("Failed to create temporary logo file: " + err.Error())
@@ -121,10 +146,54 @@ func main() {
 
 		burnBtn := gtk.NewButtonWithLabel("🔥 Burn!")
 		burnBtn.SetSensitive(false)
+		burnBtn.SetHExpand(true)
+		dryRunBtn := gtk.NewButtonWithLabel("📝 Dry run")
+		dryRunBtn.SetTooltipText("Show what burning would do to the drive without writing anything")
+		dryRunBtn.SetSensitive(false)
 
 		var drive string
+		burnMode := BurnImage
+		// updateDrives refreshes the drive list after the ISO or cloud-config changed, or detects the
+		// drives again with rescan. It is set once the list exists
+		var updateDrives func(rescan bool)
+		// activeProfile is the burn profile the settings come from, clearProfile forgets it once the
+		// image is picked by hand
+		var activeProfile *BurnProfile
+		var clearProfile func()
+
+		verifyBtn := gtk.NewButtonWithLabel("🔍 Verify")
+		verifyBtn.SetTooltipText("Check the ISO against a SHA256 hash or checksum file")
+		verifyBtn.SetSensitive(isoPath != "")
+		verifyBtn.ConnectClicked(func() {
+			showVerifyWindow(&win.Window, isoPath, nil)
+		})
+
+		infoBtn := gtk.NewButtonWithLabel("ℹ")
+		infoBtn.SetTooltipText("Show the volume, boot and OS details of the ISO")
+		infoBtn.SetSensitive(isoPath != "")
+		infoBtn.ConnectClicked(func() {
+			showISOInfoWindow(&win.Window, isoPath)
+		})
 
 		isoBtn := gtk.NewButtonWithLabel("💿 Select ISO")
+		// describeISO shows what the selected image contains as the tooltip of isoBtn
+		describeISO := func(path string) {
+			infoBtn.SetSensitive(true)
+			isoBtn.SetTooltipText("Reading " + filepath.Base(path) + "...")
+			go func() {
+				info, err := InspectISO(path)
+				glib.IdleAdd(func() {
+					if path != isoPath {
+						return
+					}
+					if err != nil {
+						isoBtn.SetTooltipText("Not a valid ISO: " + err.Error())
+						return
+					}
+					isoBtn.SetTooltipText(info.Summary())
+				})
+			}()
+		}
 		isoBtn.ConnectClicked(func() {
 			dialog := gtk.NewFileDialog()
 			dialog.SetTitle("Select ISO File")
@@ -152,20 +221,186 @@ func main() {
 				if err == nil && file != nil {
 					isoPath = file.Path()
 					isoBtn.SetLabel("ISO: " + isoPath)
-					if drive != "" {
-						burnBtn.SetSensitive(true)
-					} else {
-						burnBtn.SetSensitive(false)
-					}
+					verifyBtn.SetSensitive(true)
+					describeISO(isoPath)
+					updateDrives(false)
+					clearProfile()
+				}
+			})
+		})
+
+		// Optional cloud-config written to a cidata partition after the image
+		cloudConfigBtn := gtk.NewButtonWithLabel("☁ No cloud-config")
+		cloudConfigBtn.SetTooltipText("Select a cloud-config.yaml to write to the stick for an unattended installation")
+		clearCloudConfigBtn := gtk.NewButtonWithLabel("✕")
+		clearCloudConfigBtn.SetTooltipText("Don't write a cloud-config")
+		clearCloudConfigBtn.SetSensitive(false)
+		clearCloudConfig := func() {
+			cloudConfigPath = ""
+			cloudConfigBtn.SetLabel("☁ No cloud-config")
+			clearCloudConfigBtn.SetSensitive(false)
+			updateDrives(false)
+		}
+		clearCloudConfigBtn.ConnectClicked(clearCloudConfig)
+		useCloudConfig := func(path string) {
+			cloudConfigPath = path
+			cloudConfigBtn.SetLabel("☁ Cloud-config: " + cloudConfigPath)
+			clearCloudConfigBtn.SetSensitive(true)
+			updateDrives(false)
+		}
+		embedCloudConfigCheck := gtk.NewCheckButtonWithLabel("Inside the ISO")
+		embedCloudConfigCheck.SetTooltipText("Embed the cloud-config in a remastered copy of the ISO instead of a partition after it, for machines that ignore extra partitions")
+		embedCloudConfigCheck.SetActive(embedCloudConfig)
+		embedCloudConfigCheck.ConnectToggled(func() {
+			embedCloudConfig = embedCloudConfigCheck.Active()
+			updateDrives(false)
+		})
+		editCloudConfigBtn := gtk.NewButtonWithLabel("✎ Edit")
+		editCloudConfigBtn.SetTooltipText("Write or check a cloud-config")
+		editCloudConfigBtn.ConnectClicked(func() {
+			showCloudConfigEditor(&win.Window, cloudConfigPath, useCloudConfig)
+		})
+		cloudConfigBtn.ConnectClicked(func() {
+			dialog := gtk.NewFileDialog()
+			dialog.SetTitle("Select cloud-config")
+			dialog.SetModal(true)
+			if homeDir, err := getHomeDirectory(); err == nil && homeDir != "" {
+				dialog.SetInitialFolder(gio.NewFileForPath(homeDir))
+			}
+			filter := gtk.NewFileFilter()
+			filter.SetName("YAML files")
+			filter.AddPattern("*.yaml")
+			filter.AddPattern("*.yml")
+			dialog.SetDefaultFilter(filter)
 
+			dialog.Open(context.Background(), &win.Window, func(res gio.AsyncResulter) {
+				file, err := dialog.OpenFinish(res)
+				if err == nil && file != nil {
+					// Broken configs go to the editor first
+					data, err := os.ReadFile(file.Path())
+					if err != nil || CloudConfigErrors(ValidateCloudConfig(data)) > 0 {
+						showCloudConfigEditor(&win.Window, file.Path(), useCloudConfig)
+						return
+					}
+					useCloudConfig(file.Path())
 				}
 			})
 		})
 
-		drives := ListUSBDrives()
+		// Optional persistent partition in the space left after the image
+		persistenceCheck := gtk.NewCheckButtonWithLabel("💾 Persistent partition")
+		persistenceCheck.SetTooltipText("Add a partition labeled " + persistenceLabel + " after the image, where the live system keeps its changes across reboots")
+		persistenceSize := gtk.NewSpinButtonWithRange(0, 4096, 1)
+		persistenceSize.SetTooltipText("Size of the partition in GB, 0 takes the rest of the drive")
+		persistenceSizeLabel := gtk.NewLabel("GB (0 = rest of the drive)")
+		updatePersistence := func() {
+			persistence = Persistence{}
+			if persistenceCheck.Active() {
+				persistence.Filesystem = PersistenceExt4
+				persistence.Size = int64(persistenceSize.Value()) * 1024 * 1024 * 1024
+			}
+			persistenceSize.SetSensitive(persistence.Enabled())
+			updateDrives(false)
+		}
+		persistenceSize.SetSensitive(false)
+		persistenceCheck.ConnectToggled(updatePersistence)
+		persistenceSize.ConnectValueChanged(updatePersistence)
+
+		// drives are the labels of the drive list, a placeholder first, usbDrives the drives they stand for
+		var drives []string
+		var usbDrives []USBDrive
+		listDrives := func() {
+			found, err := ListUSBDrives()
+			if err != nil {
+				logln("Error detecting USB drives:", err)
+			}
+			usbDrives = found
+			drives = []string{"No USB devices found"}
+			if len(found) > 0 {
+				drives = []string{"🖴 Select a USB device"}
+			}
+			for _, d := range found {
+				drives = append(drives, d.Label())
+			}
+		}
+		listDrives()
+
+		// requiredSize is the capacity the selected ISO and cloud-config need, 0 until an ISO is selected
+		requiredSize := func() int64 {
+			if isoPath == "" {
+				return 0
+			}
+			info, err := os.Stat(isoPath)
+			if err != nil {
+				return 0
+			}
+			return RequiredDriveSize(info.Size(), cloudConfigPath != "" && !embedCloudConfig, persistence)
+		}
+		driveFits := func(index int) bool {
+			return index < 1 || index > len(usbDrives) || usbDrives[index-1].Size >= requiredSize()
+		}
+
 		model := gtk.NewStringList(drives)
 		driveDropdown := gtk.NewDropDown(model, nil)
 		driveDropdown.SetSelected(0)
+		// Drives too small for the image are grayed out in the list and can't be picked
+		driveFactory := gtk.NewSignalListItemFactory()
+		driveFactory.ConnectSetup(func(object *coreglib.Object) {
+			label := gtk.NewLabel("")
+			label.SetHAlign(gtk.AlignStart)
+			object.Cast().(*gtk.ListItem).SetChild(label)
+		})
+		driveFactory.ConnectBind(func(object *coreglib.Object) {
+			item := object.Cast().(*gtk.ListItem)
+			label := item.Child().(*gtk.Label)
+			label.SetLabel(item.Item().Cast().(*gtk.StringObject).String())
+			fits := driveFits(int(item.Position()))
+			label.SetSensitive(fits)
+			item.SetSelectable(fits)
+			item.SetActivatable(fits)
+			if fits {
+				label.SetTooltipText("")
+			} else {
+				label.SetTooltipText("Too small for " + filepath.Base(isoPath))
+			}
+		})
+		driveDropdown.SetListFactory(&driveFactory.ListItemFactory)
+
+		driveWarning := gtk.NewLabel("")
+		driveWarning.SetWrap(true)
+		driveWarning.SetHAlign(gtk.AlignStart)
+		driveWarning.SetVisible(false)
+
+		// updateBurnBtn enables burning once an ISO and a drive large enough for it are selected
+		updateBurnBtn := func() {
+			index := int(driveDropdown.Selected())
+			drive = ""
+			if index > 0 && index < len(drives) {
+				drive = drives[index]
+			}
+			driveWarning.SetVisible(false)
+			if drive != "" && !driveFits(index) {
+				d := usbDrives[index-1]
+				driveWarning.SetLabel("⚠ " + driveTooSmallError(d.Path, requiredSize(), d.Size).Error())
+				driveWarning.SetVisible(true)
+				burnBtn.SetSensitive(false)
+				dryRunBtn.SetSensitive(isoPath != "")
+				return
+			}
+			burnBtn.SetSensitive(drive != "" && isoPath != "")
+			dryRunBtn.SetSensitive(drive != "" && isoPath != "")
+		}
+		updateDrives = func(rescan bool) {
+			selected := driveDropdown.Selected()
+			if rescan {
+				listDrives()
+				selected = 0
+			}
+			// A new model binds the items again, with the sizes checked against the current image
+			driveDropdown.SetModel(gtk.NewStringList(drives))
+			driveDropdown.SetSelected(selected)
+			updateBurnBtn()
+		}
 
 		refreshBtn := gtk.NewButtonWithLabel("⟳")
 		refreshBtn.SetTooltipText("Refresh USB drives list")
@@ -173,31 +408,97 @@ func main() {
 		refreshBtn.SetVAlign(gtk.AlignCenter)
 		refreshBtn.SetSizeRequest(40, 32)
 		refreshBtn.ConnectClicked(func() {
-			newDrives := ListUSBDrives()
-			model := gtk.NewStringList(newDrives)
-			driveDropdown.SetModel(model)
-			driveDropdown.SetSelected(0)
-			drives = newDrives
-			burnBtn.SetSensitive(false)
+			updateDrives(true)
+		})
+
+		testDriveBtn := gtk.NewButtonWithLabel("🩺")
+		testDriveBtn.SetTooltipText("Test a USB drive for a fake capacity or bad sectors")
+		testDriveBtn.SetVAlign(gtk.AlignCenter)
+		testDriveBtn.ConnectClicked(func() {
+			showDriveTestWindow(&win.Window, usbDrives)
 		})
 
 		driveBox := gtk.NewBox(gtk.OrientationHorizontal, 5)
 		driveDropdown.SetHExpand(true) // Make dropdown expand to fill available space
 		driveBox.Append(driveDropdown)
 		driveBox.Append(refreshBtn)
+		driveBox.Append(testDriveBtn)
 
-		driveDropdown.Connect("notify::selected", func() {
-			index := int(driveDropdown.Selected())
-			if index > 0 && index < len(drives) {
-				drive = drives[index]
-				if isoPath != "" {
-					burnBtn.SetSensitive(true)
-				} else {
-					burnBtn.SetSensitive(false)
-				}
+		driveDropdown.Connect("notify::selected", updateBurnBtn)
+
+		// useISO sets isoPath and updates isoBtn label
+		useISO := func(newPath string) {
+			isoPath = newPath
+			isoBtn.SetLabel("ISO: " + isoPath)
+			verifyBtn.SetSensitive(true)
+			describeISO(isoPath)
+			updateDrives(false)
+		}
+		// Callback for the download and library windows
+		selectISO := func(newPath string) {
+			useISO(newPath)
+			clearProfile()
+		}
+
+		// Burn profiles from the config fill in the image, cloud-config and partitions in one go
+		profiles := BurnProfiles()
+		profileNames := []string{"📋 No profile"}
+		for _, p := range profiles {
+			profileNames = append(profileNames, "📋 "+p.Name)
+		}
+		profileDropdown := gtk.NewDropDown(gtk.NewStringList(profileNames), nil)
+		profileDropdown.SetTooltipText("Burn profiles are set in the config file")
+		clearProfile = func() {
+			activeProfile = nil
+			profileDropdown.SetSelected(0)
+		}
+		applyProfile := func(p BurnProfile, path string) {
+			useISO(path)
+			if p.CloudConfig != "" {
+				useCloudConfig(p.CloudConfig)
 			} else {
-				burnBtn.SetSensitive(false)
+				clearCloudConfig()
+			}
+			embedCloudConfigCheck.SetActive(p.EmbedCloudConfig)
+			persistenceCheck.SetActive(p.Persistence.Enabled())
+			persistenceSize.SetValue(float64(p.Persistence.Size) / (1024 * 1024 * 1024))
+			activeProfile = &p
+		}
+		profileDropdown.Connect("notify::selected", func() {
+			index := int(profileDropdown.Selected())
+			activeProfile = nil
+			if index < 1 || index > len(profiles) {
+				return
 			}
+			p := profiles[index-1]
+			isoBtn.SetLabel("Getting the image of " + p.Name + "...")
+			go func() {
+				lastPercent := int64(-1)
+				path, err := p.ResolveImage(context.Background(), func(done, total int64) {
+					if percent := done * 100 / total; percent != lastPercent {
+						lastPercent = percent
+						glib.IdleAdd(func() {
+							isoBtn.SetLabel(fmt.Sprintf("Downloading the image of %s... %d%%", p.Name, percent))
+						})
+					}
+				})
+				glib.IdleAdd(func() {
+					// Another profile was picked meanwhile
+					if int(profileDropdown.Selected()) != index {
+						return
+					}
+					if err != nil {
+						isoBtn.SetLabel("💿 Select ISO")
+						if isoPath != "" {
+							isoBtn.SetLabel("ISO: " + isoPath)
+						}
+						clearProfile()
+						errDialog(win.Window, err)
+						return
+					}
+					applyProfile(p, path)
+				})
+			}()
 		})
 
 		// Add image at the top and make it bigger
@@ -209,21 +510,38 @@ func main() {
 		layout.SetMarginStart(20)
 		layout.SetMarginEnd(20)
 		layout.Append(logo)
-		layout.Append(isoBtn)
-
-		// Pass a callback to getDownloadWindow to set isoPath and update isoBtn label
-		layout.Append(getDownloadWindow(func(newPath string) {
-			isoPath = newPath
-			isoBtn.SetLabel("ISO: " + isoPath)
-			if drive != "" {
-				burnBtn.SetSensitive(true)
-			} else {
-				burnBtn.SetSensitive(false)
-			}
-		}))
+		if len(profiles) > 0 {
+			layout.Append(profileDropdown)
+		}
+		isoBox := gtk.NewBox(gtk.OrientationHorizontal, 5)
+		isoBtn.SetHExpand(true)
+		isoBox.Append(isoBtn)
+		isoBox.Append(verifyBtn)
+		isoBox.Append(infoBtn)
+		layout.Append(isoBox)
+		cloudConfigBox := gtk.NewBox(gtk.OrientationHorizontal, 5)
+		cloudConfigBtn.SetHExpand(true)
+		cloudConfigBox.Append(cloudConfigBtn)
+		cloudConfigBox.Append(embedCloudConfigCheck)
+		cloudConfigBox.Append(editCloudConfigBtn)
+		cloudConfigBox.Append(clearCloudConfigBtn)
+		layout.Append(cloudConfigBox)
+		persistenceBox := gtk.NewBox(gtk.OrientationHorizontal, 5)
+		persistenceCheck.SetHExpand(true)
+		persistenceBox.Append(persistenceCheck)
+		persistenceBox.Append(persistenceSize)
+		persistenceBox.Append(persistenceSizeLabel)
+		layout.Append(persistenceBox)
+
+		layout.Append(getLibraryWindow(selectISO))
+		layout.Append(getDownloadWindow(selectISO))
 
 		layout.Append(driveBox)
-		layout.Append(burnBtn)
+		layout.Append(driveWarning)
+		burnBox := gtk.NewBox(gtk.OrientationHorizontal, 5)
+		burnBox.Append(burnBtn)
+		burnBox.Append(dryRunBtn)
+		layout.Append(burnBox)
 
 		win.SetChild(layout)
 		win.SetVisible(true)
@@ -258,22 +576,98 @@ func main() {
 			exitBtn.SetSensitive(false)
 			exitBtn.SetHAlign(gtk.AlignCenter)
 
+			// The boot test shows up once the burn succeeded
+			bootTestBtn := gtk.NewButtonWithLabel("🧪 Boot test in QEMU")
+			bootTestBtn.SetTooltipText("Boot the stick in a virtual machine with UEFI and BIOS and wait for Kairos to come up")
+			bootTestBtn.SetHAlign(gtk.AlignCenter)
+			bootTestBtn.SetVisible(false)
+			bootTestResults := gtk.NewLabel("")
+			bootTestResults.SetWrap(true)
+			bootTestResults.SetSelectable(true)
+			bootTestResults.SetVisible(false)
+
+			buttonBox := gtk.NewBox(gtk.OrientationHorizontal, 10)
+			buttonBox.SetHAlign(gtk.AlignCenter)
+			buttonBox.Append(bootTestBtn)
+			buttonBox.Append(exitBtn)
+
 			content.Append(progress)
 			content.Append(status)
-			content.Append(exitBtn)
+			content.Append(bootTestResults)
+			content.Append(buttonBox)
 
 			win.SetChild(content)
 
+			// The drive label starts with the device path
+			device := strings.Fields(drive)[0]
+			firmwares := []string{BootUEFI, BootBIOS}
+			if burnMode == BurnFAT32 {
+				// The FAT32 copy only boots with UEFI
+				firmwares = firmwares[:1]
+			}
 			go func() {
-				Burn(isoPath, drive, progress, status, exitBtn)
+				err := Burn(BurnOptions{
+					ISO:              isoPath,
+					CloudConfig:      cloudConfigPath,
+					EmbedCloudConfig: embedCloudConfig,
+					Mode:             burnMode,
+					Persistence:      persistence,
+					Device:           device,
+				}, progress, status, exitBtn)
+				if err != nil {
+					return
+				}
+				glib.IdleAdd(func() {
+					if err := BootTestAvailable(); err != nil {
+						bootTestBtn.SetSensitive(false)
+						bootTestBtn.SetTooltipText(err.Error())
+					}
+					bootTestBtn.SetVisible(true)
+				})
 			}()
 
+			bootTestBtn.ConnectClicked(func() {
+				bootTestBtn.SetSensitive(false)
+				exitBtn.SetSensitive(false)
+				progress.Pulse()
+				go func() {
+					var results []string
+					for _, firmware := range firmwares {
+						name := strings.ToUpper(firmware)
+						glib.IdleAdd(func() { status.SetLabel("Booting with " + name + "...") })
+						result, err := BootTest(context.Background(), device, firmware, func(line string) {
+							glib.IdleAdd(func() {
+								progress.Pulse()
+								status.SetLabel(name + ": " + line)
+							})
+						})
+						if err != nil {
+							results = append(results, "❌ "+err.Error())
+							break
+						}
+						results = append(results, result.String())
+						if !result.Passed && len(result.Console) > 0 {
+							results = append(results, "   last console line: "+result.Console[len(result.Console)-1])
+						}
+					}
+					glib.IdleAdd(func() {
+						progress.SetFraction(1)
+						status.SetLabel("Boot test over")
+						bootTestResults.SetLabel(strings.Join(results, "\n"))
+						bootTestResults.SetVisible(true)
+						bootTestBtn.SetSensitive(true)
+						exitBtn.SetSensitive(true)
+					})
+				}()
+			})
+
 			exitBtn.ConnectClicked(func() {
 				win.Close()
 			})
 		}
 
-		burnBtn.ConnectClicked(func() {
+		// unmountAndBurn asks to unmount the partitions of the drive in use, if any, and starts burning
+		unmountAndBurn := func() {
 			// Check if any partitions of the selected device are mounted
 			if drive != "" && !strings.HasPrefix(drive, "Select") && !strings.HasPrefix(drive, "No USB") {
 				devPath := strings.Fields(drive)[0] // e.g. /dev/sdb
@@ -352,7 +746,7 @@ func main() {
 						// Try to unmount
 						err := UnmountDevice(mounted)
 						if err != nil {
-							errDialog(win.Window, err)
+							errDialog(win.Window, fmt.Errorf("failed to unmount: %w", err))
 						} else {
 							// Continue with burn after successful unmount
 							startBurning()
@@ -364,6 +758,72 @@ func main() {
 
 			// Start burning directly if no unmounting is needed
 			startBurning()
+		}
+
+		// Profiles set how strictly the image is verified, by hand it is checked unless the user skips it
+		verifyPolicy := func() string {
+			if activeProfile != nil {
+				return activeProfile.VerifyPolicy()
+			}
+			return VerifyChecksum
+		}
+
+		dryRunBtn.ConnectClicked(func() {
+			mode := BurnImage
+			if activeProfile != nil {
+				mode = activeProfile.Mode()
+			}
+			showPlanWindow(&win.Window, BurnOptions{
+				ISO:              isoPath,
+				CloudConfig:      cloudConfigPath,
+				EmbedCloudConfig: embedCloudConfig,
+				Mode:             mode,
+				Persistence:      persistence,
+				Device:           strings.Fields(drive)[0],
+			}, verifyPolicy())
+		})
+
+		burnBtn.ConnectClicked(func() {
+			// Images whose signature failed verification are never burned
+			if err := CheckBurnSignature(isoPath); err != nil {
+				errDialog(win.Window, err)
+				return
+			}
+			// A config that changed since it was selected is checked again, Kairos would ignore it at install time
+			if cloudConfigPath != "" {
+				data, err := os.ReadFile(cloudConfigPath)
+				if err != nil {
+					errDialog(win.Window, err)
+					return
+				}
+				if CloudConfigErrors(ValidateCloudConfig(data)) > 0 {
+					showCloudConfigEditor(&win.Window, cloudConfigPath, useCloudConfig)
+					return
+				}
+			}
+			proceed := func() {
+				if activeProfile != nil && activeProfile.FAT32 {
+					burnMode = BurnFAT32
+					unmountAndBurn()
+					return
+				}
+				checkBootableBeforeBurn(&win.Window, isoPath, func(mode BurnMode) {
+					burnMode = mode
+					unmountAndBurn()
+				})
+			}
+			switch verifyPolicy() {
+			case VerifyNone:
+				proceed()
+			case VerifySignature:
+				if err := checkVerifiedSignature(isoPath); err != nil {
+					errDialog(win.Window, err)
+					return
+				}
+				verifyBeforeBurn(&win.Window, isoPath, proceed)
+			default:
+				verifyBeforeBurn(&win.Window, isoPath, proceed)
+			}
 		})
 
 	})
@@ -393,7 +853,7 @@ func errDialog(win gtk.Window, err error) {
 	box.Append(icon)
 
 	// Error message
-	errMsgLabel := gtk.NewLabel("Failed to unmount: " + err.Error())
+	errMsgLabel := gtk.NewLabel(err.Error())
 	errMsgLabel.SetHAlign(gtk.AlignCenter)
 	errMsgLabel.SetWrap(true)
 	box.Append(errMsgLabel)
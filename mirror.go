@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// mirrorScheme is the URL scheme of assets served from the mirror directory, see newHTTPClient.
+// URLs are relative to the mirror so it keeps working when the drive is mounted somewhere else
+const mirrorScheme = "mirror"
+
+// mirrorIndex is mirror.json at the top of a mirror: the releases it has, in the same shape as the
+// release cache, with asset URLs pointing into the mirror
+type mirrorIndex struct {
+	SyncedAt time.Time               `json:"synced_at"`
+	Assets   []ReleaseAsset          `json:"assets"`
+	Notes    map[string]ReleaseNotes `json:"notes"`
+	// Files are the sizes of the mirrored files by their path relative to the mirror, to skip them next time
+	Files map[string]int64 `json:"files"`
+}
+
+// MirrorOptions selects what SyncMirror copies
+type MirrorOptions struct {
+	Dir string
+	// Versions is a regex on the release tags, empty matches every version
+	Versions string
+	// Latest keeps only the newest matching versions, 0 keeps them all
+	Latest int
+	// Flavors is a regex on the ISO names, e.g. "ubuntu-24.04-standard", empty matches every ISO
+	Flavors string
+}
+
+// mirrorDir returns the configured mirror directory or the default one in the user's data directory
+func mirrorDir() (string, error) {
+	if appConfig.MirrorDir != "" {
+		return appConfig.MirrorDir, nil
+	}
+	dir, err := userDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mirror"), nil
+}
+
+// useMirror tells if releases are read from the mirror instead of GitHub
+func useMirror() bool {
+	return appConfig.ReleaseSource == "mirror"
+}
+
+func readMirrorIndex(dir string) (*mirrorIndex, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "mirror.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index mirrorIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid mirror index: %w", err)
+	}
+	return &index, nil
+}
+
+func (m *mirrorIndex) save(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeUserFile(filepath.Join(dir, "mirror.json"), data)
+}
+
+// mirrorReleaseAssets returns the releases available in the configured mirror
+func mirrorReleaseAssets() ([]ReleaseAsset, map[string]ReleaseNotes, error) {
+	dir, err := mirrorDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := readMirrorIndex(dir)
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("no mirror found in %s, sync one with the mirror command", dir)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return index.Assets, index.Notes, nil
+}
+
+// mirrorAssetsFor returns the ISOs of the selected versions with the checksum and signature files
+// published next to them
+func mirrorAssetsFor(assets []ReleaseAsset, opts MirrorOptions) ([]ReleaseAsset, error) {
+	versionRe, err := regexp.Compile(opts.Versions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid versions pattern: %w", err)
+	}
+	flavorRe, err := regexp.Compile(opts.Flavors)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flavors pattern: %w", err)
+	}
+
+	var versions []*semver.Version
+	seen := make(map[string]bool)
+	for _, a := range assets {
+		if seen[a.Version] || !versionRe.MatchString(a.Version) {
+			continue
+		}
+		seen[a.Version] = true
+		if v, err := semver.NewVersion(a.Version); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	sort.Sort(sort.Reverse(semver.Collection(versions)))
+	if opts.Latest > 0 && len(versions) > opts.Latest {
+		versions = versions[:opts.Latest]
+	}
+	selected := make(map[string]bool)
+	for _, v := range versions {
+		selected[v.Original()] = true
+	}
+
+	var files []ReleaseAsset
+	added := make(map[string]bool)
+	add := func(a *ReleaseAsset) {
+		if a != nil && !added[a.Version+"/"+a.Name] {
+			added[a.Version+"/"+a.Name] = true
+			files = append(files, *a)
+		}
+	}
+	for _, a := range assets {
+		if !selected[a.Version] || !strings.HasSuffix(a.Name, ".iso") || !flavorRe.MatchString(a.Name) {
+			continue
+		}
+		add(&a)
+		if checksum, ok := checksumAssetFor(a, assets); ok {
+			add(&checksum)
+		}
+		sig, cert, bundle := signatureAssetsFor(a, assets)
+		add(sig)
+		add(cert)
+		add(bundle)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no ISO matches the given versions and flavors")
+	}
+	return files, nil
+}
+
+// SyncMirror copies the selected releases from GitHub into opts.Dir, which can then be used offline
+// with release_source set to "mirror". Files already mirrored are skipped and interrupted downloads
+// resume, so it can be run again to update the mirror. progress is called with each file as it downloads
+func SyncMirror(ctx context.Context, opts MirrorOptions, progress func(name string, done, total int64)) error {
+	assets, notes, _, _, err := fetchReleaseAssets(ctx, "kairos-io", "kairos", "")
+	if err != nil {
+		return err
+	}
+	files, err := mirrorAssetsFor(assets, opts)
+	if err != nil {
+		return err
+	}
+	if err := mkdirUserDir(opts.Dir); err != nil {
+		return err
+	}
+	index, err := readMirrorIndex(opts.Dir)
+	if err != nil {
+		index = &mirrorIndex{}
+	}
+	if index.Notes == nil {
+		index.Notes = make(map[string]ReleaseNotes)
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]int64)
+	}
+
+	for _, a := range files {
+		rel := path.Join(a.Version, a.Name)
+		dest := filepath.Join(opts.Dir, filepath.FromSlash(rel))
+		if size, ok := index.Files[rel]; ok {
+			if info, err := os.Stat(dest); err == nil && info.Size() == size {
+				continue
+			}
+		}
+		if err := mkdirUserDir(filepath.Dir(dest)); err != nil {
+			return err
+		}
+		var checksum string
+		if checksumAsset, ok := checksumAssetFor(a, assets); ok {
+			if checksum, err = fetchChecksum(ctx, checksumAsset.URL, a.Name); err != nil {
+				return fmt.Errorf("fetching checksum of %s: %w", a.Name, err)
+			}
+		}
+		err := DownloadFile(ctx, a.URL, dest, checksum, func(done, total int64) {
+			if progress != nil {
+				progress(a.Name, done, total)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("downloading %s: %w", a.Name, err)
+		}
+		chownToRealUser(dest)
+		info, err := os.Stat(dest)
+		if err != nil {
+			return err
+		}
+		index.Files[rel] = info.Size()
+
+		mirrored := a
+		mirrored.URL = mirrorScheme + ":///" + rel
+		replaced := false
+		for i := range index.Assets {
+			if index.Assets[i].Version == a.Version && index.Assets[i].Name == a.Name {
+				index.Assets[i] = mirrored
+				replaced = true
+			}
+		}
+		if !replaced {
+			index.Assets = append(index.Assets, mirrored)
+		}
+		if n, ok := notes[a.Version]; ok {
+			index.Notes[a.Version] = n
+		}
+		// Saved after every file so an interrupted sync still leaves a usable mirror
+		index.SyncedAt = time.Now()
+		if err := index.save(opts.Dir); err != nil {
+			return err
+		}
+	}
+	index.SyncedAt = time.Now()
+	return index.save(opts.Dir)
+}
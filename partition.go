@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// partitionAlign is where new partitions start, 1MiB like every partitioning tool
+	partitionAlign = 1024 * 1024
+	mbrTypeGPT     = 0xEE
+	mbrTypeFAT32   = 0x0C
+	mbrTypeLinux   = 0x83
+	gptEntrySize   = 128
+)
+
+var (
+	// gptTypeBasicData is the Microsoft basic data partition type, what FAT volumes use
+	gptTypeBasicData = mustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+	// gptTypeLinuxData is the Linux filesystem data partition type
+	gptTypeLinuxData = mustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	gptSignature     = []byte("EFI PART")
+)
+
+// mbrPartition is an entry of the MBR partition table
+type mbrPartition struct {
+	Status   byte
+	Type     byte
+	StartLBA uint32
+	Sectors  uint32
+}
+
+// PartitionSpec describes a partition to add after the image on a disk
+type PartitionSpec struct {
+	// Size is in bytes, 0 takes the rest of the disk
+	Size    int64
+	MBRType byte
+	GPTType [16]byte
+	Name    string
+}
+
+// readMBR returns the 4 primary partitions of the MBR in the first sector of disk
+func readMBR(disk io.ReaderAt) ([4]mbrPartition, error) {
+	var parts [4]mbrPartition
+	sector := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(sector, 0); err != nil {
+		return parts, err
+	}
+	if sector[510] != 0x55 || sector[511] != 0xAA {
+		return parts, errors.New("no partition table found")
+	}
+	for i := range parts {
+		e := sector[446+i*16:]
+		parts[i] = mbrPartition{
+			Status:   e[0],
+			Type:     e[4],
+			StartLBA: binary.LittleEndian.Uint32(e[8:]),
+			Sectors:  binary.LittleEndian.Uint32(e[12:]),
+		}
+	}
+	return parts, nil
+}
+
+// gptHeader is the part of a GPT header we need to add a partition
+type gptHeader struct {
+	raw        []byte
+	entriesLBA uint64
+	entries    []byte
+}
+
+// readGPT returns the primary GPT of disk, or nil if it has none. A header or entries that fail their
+// checksum are an error, the table can't be trusted
+func readGPT(disk io.ReaderAt) (*gptHeader, error) {
+	sector := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(sector, sectorSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sector[:8], gptSignature) {
+		return nil, nil
+	}
+	headerSize := binary.LittleEndian.Uint32(sector[12:])
+	if headerSize < 92 || headerSize > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header of %d bytes", headerSize)
+	}
+	// The CRC covers the header with its own field zeroed
+	header := append([]byte(nil), sector[:headerSize]...)
+	binary.LittleEndian.PutUint32(header[16:], 0)
+	if crc32.ChecksumIEEE(header) != binary.LittleEndian.Uint32(sector[16:]) {
+		return nil, errors.New("corrupt GPT header, its checksum doesn't match")
+	}
+	h := &gptHeader{raw: sector, entriesLBA: binary.LittleEndian.Uint64(sector[72:])}
+	count := binary.LittleEndian.Uint32(sector[80:])
+	size := binary.LittleEndian.Uint32(sector[84:])
+	if size != gptEntrySize || count == 0 || count > 1024 {
+		return nil, fmt.Errorf("unsupported GPT with %d entries of %d bytes", count, size)
+	}
+	h.entries = make([]byte, int(count)*gptEntrySize)
+	if _, err := disk.ReadAt(h.entries, int64(h.entriesLBA)*sectorSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(h.entries) != binary.LittleEndian.Uint32(sector[88:]) {
+		return nil, errors.New("corrupt GPT partition entries, their checksum doesn't match")
+	}
+	return h, nil
+}
+
+// partitionsEnd returns the first byte after the last partition in the MBR or GPT of disk
+func partitionsEnd(mbr [4]mbrPartition, gpt *gptHeader) int64 {
+	var end int64
+	for _, p := range mbr {
+		if p.Type != 0 && p.Type != mbrTypeGPT {
+			end = max(end, (int64(p.StartLBA)+int64(p.Sectors))*sectorSize)
+		}
+	}
+	if gpt != nil {
+		for i := 0; i+gptEntrySize <= len(gpt.entries); i += gptEntrySize {
+			e := gpt.entries[i : i+gptEntrySize]
+			if bytes.Equal(e[:16], make([]byte, 16)) {
+				continue
+			}
+			end = max(end, (int64(binary.LittleEndian.Uint64(e[40:]))+1)*sectorSize)
+		}
+	}
+	return end
+}
+
+// AppendPartition adds a partition in the free space after the image written at the start of disk,
+// which is diskSize bytes. Hybrid images carry both an MBR and a GPT, the partition is added to
+// whichever tables are present. It returns the offset in bytes where the new partition starts and its size
+func AppendPartition(disk interface {
+	io.ReaderAt
+	io.WriterAt
+}, diskSize, imageSize int64, spec PartitionSpec) (int64, int64, error) {
+	mbr, err := readMBR(disk)
+	if err != nil {
+		return 0, 0, err
+	}
+	gpt, err := readGPT(disk)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := (max(imageSize, partitionsEnd(mbr, gpt)) + partitionAlign - 1) / partitionAlign * partitionAlign
+	// The backup GPT takes the last 33 sectors of the disk
+	if spec.Size == 0 {
+		spec.Size = (diskSize - 34*sectorSize - start) / partitionAlign * partitionAlign
+		if spec.Size <= 0 {
+			return 0, 0, errors.New("no free space left after the image")
+		}
+	}
+	end := start + spec.Size
+	if end > diskSize-34*sectorSize {
+		return 0, 0, fmt.Errorf("not enough free space after the image: need %d MB, %d MB available",
+			spec.Size/(1024*1024), max(diskSize-34*sectorSize-start, 0)/(1024*1024))
+	}
+	startLBA, sectors := uint64(start/sectorSize), uint64(spec.Size/sectorSize)
+
+	updated := false
+	isProtective := mbr[0].Type == mbrTypeGPT
+	if !isProtective {
+		slot := -1
+		for i, p := range mbr {
+			if p.Type == 0 {
+				slot = i
+				break
+			}
+		}
+		if slot >= 0 && startLBA+sectors <= 0xFFFFFFFF {
+			// Raw disks on Windows only take whole sectors
+			sector := make([]byte, sectorSize)
+			if _, err := disk.ReadAt(sector, 0); err != nil {
+				return 0, 0, err
+			}
+			entry := sector[446+slot*16 : 446+slot*16+16]
+			clear(entry)
+			entry[4] = spec.MBRType
+			// CHS is unused on disks this size, fill with the LBA marker values
+			copy(entry[1:4], []byte{0xFE, 0xFF, 0xFF})
+			copy(entry[5:8], []byte{0xFE, 0xFF, 0xFF})
+			binary.LittleEndian.PutUint32(entry[8:], uint32(startLBA))
+			binary.LittleEndian.PutUint32(entry[12:], uint32(sectors))
+			if _, err := disk.WriteAt(sector, 0); err != nil {
+				return 0, 0, err
+			}
+			updated = true
+		} else if gpt == nil {
+			return 0, 0, errors.New("the partition table of the image has no free slot")
+		}
+	}
+
+	if gpt != nil {
+		if err := appendGPTPartition(disk, diskSize, gpt, startLBA, sectors, spec); err != nil {
+			return 0, 0, err
+		}
+		sector := make([]byte, sectorSize)
+		if _, err := disk.ReadAt(sector, 0); err != nil {
+			return 0, 0, err
+		}
+		oldLastLBA := binary.LittleEndian.Uint64(gpt.raw[32:])
+		if growProtectiveMBR(sector, oldLastLBA, uint64(diskSize/sectorSize)-1) {
+			if _, err := disk.WriteAt(sector, 0); err != nil {
+				return 0, 0, err
+			}
+		}
+		updated = true
+	}
+	if !updated {
+		return 0, 0, errors.New("no partition table to add the partition to")
+	}
+	return start, spec.Size, nil
+}
+
+// appendGPTPartition adds an entry to the GPT and moves its backup to the end of the disk, as the
+// image only knew its own size
+func appendGPTPartition(disk io.WriterAt, diskSize int64, h *gptHeader, startLBA, sectors uint64, spec PartitionSpec) error {
+	slot := -1
+	for i := 0; i+gptEntrySize <= len(h.entries); i += gptEntrySize {
+		if bytes.Equal(h.entries[i:i+16], make([]byte, 16)) {
+			slot = i
+			break
+		}
+	}
+	if slot < 0 {
+		return errors.New("the GPT of the image has no free entry")
+	}
+	e := h.entries[slot : slot+gptEntrySize]
+	copy(e[0:16], spec.GPTType[:])
+	if _, err := rand.Read(e[16:32]); err != nil {
+		return err
+	}
+	// Version 4 GUID, the version is the high nibble of Data3, stored little endian
+	e[23] = e[23]&0x0F | 0x40
+	e[24] = e[24]&0x3F | 0x80
+	binary.LittleEndian.PutUint64(e[32:], startLBA)
+	binary.LittleEndian.PutUint64(e[40:], startLBA+sectors-1)
+	for i, c := range utf16.Encode([]rune(spec.Name)) {
+		if i >= 36 {
+			break
+		}
+		binary.LittleEndian.PutUint16(e[56+i*2:], c)
+	}
+
+	return writeGPT(disk, h, uint64(diskSize/sectorSize)-1)
+}
+
+// growProtectiveMBR extends the 0xEE entries of the MBR in sector that reached the backup GPT at
+// oldLastLBA to reach lastLBA, where the backup moved. It tells if sector changed
+func growProtectiveMBR(sector []byte, oldLastLBA, lastLBA uint64) bool {
+	changed := false
+	for i := 0; i < 4; i++ {
+		e := sector[446+i*16 : 446+i*16+16]
+		start, sectors := uint64(binary.LittleEndian.Uint32(e[8:])), uint64(binary.LittleEndian.Uint32(e[12:]))
+		if e[4] != mbrTypeGPT || start == 0 || (start+sectors-1 < oldLastLBA && sectors != 0xFFFFFFFF) {
+			continue
+		}
+		binary.LittleEndian.PutUint32(e[12:], uint32(min(lastLBA+1-start, 0xFFFFFFFF)))
+		changed = true
+	}
+	return changed
+}
+
+// writeGPT writes the entries of h and both headers with fresh CRCs, the backup at lastLBA
+func writeGPT(disk io.WriterAt, h *gptHeader, lastLBA uint64) error {
+	entriesSectors := uint64((len(h.entries) + sectorSize - 1) / sectorSize)
+	backupEntriesLBA := lastLBA - entriesSectors
+	entriesCRC := crc32.ChecksumIEEE(h.entries)
+
+	header := func(current, backup, entriesLBA uint64) []byte {
+		raw := append([]byte(nil), h.raw...)
+		binary.LittleEndian.PutUint64(raw[24:], current)
+		binary.LittleEndian.PutUint64(raw[32:], backup)
+		binary.LittleEndian.PutUint64(raw[48:], backupEntriesLBA-1)
+		binary.LittleEndian.PutUint64(raw[72:], entriesLBA)
+		binary.LittleEndian.PutUint32(raw[88:], entriesCRC)
+		size := binary.LittleEndian.Uint32(raw[12:])
+		binary.LittleEndian.PutUint32(raw[16:], 0)
+		binary.LittleEndian.PutUint32(raw[16:], crc32.ChecksumIEEE(raw[:size]))
+		return raw
+	}
+
+	padded := make([]byte, entriesSectors*sectorSize)
+	copy(padded, h.entries)
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{h.entriesLBA, padded},
+		{1, header(1, lastLBA, h.entriesLBA)},
+		{backupEntriesLBA, padded},
+		{lastLBA, header(lastLBA, 1, backupEntriesLBA)},
+	}
+	for _, w := range writes {
+		if _, err := disk.WriteAt(w.data, int64(w.lba)*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mustParseGUID parses a GUID in its text form into the mixed endian layout GPT uses
+func mustParseGUID(s string) [16]byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("invalid GUID " + s)
+	}
+	var g [16]byte
+	binary.LittleEndian.PutUint32(g[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(g[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(g[6:], binary.BigEndian.Uint16(b[6:]))
+	copy(g[8:], b[8:])
+	return g
+}
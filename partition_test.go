@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+const (
+	testDiskSize  = 64 * 1024 * 1024
+	testImageSize = 8 * 1024 * 1024
+)
+
+// newMBRDisk returns a disk with an image of testImageSize at its start, partitioned with MBR entries
+// of the given types, each 1MiB long from LBA 64
+func newMBRDisk(types ...byte) memDisk {
+	d := make(memDisk, testDiskSize)
+	for i, typ := range types {
+		e := d[446+i*16:]
+		e[4] = typ
+		binary.LittleEndian.PutUint32(e[8:], uint32(64+i*2048))
+		binary.LittleEndian.PutUint32(e[12:], 2048)
+	}
+	d[510], d[511] = 0x55, 0xAA
+	return d
+}
+
+// newHybridDisk returns a disk with an image of testImageSize carrying a protective MBR and a GPT, with
+// the backup GPT at the end of the image as image builders leave it
+func newHybridDisk() memDisk {
+	d := newMBRDisk(mbrTypeGPT)
+	imageLastLBA := uint64(testImageSize/sectorSize - 1)
+	binary.LittleEndian.PutUint32(d[446+8:], 1)
+	binary.LittleEndian.PutUint32(d[446+12:], uint32(imageLastLBA))
+
+	raw := make([]byte, sectorSize)
+	copy(raw, gptSignature)
+	binary.LittleEndian.PutUint32(raw[8:], 0x10000)
+	binary.LittleEndian.PutUint32(raw[12:], 92)
+	binary.LittleEndian.PutUint64(raw[40:], 34)
+	binary.LittleEndian.PutUint32(raw[80:], 128)
+	binary.LittleEndian.PutUint32(raw[84:], gptEntrySize)
+	entries := make([]byte, 128*gptEntrySize)
+	copy(entries, gptTypeBasicData[:])
+	entries[16] = 1
+	binary.LittleEndian.PutUint64(entries[32:], 64)
+	binary.LittleEndian.PutUint64(entries[40:], imageLastLBA-33)
+	if err := writeGPT(d, &gptHeader{raw: raw, entriesLBA: 2, entries: entries}, imageLastLBA); err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// checkGPTHeader checks the CRCs of the GPT header at lba and that it points to the other copy at
+// alternate, returning its entries
+func checkGPTHeader(t *testing.T, d memDisk, lba, alternate uint64) []byte {
+	t.Helper()
+	raw := d[lba*sectorSize : (lba+1)*sectorSize]
+	if !bytes.Equal(raw[:8], gptSignature) {
+		t.Fatalf("no GPT header at LBA %d", lba)
+	}
+	header := append([]byte(nil), raw[:binary.LittleEndian.Uint32(raw[12:])]...)
+	crc := binary.LittleEndian.Uint32(header[16:])
+	binary.LittleEndian.PutUint32(header[16:], 0)
+	if got := crc32.ChecksumIEEE(header); got != crc {
+		t.Errorf("GPT header at LBA %d: CRC %08x, want %08x", lba, crc, got)
+	}
+	if got := binary.LittleEndian.Uint64(raw[24:]); got != lba {
+		t.Errorf("GPT header at LBA %d: current LBA %d", lba, got)
+	}
+	if got := binary.LittleEndian.Uint64(raw[32:]); got != alternate {
+		t.Errorf("GPT header at LBA %d: alternate LBA %d, want %d", lba, got, alternate)
+	}
+	entriesLBA := binary.LittleEndian.Uint64(raw[72:])
+	entries := d[entriesLBA*sectorSize : entriesLBA*sectorSize+128*gptEntrySize]
+	if got, want := crc32.ChecksumIEEE(entries), binary.LittleEndian.Uint32(raw[88:]); got != want {
+		t.Errorf("GPT entries of LBA %d: CRC %08x, want %08x", lba, got, want)
+	}
+	return entries
+}
+
+func TestAppendPartition(t *testing.T) {
+	tests := []struct {
+		name      string
+		disk      func() memDisk
+		spec      PartitionSpec
+		wantStart int64
+		wantSize  int64
+		wantErr   bool
+	}{
+		{
+			name:      "mbr",
+			disk:      func() memDisk { return newMBRDisk(0x17) },
+			spec:      PartitionSpec{Size: 4 * 1024 * 1024, MBRType: mbrTypeFAT32, GPTType: gptTypeBasicData, Name: "COS_OEM"},
+			wantStart: testImageSize,
+			wantSize:  4 * 1024 * 1024,
+		},
+		{
+			name:      "mbr rest of the disk",
+			disk:      func() memDisk { return newMBRDisk(0x17) },
+			spec:      PartitionSpec{MBRType: mbrTypeLinux, GPTType: gptTypeLinuxData, Name: "COS_PERSISTENT"},
+			wantStart: testImageSize,
+			wantSize:  testDiskSize - testImageSize - partitionAlign,
+		},
+		{
+			name: "mbr partition past the image",
+			disk: func() memDisk {
+				d := newMBRDisk(0x17)
+				binary.LittleEndian.PutUint32(d[446+12:], testImageSize/sectorSize)
+				return d
+			},
+			spec:      PartitionSpec{Size: partitionAlign, MBRType: mbrTypeFAT32},
+			wantStart: testImageSize + partitionAlign,
+			wantSize:  partitionAlign,
+		},
+		{
+			name:    "mbr full",
+			disk:    func() memDisk { return newMBRDisk(0x17, 0xEF, 0x83, 0x83) },
+			spec:    PartitionSpec{Size: partitionAlign, MBRType: mbrTypeFAT32},
+			wantErr: true,
+		},
+		{
+			name:    "too large",
+			disk:    func() memDisk { return newMBRDisk(0x17) },
+			spec:    PartitionSpec{Size: testDiskSize, MBRType: mbrTypeFAT32},
+			wantErr: true,
+		},
+		{
+			name:    "no partition table",
+			disk:    func() memDisk { return make(memDisk, testDiskSize) },
+			spec:    PartitionSpec{Size: partitionAlign, MBRType: mbrTypeFAT32},
+			wantErr: true,
+		},
+		{
+			name: "gpt header too large",
+			disk: func() memDisk {
+				d := newHybridDisk()
+				binary.LittleEndian.PutUint32(d[sectorSize+12:], 4096)
+				return d
+			},
+			spec:    PartitionSpec{Size: partitionAlign, MBRType: mbrTypeFAT32, GPTType: gptTypeBasicData},
+			wantErr: true,
+		},
+		{
+			name: "gpt header too small",
+			disk: func() memDisk {
+				d := newHybridDisk()
+				binary.LittleEndian.PutUint32(d[sectorSize+12:], 16)
+				return d
+			},
+			spec:    PartitionSpec{Size: partitionAlign, MBRType: mbrTypeFAT32, GPTType: gptTypeBasicData},
+			wantErr: true,
+		},
+		{
+			name: "gpt header corrupt",
+			disk: func() memDisk {
+				d := newHybridDisk()
+				d[sectorSize+40]++
+				return d
+			},
+			spec:    PartitionSpec{Size: partitionAlign, MBRType: mbrTypeFAT32, GPTType: gptTypeBasicData},
+			wantErr: true,
+		},
+		{
+			name: "gpt entries corrupt",
+			disk: func() memDisk {
+				d := newHybridDisk()
+				d[2*sectorSize+32]++
+				return d
+			},
+			spec:    PartitionSpec{Size: partitionAlign, MBRType: mbrTypeFAT32, GPTType: gptTypeBasicData},
+			wantErr: true,
+		},
+		{
+			name:      "hybrid",
+			disk:      newHybridDisk,
+			spec:      PartitionSpec{Size: 4 * 1024 * 1024, MBRType: mbrTypeFAT32, GPTType: gptTypeBasicData, Name: "COS_OEM"},
+			wantStart: testImageSize,
+			wantSize:  4 * 1024 * 1024,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := tt.disk()
+			start, size, err := AppendPartition(d, testDiskSize, testImageSize, tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("AppendPartition() = %d, %d, want an error", start, size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start != tt.wantStart || size != tt.wantSize {
+				t.Fatalf("AppendPartition() = %d, %d, want %d, %d", start, size, tt.wantStart, tt.wantSize)
+			}
+
+			mbr, err := readMBR(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gpt, err := readGPT(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gpt == nil {
+				p := mbr[1]
+				if p.Type != tt.spec.MBRType || int64(p.StartLBA)*sectorSize != start || int64(p.Sectors)*sectorSize != size {
+					t.Errorf("MBR entry %+v, want type %#x at %d, %d bytes", p, tt.spec.MBRType, start, size)
+				}
+				return
+			}
+
+			// The GPT and its backup, moved to the end of the disk, both hold the partition
+			lastLBA := uint64(testDiskSize/sectorSize - 1)
+			primary := checkGPTHeader(t, d, 1, lastLBA)
+			backup := checkGPTHeader(t, d, lastLBA, 1)
+			if !bytes.Equal(primary, backup) {
+				t.Error("the backup GPT entries differ from the primary ones")
+			}
+			if got := binary.LittleEndian.Uint64(d[sectorSize+48:]); got != lastLBA-33 {
+				t.Errorf("last usable LBA %d, want %d", got, lastLBA-33)
+			}
+			e := primary[gptEntrySize : 2*gptEntrySize]
+			if !bytes.Equal(e[:16], tt.spec.GPTType[:]) {
+				t.Errorf("GPT entry type %x, want %x", e[:16], tt.spec.GPTType)
+			}
+			if e[23]>>4 != 4 || e[24]>>6 != 2 {
+				t.Errorf("GPT entry GUID %x is not a version 4 GUID", e[16:32])
+			}
+			first, last := binary.LittleEndian.Uint64(e[32:]), binary.LittleEndian.Uint64(e[40:])
+			if int64(first)*sectorSize != start || int64(last-first+1)*sectorSize != size {
+				t.Errorf("GPT entry spans LBA %d-%d, want %d bytes at %d", first, last, size, start)
+			}
+			if got := string(bytes.ReplaceAll(e[56:56+2*len(tt.spec.Name)], []byte{0}, nil)); got != tt.spec.Name {
+				t.Errorf("GPT entry name %q, want %q", got, tt.spec.Name)
+			}
+
+			// The protective MBR covers the grown disk
+			if mbr[0].Type != mbrTypeGPT || uint64(mbr[0].StartLBA)+uint64(mbr[0].Sectors) != lastLBA+1 {
+				t.Errorf("protective MBR entry %+v doesn't reach LBA %d", mbr[0], lastLBA)
+			}
+			if mbr[1].Type != 0 {
+				t.Errorf("MBR entry %+v added next to the protective one", mbr[1])
+			}
+		})
+	}
+}
+
+func TestGrowProtectiveMBR(t *testing.T) {
+	tests := []struct {
+		name        string
+		typ         byte
+		start       uint32
+		sectors     uint32
+		wantSectors uint32
+		wantChanged bool
+	}{
+		{"reaches the backup", mbrTypeGPT, 1, 999, 1999, true},
+		{"past the backup", mbrTypeGPT, 1, 1500, 1999, true},
+		{"whole disk marker", mbrTypeGPT, 1, 0xFFFFFFFF, 1999, true},
+		{"short of the backup", mbrTypeGPT, 1, 500, 500, false},
+		{"not protective", mbrTypeFAT32, 1, 999, 999, false},
+		{"empty", mbrTypeGPT, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sector := make([]byte, sectorSize)
+			e := sector[446+16:]
+			e[4] = tt.typ
+			binary.LittleEndian.PutUint32(e[8:], tt.start)
+			binary.LittleEndian.PutUint32(e[12:], tt.sectors)
+			changed := growProtectiveMBR(sector, 999, 1999)
+			if got := binary.LittleEndian.Uint32(e[12:]); changed != tt.wantChanged || got != tt.wantSectors {
+				t.Errorf("growProtectiveMBR() = %v with %d sectors, want %v with %d", changed, got, tt.wantChanged, tt.wantSectors)
+			}
+		})
+	}
+}
+
+func TestMustParseGUID(t *testing.T) {
+	g := mustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	want := []byte{0xAF, 0x3D, 0xC6, 0x0F, 0x83, 0x84, 0x72, 0x47, 0x8E, 0x79, 0x3D, 0x69, 0xD8, 0x47, 0x7D, 0xE4}
+	if !bytes.Equal(g[:], want) {
+		t.Errorf("mustParseGUID() = %x, want %x", g, want)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// persistenceLabel is the label of the partition Kairos keeps its persistent state on
+	persistenceLabel = "COS_PERSISTENT"
+	// persistenceMinSize is the smallest persistent partition, what the ext4 journal needs
+	persistenceMinSize = 64 * 1024 * 1024
+	// PersistenceExt4 is the filesystem of persistent partitions. FAT labels hold 11 characters, Kairos
+	// wouldn't find a FAT volume by its label
+	PersistenceExt4 = "ext4"
+)
+
+// Persistence is the persistent partition added after the image, there is none when Filesystem is empty
+type Persistence struct {
+	// Filesystem is PersistenceExt4
+	Filesystem string `json:"filesystem,omitempty"`
+	// Size is in bytes, 0 takes the rest of the drive
+	Size int64 `json:"size,omitempty"`
+}
+
+// Enabled tells if a persistent partition is added
+func (p Persistence) Enabled() bool {
+	return p.Filesystem != ""
+}
+
+// reserved is the space the partition needs after the image, the minimum when it takes the rest of the drive
+func (p Persistence) reserved() int64 {
+	if !p.Enabled() {
+		return 0
+	}
+	return (max(p.Size, persistenceMinSize) + partitionAlign - 1) / partitionAlign * partitionAlign
+}
+
+// Validate checks the filesystem and the size
+func (p Persistence) Validate() error {
+	if p.Filesystem != "" && p.Filesystem != PersistenceExt4 {
+		return fmt.Errorf("unsupported persistent partition filesystem %q, use %s which can be labeled %s", p.Filesystem, PersistenceExt4, persistenceLabel)
+	}
+	if p.Size < 0 || p.Size > 0 && p.Size < persistenceMinSize {
+		return fmt.Errorf("the persistent partition must be at least %d MB", persistenceMinSize/(1024*1024))
+	}
+	return nil
+}
+
+// AddPersistentPartition adds a partition labeled COS_PERSISTENT in the free space after the image burned
+// to devicePath and creates its ext4 filesystem, so the live system keeps its changes across reboots
+func AddPersistentPartition(devicePath string, imageSize int64, p Persistence) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	// Raw disk, the buffered one reads stale sectors right after the burn
+	devicePath = rawDevicePath(devicePath)
+	device, err := os.OpenFile(devicePath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open device %s: %w", devicePath, err)
+	}
+	defer device.Close()
+
+	diskSize, err := targetSize(device)
+	if err != nil {
+		return fmt.Errorf("failed to get the size of %s: %w", devicePath, err)
+	}
+	spec := PartitionSpec{Size: p.Size, MBRType: mbrTypeLinux, GPTType: gptTypeLinuxData, Name: persistenceLabel}
+	start, size, err := AppendPartition(device, diskSize, imageSize, spec)
+	if err != nil {
+		return fmt.Errorf("failed to add the persistent partition: %w", err)
+	}
+	if size < persistenceMinSize {
+		return fmt.Errorf("only %d MB left after the image, the persistent partition needs %d MB", size/(1024*1024), persistenceMinSize/(1024*1024))
+	}
+
+	if err := formatExt4(device, start, size, persistenceLabel); err != nil {
+		return fmt.Errorf("failed to format the persistent partition: %w", err)
+	}
+	if err := device.Sync(); err != nil {
+		return err
+	}
+	// Best effort, the new partition shows up on the next plug in anyway
+	_ = rereadPartitions(device)
+	return nil
+}
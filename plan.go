@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// BurnPlan is what RunBurn would do with a set of options, worked out without writing anything, to
+// review a burn before it erases a drive
+type BurnPlan struct {
+	Device string `json:"device"`
+	// Target is TargetDrive, TargetLoop or TargetFile
+	Target string `json:"target"`
+	Model  string `json:"model,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	// DeviceSize is the capacity of the target, for files the size they are made, 0 when unknown
+	DeviceSize int64 `json:"device_size"`
+	// Unmount are the mounted partitions of the target
+	Unmount []string `json:"unmount,omitempty"`
+	ISO     string   `json:"iso"`
+	// ImageSize is the size of the ISO, 0 when it is yet to be downloaded
+	ImageSize int64 `json:"image_size,omitempty"`
+	// Mode is "image" or "fat32"
+	Mode string `json:"mode"`
+	// Required is the capacity the burn needs, 0 when it depends on the files of the ISO
+	Required   int64              `json:"required,omitempty"`
+	Partitions []PlannedPartition `json:"partitions,omitempty"`
+	Steps      []string           `json:"steps"`
+	// Warnings don't stop the burn, Problems do
+	Warnings []string `json:"warnings,omitempty"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// PlannedPartition is a partition on the target after the burn
+type PlannedPartition struct {
+	Name       string `json:"name"`
+	Filesystem string `json:"filesystem,omitempty"`
+	// Start and Size are in bytes, 0 when they depend on what is written before
+	Start int64 `json:"start,omitempty"`
+	Size  int64 `json:"size,omitempty"`
+}
+
+// OK tells if the burn would go ahead
+func (p *BurnPlan) OK() bool {
+	return len(p.Problems) == 0
+}
+
+func (p *BurnPlan) String() string {
+	var b strings.Builder
+	target := p.Device
+	if p.Model != "" {
+		target += " " + p.Model
+	}
+	if p.Serial != "" {
+		target += ", serial " + p.Serial
+	}
+	fmt.Fprintf(&b, "Target:     %s (%s", target, p.Target)
+	if p.DeviceSize > 0 {
+		fmt.Fprintf(&b, ", %s", planSize(p.DeviceSize))
+	}
+	b.WriteString(")\n")
+	fmt.Fprintf(&b, "Image:      %s", filepath.Base(p.ISO))
+	if p.ImageSize > 0 {
+		fmt.Fprintf(&b, " (%s)", planSize(p.ImageSize))
+	}
+	if p.Mode == "fat32" {
+		b.WriteString(", files copied to FAT32")
+	}
+	b.WriteString("\n")
+	if p.Required > 0 {
+		fmt.Fprintf(&b, "Needs:      %s", planSize(p.Required))
+		if p.DeviceSize >= p.Required {
+			fmt.Fprintf(&b, ", %s to spare", planSize(p.DeviceSize-p.Required))
+		}
+		b.WriteString("\n")
+	}
+	if len(p.Partitions) > 0 {
+		b.WriteString("Partitions:\n")
+		for _, part := range p.Partitions {
+			var where []string
+			if part.Start > 0 {
+				where = append(where, "at "+planSize(part.Start))
+			}
+			if part.Size > 0 {
+				where = append(where, planSize(part.Size))
+			}
+			fmt.Fprintf(&b, "  %-16s %-6s %s\n", part.Name, part.Filesystem, strings.Join(where, ", "))
+		}
+	}
+	b.WriteString("Steps:\n")
+	for i, step := range p.Steps {
+		fmt.Fprintf(&b, "  %d. %s\n", i+1, step)
+	}
+	for _, w := range p.Warnings {
+		fmt.Fprintf(&b, "⚠ %s\n", w)
+	}
+	for _, problem := range p.Problems {
+		fmt.Fprintf(&b, "❌ %s\n", problem)
+	}
+	if p.OK() {
+		b.WriteString("Dry run, nothing was written")
+	} else {
+		b.WriteString("Dry run, the burn would not go ahead")
+	}
+	return b.String()
+}
+
+// planSize formats a size in GB, or MB below a GB
+func planSize(n int64) string {
+	if n >= 1024*1024*1024 {
+		return fmt.Sprintf("%.2f GB", float64(n)/(1024*1024*1024))
+	}
+	return fmt.Sprintf("%d MB", n/(1024*1024))
+}
+
+// PlanBurn works out what RunBurn would do with opts without writing anything: the target and its size,
+// the partitions to unmount, whether the image fits and each step of the burn. verify is the
+// verification policy applied to the image before burning, empty to leave it out. The error is for
+// options RunBurn would reject outright, what would fail later is listed in the problems of the plan
+func PlanBurn(opts BurnOptions, verify string) (*BurnPlan, error) {
+	if opts.ISO == "" || opts.Device == "" {
+		return nil, errors.New("no ISO or drive selected")
+	}
+	if err := opts.Persistence.Validate(); err != nil {
+		return nil, err
+	}
+	kind, err := targetKind(opts.Device)
+	if err != nil {
+		return nil, err
+	}
+	plan := &BurnPlan{Device: opts.Device, Target: kind, ISO: opts.ISO, Mode: "image"}
+	if opts.Mode == BurnFAT32 {
+		plan.Mode = "fat32"
+	}
+	iso := filepath.Base(opts.ISO)
+	withConfigPartition := opts.CloudConfig != "" && !opts.EmbedCloudConfig
+
+	if info, err := os.Stat(opts.ISO); err == nil {
+		plan.ImageSize = info.Size()
+		if verify != "" {
+			plan.planVerification(verify)
+		}
+		if opts.Mode == BurnImage {
+			if isoInfo, err := InspectISO(opts.ISO); err == nil && !isoInfo.Hybrid() {
+				plan.Warnings = append(plan.Warnings, iso+" has no MBR or GPT partition table, written as it is the stick won't boot")
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		plan.Problems = append(plan.Problems, err.Error())
+	}
+	if opts.CloudConfig != "" {
+		if data, err := os.ReadFile(opts.CloudConfig); err != nil {
+			plan.Problems = append(plan.Problems, err.Error())
+		} else if CloudConfigErrors(ValidateCloudConfig(data)) > 0 {
+			plan.Problems = append(plan.Problems, opts.CloudConfig+" has errors, Kairos would ignore it")
+		}
+	}
+	if opts.Mode == BurnImage && plan.ImageSize > 0 {
+		plan.Required = RequiredDriveSize(plan.ImageSize, withConfigPartition, opts.Persistence)
+	}
+
+	// The target as it is now
+	if kind == TargetDrive {
+		if drives, err := ListUSBDrives(); err == nil {
+			for _, d := range drives {
+				if d.Path == opts.Device {
+					plan.Model, plan.Serial = d.Model, d.Serial
+				}
+			}
+		}
+	}
+	if kind != TargetFile {
+		if mounted, err := IsDeviceMounted(opts.Device); err == nil && len(mounted) > 0 {
+			plan.Unmount = mounted
+			plan.Steps = append(plan.Steps, "Unmount "+strings.Join(mounted, ", "))
+		}
+	}
+	switch info, err := os.Stat(opts.Device); {
+	case kind == TargetFile && opts.TargetSize > 0:
+		plan.DeviceSize = opts.TargetSize
+		plan.Steps = append(plan.Steps, fmt.Sprintf("Make %s a file of %s", opts.Device, planSize(opts.TargetSize)))
+	case kind == TargetFile && err == nil && info.Size() > 0:
+		plan.DeviceSize = info.Size()
+	case kind == TargetFile:
+		plan.DeviceSize = plan.Required
+		if plan.Required > 0 {
+			plan.Steps = append(plan.Steps, fmt.Sprintf("Create %s, %s", opts.Device, planSize(plan.Required)))
+		} else {
+			plan.Problems = append(plan.Problems, opts.Device+" doesn't exist, give the size to make it")
+		}
+	default:
+		device, err := os.Open(rawDevicePath(opts.Device))
+		if err == nil {
+			plan.DeviceSize, err = targetSize(device)
+			device.Close()
+		}
+		if err != nil {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("can't read the size of %s: %v", opts.Device, err))
+		}
+	}
+	if plan.Required > 0 && plan.DeviceSize > 0 && plan.DeviceSize < plan.Required {
+		plan.Problems = append(plan.Problems, driveTooSmallError(opts.Device, plan.Required, plan.DeviceSize).Error())
+	}
+
+	// The burn itself, in the order RunBurn goes
+	if opts.CloudConfig != "" && opts.EmbedCloudConfig {
+		if opts.Mode == BurnFAT32 {
+			plan.Steps = append(plan.Steps, fmt.Sprintf("Add %s to the files of %s as /%s", filepath.Base(opts.CloudConfig), iso, remasterConfigName))
+		} else {
+			plan.Steps = append(plan.Steps, fmt.Sprintf("Remaster %s in the cache directory with %s embedded as /%s", iso, filepath.Base(opts.CloudConfig), remasterConfigName))
+		}
+	}
+	switch {
+	case kind != TargetDrive || runtime.GOOS == "linux":
+		plan.Steps = append(plan.Steps, "Wipe the partition tables at the start and the end of "+opts.Device)
+	case runtime.GOOS == "darwin":
+		plan.Steps = append(plan.Steps, "Erase "+opts.Device+" with diskutil, leaving an empty GPT")
+	default:
+		plan.Steps = append(plan.Steps, "Clean "+opts.Device+" with diskpart and convert it to GPT")
+	}
+	var end int64
+	if opts.Mode == BurnFAT32 {
+		plan.Steps = append(plan.Steps, fmt.Sprintf("Partition %s with a FAT32 partition sized to the files of %s and copy them to it", opts.Device, iso))
+		plan.Partitions = append(plan.Partitions, PlannedPartition{Name: "ISO label", Filesystem: "FAT32", Start: partitionAlign})
+	} else {
+		size := "its size"
+		if plan.ImageSize > 0 {
+			size = planSize(plan.ImageSize)
+			end = (plan.ImageSize + partitionAlign - 1) / partitionAlign * partitionAlign
+		}
+		plan.Steps = append(plan.Steps, fmt.Sprintf("Write %s to %s, %s", iso, opts.Device, size))
+		plan.Partitions = append(plan.Partitions, PlannedPartition{Name: "image", Filesystem: "ISO", Size: plan.ImageSize})
+	}
+	if withConfigPartition {
+		plan.Steps = append(plan.Steps, fmt.Sprintf("Add a %s FAT32 partition labeled %s with %s as user-data", planSize(cloudConfigPartitionSize), cloudConfigLabel, filepath.Base(opts.CloudConfig)))
+		plan.Partitions = append(plan.Partitions, PlannedPartition{Name: cloudConfigLabel, Filesystem: "FAT32", Start: end, Size: cloudConfigPartitionSize})
+		if end > 0 {
+			end += cloudConfigPartitionSize
+		}
+	}
+	if p := opts.Persistence; p.Enabled() {
+		part := PlannedPartition{Name: persistenceLabel, Filesystem: p.Filesystem, Start: end, Size: p.Size}
+		size := planSize(p.Size)
+		if p.Size == 0 {
+			size = "the rest of the drive"
+			if end > 0 && plan.DeviceSize > 0 {
+				// What AppendPartition leaves before the backup GPT
+				part.Size = max(0, (plan.DeviceSize-34*sectorSize)/partitionAlign*partitionAlign-end)
+				size += ", " + planSize(part.Size)
+			}
+		}
+		plan.Steps = append(plan.Steps, fmt.Sprintf("Add the persistent partition labeled %s, %s on %s", persistenceLabel, p.Filesystem, size))
+		plan.Partitions = append(plan.Partitions, part)
+	}
+	return plan, nil
+}
+
+// planVerification adds how the image would be verified under policy, without hashing it
+func (p *BurnPlan) planVerification(policy string) {
+	if err := CheckBurnSignature(p.ISO); err != nil {
+		p.Problems = append(p.Problems, err.Error())
+		return
+	}
+	if policy == VerifyNone {
+		p.Steps = append(p.Steps, "Skip the checksum of "+filepath.Base(p.ISO))
+		return
+	}
+	if policy == VerifySignature {
+		if err := checkVerifiedSignature(p.ISO); err != nil {
+			p.Problems = append(p.Problems, err.Error())
+			return
+		}
+	}
+	if record, ok := CachedVerification(p.ISO); ok && record.Matches() {
+		p.Steps = append(p.Steps, "Use the checksum of "+filepath.Base(p.ISO)+" verified before, it is unchanged")
+		return
+	}
+	expected, ok := DiscoverChecksum(p.ISO)
+	if !ok {
+		p.Problems = append(p.Problems, fmt.Sprintf("no checksum found for %s, put a .sha256 file next to it or use verify %q", p.ISO, VerifyNone))
+		return
+	}
+	p.Steps = append(p.Steps, fmt.Sprintf("Hash %s and compare it to the checksum from %s", filepath.Base(p.ISO), expected.Origin))
+}
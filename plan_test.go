@@ -0,0 +1,227 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanBurn(t *testing.T) {
+	const mib = 1024 * 1024
+	// The library and the verification cache of the user are left alone
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	dir := t.TempDir()
+	write := func(name string, size int64, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 {
+			if err := os.Truncate(path, size); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return path
+	}
+	// Not an ISO9660 image, so there is no warning about a missing partition table
+	iso := write("kairos.iso", 10*mib+100, "")
+	sums := write("checked.iso", 10*mib, "")
+	write("checked.iso.sha256", 0, "3a7bd3e2360a3d29eea436fcfb7e44c735d117c42d1c1835420b6b9942dd4f1b  checked.iso\n")
+	config := write("cloud-config.yaml", 0, "#cloud-config\nhostname: edge\n")
+	badConfig := write("bad.yaml", 0, "hostname: edge\n")
+	stick := write("stick.img", 256*mib, "")
+	small := write("small.img", 4*mib, "")
+	missing := filepath.Join(dir, "new.img")
+	imageEnd := int64(11 * mib)
+
+	tests := []struct {
+		name           string
+		opts           BurnOptions
+		verify         string
+		wantDeviceSize int64
+		wantRequired   int64
+		wantSteps      []string
+		wantPartitions []PlannedPartition
+		wantProblems   []string
+		wantErr        bool
+	}{
+		{
+			name:           "new file target",
+			opts:           BurnOptions{ISO: iso, Device: missing},
+			wantDeviceSize: 10*mib + 100,
+			wantRequired:   10*mib + 100,
+			wantSteps:      []string{"Create " + missing + ", 10 MB", "Wipe the partition tables at the start and the end of " + missing, "Write kairos.iso to " + missing + ", 10 MB"},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO", Size: 10*mib + 100}},
+		},
+		{
+			name:           "file target of a size",
+			opts:           BurnOptions{ISO: iso, Device: missing, TargetSize: 8 * 1024 * mib},
+			wantDeviceSize: 8 * 1024 * mib,
+			wantRequired:   10*mib + 100,
+			wantSteps:      []string{"Make " + missing + " a file of 8.00 GB", "Wipe the partition tables at the start and the end of " + missing, "Write kairos.iso to " + missing + ", 10 MB"},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO", Size: 10*mib + 100}},
+		},
+		{
+			name:           "image too large",
+			opts:           BurnOptions{ISO: iso, Device: small},
+			wantDeviceSize: 4 * mib,
+			wantRequired:   10*mib + 100,
+			wantSteps:      []string{"Wipe the partition tables at the start and the end of " + small, "Write kairos.iso to " + small + ", 10 MB"},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO", Size: 10*mib + 100}},
+			wantProblems:   []string{driveTooSmallError(small, 10*mib+100, 4*mib).Error()},
+		},
+		{
+			name:           "cloud config partition",
+			opts:           BurnOptions{ISO: iso, Device: stick, CloudConfig: config},
+			wantDeviceSize: 256 * mib,
+			wantRequired:   imageEnd + cloudConfigPartitionSize + 34*sectorSize,
+			wantSteps: []string{
+				"Wipe the partition tables at the start and the end of " + stick,
+				"Write kairos.iso to " + stick + ", 10 MB",
+				"Add a 64 MB FAT32 partition labeled cidata with cloud-config.yaml as user-data",
+			},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO", Size: 10*mib + 100}, {Name: "cidata", Filesystem: "FAT32", Start: imageEnd, Size: cloudConfigPartitionSize}},
+		},
+		{
+			name:           "embedded cloud config",
+			opts:           BurnOptions{ISO: iso, Device: stick, CloudConfig: config, EmbedCloudConfig: true},
+			wantDeviceSize: 256 * mib,
+			wantRequired:   10*mib + 100,
+			wantSteps: []string{
+				"Remaster kairos.iso in the cache directory with cloud-config.yaml embedded as /config.yaml",
+				"Wipe the partition tables at the start and the end of " + stick,
+				"Write kairos.iso to " + stick + ", 10 MB",
+			},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO", Size: 10*mib + 100}},
+		},
+		{
+			name:           "persistence on the rest of the drive",
+			opts:           BurnOptions{ISO: iso, Device: stick, Persistence: Persistence{Filesystem: PersistenceExt4}},
+			wantDeviceSize: 256 * mib,
+			wantRequired:   imageEnd + persistenceMinSize + 34*sectorSize,
+			wantSteps: []string{
+				"Wipe the partition tables at the start and the end of " + stick,
+				"Write kairos.iso to " + stick + ", 10 MB",
+				"Add the persistent partition labeled COS_PERSISTENT, ext4 on the rest of the drive, 244 MB",
+			},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO", Size: 10*mib + 100}, {Name: "COS_PERSISTENT", Filesystem: "ext4", Start: imageEnd, Size: 244 * mib}},
+		},
+		{
+			// The files take what they need, nothing is known of where the persistent partition goes
+			name:           "persistence in FAT32 mode",
+			opts:           BurnOptions{ISO: iso, Device: stick, Mode: BurnFAT32, CloudConfig: config, EmbedCloudConfig: true, Persistence: Persistence{Filesystem: PersistenceExt4, Size: 128 * mib}},
+			wantDeviceSize: 256 * mib,
+			wantSteps: []string{
+				"Add cloud-config.yaml to the files of kairos.iso as /config.yaml",
+				"Wipe the partition tables at the start and the end of " + stick,
+				"Partition " + stick + " with a FAT32 partition sized to the files of kairos.iso and copy them to it",
+				"Add the persistent partition labeled COS_PERSISTENT, ext4 on 128 MB",
+			},
+			wantPartitions: []PlannedPartition{{Name: "ISO label", Filesystem: "FAT32", Start: partitionAlign}, {Name: "COS_PERSISTENT", Filesystem: "ext4", Size: 128 * mib}},
+		},
+		{
+			name:           "checksum next to the image",
+			opts:           BurnOptions{ISO: sums, Device: stick},
+			verify:         VerifyChecksum,
+			wantDeviceSize: 256 * mib,
+			wantRequired:   10 * mib,
+			wantSteps: []string{
+				"Hash checked.iso and compare it to the checksum from " + sums + ".sha256",
+				"Wipe the partition tables at the start and the end of " + stick,
+				"Write checked.iso to " + stick + ", 10 MB",
+			},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO", Size: 10 * mib}},
+		},
+		{
+			name:           "checksum skipped",
+			opts:           BurnOptions{ISO: iso, Device: stick},
+			verify:         VerifyNone,
+			wantDeviceSize: 256 * mib,
+			wantRequired:   10*mib + 100,
+			wantSteps:      []string{"Skip the checksum of kairos.iso", "Wipe the partition tables at the start and the end of " + stick, "Write kairos.iso to " + stick + ", 10 MB"},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO", Size: 10*mib + 100}},
+		},
+		{
+			name:           "problems",
+			opts:           BurnOptions{ISO: iso, Device: missing, CloudConfig: badConfig, EmbedCloudConfig: true},
+			verify:         VerifyChecksum,
+			wantDeviceSize: 10*mib + 100,
+			wantRequired:   10*mib + 100,
+			wantSteps: []string{
+				"Create " + missing + ", 10 MB",
+				"Remaster kairos.iso in the cache directory with bad.yaml embedded as /config.yaml",
+				"Wipe the partition tables at the start and the end of " + missing,
+				"Write kairos.iso to " + missing + ", 10 MB",
+			},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO", Size: 10*mib + 100}},
+			wantProblems: []string{
+				`no checksum found for ` + iso + `, put a .sha256 file next to it or use verify "none"`,
+				badConfig + " has errors, Kairos would ignore it",
+			},
+		},
+		{
+			// A missing image is downloaded by the burn, its size is unknown until then
+			name:           "missing image and target size",
+			opts:           BurnOptions{ISO: filepath.Join(dir, "later.iso"), Device: missing},
+			verify:         VerifyChecksum,
+			wantSteps:      []string{"Wipe the partition tables at the start and the end of " + missing, "Write later.iso to " + missing + ", its size"},
+			wantPartitions: []PlannedPartition{{Name: "image", Filesystem: "ISO"}},
+			wantProblems:   []string{missing + " doesn't exist, give the size to make it"},
+		},
+		{name: "no image", opts: BurnOptions{Device: stick}, wantErr: true},
+		{name: "no target", opts: BurnOptions{ISO: iso}, wantErr: true},
+		{name: "fat32 persistence", opts: BurnOptions{ISO: iso, Device: stick, Persistence: Persistence{Filesystem: "fat32"}}, wantErr: true},
+		{name: "persistence too small", opts: BurnOptions{ISO: iso, Device: stick, Persistence: Persistence{Filesystem: PersistenceExt4, Size: mib}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := PlanBurn(tt.opts, tt.verify)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("PlanBurn() = %v, want an error", plan)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plan.Target != TargetFile {
+				t.Errorf("target %q, want a file", plan.Target)
+			}
+			if plan.DeviceSize != tt.wantDeviceSize || plan.Required != tt.wantRequired {
+				t.Errorf("target of %d bytes needing %d, want %d needing %d", plan.DeviceSize, plan.Required, tt.wantDeviceSize, tt.wantRequired)
+			}
+			if strings.Join(plan.Steps, "\n") != strings.Join(tt.wantSteps, "\n") {
+				t.Errorf("steps\n%s\nwant\n%s", strings.Join(plan.Steps, "\n"), strings.Join(tt.wantSteps, "\n"))
+			}
+			if len(plan.Partitions) != len(tt.wantPartitions) {
+				t.Errorf("partitions %+v, want %+v", plan.Partitions, tt.wantPartitions)
+			} else {
+				for i, p := range plan.Partitions {
+					if p != tt.wantPartitions[i] {
+						t.Errorf("partition %d is %+v, want %+v", i, p, tt.wantPartitions[i])
+					}
+				}
+			}
+			if strings.Join(plan.Problems, "\n") != strings.Join(tt.wantProblems, "\n") {
+				t.Errorf("problems %q, want %q", plan.Problems, tt.wantProblems)
+			}
+			if len(plan.Warnings) > 0 {
+				t.Errorf("warnings %q", plan.Warnings)
+			}
+			// The problems stop the burn
+			if plan.OK() != (len(tt.wantProblems) == 0) {
+				t.Errorf("OK() = %v with problems %q", plan.OK(), plan.Problems)
+			}
+			wantEnd := "Dry run, nothing was written"
+			if !plan.OK() {
+				wantEnd = "Dry run, the burn would not go ahead"
+			}
+			if s := plan.String(); !strings.HasSuffix(s, wantEnd) {
+				t.Errorf("String() = %q, want it to end with %q", s, wantEnd)
+			}
+		})
+	}
+}
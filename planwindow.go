@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// showPlanWindow shows what burning with opts would do, see PlanBurn, without writing anything. The
+// plan can be switched to JSON to copy it
+func showPlanWindow(parent *gtk.Window, opts BurnOptions, verify string) {
+	planWin := gtk.NewWindow()
+	planWin.SetTitle("Dry run")
+	planWin.SetTransientFor(parent)
+	planWin.SetModal(true)
+	planWin.SetDefaultSize(700, 500)
+
+	vbox := gtk.NewBox(gtk.OrientationVertical, 10)
+	vbox.SetMarginTop(20)
+	vbox.SetMarginBottom(20)
+	vbox.SetMarginStart(20)
+	vbox.SetMarginEnd(20)
+
+	textView := gtk.NewTextView()
+	textView.SetMonospace(true)
+	textView.SetEditable(false)
+	textView.SetWrapMode(gtk.WrapWordChar)
+	textView.Buffer().SetText("Planning...")
+	scrolled := gtk.NewScrolledWindow()
+	scrolled.SetChild(textView)
+	scrolled.SetVExpand(true)
+	vbox.Append(scrolled)
+
+	jsonCheck := gtk.NewCheckButtonWithLabel("JSON")
+	jsonCheck.SetSensitive(false)
+	jsonCheck.SetHExpand(true)
+	closeBtn := gtk.NewButtonWithLabel("Close")
+	closeBtn.ConnectClicked(planWin.Close)
+	buttonBox := gtk.NewBox(gtk.OrientationHorizontal, 10)
+	buttonBox.Append(jsonCheck)
+	buttonBox.Append(closeBtn)
+	vbox.Append(buttonBox)
+	planWin.SetChild(vbox)
+	planWin.Present()
+
+	// Listing drives and reading the image take a moment
+	go func() {
+		plan, err := PlanBurn(opts, verify)
+		glib.IdleAdd(func() {
+			if err != nil {
+				textView.Buffer().SetText(fmt.Sprintf("❌ %v", err))
+				return
+			}
+			textView.Buffer().SetText(plan.String())
+			jsonCheck.SetSensitive(true)
+			jsonCheck.ConnectToggled(func() {
+				if !jsonCheck.Active() {
+					textView.Buffer().SetText(plan.String())
+					return
+				}
+				data, _ := json.MarshalIndent(plan, "", "  ")
+				textView.Buffer().SetText(string(data))
+			})
+		})
+	}()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The verification policies of a burn profile
+const (
+	// VerifyChecksum requires the image to match a checksum found next to it or published with it
+	VerifyChecksum = "checksum"
+	// VerifySignature also requires a signature verified when the image was downloaded
+	VerifySignature = "signature"
+	// VerifyNone burns without checking the checksum, signatures that failed still block the burn
+	VerifyNone = "none"
+)
+
+// BurnProfile is a named combination of image, verification, cloud-config and partitions kept in the
+// profiles of the config file, for configurations that are flashed again and again
+type BurnProfile struct {
+	Name string `json:"name"`
+	// Image is the path of a local ISO, Release picks one from the releases instead
+	Image   string        `json:"image,omitempty"`
+	Release *ReleaseQuery `json:"release,omitempty"`
+	// Verify is VerifyChecksum, the default, VerifySignature or VerifyNone
+	Verify           string `json:"verify,omitempty"`
+	CloudConfig      string `json:"cloud_config,omitempty"`
+	EmbedCloudConfig bool   `json:"embed_cloud_config,omitempty"`
+	// FAT32 copies the files of the ISO to a FAT32 partition instead of writing the image, see BurnFAT32
+	FAT32       bool        `json:"fat32,omitempty"`
+	Persistence Persistence `json:"persistence"`
+}
+
+// ReleaseQuery picks an ISO from the releases, like the download command
+type ReleaseQuery struct {
+	// Version is the release, the latest when empty
+	Version string `json:"version,omitempty"`
+	// Asset is the name of the ISO or a regex matching a single one
+	Asset string `json:"asset"`
+}
+
+func (q ReleaseQuery) String() string {
+	version := q.Version
+	if version == "" {
+		version = "latest"
+	}
+	return fmt.Sprintf("%s of %s", q.Asset, version)
+}
+
+// Validate checks that the profile names a single image source and known policies
+func (p BurnProfile) Validate() error {
+	if p.Name == "" {
+		return errors.New("profile without a name")
+	}
+	if (p.Image == "") == (p.Release == nil) {
+		return fmt.Errorf("profile %s: set either image or release", p.Name)
+	}
+	if p.Release != nil && p.Release.Asset == "" {
+		return fmt.Errorf("profile %s: the release has no asset", p.Name)
+	}
+	switch p.Verify {
+	case "", VerifyChecksum, VerifySignature, VerifyNone:
+	default:
+		return fmt.Errorf("profile %s: unknown verify policy %q, use %s, %s or %s", p.Name, p.Verify, VerifyChecksum, VerifySignature, VerifyNone)
+	}
+	if err := p.Persistence.Validate(); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	return nil
+}
+
+// VerifyPolicy is the verification policy of the profile with the default filled in
+func (p BurnProfile) VerifyPolicy() string {
+	if p.Verify == "" {
+		return VerifyChecksum
+	}
+	return p.Verify
+}
+
+// Mode is how the profile writes the image
+func (p BurnProfile) Mode() BurnMode {
+	if p.FAT32 {
+		return BurnFAT32
+	}
+	return BurnImage
+}
+
+// Summary describes the profile in a line, for lists
+func (p BurnProfile) Summary() string {
+	parts := []string{p.Image}
+	if p.Release != nil {
+		parts[0] = p.Release.String()
+	}
+	if p.CloudConfig != "" {
+		parts = append(parts, "cloud-config "+filepath.Base(p.CloudConfig))
+	}
+	if p.FAT32 {
+		parts = append(parts, "FAT32 copy")
+	}
+	if p.Persistence.Enabled() {
+		size := "rest of the drive"
+		if p.Persistence.Size > 0 {
+			size = fmt.Sprintf("%.1f GB", float64(p.Persistence.Size)/(1024*1024*1024))
+		}
+		parts = append(parts, fmt.Sprintf("%s persistence on the %s", p.Persistence.Filesystem, size))
+	}
+	return strings.Join(append(parts, "verify "+p.VerifyPolicy()), ", ")
+}
+
+// BurnProfiles returns the valid profiles of the config, invalid ones are reported and left out
+func BurnProfiles() []BurnProfile {
+	var profiles []BurnProfile
+	for _, p := range appConfig.Profiles {
+		if err := p.Validate(); err != nil {
+			logln("Ignoring invalid burn profile:", err)
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles
+}
+
+// FindBurnProfile returns the profile called name
+func FindBurnProfile(name string) (BurnProfile, error) {
+	for _, p := range BurnProfiles() {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return BurnProfile{}, fmt.Errorf("no burn profile called %q in the config", name)
+}
+
+// locateImage returns the local ISO of the profile, or for release images missing from the library
+// an empty path with the asset to download and the assets of the release list
+func (p BurnProfile) locateImage(ctx context.Context) (string, ReleaseAsset, []ReleaseAsset, error) {
+	if p.Release == nil {
+		if _, err := os.Stat(p.Image); err != nil {
+			return "", ReleaseAsset{}, nil, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		return p.Image, ReleaseAsset{}, nil, nil
+	}
+	assets, err := GetCachedReleaseAssets(ctx, "kairos-io", "kairos", nil)
+	if err != nil {
+		return "", ReleaseAsset{}, nil, fmt.Errorf("loading releases: %s", describeHTTPError(err))
+	}
+	version := p.Release.Version
+	if version == "" {
+		version = latestVersion(assets)
+	}
+	matched, err := matchAssets(assets, version, []string{p.Release.Asset})
+	if err != nil {
+		return "", ReleaseAsset{}, nil, fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	if len(matched) > 1 {
+		return "", ReleaseAsset{}, nil, fmt.Errorf("profile %s: %q matches %d ISOs of %s, make it match one", p.Name, p.Release.Asset, len(matched), version)
+	}
+	asset := matched[0]
+
+	if lib, err := OpenLibrary(); err == nil {
+		for _, e := range lib.Entries {
+			if e.Name == asset.Name {
+				if _, err := os.Stat(e.Path); err == nil {
+					return e.Path, asset, assets, nil
+				}
+			}
+		}
+	}
+	return "", asset, assets, nil
+}
+
+// ResolveImage returns the ISO the profile burns. Release images are taken from the library, or
+// downloaded into it when missing, reporting progress
+func (p BurnProfile) ResolveImage(ctx context.Context, progress func(done, total int64)) (string, error) {
+	path, asset, assets, err := p.locateImage(ctx)
+	if err != nil || path != "" {
+		return path, err
+	}
+	dir, err := libraryDir()
+	if err != nil {
+		return "", err
+	}
+	if err := mkdirUserDir(dir); err != nil {
+		return "", err
+	}
+	item, err := downloadManager.Add(asset, assets, filepath.Join(dir, asset.Name))
+	if err != nil {
+		return "", err
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// The partial file is kept, resolving again resumes it
+			downloadManager.Pause(item)
+			downloadManager.Wait(item)
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+		st := item.Status()
+		if progress != nil && st.Total > 0 {
+			progress(st.Done, st.Total)
+		}
+		switch {
+		case st.State == DownloadDone:
+			return item.Dest, nil
+		case st.Err != nil:
+			return "", fmt.Errorf("downloading %s: %s", asset.Name, describeHTTPError(st.Err))
+		case st.State.finished():
+			return "", fmt.Errorf("downloading %s: %s", asset.Name, st.State)
+		}
+	}
+}
+
+// CheckImageVerification applies a verification policy to the image at path without asking anything:
+// the checksum must be known and match, hashing the image if it changed since it was last checked
+func CheckImageVerification(path, policy string, progress func(done, total int64)) error {
+	if err := CheckBurnSignature(path); err != nil {
+		return err
+	}
+	events := appEvents.job("verify", path)
+	if policy == VerifyNone {
+		events.Verification("checksum", "skipped", "verify "+VerifyNone)
+		return nil
+	}
+	if policy == VerifySignature {
+		if err := checkVerifiedSignature(path); err != nil {
+			return err
+		}
+		events.Verification("signature", SignatureVerified, "")
+	}
+	if record, ok := CachedVerification(path); ok && record.Matches() {
+		events.Verification("checksum", "verified", record.Origin)
+		return nil
+	}
+	expected, ok := DiscoverChecksum(path)
+	if !ok {
+		return fmt.Errorf("no checksum found for %s, put a .sha256 file next to it or use verify %q", path, VerifyNone)
+	}
+	_, err := VerifyImage(path, expected, progress)
+	return err
+}
+
+// checkVerifiedSignature returns an error unless the signature of the image at path was verified when
+// it was downloaded
+func checkVerifiedSignature(path string) error {
+	if entry, ok := findLibraryEntry(path); !ok || entry.Signature != SignatureVerified {
+		return signatureError{fmt.Errorf("%s has no verified signature", path)}
+	}
+	return nil
+}
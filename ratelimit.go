@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every download, so the limit applies to the total bandwidth
+// used by the tool. The rate can be changed at any time and applies to transfers in progress
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second, 0 is unlimited
+	tokens float64
+	last   time.Time
+}
+
+// downloadLimiter throttles asset downloads, see Config.DownloadRateLimit
+var downloadLimiter = &rateLimiter{}
+
+// SetRate changes the limit in bytes per second, 0 removes it
+func (l *rateLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = max(bytesPerSecond, 0)
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Rate returns the limit in bytes per second, 0 means unlimited
+func (l *rateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// burst is the most a single read may take at once, a quarter of a second worth of data
+func (l *rateLimiter) burst() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	return int(max(l.rate/4, 1024))
+}
+
+// wait blocks until n bytes may be transferred. Reads larger than the bucket, read before the rate was
+// lowered, go through once it is full and leave it in debt
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		if l.rate == 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		now := time.Now()
+		capacity := float64(max(l.rate/4, 1024))
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), capacity)
+		l.last = now
+		need := min(float64(n), capacity)
+		if l.tokens >= need {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+		// Sleep in short steps so a new rate is picked up quickly
+		sleep := min(time.Duration((need-l.tokens)/float64(l.rate)*float64(time.Second)), 100*time.Millisecond)
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+	}
+}
+
+// rateLimitedReader reads from r no faster than its limiter allows
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func newRateLimitedReader(ctx context.Context, r io.Reader) io.Reader {
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: downloadLimiter}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if burst := r.limiter.burst(); burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// parseByteRate reads a rate like "500K", "2.5M" or "1G" (per second, the "B" and "/s" are optional)
+// into bytes per second. "0" and "" mean unlimited
+func parseByteRate(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S"), "B")
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		multiplier = 1024
+	case 'M':
+		multiplier = 1024 * 1024
+	case 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q, use a number with an optional K, M or G suffix", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// formatByteRate is the reverse of parseByteRate, for display
+func formatByteRate(bytesPerSecond int64) string {
+	switch {
+	case bytesPerSecond <= 0:
+		return "unlimited"
+	case bytesPerSecond >= 1024*1024:
+		return fmt.Sprintf("%.1f MB/s", float64(bytesPerSecond)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.0f KB/s", float64(bytesPerSecond)/1024)
+	}
+}
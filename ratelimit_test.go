@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "1024", want: 1024},
+		{in: "500K", want: 500 * 1024},
+		{in: "500k", want: 500 * 1024},
+		{in: "2.5M", want: 5 * 512 * 1024},
+		{in: "1G", want: 1024 * 1024 * 1024},
+		{in: "10MB", want: 10 * 1024 * 1024},
+		{in: " 10MB/s ", want: 10 * 1024 * 1024},
+		{in: "300KB/s", want: 300 * 1024},
+		{in: "fast", wantErr: true},
+		{in: "-1M", wantErr: true},
+		{in: "M", wantErr: true},
+		{in: "10T", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteRate(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseByteRate(%q) = %d, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseByteRate(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatByteRate(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{0, "unlimited"},
+		{-1, "unlimited"},
+		{512 * 1024, "512 KB/s"},
+		{1024 * 1024, "1.0 MB/s"},
+		{5 * 512 * 1024, "2.5 MB/s"},
+	}
+	for _, tt := range tests {
+		if got := formatByteRate(tt.in); got != tt.want {
+			t.Errorf("formatByteRate(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	const rate = 1024 * 1024
+	tests := []struct {
+		name        string
+		rate        int64
+		size        int
+		min, max    time.Duration
+		wantMaxRead int
+	}{
+		{name: "unlimited", rate: 0, size: 4 * rate, max: 500 * time.Millisecond, wantMaxRead: 32 * 1024},
+		// The bucket starts empty, half a second of data takes about that long
+		{name: "limited", rate: rate, size: rate / 2, min: 350 * time.Millisecond, max: 2 * time.Second, wantMaxRead: rate / 4},
+		// Reads take at least 1KB, however low the rate
+		{name: "small rate", rate: 2048, size: 2048, min: 700 * time.Millisecond, max: 3 * time.Second, wantMaxRead: 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &rateLimiter{}
+			l.SetRate(tt.rate)
+			r := &rateLimitedReader{ctx: context.Background(), r: bytes.NewReader(make([]byte, tt.size)), limiter: l}
+			buf := make([]byte, 32*1024)
+			if tt.rate > 0 {
+				buf = make([]byte, tt.size)
+			}
+			started := time.Now()
+			total, largest := 0, 0
+			for {
+				n, err := r.Read(buf)
+				total += n
+				largest = max(largest, n)
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			elapsed := time.Since(started)
+			if total != tt.size {
+				t.Errorf("read %d bytes, want %d", total, tt.size)
+			}
+			if largest > tt.wantMaxRead {
+				t.Errorf("a read took %d bytes, more than the %d burst", largest, tt.wantMaxRead)
+			}
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("reading took %s, want between %s and %s", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	tests := []struct {
+		name string
+		// during runs while wait blocks
+		during  func(l *rateLimiter, cancel context.CancelFunc)
+		wantErr error
+	}{
+		{name: "cancelled", during: func(_ *rateLimiter, cancel context.CancelFunc) { cancel() }, wantErr: context.Canceled},
+		{name: "limit removed", during: func(l *rateLimiter, _ context.CancelFunc) { l.SetRate(0) }},
+		{name: "limit raised", during: func(l *rateLimiter, _ context.CancelFunc) { l.SetRate(1 << 30) }},
+		// The bytes were read before the limit was lowered, more than the bucket now holds
+		{name: "limit lowered", during: func(l *rateLimiter, _ context.CancelFunc) { l.SetRate(8192) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &rateLimiter{}
+			// A minute in debt, unless the rate changes
+			l.SetRate(1024 * 1024)
+			l.tokens = -60 * 1024 * 1024
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- l.wait(ctx, 256*1024) }()
+			time.Sleep(50 * time.Millisecond)
+			tt.during(l, cancel)
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("wait() = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("wait() still blocks")
+			}
+		})
+	}
+}
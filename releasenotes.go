@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// k3sVersionRe matches the Kubernetes distribution bundled in an artifact name, e.g. -k3sv1.32.3+k3s1
+var k3sVersionRe = regexp.MustCompile(`-(k3s|k0s)(v\d+\.\d+\.\d+(?:\+k[03]s\d+)?)`)
+
+// highlightLineRe matches lines of release notes that mention component versions we care about
+var highlightLineRe = regexp.MustCompile(`(?i)\b(kernel|k3s|k0s|kubernetes|immucore|kairos-agent|kairos-init|systemd|grub)\b.*\bv?\d+\.\d+`)
+
+// releaseHighlights returns a short list of notable facts about a release: the k3s/k0s versions
+// shipped as assets and the notes lines that mention kernel or component versions
+func releaseHighlights(notes ReleaseNotes, assets []ReleaseAsset) []string {
+	var highlights []string
+
+	distros := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, a := range assets {
+		if a.Version != notes.Version {
+			continue
+		}
+		for _, m := range k3sVersionRe.FindAllStringSubmatch(a.Name, -1) {
+			if !seen[m[1]+m[2]] {
+				seen[m[1]+m[2]] = true
+				distros[m[1]] = append(distros[m[1]], m[2])
+			}
+		}
+	}
+	for _, distro := range []string{"k3s", "k0s"} {
+		if versions := distros[distro]; len(versions) > 0 {
+			sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+			highlights = append(highlights, fmt.Sprintf("%s: %s", distro, strings.Join(versions, ", ")))
+		}
+	}
+
+	for _, line := range strings.Split(notes.Body, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*+#"))
+		if line == "" || !highlightLineRe.MatchString(line) {
+			continue
+		}
+		highlights = append(highlights, stripMarkdown(line))
+		// Long changelogs mention dependencies a lot, a few lines are enough
+		if len(highlights) >= 8 {
+			break
+		}
+	}
+	return highlights
+}
+
+var (
+	mdLinkRe   = regexp.MustCompile(`\[([^\]]*)\]\(([^)\s]+)\)`)
+	mdBoldRe   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdItalicRe = regexp.MustCompile(`(^|[^*\w])[*_]([^*_\s][^*_]*?)[*_]([^*\w]|$)`)
+	mdCodeRe   = regexp.MustCompile("`([^`]+)`")
+	mdURLRe    = regexp.MustCompile(`https?://[^\s<>()]+`)
+)
+
+// stripMarkdown drops inline markdown, keeping link texts
+func stripMarkdown(s string) string {
+	s = mdLinkRe.ReplaceAllString(s, "$1")
+	s = mdBoldRe.ReplaceAllString(s, "$1$2")
+	s = mdCodeRe.ReplaceAllString(s, "$1")
+	return s
+}
+
+// pangoEscape escapes text to be used inside Pango markup
+var pangoEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&#39;").Replace
+
+// markdownToPango renders the GitHub markdown of release notes as Pango markup for a gtk.Label.
+// It only handles what release notes use: headings, lists, emphasis, code, links and rules
+func markdownToPango(md string) string {
+	var out []string
+	inCode := false
+	for _, line := range strings.Split(strings.ReplaceAll(md, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out = append(out, "<tt>"+pangoEscape(line)+"</tt>")
+			continue
+		}
+		// Release notes embed html comments and tags, like <details>, that Pango doesn't know
+		if strings.HasPrefix(trimmed, "<") && strings.HasSuffix(trimmed, ">") {
+			continue
+		}
+		switch {
+		case trimmed == "":
+			out = append(out, "")
+		case trimmed == "---" || trimmed == "***":
+			out = append(out, "────────")
+		case strings.HasPrefix(trimmed, "#"):
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			text := inlineMarkdownToPango(strings.TrimSpace(strings.TrimLeft(trimmed, "#")))
+			size := "large"
+			if level == 1 {
+				size = "x-large"
+			} else if level > 2 {
+				size = "medium"
+			}
+			out = append(out, fmt.Sprintf(`<span size="%s" weight="bold">%s</span>`, size, text))
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "+ "):
+			indent := strings.Repeat("  ", (len(line)-len(strings.TrimLeft(line, " ")))/2)
+			out = append(out, indent+"• "+inlineMarkdownToPango(trimmed[2:]))
+		case strings.HasPrefix(trimmed, ">"):
+			out = append(out, "<i>"+inlineMarkdownToPango(strings.TrimSpace(strings.TrimPrefix(trimmed, ">")))+"</i>")
+		default:
+			out = append(out, inlineMarkdownToPango(trimmed))
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// inlineMarkdownToPango converts the inline markdown of a single line
+func inlineMarkdownToPango(s string) string {
+	// Pull out links and code first so their contents are not touched by the other rules
+	var spans []string
+	keep := func(markup string) string {
+		spans = append(spans, markup)
+		return fmt.Sprintf("\x00%d\x00", len(spans)-1)
+	}
+	s = mdCodeRe.ReplaceAllStringFunc(s, func(m string) string {
+		return keep("<tt>" + pangoEscape(mdCodeRe.FindStringSubmatch(m)[1]) + "</tt>")
+	})
+	s = mdLinkRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := mdLinkRe.FindStringSubmatch(m)
+		return keep(fmt.Sprintf(`<a href="%s">%s</a>`, pangoEscape(sub[2]), pangoEscape(stripMarkdown(sub[1]))))
+	})
+	s = mdURLRe.ReplaceAllStringFunc(s, func(m string) string {
+		return keep(fmt.Sprintf(`<a href="%s">%s</a>`, pangoEscape(m), pangoEscape(m)))
+	})
+	s = pangoEscape(s)
+	s = mdBoldRe.ReplaceAllString(s, "<b>$1$2</b>")
+	s = mdItalicRe.ReplaceAllString(s, "$1<i>$2</i>$3")
+	for i, span := range spans {
+		s = strings.Replace(s, fmt.Sprintf("\x00%d\x00", i), span, 1)
+	}
+	return s
+}
+
+// validPango tells if markup is well formed, GTK shows nothing at all for a label with broken markup
+func validPango(markup string) bool {
+	decoder := xml.NewDecoder(strings.NewReader("<markup>" + markup + "</markup>"))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// releaseNotesMarkup renders the notes of a release with its highlights on top
+func releaseNotesMarkup(notes ReleaseNotes, assets []ReleaseAsset) string {
+	title := notes.Name
+	if title == "" {
+		title = notes.Version
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<span size="x-large" weight="bold">%s</span>`, pangoEscape(title))
+	if !notes.PublishedAt.IsZero() {
+		fmt.Fprintf(&b, "\nPublished %s", notes.PublishedAt.Format("2006-01-02"))
+	}
+	if notes.URL != "" {
+		fmt.Fprintf(&b, ` · <a href="%s">View on GitHub</a>`, pangoEscape(notes.URL))
+	}
+	if highlights := releaseHighlights(notes, assets); len(highlights) > 0 {
+		b.WriteString("\n\n<b>Highlights</b>")
+		for _, h := range highlights {
+			b.WriteString("\n• " + pangoEscape(h))
+		}
+	}
+	b.WriteString("\n\n")
+	body := markdownToPango(notes.Body)
+	if !validPango(body) {
+		body = pangoEscape(notes.Body)
+	}
+	b.WriteString(body)
+	return b.String()
+}
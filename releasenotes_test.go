@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReleaseHighlights(t *testing.T) {
+	assets := []ReleaseAsset{
+		{Version: "v3.1.0", Name: "kairos-ubuntu-24.04-standard-amd64-generic-v3.1.0-k3sv1.31.4+k3s1.iso"},
+		{Version: "v3.1.0", Name: "kairos-ubuntu-24.04-standard-amd64-generic-v3.1.0-k3sv1.32.3+k3s1.iso"},
+		{Version: "v3.1.0", Name: "kairos-ubuntu-24.04-standard-amd64-generic-v3.1.0-k3sv1.32.3+k3s1.iso.sha256"},
+		{Version: "v3.1.0", Name: "kairos-alpine-3.21-standard-amd64-generic-v3.1.0-k0sv1.32.2+k0s0.iso"},
+		{Version: "v3.0.0", Name: "kairos-ubuntu-24.04-standard-amd64-generic-v3.0.0-k3sv1.30.1+k3s1.iso"},
+	}
+	tests := []struct {
+		name   string
+		body   string
+		assets []ReleaseAsset
+		want   []string
+	}{
+		{name: "empty"},
+		{
+			name:   "distributions",
+			assets: assets,
+			want:   []string{"k3s: v1.32.3+k3s1, v1.31.4+k3s1", "k0s: v1.32.2+k0s0"},
+		},
+		{
+			name: "component lines",
+			body: "## What's changed\n* Bump **kernel** to 6.8.0-52 by @bot in [#123](https://github.com/kairos-io/kairos/pull/123)\n" +
+				"* Fix typos in the docs\n- `kairos-agent` v2.16.1\n### immucore v0.8.2\n",
+			want: []string{"Bump kernel to 6.8.0-52 by @bot in #123", "kairos-agent v2.16.1", "immucore v0.8.2"},
+		},
+		{
+			name: "capped",
+			body: strings.Repeat("* systemd 256.1\n", 20),
+			want: strings.Split(strings.Repeat("systemd 256.1\n", 8), "\n")[:8],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := releaseHighlights(ReleaseNotes{Version: "v3.1.0", Body: tt.body}, tt.assets)
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("releaseHighlights() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineMarkdownToPango(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain text", "plain text"},
+		{"**bold** and __bold__", "<b>bold</b> and <b>bold</b>"},
+		{"an *italic* word", "an <i>italic</i> word"},
+		{"snake_case_name stays", "snake_case_name stays"},
+		{"`a < b && c`", "<tt>a &lt; b &amp;&amp; c</tt>"},
+		{"`**not bold**`", "<tt>**not bold**</tt>"},
+		{"[the **docs**](https://kairos.io/docs?a=1&b=2)", `<a href="https://kairos.io/docs?a=1&amp;b=2">the docs</a>`},
+		{"see https://kairos.io/x_y_z", `see <a href="https://kairos.io/x_y_z">https://kairos.io/x_y_z</a>`},
+		{"<script> & \"quotes\"", "&lt;script&gt; &amp; &quot;quotes&quot;"},
+	}
+	for _, tt := range tests {
+		if got := inlineMarkdownToPango(tt.in); got != tt.want {
+			t.Errorf("inlineMarkdownToPango(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMarkdownToPango(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"heading", "# Kairos v3.1.0", `<span size="x-large" weight="bold">Kairos v3.1.0</span>`},
+		{"subheading", "### Fixes", `<span size="medium" weight="bold">Fixes</span>`},
+		{"list", "- one\n  * nested", "• one\n  • nested"},
+		{"quote", "> note", "<i>note</i>"},
+		{"rule", "---", "────────"},
+		{"code block", "```\nif a < b {\n```", "<tt>if a &lt; b {</tt>"},
+		{"html dropped", "<details>\ntext\n</details>", "text"},
+		{"crlf", "one\r\ntwo", "one\ntwo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := markdownToPango(tt.in)
+			if got != tt.want {
+				t.Errorf("markdownToPango() = %q, want %q", got, tt.want)
+			}
+			if !validPango(got) {
+				t.Errorf("markdownToPango() = %q, not valid markup", got)
+			}
+		})
+	}
+}
+
+func TestReleaseNotesMarkup(t *testing.T) {
+	tests := []struct {
+		name  string
+		notes ReleaseNotes
+		want  []string
+	}{
+		{
+			name:  "notes",
+			notes: ReleaseNotes{Version: "v3.1.0", Name: "v3.1.0 <final>", URL: "https://github.com/kairos-io/kairos/releases/tag/v3.1.0", Body: "* kernel 6.8"},
+			want:  []string{"v3.1.0 &lt;final&gt;", `<a href="https://github.com/kairos-io/kairos/releases/tag/v3.1.0">`, "<b>Highlights</b>\n• kernel 6.8", "• kernel 6.8"},
+		},
+		{
+			name:  "no name",
+			notes: ReleaseNotes{Version: "v3.1.0"},
+			want:  []string{`<span size="x-large" weight="bold">v3.1.0</span>`},
+		},
+		{
+			// Overlapping emphasis nests tags wrongly, the notes are shown as text instead
+			name:  "broken markup",
+			notes: ReleaseNotes{Version: "v3.1.0", Body: "*one **two* three**"},
+			want:  []string{"\n\n*one **two* three**"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := releaseNotesMarkup(tt.notes, nil)
+			if !validPango(got) {
+				t.Errorf("releaseNotesMarkup() = %q, not valid markup", got)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("releaseNotesMarkup() = %q, want it to hold %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/Masterminds/semver/v3"
 	"github.com/google/go-github/v55/github"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // ReleaseAsset represents an asset grouped by version
@@ -19,14 +22,56 @@ type ReleaseAsset struct {
 	ID      int64 // Add asset ID for unique identification
 }
 
+// ReleaseNotes is the description of a release, its body is markdown
+type ReleaseNotes struct {
+	Version     string    `json:"version"`
+	Name        string    `json:"name"`
+	Body        string    `json:"body"`
+	PublishedAt time.Time `json:"published_at"`
+	URL         string    `json:"url"`
+}
+
+// releaseCache is what we store on disk between runs
+type releaseCache struct {
+	FetchedAt time.Time               `json:"fetched_at"`
+	ETag      string                  `json:"etag"`
+	Assets    []ReleaseAsset          `json:"assets"`
+	Notes     map[string]ReleaseNotes `json:"notes"`
+}
+
 // FetchReleaseAssets fetches releases and parses assets
 func FetchReleaseAssets(ctx context.Context, owner, repo string) ([]ReleaseAsset, error) {
-	client := github.NewClient(nil)
-	releases, _, err := client.Repositories.ListReleases(ctx, owner, repo, nil)
+	assets, _, _, _, err := fetchReleaseAssets(ctx, owner, repo, "")
+	return assets, err
+}
+
+// fetchReleaseAssets lists the releases of owner/repo with their notes. If etag is set the request is
+// conditional and notModified is returned when GitHub answers 304, in which case nothing else is returned
+func fetchReleaseAssets(ctx context.Context, owner, repo, etag string) (assets []ReleaseAsset, notes map[string]ReleaseNotes, newETag string, notModified bool, err error) {
+	client := github.NewClient(httpClient)
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%s/%s/releases", owner, repo), nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, "", false, err
 	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	var releases []*github.RepositoryRelease
+	resp, err := client.Do(ctx, req, &releases)
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		return nil, nil, etag, true, nil
+	}
+	if err != nil {
+		return nil, nil, "", false, err
+	}
+	assets, notes = parseReleaseAssets(releases)
+	return assets, notes, resp.Header.Get("ETag"), false, nil
+}
+
+// parseReleaseAssets flattens the releases into assets and notes by version, skipping pre-releases and invalid versions
+func parseReleaseAssets(releases []*github.RepositoryRelease) ([]ReleaseAsset, map[string]ReleaseNotes) {
 	var assets []ReleaseAsset
+	notes := make(map[string]ReleaseNotes)
 	versionAssets := make(map[string][]ReleaseAsset)
 	for _, rel := range releases {
 		version := rel.GetTagName()
@@ -37,6 +82,13 @@ func FetchReleaseAssets(ctx context.Context, owner, repo string) ([]ReleaseAsset
 		if _, err := semver.NewVersion(version); err != nil {
 			continue // skip invalid semver
 		}
+		notes[version] = ReleaseNotes{
+			Version:     version,
+			Name:        rel.GetName(),
+			Body:        rel.GetBody(),
+			PublishedAt: rel.GetPublishedAt().Time,
+			URL:         rel.GetHTMLURL(),
+		}
 		for _, asset := range rel.Assets {
 			name := asset.GetName()
 			versionAssets[version] = append(versionAssets[version], ReleaseAsset{
@@ -50,25 +102,125 @@ func FetchReleaseAssets(ctx context.Context, owner, repo string) ([]ReleaseAsset
 	for _, assetList := range versionAssets {
 		assets = append(assets, assetList...)
 	}
-	return assets, nil
+	return assets, notes
 }
 
-// GetCachedReleaseAssets returns cached assets if available, otherwise fetches and caches them
-func GetCachedReleaseAssets(ctx context.Context, owner, repo string) ([]ReleaseAsset, error) {
-	cacheFile := filepath.Join(os.TempDir(), "kairos_releases_cache.json")
-	if data, err := os.ReadFile(cacheFile); err == nil {
-		var assets []ReleaseAsset
-		if err := json.Unmarshal(data, &assets); err == nil {
-			return assets, nil
-		}
+// releaseCachePath returns the cache file for owner/repo in the real user's cache directory
+func releaseCachePath(owner, repo string) (string, error) {
+	dir, err := userCacheDir()
+	if err != nil {
+		return "", err
 	}
-	assets, err := FetchReleaseAssets(ctx, owner, repo)
+	return filepath.Join(dir, fmt.Sprintf("releases_%s_%s.json", owner, repo)), nil
+}
+
+func readReleaseCache(path string) (*releaseCache, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	data, err := json.Marshal(assets)
-	if err == nil {
-		_ = os.WriteFile(cacheFile, data, 0644)
+	var cache releaseCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, err
+	}
+	return &cache, nil
+}
+
+func writeReleaseCache(path string, cache *releaseCache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return writeUserFile(path, data)
+}
+
+// GetCachedReleaseAssets returns cached assets if available, otherwise fetches and caches them.
+// With release_source set to "mirror" the releases come from the local mirror and GitHub is never asked.
+// Once the cache is older than the configured TTL the stale assets are still returned straight away so the
+// window opens instantly, and the cache is revalidated in the background. revalidated, if not nil, is called
+// with the new asset list only when the releases changed upstream.
+func GetCachedReleaseAssets(ctx context.Context, owner, repo string, revalidated func([]ReleaseAsset)) ([]ReleaseAsset, error) {
+	if useMirror() {
+		assets, _, err := mirrorReleaseAssets()
+		return assets, err
+	}
+	path, err := releaseCachePath(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := readReleaseCache(path)
+	if err != nil || cache.Notes == nil {
+		// No usable cache, we have to wait for GitHub
+		return RefreshReleaseAssets(ctx, owner, repo)
+	}
+	// Taken before the revalidation replaces them
+	stale := cache.Assets
+	if time.Since(cache.FetchedAt) > time.Duration(appConfig.ReleaseCacheTTL) {
+		go func() {
+			changed, assets, err := revalidateReleaseCache(context.WithoutCancel(ctx), owner, repo, path, cache)
+			if err != nil {
+				logln("Error revalidating release cache:", err)
+				return
+			}
+			if changed && revalidated != nil {
+				revalidated(assets)
+			}
+		}()
+	}
+	return stale, nil
+}
+
+// RefreshReleaseAssets asks GitHub for the releases now, reusing the cached list if it didn't change
+func RefreshReleaseAssets(ctx context.Context, owner, repo string) ([]ReleaseAsset, error) {
+	if useMirror() {
+		assets, _, err := mirrorReleaseAssets()
+		return assets, err
+	}
+	path, err := releaseCachePath(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := readReleaseCache(path)
+	if err != nil || cache.Notes == nil {
+		// Caches written before notes were stored need a full refresh
+		cache = &releaseCache{}
+	}
+	_, assets, err := revalidateReleaseCache(ctx, owner, repo, path, cache)
+	return assets, err
+}
+
+// CachedReleaseNotes returns the notes of every cached release by version
+func CachedReleaseNotes(owner, repo string) map[string]ReleaseNotes {
+	if useMirror() {
+		_, notes, _ := mirrorReleaseAssets()
+		return notes
+	}
+	path, err := releaseCachePath(owner, repo)
+	if err != nil {
+		return nil
+	}
+	cache, err := readReleaseCache(path)
+	if err != nil {
+		return nil
+	}
+	return cache.Notes
+}
+
+// revalidateReleaseCache does a conditional request with the cached ETag and updates the cache file
+func revalidateReleaseCache(ctx context.Context, owner, repo, path string, cache *releaseCache) (bool, []ReleaseAsset, error) {
+	assets, notes, etag, notModified, err := fetchReleaseAssets(ctx, owner, repo, cache.ETag)
+	if err != nil {
+		return false, nil, err
+	}
+	changed := !notModified
+	if changed {
+		cache.Assets = assets
+		cache.Notes = notes
+		cache.ETag = etag
+	}
+	cache.FetchedAt = time.Now()
+	if err := writeReleaseCache(path, cache); err != nil {
+		logln("Error writing release cache:", err)
 	}
-	return assets, nil
+	return changed, cache.Assets, nil
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redirectTransport sends the requests meant for GitHub to a test server
+type redirectTransport struct {
+	to   *url.URL
+	base http.RoundTripper
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.to.Scheme, t.to.Host
+	return t.base.RoundTrip(req)
+}
+
+// assetKeys lists assets as version/name, sorted as the releases come in any order
+func assetKeys(assets []ReleaseAsset) []string {
+	var keys []string
+	for _, a := range assets {
+		keys = append(keys, a.Version+"/"+a.Name)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestReleaseCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	defer func(c Config) { appConfig = c }(appConfig)
+
+	// The server answers 304 while the ETag it is sent is the current one
+	var mu sync.Mutex
+	etag := `"v1"`
+	releases := `[{"tag_name": "v3.1.0", "assets": [{"id": 1, "name": "kairos.iso"}]}, {"tag_name": "v3.2.0-rc1", "assets": [{"id": 2, "name": "kairos.iso"}]}]`
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/repos/kairos-io/kairos/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		sent = append(sent, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, releases)
+	}))
+	defer server.Close()
+	to, _ := url.Parse(server.URL)
+	defer func(base http.RoundTripper) { http.DefaultTransport = base }(http.DefaultTransport)
+	http.DefaultTransport = redirectTransport{to: to, base: http.DefaultTransport}
+
+	check := func(step string, assets []ReleaseAsset, err error, want []string, wantSent ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if got := assetKeys(assets); !slices.Equal(got, want) {
+			t.Errorf("%s: assets %q, want %q", step, got, want)
+		}
+		if !slices.Equal(sent, wantSent) {
+			t.Errorf("%s: sent If-None-Match %q, want %q", step, sent, wantSent)
+		}
+		sent = nil
+	}
+	ctx := context.Background()
+
+	assets, err := GetCachedReleaseAssets(ctx, "kairos-io", "kairos", nil)
+	check("without a cache", assets, err, []string{"v3.1.0/kairos.iso"}, "")
+
+	// Within the TTL GitHub isn't asked
+	assets, err = GetCachedReleaseAssets(ctx, "kairos-io", "kairos", nil)
+	check("fresh cache", assets, err, []string{"v3.1.0/kairos.iso"})
+
+	assets, err = RefreshReleaseAssets(ctx, "kairos-io", "kairos")
+	check("not modified", assets, err, []string{"v3.1.0/kairos.iso"}, `"v1"`)
+
+	// A stale cache is returned straight away and revalidated in the background
+	mu.Lock()
+	etag = `"v2"`
+	releases = `[{"tag_name": "v3.1.0", "assets": [{"id": 1, "name": "kairos.iso"}]}, {"tag_name": "v3.2.0", "assets": [{"id": 3, "name": "kairos.iso"}]}]`
+	mu.Unlock()
+	appConfig.ReleaseCacheTTL = 0
+	revalidated := make(chan []ReleaseAsset, 1)
+	assets, err = GetCachedReleaseAssets(ctx, "kairos-io", "kairos", func(assets []ReleaseAsset) { revalidated <- assets })
+	if err != nil || !slices.Equal(assetKeys(assets), []string{"v3.1.0/kairos.iso"}) {
+		t.Errorf("stale cache: %q, %v, want the cached assets", assetKeys(assets), err)
+	}
+	select {
+	case assets := <-revalidated:
+		check("changed", assets, nil, []string{"v3.1.0/kairos.iso", "v3.2.0/kairos.iso"}, `"v1"`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stale cache wasn't revalidated")
+	}
+
+	// The new list and its ETag were cached
+	appConfig.ReleaseCacheTTL = Duration(time.Hour)
+	assets, err = GetCachedReleaseAssets(ctx, "kairos-io", "kairos", nil)
+	check("updated cache", assets, err, []string{"v3.1.0/kairos.iso", "v3.2.0/kairos.iso"})
+	assets, err = RefreshReleaseAssets(ctx, "kairos-io", "kairos")
+	check("updated etag", assets, err, []string{"v3.1.0/kairos.iso", "v3.2.0/kairos.iso"}, `"v2"`)
+}
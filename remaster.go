@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// remasterConfigName is where Kairos looks for a cloud-config on the live media
+const remasterConfigName = "config.yaml"
+
+// isoTree is the volume descriptors of one directory tree set, base is the sector they count from:
+// 0 for the image, the partition start for the copy xorriso writes at a partition offset
+type isoTree struct {
+	base        int64
+	descriptors []*isoVolumeDescriptor
+}
+
+// RemasterISO writes the image src of srcSize bytes to dst with data as the file name in the root
+// directory, replacing a file of the same name. Nothing of the original image moves: the file and a copy
+// of the directories are appended and the volume descriptors point to them, so El Torito boot images
+// and hybrid MBR/GPT partitions keep working. Partitions covering the image are grown and the backup GPT is
+// moved to the new end. It returns the size of the new image
+func RemasterISO(src io.ReaderAt, srcSize int64, dst io.WriterAt, name string, data []byte, progress func(done, total int64)) (int64, error) {
+	primary, err := readISOVolumeDescriptors(src, 0)
+	if err != nil {
+		return 0, err
+	}
+	trees := []isoTree{{0, primary}}
+	volumeEnd := int64(primary[0].VolumeSpaceSize()) * isoSectorSize
+	mbr, mbrErr := readMBR(src)
+	var gpt *gptHeader
+	if mbrErr == nil {
+		if gpt, err = readGPT(src); err != nil {
+			return 0, err
+		}
+		// xorriso's -partition_offset puts a second tree at the start of the partition holding the image
+		var starts []int64
+		for _, p := range mbr {
+			if p.Type != 0 && p.Type != mbrTypeGPT {
+				starts = append(starts, int64(p.StartLBA))
+			}
+		}
+		for _, start := range starts {
+			if start == 0 || start%(isoSectorSize/sectorSize) != 0 || slices.ContainsFunc(trees, func(t isoTree) bool {
+				return t.base == start/(isoSectorSize/sectorSize)
+			}) {
+				continue
+			}
+			base := start / (isoSectorSize / sectorSize)
+			if descriptors, err := readISOVolumeDescriptors(src, base); err == nil {
+				trees = append(trees, isoTree{base, descriptors})
+			}
+		}
+	}
+
+	if err := copyImage(src, srcSize, dst, progress); err != nil {
+		return 0, err
+	}
+
+	oldEnd := (max(srcSize, volumeEnd) + isoSectorSize - 1) / isoSectorSize * isoSectorSize
+	next := oldEnd / isoSectorSize
+	fileLBA := next
+	if len(data) > 0 {
+		padded := make([]byte, (int64(len(data))+isoSectorSize-1)/isoSectorSize*isoSectorSize)
+		copy(padded, data)
+		if _, err := dst.WriteAt(padded, fileLBA*isoSectorSize); err != nil {
+			return 0, err
+		}
+		next += int64(len(padded)) / isoSectorSize
+	}
+
+	now := time.Now()
+	for _, tree := range trees {
+		for _, d := range tree.descriptors {
+			if d.Type() != isoPrimary && !d.Joliet() {
+				continue
+			}
+			if next, err = remasterTree(src, dst, tree.base, d, name, fileLBA, uint32(len(data)), next, now); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	newSize := next * isoSectorSize
+	var lastLBA uint64
+	if gpt != nil {
+		// The backup GPT goes at the very end, the image stays a whole number of ISO sectors
+		entriesSectors := int64((len(gpt.entries) + sectorSize - 1) / sectorSize)
+		newSize = (newSize + (entriesSectors+1)*sectorSize + isoSectorSize - 1) / isoSectorSize * isoSectorSize
+		lastLBA = uint64(newSize/sectorSize) - 1
+	}
+
+	for _, tree := range trees {
+		for _, d := range tree.descriptors {
+			if d.Type() == isoPrimary || d.Type() == isoSupplementary {
+				putBothEndian32(d.Raw[80:], uint32(newSize/isoSectorSize-tree.base))
+			}
+			if _, err := dst.WriteAt(d.Raw, d.LBA*isoSectorSize); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if mbrErr == nil {
+		if err := growHybridPartitions(src, dst, mbr, gpt, oldEnd, volumeEnd, newSize, lastLBA); err != nil {
+			return 0, err
+		}
+	}
+	return newSize, nil
+}
+
+// copyImage copies src to dst at the same offsets
+func copyImage(src io.ReaderAt, size int64, dst io.WriterAt, progress func(done, total int64)) error {
+	buf := make([]byte, BufferSize)
+	for pos := int64(0); pos < size; {
+		n, err := src.ReadAt(buf[:min(int64(len(buf)), size-pos)], pos)
+		if n > 0 {
+			if _, werr := dst.WriteAt(buf[:n], pos); werr != nil {
+				return werr
+			}
+			pos += int64(n)
+			if progress != nil {
+				progress(pos, size)
+			}
+		}
+		if err != nil && !(errors.Is(err, io.EOF) && pos == size) {
+			return err
+		}
+	}
+	return nil
+}
+
+// remasterDir is a directory of a tree being copied by remasterTree
+type remasterDir struct {
+	extent, size uint32
+	// parent is the index of the parent directory, the root is its own parent
+	parent int
+	data   []byte
+	// children are the offsets in data of the records of subdirectories, with their indexes
+	children [][2]int
+	// lba is where the copy goes, relative to the base of the tree, areas are its continuation areas
+	lba   int64
+	areas []byte
+}
+
+// remasterTree writes a copy of the directories of the tree of d at sector next, with the file added
+// to the root, and points d and the path tables to it. Parents are written before their children, as
+// readers that go through the image in order, like libarchive, skip directories behind them. The
+// original directories are left as they are. It returns the sector after the copy
+func remasterTree(src io.ReaderAt, dst io.WriterAt, base int64, d *isoVolumeDescriptor, name string, fileLBA int64, fileSize uint32, next int64, now time.Time) (int64, error) {
+	root := d.Root()
+	dirs := []*remasterDir{{extent: root.Extent, size: root.Size}}
+	index := map[uint32]int{root.Extent: 0}
+	for i := 0; i < len(dirs); i++ {
+		dir := dirs[i]
+		records, err := readISODirectory(src, base, isoDirRecord{Extent: dir.extent, Size: dir.size})
+		if err != nil {
+			return 0, err
+		}
+		raws := make([][]byte, 0, len(records)+1)
+		for _, r := range records {
+			raws = append(raws, r.Raw)
+		}
+		if i == 0 {
+			raws = addISOFile(records, d.Joliet(), name, uint32(fileLBA-base), fileSize, now)
+		}
+		var offsets []int
+		dir.data, offsets = packISODirectory(raws)
+		for j, off := range offsets[2:] {
+			rec, _ := parseISODirRecord(raws[j+2])
+			if !rec.IsDir() {
+				continue
+			}
+			if _, ok := index[rec.Extent]; ok {
+				return 0, fmt.Errorf("directory at sector %d is linked twice", base+int64(rec.Extent))
+			}
+			index[rec.Extent] = len(dirs)
+			dir.children = append(dir.children, [2]int{off, len(dirs)})
+			dirs = append(dirs, &remasterDir{extent: rec.Extent, size: rec.Size, parent: i})
+		}
+		// The .. record follows .
+		dir.children = append(dir.children, [2]int{offsets[1], dir.parent}, [2]int{0, i})
+	}
+
+	// Each directory is followed by its Rock Ridge continuation areas
+	lba := next - base
+	for _, dir := range dirs {
+		dir.lba = lba
+		lba += int64(len(dir.data)) / isoSectorSize
+		areas, err := relocateContinuations(src, base, dir.data, lba)
+		if err != nil {
+			return 0, err
+		}
+		dir.areas = areas
+		lba += int64(len(areas)) / isoSectorSize
+	}
+	moved := make(map[uint32]uint32, len(dirs))
+	for _, dir := range dirs {
+		moved[dir.extent] = uint32(dir.lba)
+	}
+	for _, dir := range dirs {
+		for _, child := range dir.children {
+			target := dirs[child[1]]
+			putBothEndian32(dir.data[child[0]+2:], uint32(target.lba))
+			putBothEndian32(dir.data[child[0]+10:], uint32(len(target.data)))
+		}
+		relocateRockRidgeLinks(dir.data, moved)
+		if _, err := dst.WriteAt(append(dir.data, dir.areas...), (base+dir.lba)*isoSectorSize); err != nil {
+			return 0, err
+		}
+	}
+	putBothEndian32(d.Raw[156+2:], uint32(dirs[0].lba))
+	putBothEndian32(d.Raw[156+10:], uint32(len(dirs[0].data)))
+
+	tableSize := int64(binary.LittleEndian.Uint32(d.Raw[132:]))
+	for _, table := range []struct {
+		offset int
+		order  binary.ByteOrder
+	}{{140, binary.LittleEndian}, {144, binary.LittleEndian}, {148, binary.BigEndian}, {152, binary.BigEndian}} {
+		tableLBA := int64(table.order.Uint32(d.Raw[table.offset:]))
+		if tableLBA == 0 {
+			continue
+		}
+		if err := relocatePathTable(src, dst, (base+tableLBA)*isoSectorSize, tableSize, table.order, moved); err != nil {
+			return 0, err
+		}
+	}
+	return base + lba, nil
+}
+
+// addISOFile returns the records of a root directory with a record for the file name added, replacing
+// a file of the same name, sorted by identifier
+func addISOFile(records []isoDirRecord, joliet bool, name string, fileLBA, fileSize uint32, now time.Time) [][]byte {
+	var identifier, systemUse []byte
+	rockRidge := !joliet && len(susp(records[0].SystemUse)["SP"]) > 0
+	if joliet {
+		for _, u := range utf16.Encode([]rune(name)) {
+			identifier = binary.BigEndian.AppendUint16(identifier, u)
+		}
+		// Follow the other files on whether names carry a version
+		for _, r := range records[2:] {
+			if !r.IsDir() && bytes.HasSuffix(r.Identifier, []byte{0, ';', 0, '1'}) {
+				identifier = append(identifier, 0, ';', 0, '1')
+				break
+			}
+		}
+	} else {
+		identifier = isoFileIdentifier(name)
+		if rockRidge {
+			systemUse = rockRidgeFileEntries(records, name, fileLBA)
+		}
+	}
+	record := newISODirRecord(identifier, fileLBA, fileSize, systemUse, now)
+	newRec, _ := parseISODirRecord(record)
+	newName := isoRecordName(newRec, joliet)
+
+	raws := [][]byte{records[0].Raw, records[1].Raw}
+	inserted := false
+	for _, r := range records[2:] {
+		// Rock Ridge names are case sensitive, ISO9660 identifiers are not and Joliet ones are for Windows
+		same := isoRecordName(r, joliet) == newName
+		if !rockRidge {
+			same = strings.EqualFold(isoRecordName(r, joliet), newName)
+		}
+		if !r.IsDir() && same {
+			continue
+		}
+		if !inserted && bytes.Compare(r.Identifier, identifier) > 0 {
+			raws = append(raws, record)
+			inserted = true
+		}
+		raws = append(raws, r.Raw)
+	}
+	if !inserted {
+		raws = append(raws, record)
+	}
+	return raws
+}
+
+// packISODirectory lays out the records of a directory in whole sectors, which records can't cross.
+// It returns the offset of each record too
+func packISODirectory(raws [][]byte) ([]byte, []int) {
+	var dir []byte
+	offsets := make([]int, len(raws))
+	for i, raw := range raws {
+		if len(dir)%isoSectorSize+len(raw) > isoSectorSize {
+			dir = append(dir, make([]byte, isoSectorSize-len(dir)%isoSectorSize)...)
+		}
+		offsets[i] = len(dir)
+		dir = append(dir, raw...)
+	}
+	dir = append(dir, make([]byte, (isoSectorSize-len(dir)%isoSectorSize)%isoSectorSize)...)
+	return dir, offsets
+}
+
+// relocateRockRidgeLinks points the CL and PL entries of the records in dir, which link the directories
+// Rock Ridge moved out of too deep trees, to where the directories were copied
+func relocateRockRidgeLinks(dir []byte, moved map[uint32]uint32) {
+	for pos := 0; pos < len(dir); {
+		if dir[pos] == 0 {
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		rec, ok := parseISODirRecord(dir[pos:])
+		if !ok {
+			return
+		}
+		entries := susp(rec.SystemUse)
+		for _, link := range append(entries["CL"], entries["PL"]...) {
+			if len(link) < 12 {
+				continue
+			}
+			if lba, ok := moved[binary.LittleEndian.Uint32(link[4:])]; ok {
+				putBothEndian32(link[4:], lba)
+			}
+		}
+		pos += len(rec.Raw)
+	}
+}
+
+// relocatePathTable points the entries of the path table of size bytes at offset to where the
+// directories were copied
+func relocatePathTable(src io.ReaderAt, dst io.WriterAt, offset, size int64, order binary.ByteOrder, moved map[uint32]uint32) error {
+	if size > isoMaxDirectory {
+		return fmt.Errorf("path table of %d bytes is too large", size)
+	}
+	table := make([]byte, size)
+	if _, err := src.ReadAt(table, offset); err != nil {
+		return err
+	}
+	for pos := 0; pos+8 <= len(table) && table[pos] != 0; {
+		if lba, ok := moved[order.Uint32(table[pos+2:])]; ok {
+			order.PutUint32(table[pos+2:], lba)
+		}
+		idLen := int(table[pos])
+		pos += 8 + idLen + idLen%2
+	}
+	_, err := dst.WriteAt(table, offset)
+	return err
+}
+
+// relocateContinuations copies the Rock Ridge continuation areas the records of dir point to into
+// sectors following it at lba, relative to base, so the new directory doesn't refer back into the
+// original tree, which readers going through the image in order have passed
+func relocateContinuations(src io.ReaderAt, base int64, dir []byte, lba int64) ([]byte, error) {
+	var areas []byte
+	for pos := 0; pos < len(dir); {
+		if dir[pos] == 0 {
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		rec, ok := parseISODirRecord(dir[pos:])
+		if !ok {
+			return nil, errors.New("invalid directory record")
+		}
+		for _, ce := range susp(rec.SystemUse)["CE"] {
+			if len(ce) < 28 {
+				continue
+			}
+			block, offset := binary.LittleEndian.Uint32(ce[4:]), binary.LittleEndian.Uint32(ce[12:])
+			length := binary.LittleEndian.Uint32(ce[20:])
+			if length > isoSectorSize {
+				return nil, fmt.Errorf("rock ridge continuation area of %d bytes is too large", length)
+			}
+			area := make([]byte, length)
+			if _, err := src.ReadAt(area, (base+int64(block))*isoSectorSize+int64(offset)); err != nil {
+				return nil, err
+			}
+			// Areas don't cross sectors either
+			if len(areas)%isoSectorSize+len(area) > isoSectorSize {
+				areas = append(areas, make([]byte, isoSectorSize-len(areas)%isoSectorSize)...)
+			}
+			putBothEndian32(ce[4:], uint32(lba+int64(len(areas)/isoSectorSize)))
+			putBothEndian32(ce[12:], uint32(len(areas)%isoSectorSize))
+			areas = append(areas, area...)
+		}
+		pos += len(rec.Raw)
+	}
+	areas = append(areas, make([]byte, (isoSectorSize-len(areas)%isoSectorSize)%isoSectorSize)...)
+	return areas, nil
+}
+
+// rockRidgeFileEntries returns the PX and NM entries of a read-only file named name, in the Rock
+// Ridge version the other records of the directory use
+func rockRidgeFileEntries(records []isoDirRecord, name string, serial uint32) []byte {
+	pxLen := 44
+	for _, r := range records {
+		if px := susp(r.SystemUse)["PX"]; len(px) > 0 {
+			pxLen = len(px[0])
+			break
+		}
+	}
+	px := make([]byte, pxLen)
+	copy(px, "PX")
+	px[2], px[3] = byte(pxLen), 1
+	putBothEndian32(px[4:], 0o100444)
+	putBothEndian32(px[12:], 1)
+	if pxLen >= 44 {
+		putBothEndian32(px[36:], serial)
+	}
+	nm := append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+	return append(px, nm...)
+}
+
+// growHybridPartitions extends the MBR and GPT partitions holding the original image to the new size,
+// and moves the backup GPT to lastLBA. Those are the partitions starting before the first volume
+// descriptor, at 0 or at the offset of a second tree, and ending past the volume, partitions appended
+// after the image are left alone
+func growHybridPartitions(src io.ReaderAt, dst io.WriterAt, mbr [4]mbrPartition, gpt *gptHeader, oldEnd, volumeEnd, newSize int64, lastLBA uint64) error {
+	// Tools pad the image, the partition holding it may end within the last MB of the volume
+	covers := func(start, end int64) bool {
+		return start <= isoFirstDescriptor*isoSectorSize && end >= volumeEnd-partitionAlign
+	}
+
+	sector := make([]byte, sectorSize)
+	if _, err := src.ReadAt(sector, 0); err != nil {
+		return err
+	}
+	changed := false
+	for i, p := range mbr {
+		start := int64(p.StartLBA) * sectorSize
+		if p.Type == 0 || p.Type == mbrTypeGPT || !covers(start, start+int64(p.Sectors)*sectorSize) {
+			continue
+		}
+		sectors := min(newSize/sectorSize-int64(p.StartLBA), 0xFFFFFFFF)
+		binary.LittleEndian.PutUint32(sector[446+i*16+12:], uint32(sectors))
+		changed = true
+	}
+	if gpt != nil && growProtectiveMBR(sector, binary.LittleEndian.Uint64(gpt.raw[32:]), lastLBA) {
+		changed = true
+	}
+	if changed {
+		if _, err := dst.WriteAt(sector, 0); err != nil {
+			return err
+		}
+	}
+
+	if gpt == nil {
+		return nil
+	}
+	entriesSectors := uint64((len(gpt.entries) + sectorSize - 1) / sectorSize)
+	for i := 0; i+gptEntrySize <= len(gpt.entries); i += gptEntrySize {
+		e := gpt.entries[i : i+gptEntrySize]
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			continue
+		}
+		first, last := binary.LittleEndian.Uint64(e[32:]), binary.LittleEndian.Uint64(e[40:])
+		if covers(int64(first)*sectorSize, int64(last+1)*sectorSize) {
+			binary.LittleEndian.PutUint64(e[40:], lastLBA-entriesSectors-1)
+		}
+	}
+	// The old backup header would be found by tools scanning for it, clear it unless it is image data
+	oldBackup := int64(binary.LittleEndian.Uint64(gpt.raw[32:])) * sectorSize
+	if oldBackup >= volumeEnd && oldBackup < oldEnd {
+		if _, err := dst.WriteAt(make([]byte, sectorSize), oldBackup); err != nil {
+			return err
+		}
+	}
+	return writeGPT(dst, gpt, lastLBA)
+}
+
+// RemasterISOFile writes a copy of the image at srcPath to dstPath with data as the file name in its root
+func RemasterISOFile(srcPath, dstPath, name string, data []byte, progress func(done, total int64)) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	size, err := RemasterISO(src, info.Size(), dst, name, data, progress)
+	if err == nil {
+		err = dst.Truncate(size)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dstPath)
+		return err
+	}
+	chownToRealUser(dstPath)
+	return nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// testISOEntry is a file or directory of the images built by buildTestISO
+type testISOEntry struct {
+	Name  string
+	Data  string
+	Dir   bool
+	Files []testISOEntry
+}
+
+// testISOOptions are the trees and partitions buildTestISO gives an image
+type testISOOptions struct {
+	rockRidge, joliet bool
+	// mbr adds an MBR partition holding the image from sector 0, gpt a protective MBR and a GPT
+	// partition from LBA 64, like xorriso's hybrid images
+	mbr, gpt bool
+}
+
+// buildTestISO returns an ISO9660 image holding files. Each directory takes one sector, the trees
+// share the file data
+func buildTestISO(files []testISOEntry, opts testISOOptions) []byte {
+	type dirInfo struct {
+		entry  *testISOEntry
+		parent int
+	}
+	dirs := []dirInfo{{entry: &testISOEntry{Dir: true, Files: files}}}
+	for i := 0; i < len(dirs); i++ {
+		for j := range dirs[i].entry.Files {
+			if f := &dirs[i].entry.Files[j]; f.Dir {
+				dirs = append(dirs, dirInfo{entry: f, parent: i})
+			}
+		}
+	}
+
+	trees := 1
+	if opts.joliet {
+		trees = 2
+	}
+	next := uint32(isoFirstDescriptor + trees + 1)
+	pathTables := make([]uint32, trees)
+	dirLBA := make([][]uint32, trees)
+	for t := range trees {
+		pathTables[t] = next
+		next += 2
+		for range dirs {
+			dirLBA[t] = append(dirLBA[t], next)
+			next++
+		}
+	}
+	dataLBA := make(map[*testISOEntry]uint32)
+	for _, dir := range dirs {
+		for j := range dir.entry.Files {
+			if f := &dir.entry.Files[j]; !f.Dir && f.Data != "" {
+				dataLBA[f] = next
+				next += uint32((len(f.Data) + isoSectorSize - 1) / isoSectorSize)
+			}
+		}
+	}
+	img := make([]byte, int64(next)*isoSectorSize)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	dirRecord := func(identifier []byte, extent, size uint32, dir bool, systemUse []byte) []byte {
+		raw := newISODirRecord(identifier, extent, size, systemUse, now)
+		if dir {
+			raw[25] = isoFlagDirectory
+		}
+		return raw
+	}
+	for t := range trees {
+		joliet := t == 1
+		rockRidge := opts.rockRidge && !joliet
+		var table bytes.Buffer
+		for i, dir := range dirs {
+			// libarchive wants Rock Ridge entries in every record once the root announced them
+			var self, parent []byte
+			if rockRidge {
+				self, parent = testRockRidgePX(0o40555), testRockRidgePX(0o40555)
+				if i == 0 {
+					self = append([]byte{'S', 'P', 7, 1, 0xBE, 0xEF, 0}, self...)
+				}
+			}
+			raws := [][]byte{
+				dirRecord([]byte{0}, dirLBA[t][i], isoSectorSize, true, self),
+				dirRecord([]byte{1}, dirLBA[t][dir.parent], isoSectorSize, true, parent),
+			}
+			var children [][]byte
+			for j := range dir.entry.Files {
+				f := &dir.entry.Files[j]
+				var identifier []byte
+				switch {
+				case joliet:
+					for _, u := range utf16.Encode([]rune(f.Name)) {
+						identifier = binary.BigEndian.AppendUint16(identifier, u)
+					}
+				case f.Dir:
+					identifier = []byte(strings.ToUpper(f.Name))
+				default:
+					identifier = isoFileIdentifier(f.Name)
+				}
+				var su []byte
+				if rockRidge {
+					mode := uint32(0o100444)
+					if f.Dir {
+						mode = 0o40555
+					}
+					su = append(testRockRidgePX(mode), append([]byte{'N', 'M', byte(5 + len(f.Name)), 1, 0}, f.Name...)...)
+				}
+				extent, size := dataLBA[f], uint32(len(f.Data))
+				if f.Dir {
+					for k := range dirs {
+						if dirs[k].entry == f {
+							extent, size = dirLBA[t][k], isoSectorSize
+						}
+					}
+				}
+				children = append(children, dirRecord(identifier, extent, size, f.Dir, su))
+			}
+			sort.Slice(children, func(a, b int) bool {
+				return bytes.Compare(children[a][33:33+children[a][32]], children[b][33:33+children[b][32]]) < 0
+			})
+			data, _ := packISODirectory(append(raws, children...))
+			copy(img[int64(dirLBA[t][i])*isoSectorSize:], data)
+
+			identifier := []byte{0}
+			if i > 0 {
+				identifier = nil
+				if joliet {
+					for _, u := range utf16.Encode([]rune(dir.entry.Name)) {
+						identifier = binary.BigEndian.AppendUint16(identifier, u)
+					}
+				} else {
+					identifier = []byte(strings.ToUpper(dir.entry.Name))
+				}
+			}
+			entry := make([]byte, 8+len(identifier)+len(identifier)%2)
+			entry[0] = byte(len(identifier))
+			binary.LittleEndian.PutUint32(entry[2:], dirLBA[t][i])
+			binary.LittleEndian.PutUint16(entry[6:], uint16(dir.parent+1))
+			copy(entry[8:], identifier)
+			table.Write(entry)
+		}
+		// The M path table is the L one with its numbers big endian
+		little := table.Bytes()
+		big := append([]byte(nil), little...)
+		for pos := 0; pos < len(big); pos += 8 + int(big[pos]) + int(big[pos])%2 {
+			binary.BigEndian.PutUint32(big[pos+2:], binary.LittleEndian.Uint32(little[pos+2:]))
+			binary.BigEndian.PutUint16(big[pos+6:], binary.LittleEndian.Uint16(little[pos+6:]))
+		}
+		copy(img[int64(pathTables[t])*isoSectorSize:], little)
+		copy(img[int64(pathTables[t]+1)*isoSectorSize:], big)
+
+		d := img[int64(isoFirstDescriptor+t)*isoSectorSize:][:isoSectorSize]
+		d[0] = isoPrimary
+		if joliet {
+			d[0] = isoSupplementary
+			copy(d[88:], "%/E")
+		}
+		copy(d[1:], "CD001")
+		d[6] = 1
+		putBothEndian32(d[80:], next)
+		putBothEndian16(d[120:], 1)
+		putBothEndian16(d[124:], 1)
+		putBothEndian16(d[128:], isoSectorSize)
+		putBothEndian32(d[132:], uint32(len(little)))
+		binary.LittleEndian.PutUint32(d[140:], pathTables[t])
+		binary.BigEndian.PutUint32(d[148:], pathTables[t]+1)
+		copy(d[156:190], dirRecord([]byte{0}, dirLBA[t][0], isoSectorSize, true, nil))
+		d[881] = 1
+	}
+	terminator := img[int64(isoFirstDescriptor+trees)*isoSectorSize:]
+	terminator[0] = isoTerminator
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+
+	for _, dir := range dirs {
+		for j := range dir.entry.Files {
+			if f := &dir.entry.Files[j]; dataLBA[f] != 0 {
+				copy(img[int64(dataLBA[f])*isoSectorSize:], f.Data)
+			}
+		}
+	}
+
+	switch {
+	case opts.gpt:
+		// Room for the backup GPT after the volume, tools pad hybrid images that way
+		img = append(img, make([]byte, 17*isoSectorSize)...)
+		lastLBA := uint64(len(img)/sectorSize - 1)
+		mbr := img[446:]
+		mbr[4] = mbrTypeGPT
+		binary.LittleEndian.PutUint32(mbr[8:], 1)
+		binary.LittleEndian.PutUint32(mbr[12:], uint32(lastLBA))
+		img[510], img[511] = 0x55, 0xAA
+		raw := make([]byte, sectorSize)
+		copy(raw, gptSignature)
+		binary.LittleEndian.PutUint32(raw[8:], 0x10000)
+		binary.LittleEndian.PutUint32(raw[12:], 92)
+		binary.LittleEndian.PutUint64(raw[40:], 34)
+		binary.LittleEndian.PutUint32(raw[80:], 128)
+		binary.LittleEndian.PutUint32(raw[84:], gptEntrySize)
+		entries := make([]byte, 128*gptEntrySize)
+		copy(entries, gptTypeBasicData[:])
+		entries[16] = 1
+		binary.LittleEndian.PutUint64(entries[32:], 64)
+		binary.LittleEndian.PutUint64(entries[40:], lastLBA-33)
+		if err := writeGPT(memDisk(img), &gptHeader{raw: raw, entriesLBA: 2, entries: entries}, lastLBA); err != nil {
+			panic(err)
+		}
+	case opts.mbr:
+		mbr := img[446:]
+		mbr[0], mbr[4] = 0x80, 0x17
+		binary.LittleEndian.PutUint32(mbr[12:], uint32(len(img)/sectorSize))
+		img[510], img[511] = 0x55, 0xAA
+	}
+	return img
+}
+
+// testRockRidgePX returns the Rock Ridge PX entry of a file or directory with mode
+func testRockRidgePX(mode uint32) []byte {
+	px := make([]byte, 44)
+	copy(px, "PX")
+	px[2], px[3] = 44, 1
+	putBothEndian32(px[4:], mode)
+	putBothEndian32(px[12:], 1)
+	return px
+}
+
+// readTestISOTree returns the files of the tree of d by path, directories end with a slash. It checks
+// the . and .. records, that directories follow their parents in the image and that the path table
+// points to them
+func readTestISOTree(t *testing.T, img []byte, d *isoVolumeDescriptor) map[string]string {
+	t.Helper()
+	r := memDisk(img)
+	files := make(map[string]string)
+	extents := make(map[uint32]bool)
+	var walk func(rec isoDirRecord, path string, parent uint32)
+	walk = func(rec isoDirRecord, path string, parent uint32) {
+		extents[rec.Extent] = true
+		records, err := readISODirectory(r, 0, rec)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if records[0].Extent != rec.Extent || records[1].Extent != parent {
+			t.Errorf("%s: . is at %d and .. at %d, want %d and %d", path, records[0].Extent, records[1].Extent, rec.Extent, parent)
+		}
+		for _, child := range records[2:] {
+			name := path + isoRecordName(child, d.Joliet())
+			if child.IsDir() {
+				if child.Extent <= rec.Extent {
+					t.Errorf("%s at %d is before its parent at %d", name, child.Extent, rec.Extent)
+				}
+				files[name+"/"] = ""
+				walk(child, name+"/", rec.Extent)
+				continue
+			}
+			start := int64(child.Extent) * isoSectorSize
+			files[name] = string(img[start : start+int64(child.Size)])
+		}
+	}
+	root := d.Root()
+	walk(root, "", root.Extent)
+
+	for _, table := range []struct {
+		offset int
+		order  binary.ByteOrder
+	}{{140, binary.LittleEndian}, {148, binary.BigEndian}} {
+		start := int64(table.order.Uint32(d.Raw[table.offset:])) * isoSectorSize
+		data := img[start : start+int64(binary.LittleEndian.Uint32(d.Raw[132:]))]
+		count := 0
+		for pos := 0; pos < len(data); pos += 8 + int(data[pos]) + int(data[pos])%2 {
+			if extent := table.order.Uint32(data[pos+2:]); !extents[extent] {
+				t.Errorf("the path table points to %d, which isn't a directory of the tree", extent)
+			}
+			count++
+		}
+		if count != len(extents) {
+			t.Errorf("%d entries in the path table for %d directories", count, len(extents))
+		}
+	}
+	return files
+}
+
+func TestRemasterISO(t *testing.T) {
+	tree := func(config string) []testISOEntry {
+		files := []testISOEntry{
+			{Name: "boot", Dir: true, Files: []testISOEntry{
+				{Name: "grub2", Dir: true, Files: []testISOEntry{{Name: "grub.cfg", Data: "menuentry\n"}}},
+				{Name: "kernel", Data: strings.Repeat("k", 5000)},
+			}},
+			{Name: "efi", Dir: true, Files: []testISOEntry{
+				{Name: "boot", Dir: true, Files: []testISOEntry{{Name: "bootx64.efi", Data: "MZ"}}},
+			}},
+			{Name: "readme", Data: "hello\n"},
+		}
+		if config != "" {
+			files = append(files, testISOEntry{Name: config, Data: "old\n"})
+		}
+		return files
+	}
+	// want returns the files every tree should list after remastering, names as the tree shows them
+	want := func(upper bool, config string, extra ...string) map[string]string {
+		files := map[string]string{
+			"boot/": "", "boot/grub2/": "", "boot/grub2/grub.cfg": "menuentry\n", "boot/kernel": strings.Repeat("k", 5000),
+			"efi/": "", "efi/boot/": "", "efi/boot/bootx64.efi": "MZ",
+			"readme": "hello\n", remasterConfigName: config,
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			files[extra[i]] = extra[i+1]
+		}
+		if !upper {
+			return files
+		}
+		out := make(map[string]string, len(files))
+		for name, data := range files {
+			out[strings.ToUpper(name)] = data
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		files  []testISOEntry
+		opts   testISOOptions
+		upper  bool
+		extra  []string
+		joliet []string
+	}{
+		{name: "plain", files: tree(""), upper: true},
+		{name: "plain replaces", files: tree("config.yaml"), upper: true},
+		{name: "rock ridge", files: tree("config.yaml"), opts: testISOOptions{rockRidge: true}},
+		// Rock Ridge names are case sensitive, the file is added next to Config.yaml
+		{name: "rock ridge case", files: tree("Config.yaml"), opts: testISOOptions{rockRidge: true}, extra: []string{"Config.yaml", "old\n"}},
+		{name: "joliet", files: tree("CONFIG.YAML"), opts: testISOOptions{joliet: true}, upper: true},
+		{name: "rock ridge and joliet", files: tree(""), opts: testISOOptions{rockRidge: true, joliet: true}},
+		{name: "mbr", files: tree(""), opts: testISOOptions{rockRidge: true, mbr: true}},
+		{name: "gpt", files: tree(""), opts: testISOOptions{rockRidge: true, joliet: true, gpt: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := buildTestISO(tt.files, tt.opts)
+			// Remastered twice, the second config replaces the first
+			for _, config := range []string{"#cloud-config\nfirst: true\n", "#cloud-config\nsecond: true\n"} {
+				out := make(memDisk, len(img)+1024*1024)
+				size, err := RemasterISO(memDisk(img), int64(len(img)), out, remasterConfigName, []byte(config), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if size%isoSectorSize != 0 || size <= int64(len(img)) {
+					t.Fatalf("RemasterISO() = %d for an image of %d bytes", size, len(img))
+				}
+				img = out[:size]
+
+				descriptors, err := readISOVolumeDescriptors(memDisk(img), 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, d := range descriptors {
+					if end := int64(d.VolumeSpaceSize()) * isoSectorSize; end != size {
+						t.Errorf("volume of %d bytes in an image of %d", end, size)
+					}
+					wantFiles := want(tt.upper, config, tt.extra...)
+					if d.Joliet() {
+						wantFiles = want(false, config)
+					}
+					if got := readTestISOTree(t, img, d); fmt.Sprint(got) != fmt.Sprint(wantFiles) {
+						t.Errorf("tree %d: files %q, want %q", d.Type(), got, wantFiles)
+					}
+				}
+				checkRemasteredPartitions(t, img, tt.opts)
+			}
+			checkWithBsdtar(t, img, tt.opts.rockRidge || tt.opts.joliet)
+		})
+	}
+}
+
+// checkRemasteredPartitions checks the partitions holding the image were grown to its new size
+func checkRemasteredPartitions(t *testing.T, img []byte, opts testISOOptions) {
+	t.Helper()
+	if !opts.mbr && !opts.gpt {
+		return
+	}
+	mbr, err := readMBR(memDisk(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastLBA := uint64(len(img)/sectorSize - 1)
+	if opts.mbr {
+		if int64(mbr[0].StartLBA)+int64(mbr[0].Sectors) != int64(len(img)/sectorSize) {
+			t.Errorf("MBR partition %+v doesn't reach the end of the image", mbr[0])
+		}
+		return
+	}
+	if uint64(mbr[0].StartLBA)+uint64(mbr[0].Sectors) != lastLBA+1 {
+		t.Errorf("protective MBR %+v doesn't reach LBA %d", mbr[0], lastLBA)
+	}
+	d := memDisk(img)
+	entries := checkGPTHeader(t, d, 1, lastLBA)
+	if !bytes.Equal(entries, checkGPTHeader(t, d, lastLBA, 1)) {
+		t.Error("the backup GPT entries differ from the primary ones")
+	}
+	if got := binary.LittleEndian.Uint64(entries[40:]); got != lastLBA-33 {
+		t.Errorf("GPT partition ends at LBA %d, want %d", got, lastLBA-33)
+	}
+}
+
+// checkWithBsdtar lists the image with libarchive, which reads it in order and warns about directories
+// it has passed, when bsdtar is installed
+func checkWithBsdtar(t *testing.T, img []byte, extensions bool) {
+	t.Helper()
+	if _, err := exec.LookPath("bsdtar"); err != nil {
+		return
+	}
+	path := filepath.Join(t.TempDir(), "remastered.iso")
+	if err := os.WriteFile(path, img, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("bsdtar", "-tf", path)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil || stderr.Len() > 0 {
+		t.Fatalf("bsdtar: %v\n%s", err, stderr.String())
+	}
+	name := remasterConfigName
+	if !extensions {
+		name = strings.ToUpper(name)
+	}
+	if !strings.Contains("\n"+string(out), "\n"+name+"\n") {
+		t.Errorf("bsdtar doesn't list %s:\n%s", name, out)
+	}
+}
+
+func TestAddISOFile(t *testing.T) {
+	root := func(su []byte, names ...string) []isoDirRecord {
+		raws := [][]byte{newISODirRecord([]byte{0}, 20, isoSectorSize, su, time.Time{}), newISODirRecord([]byte{1}, 20, isoSectorSize, nil, time.Time{})}
+		for _, name := range names {
+			raws = append(raws, newISODirRecord([]byte(name), 30, 1, nil, time.Time{}))
+		}
+		var records []isoDirRecord
+		for _, raw := range raws {
+			rec, _ := parseISODirRecord(raw)
+			records = append(records, rec)
+		}
+		return records
+	}
+	tests := []struct {
+		name    string
+		records []isoDirRecord
+		want    []string
+	}{
+		{"empty", root(nil), []string{"CONFIG.YAML;1"}},
+		{"sorted", root(nil, "BOOT.CAT;1", "README.;1"), []string{"BOOT.CAT;1", "CONFIG.YAML;1", "README.;1"}},
+		{"replaced", root(nil, "A.;1", "CONFIG.YAML;1", "Z.;1"), []string{"A.;1", "CONFIG.YAML;1", "Z.;1"}},
+		{"replaced ignoring case", root(nil, "config.yaml;1"), []string{"CONFIG.YAML;1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raws := addISOFile(tt.records, false, "config.yaml", 40, 10, time.Time{})
+			var got []string
+			for _, raw := range raws[2:] {
+				rec, _ := parseISODirRecord(raw)
+				got = append(got, string(rec.Identifier))
+				if string(rec.Identifier) == "CONFIG.YAML;1" && (rec.Extent != 40 || rec.Size != 10) {
+					t.Errorf("the new record points to %d with %d bytes", rec.Extent, rec.Size)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("addISOFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Signature states recorded in the library
+const (
+	SignatureVerified = "verified"
+	SignatureFailed   = "failed"
+	SignatureUnsigned = "unsigned"
+)
+
+// SignatureResult is the outcome of checking the signature of a release artifact
+type SignatureResult struct {
+	// Status is one of the Signature* constants, empty when verification is not configured
+	Status string
+	// Signer is the identity in the signing certificate, or the key file for key based verification
+	Signer string
+	// Issuer is the OIDC issuer that vouched for Signer in keyless signatures
+	Issuer string
+	Err    error
+}
+
+// SignatureConfig is the trust policy for release signatures
+type SignatureConfig struct {
+	// PublicKey is a PEM public key file, when set signatures are verified against it instead of certificates
+	PublicKey string `json:"public_key"`
+	// TrustRoot is a PEM file with the Fulcio root and intermediate certificates keyless signing certificates must chain to
+	TrustRoot string `json:"trust_root"`
+	// RekorPublicKey is a PEM file with the transparency log key, keyless signatures need a bundle whose
+	// log entry it verifies for the signing time
+	RekorPublicKey string `json:"rekor_public_key"`
+	// Identity is a regular expression the certificate identity must match
+	Identity string `json:"identity"`
+	// Issuer is the OIDC issuer the certificate must have been issued for
+	Issuer string `json:"issuer"`
+	// Require blocks burning images that are unsigned or could not be verified, not only those that failed
+	Require bool `json:"require"`
+}
+
+// configured tells if there is something to verify signatures against
+func (c SignatureConfig) configured() bool {
+	return c.PublicKey != "" || c.TrustRoot != ""
+}
+
+// OIDs of the Fulcio certificate extensions holding the OIDC issuer
+var (
+	oidFulcioIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// cosignBundle is the file written by cosign sign-blob --bundle
+type cosignBundle struct {
+	Base64Signature string `json:"base64Signature"`
+	Cert            string `json:"cert"`
+	RekorBundle     *struct {
+		SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+		Payload              struct {
+			Body           string `json:"body"`
+			IntegratedTime int64  `json:"integratedTime"`
+			LogIndex       int64  `json:"logIndex"`
+			LogID          string `json:"logID"`
+		} `json:"Payload"`
+	} `json:"rekorBundle"`
+}
+
+// signatureAssetsFor returns the cosign signature, certificate and bundle assets published for the
+// checksum file of asset. Kairos signs the .sha256 files, which in turn cover the images
+func signatureAssetsFor(asset ReleaseAsset, assets []ReleaseAsset) (sig, cert, bundle *ReleaseAsset) {
+	signed := asset.Name + ".sha256"
+	for i, a := range assets {
+		if a.Version != asset.Version {
+			continue
+		}
+		switch a.Name {
+		case signed + ".sig":
+			sig = &assets[i]
+		case signed + ".pem", signed + ".cert":
+			cert = &assets[i]
+		case signed + ".bundle", signed + ".sigstore.json":
+			bundle = &assets[i]
+		}
+	}
+	return sig, cert, bundle
+}
+
+// VerifyReleaseSignature downloads the signature assets of asset and verifies them against checksumFile,
+// the contents of its .sha256 file. Everything is checked offline against the configured trust root
+func VerifyReleaseSignature(ctx context.Context, asset ReleaseAsset, assets []ReleaseAsset, checksumFile []byte) SignatureResult {
+	cfg := appConfig.Signature
+	if !cfg.configured() {
+		return SignatureResult{}
+	}
+	sigAsset, certAsset, bundleAsset := signatureAssetsFor(asset, assets)
+	var sig, cert, bundle []byte
+	var err error
+	if bundleAsset != nil {
+		if bundle, err = fetchSmallFile(ctx, bundleAsset.URL); err != nil {
+			return SignatureResult{Status: SignatureFailed, Err: fmt.Errorf("fetching signature bundle: %w", err)}
+		}
+	} else if sigAsset != nil {
+		if sig, err = fetchSmallFile(ctx, sigAsset.URL); err != nil {
+			return SignatureResult{Status: SignatureFailed, Err: fmt.Errorf("fetching signature: %w", err)}
+		}
+		if certAsset != nil {
+			if cert, err = fetchSmallFile(ctx, certAsset.URL); err != nil {
+				return SignatureResult{Status: SignatureFailed, Err: fmt.Errorf("fetching certificate: %w", err)}
+			}
+		}
+	} else {
+		return SignatureResult{Status: SignatureUnsigned, Err: errors.New("no signature published for " + asset.Name)}
+	}
+	return VerifyBlobSignature(checksumFile, sig, cert, bundle, cfg)
+}
+
+// VerifyBlobSignature verifies a cosign signature over blob. sig and cert are the contents of the
+// .sig and .pem files, or bundle the contents of a cosign bundle
+func VerifyBlobSignature(blob, sig, cert, bundle []byte, cfg SignatureConfig) SignatureResult {
+	fail := func(err error) SignatureResult {
+		return SignatureResult{Status: SignatureFailed, Err: err}
+	}
+
+	var b cosignBundle
+	if bundle != nil {
+		if err := json.Unmarshal(bundle, &b); err != nil {
+			return fail(fmt.Errorf("invalid signature bundle: %w", err))
+		}
+		sig = []byte(b.Base64Signature)
+		cert = []byte(b.Cert)
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fail(fmt.Errorf("invalid signature encoding: %w", err))
+	}
+
+	if cfg.PublicKey != "" {
+		pub, err := readPublicKey(cfg.PublicKey)
+		if err != nil {
+			return fail(err)
+		}
+		if err := verifyWithKey(pub, blob, rawSig); err != nil {
+			return fail(err)
+		}
+		return SignatureResult{Status: SignatureVerified, Signer: cfg.PublicKey}
+	}
+
+	if len(cert) == 0 {
+		return fail(errors.New("keyless signature without a certificate"))
+	}
+	leaf, err := parseSigningCert(cert)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Fulcio certificates only live for minutes, the chain has to be valid when the signature was made.
+	// Only the transparency log entry of a bundle proves that time, the certificate can't vouch for itself
+	if b.RekorBundle == nil {
+		return fail(errors.New("keyless signature without a transparency log entry, a bundle is needed"))
+	}
+	if cfg.RekorPublicKey == "" {
+		return fail(errors.New("no transparency log key configured to check keyless signatures"))
+	}
+	signedAt, err := verifyRekorBundle(&b, blob, rawSig, leaf, cfg.RekorPublicKey)
+	if err != nil {
+		return fail(err)
+	}
+	if err := verifyCertChain(leaf, cfg.TrustRoot, signedAt); err != nil {
+		return fail(err)
+	}
+
+	signer, issuer := certIdentity(leaf)
+	if cfg.Identity != "" {
+		re, err := regexp.Compile(cfg.Identity)
+		if err != nil {
+			return fail(fmt.Errorf("invalid identity pattern: %w", err))
+		}
+		if !re.MatchString(signer) {
+			return SignatureResult{Status: SignatureFailed, Signer: signer, Issuer: issuer, Err: fmt.Errorf("signed by %s which doesn't match %s", signer, cfg.Identity)}
+		}
+	}
+	if cfg.Issuer != "" && issuer != cfg.Issuer {
+		return SignatureResult{Status: SignatureFailed, Signer: signer, Issuer: issuer, Err: fmt.Errorf("certificate issued for %q, expected %q", issuer, cfg.Issuer)}
+	}
+	if err := verifyWithKey(leaf.PublicKey, blob, rawSig); err != nil {
+		return SignatureResult{Status: SignatureFailed, Signer: signer, Issuer: issuer, Err: err}
+	}
+	return SignatureResult{Status: SignatureVerified, Signer: signer, Issuer: issuer}
+}
+
+// verifyWithKey checks sig over the sha256 of blob as cosign produces it
+func verifyWithKey(pub crypto.PublicKey, blob, sig []byte) error {
+	digest := sha256.Sum256(blob)
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(key, digest[:], sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil || rsa.VerifyPSS(key, crypto.SHA256, digest[:], sig, nil) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, blob, sig) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return errors.New("signature does not match")
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// parseSigningCert parses a certificate as published by cosign, PEM that may be base64 encoded once more
+func parseSigningCert(data []byte) (*x509.Certificate, error) {
+	data = bytes.TrimSpace(data)
+	if !bytes.HasPrefix(data, []byte("-----BEGIN")) {
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate encoding: %w", err)
+		}
+		data = decoded
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// verifyCertChain checks that leaf chains up to a root in trustRoot at the time t
+func verifyCertChain(leaf *x509.Certificate, trustRoot string, t time.Time) error {
+	data, err := os.ReadFile(trustRoot)
+	if err != nil {
+		return fmt.Errorf("reading trust root: %w", err)
+	}
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("invalid certificate in trust root: %w", err)
+		}
+		// Self signed certificates are roots, anything else an intermediate
+		if bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil {
+			roots.AddCert(c)
+		} else {
+			intermediates.AddCert(c)
+		}
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   t,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate is not trusted: %w", err)
+	}
+	return nil
+}
+
+// certIdentity returns the signer identity (workflow URI or email) and OIDC issuer of a Fulcio certificate
+func certIdentity(cert *x509.Certificate) (signer, issuer string) {
+	if len(cert.URIs) > 0 {
+		signer = cert.URIs[0].String()
+	} else if len(cert.EmailAddresses) > 0 {
+		signer = cert.EmailAddresses[0]
+	}
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidFulcioIssuerV2):
+			var s string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &s, "utf8"); err == nil {
+				issuer = s
+			}
+		case ext.Id.Equal(oidFulcioIssuer) && issuer == "":
+			issuer = string(ext.Value)
+		}
+	}
+	return signer, issuer
+}
+
+// verifyRekorBundle checks the transparency log promise of a bundle and that the log entry is for
+// this very signature, certificate and blob. It returns when the entry was added to the log
+func verifyRekorBundle(b *cosignBundle, blob, sig []byte, leaf *x509.Certificate, rekorKeyPath string) (time.Time, error) {
+	pub, err := readPublicKey(rekorKeyPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	payload := b.RekorBundle.Payload
+	// The timestamp is signed over the canonical json of the payload, keys sorted and no spaces
+	canonical, err := json.Marshal(struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogID          string `json:"logID"`
+		LogIndex       int64  `json:"logIndex"`
+	}{payload.Body, payload.IntegratedTime, payload.LogID, payload.LogIndex})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := verifyWithKey(pub, canonical, b.RekorBundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("transparency log timestamp: %w", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry: %w", err)
+	}
+	var entry struct {
+		Spec struct {
+			Data struct {
+				Hash struct {
+					Value string `json:"value"`
+				} `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content   string `json:"content"`
+				PublicKey struct {
+					Content string `json:"content"`
+				} `json:"publicKey"`
+			} `json:"signature"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry: %w", err)
+	}
+	digest := sha256.Sum256(blob)
+	if !strings.EqualFold(entry.Spec.Data.Hash.Value, hex.EncodeToString(digest[:])) {
+		return time.Time{}, errors.New("transparency log entry is for another file")
+	}
+	if entry.Spec.Signature.Content != base64.StdEncoding.EncodeToString(sig) {
+		return time.Time{}, errors.New("transparency log entry is for another signature")
+	}
+	// The entry holds the signing certificate as base64 PEM
+	logged, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.PublicKey.Content)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry: %w", err)
+	}
+	if cert, err := parseSigningCert(logged); err != nil || !cert.Equal(leaf) {
+		return time.Time{}, errors.New("transparency log entry is for another certificate")
+	}
+	if payload.IntegratedTime <= 0 {
+		return time.Time{}, errors.New("transparency log entry without an integration time")
+	}
+	return time.Unix(payload.IntegratedTime, 0), nil
+}
+
+// CheckBurnSignature returns an error if the image at path must not be burned because of its signature:
+// it failed verification when downloaded, or verified signatures are required and it has none
+func CheckBurnSignature(path string) error {
+	entry, ok := findLibraryEntry(path)
+	if ok && entry.Signature == SignatureFailed {
+		return signatureError{fmt.Errorf("signature verification failed for %s: %s", entry.Name, entry.SignatureError)}
+	}
+	if appConfig.Signature.Require && (!ok || entry.Signature != SignatureVerified) {
+		return signatureError{fmt.Errorf("%s has no verified signature and signatures are required", path)}
+	}
+	return nil
+}
+
+// signatureError is returned for images refused for their signature
+type signatureError struct{ error }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	squashfsMagic          = 0x73717368
+	squashfsMetadataSize   = 8192
+	squashfsNoFragment     = 0xFFFFFFFF
+	squashfsUncompressed   = 1 << 15 // in metadata block headers
+	squashfsUncompressedDB = 1 << 24 // in data block sizes
+	squashfsGzip           = 1
+
+	squashfsBasicDir      = 1
+	squashfsBasicFile     = 2
+	squashfsBasicSymlink  = 3
+	squashfsExtDir        = 8
+	squashfsExtFile       = 9
+	squashfsExtSymlink    = 10
+	squashfsMaxFileSize   = 16 * 1024 * 1024
+	squashfsMaxSymlinkHop = 16
+)
+
+// squashfsCompressors are the names of the compression ids, to tell which one we can't read
+var squashfsCompressors = map[uint16]string{1: "gzip", 2: "lzma", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"}
+
+// squashfs reads small files out of a squashfs 4.0 image, enough to find the os-release of a root
+// filesystem. Only gzip compression is supported, the only one the standard library has
+type squashfs struct {
+	r          io.ReaderAt
+	blockSize  uint32
+	rootInode  uint64
+	inodeTable int64
+	dirTable   int64
+	fragTable  int64
+}
+
+// squashfsInode is the part of an inode we need
+type squashfsInode struct {
+	kind uint16
+	// Directories
+	dirBlock  uint32
+	dirOffset uint16
+	dirSize   uint32
+	// Files
+	fileBlock  uint64
+	fileSize   uint64
+	fragment   uint32
+	fragOffset uint32
+	blockSizes []uint32
+	// Symlinks
+	target string
+}
+
+func openSquashfs(r io.ReaderAt) (*squashfs, error) {
+	sb := make([]byte, 96)
+	if _, err := r.ReadAt(sb, 0); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(sb) != squashfsMagic {
+		return nil, errors.New("not a squashfs image")
+	}
+	if major := binary.LittleEndian.Uint16(sb[28:]); major != 4 {
+		return nil, fmt.Errorf("unsupported squashfs version %d", major)
+	}
+	if compressor := binary.LittleEndian.Uint16(sb[20:]); compressor != squashfsGzip {
+		name, ok := squashfsCompressors[compressor]
+		if !ok {
+			name = fmt.Sprintf("compressor %d", compressor)
+		}
+		return nil, fmt.Errorf("squashfs compressed with %s, only gzip can be read", name)
+	}
+	return &squashfs{
+		r:          r,
+		blockSize:  binary.LittleEndian.Uint32(sb[12:]),
+		rootInode:  binary.LittleEndian.Uint64(sb[32:]),
+		inodeTable: int64(binary.LittleEndian.Uint64(sb[64:])),
+		dirTable:   int64(binary.LittleEndian.Uint64(sb[72:])),
+		fragTable:  int64(binary.LittleEndian.Uint64(sb[80:])),
+	}, nil
+}
+
+func (fs *squashfs) decompress(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(io.LimitReader(zr, int64(max(fs.blockSize, squashfsMetadataSize))))
+}
+
+// metadataBlock reads the metadata block at pos and returns its content and the position of the next one
+func (fs *squashfs) metadataBlock(pos int64) ([]byte, int64, error) {
+	header := make([]byte, 2)
+	if _, err := fs.r.ReadAt(header, pos); err != nil {
+		return nil, 0, err
+	}
+	size := binary.LittleEndian.Uint16(header)
+	data := make([]byte, size&^squashfsUncompressed)
+	if _, err := fs.r.ReadAt(data, pos+2); err != nil {
+		return nil, 0, err
+	}
+	next := pos + 2 + int64(len(data))
+	if size&squashfsUncompressed != 0 {
+		return data, next, nil
+	}
+	data, err := fs.decompress(data)
+	return data, next, err
+}
+
+// metadata reads n bytes of the metadata table at start, from offset in the block at block
+func (fs *squashfs) metadata(start int64, block uint64, offset uint16, n int) ([]byte, error) {
+	pos := start + int64(block)
+	data, next, err := fs.metadataBlock(pos)
+	if err != nil {
+		return nil, err
+	}
+	if int(offset) > len(data) {
+		return nil, errors.New("invalid squashfs metadata offset")
+	}
+	data = data[offset:]
+	for len(data) < n {
+		var more []byte
+		if more, next, err = fs.metadataBlock(next); err != nil {
+			return nil, err
+		}
+		if len(more) == 0 {
+			return nil, errors.New("truncated squashfs metadata")
+		}
+		data = append(data, more...)
+	}
+	return data[:n], nil
+}
+
+// inode reads the inode at ref, the block in the upper bits and the offset in the lower 16
+func (fs *squashfs) inode(ref uint64) (*squashfsInode, error) {
+	block, offset := ref>>16, uint16(ref)
+	header, err := fs.metadata(fs.inodeTable, block, offset, 16)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	in := &squashfsInode{kind: le.Uint16(header)}
+	// Size of the fixed part of each type, block sizes and symlink targets are read after
+	sizes := map[uint16]int{
+		squashfsBasicDir: 32, squashfsExtDir: 40, squashfsBasicFile: 32, squashfsExtFile: 56,
+		squashfsBasicSymlink: 24, squashfsExtSymlink: 24,
+	}
+	size, ok := sizes[in.kind]
+	if !ok {
+		return in, nil
+	}
+	data, err := fs.metadata(fs.inodeTable, block, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	body := data[16:]
+	var blocksAt int
+	switch in.kind {
+	case squashfsBasicDir:
+		in.dirBlock, in.dirSize, in.dirOffset = le.Uint32(body), uint32(le.Uint16(body[8:])), le.Uint16(body[10:])
+		return in, nil
+	case squashfsExtDir:
+		in.dirSize, in.dirBlock, in.dirOffset = le.Uint32(body[4:]), le.Uint32(body[8:]), le.Uint16(body[18:])
+		return in, nil
+	case squashfsBasicFile:
+		in.fileBlock, in.fragment, in.fragOffset, in.fileSize = uint64(le.Uint32(body)), le.Uint32(body[4:]), le.Uint32(body[8:]), uint64(le.Uint32(body[12:]))
+		blocksAt = 16 + 16
+	case squashfsExtFile:
+		in.fileBlock, in.fileSize, in.fragment, in.fragOffset = le.Uint64(body), le.Uint64(body[8:]), le.Uint32(body[28:]), le.Uint32(body[32:])
+		blocksAt = 16 + 40
+	case squashfsBasicSymlink, squashfsExtSymlink:
+		size := int(le.Uint32(body[4:]))
+		if size > 4096 {
+			return nil, errors.New("invalid squashfs symlink")
+		}
+		data, err := fs.metadata(fs.inodeTable, block, offset, 16+8+size)
+		if err != nil {
+			return nil, err
+		}
+		in.target = string(data[24:])
+		return in, nil
+	}
+
+	if in.fileSize > squashfsMaxFileSize {
+		return nil, fmt.Errorf("file of %d bytes is too large", in.fileSize)
+	}
+	blocks := in.fileSize / uint64(fs.blockSize)
+	if in.fragment == squashfsNoFragment && in.fileSize%uint64(fs.blockSize) != 0 {
+		blocks++
+	}
+	data, err = fs.metadata(fs.inodeTable, block, offset, blocksAt+int(blocks)*4)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(blocks); i++ {
+		in.blockSizes = append(in.blockSizes, le.Uint32(data[blocksAt+i*4:]))
+	}
+	return in, nil
+}
+
+// lookup returns the inode reference of name in the directory dir
+func (fs *squashfs) lookup(dir *squashfsInode, name string) (uint64, error) {
+	// The size counts 3 bytes for the implicit . and ..
+	if dir.dirSize <= 3 {
+		return 0, fmt.Errorf("%s not found", name)
+	}
+	data, err := fs.metadata(fs.dirTable, uint64(dir.dirBlock), dir.dirOffset, int(dir.dirSize-3))
+	if err != nil {
+		return 0, err
+	}
+	le := binary.LittleEndian
+	for len(data) >= 12 {
+		count, start := int(le.Uint32(data))+1, le.Uint32(data[4:])
+		data = data[12:]
+		for i := 0; i < count && len(data) >= 8; i++ {
+			offset, nameSize := le.Uint16(data), int(le.Uint16(data[6:]))+1
+			if len(data) < 8+nameSize {
+				return 0, errors.New("invalid squashfs directory")
+			}
+			if string(data[8:8+nameSize]) == name {
+				return uint64(start)<<16 | uint64(offset), nil
+			}
+			data = data[8+nameSize:]
+		}
+	}
+	return 0, fmt.Errorf("%s not found", name)
+}
+
+// resolve returns the inode at the absolute path p, following symlinks
+func (fs *squashfs) resolve(p string, hops int) (*squashfsInode, error) {
+	if hops > squashfsMaxSymlinkHop {
+		return nil, errors.New("too many levels of symbolic links")
+	}
+	current, err := fs.inode(fs.rootInode)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		if current.kind != squashfsBasicDir && current.kind != squashfsExtDir {
+			return nil, fmt.Errorf("%s not found", p)
+		}
+		ref, err := fs.lookup(current, part)
+		if err != nil {
+			return nil, fmt.Errorf("%s not found", p)
+		}
+		if current, err = fs.inode(ref); err != nil {
+			return nil, err
+		}
+		if current.kind == squashfsBasicSymlink || current.kind == squashfsExtSymlink {
+			target := current.target
+			if !path.IsAbs(target) {
+				target = path.Join("/", path.Join(parts[:i]...), target)
+			}
+			return fs.resolve(path.Join(append([]string{target}, parts[i+1:]...)...), hops+1)
+		}
+	}
+	return current, nil
+}
+
+// ReadFile returns the content of the regular file at the absolute path p
+func (fs *squashfs) ReadFile(p string) ([]byte, error) {
+	in, err := fs.resolve(p, 0)
+	if err != nil {
+		return nil, err
+	}
+	if in.kind != squashfsBasicFile && in.kind != squashfsExtFile {
+		return nil, fmt.Errorf("%s is not a regular file", p)
+	}
+
+	var out []byte
+	pos := int64(in.fileBlock)
+	for _, size := range in.blockSizes {
+		onDisk := size &^ squashfsUncompressedDB
+		if onDisk == 0 {
+			// Sparse block
+			out = append(out, make([]byte, fs.blockSize)...)
+			continue
+		}
+		data := make([]byte, onDisk)
+		if _, err := fs.r.ReadAt(data, pos); err != nil {
+			return nil, err
+		}
+		pos += int64(onDisk)
+		if size&squashfsUncompressedDB == 0 {
+			if data, err = fs.decompress(data); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, data...)
+	}
+
+	if in.fragment != squashfsNoFragment {
+		entry, err := fs.fragmentEntry(in.fragment)
+		if err != nil {
+			return nil, err
+		}
+		onDisk := binary.LittleEndian.Uint32(entry[8:])
+		data := make([]byte, onDisk&^squashfsUncompressedDB)
+		if _, err := fs.r.ReadAt(data, int64(binary.LittleEndian.Uint64(entry))); err != nil {
+			return nil, err
+		}
+		if onDisk&squashfsUncompressedDB == 0 {
+			if data, err = fs.decompress(data); err != nil {
+				return nil, err
+			}
+		}
+		tail := in.fileSize % uint64(fs.blockSize)
+		if uint64(in.fragOffset)+tail > uint64(len(data)) {
+			return nil, errors.New("invalid squashfs fragment")
+		}
+		out = append(out, data[in.fragOffset:uint64(in.fragOffset)+tail]...)
+	}
+	if uint64(len(out)) < in.fileSize {
+		return nil, errors.New("truncated squashfs file")
+	}
+	return out[:in.fileSize], nil
+}
+
+// fragmentEntry returns the 16 byte entry of fragment i, the table is an index of metadata blocks
+func (fs *squashfs) fragmentEntry(i uint32) ([]byte, error) {
+	const perBlock = squashfsMetadataSize / 16
+	index := make([]byte, 8)
+	if _, err := fs.r.ReadAt(index, fs.fragTable+int64(i/perBlock)*8); err != nil {
+		return nil, err
+	}
+	block := int64(binary.LittleEndian.Uint64(index))
+	return fs.metadata(block, 0, uint16(i%perBlock*16), 16)
+}
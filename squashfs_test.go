@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testSquashfsEntry is a file, directory or symlink of the images built by buildTestSquashfs
+type testSquashfsEntry struct {
+	Name   string
+	Data   string
+	Target string
+	Dir    bool
+	Files  []testSquashfsEntry
+}
+
+const testSquashfsBlockSize = 4096
+
+// buildTestSquashfs returns a squashfs 4.0 image holding files, gzip compressed or not. File tails go
+// to fragments when fragments is set. Compressed images keep each metadata table in a single block,
+// uncompressed ones may span several
+func buildTestSquashfs(files []testSquashfsEntry, compress, fragments bool) []byte {
+	le := binary.LittleEndian
+	type node struct {
+		entry    *testSquashfsEntry
+		parent   int
+		children []int
+		// Files
+		start      uint64
+		blockSizes []uint32
+		fragment   uint32
+		fragOffset uint32
+		// Offsets in the inode and directory tables before they are split into blocks
+		inodeAt, dirAt, dirSize int
+	}
+	nodes := []*node{{entry: &testSquashfsEntry{Dir: true, Files: files}}}
+	for i := 0; i < len(nodes); i++ {
+		for j := range nodes[i].entry.Files {
+			nodes[i].children = append(nodes[i].children, len(nodes))
+			nodes = append(nodes, &node{entry: &nodes[i].entry.Files[j], parent: i})
+		}
+		sort.Slice(nodes[i].children, func(a, b int) bool {
+			return nodes[nodes[i].children[a]].entry.Name < nodes[nodes[i].children[b]].entry.Name
+		})
+	}
+	isFile := func(n *node) bool { return !n.entry.Dir && n.entry.Target == "" }
+	encode := func(data []byte) ([]byte, bool) {
+		if !compress {
+			return data, false
+		}
+		var b bytes.Buffer
+		zw := zlib.NewWriter(&b)
+		zw.Write(data)
+		zw.Close()
+		if b.Len() >= len(data) {
+			return data, false
+		}
+		return b.Bytes(), true
+	}
+
+	// Data blocks, then the fragment blocks holding the tails
+	img := make([]byte, 96)
+	var fragment, fragmentTable []byte
+	flushFragment := func() {
+		if len(fragment) == 0 {
+			return
+		}
+		data, compressed := encode(fragment)
+		size := uint32(len(data))
+		if !compressed {
+			size |= squashfsUncompressedDB
+		}
+		fragmentTable = le.AppendUint64(fragmentTable, uint64(len(img)))
+		fragmentTable = le.AppendUint32(fragmentTable, size)
+		fragmentTable = le.AppendUint32(fragmentTable, 0)
+		img = append(img, data...)
+		fragment = nil
+	}
+	for _, n := range nodes {
+		if !isFile(n) {
+			continue
+		}
+		data := []byte(n.entry.Data)
+		n.start, n.fragment = uint64(len(img)), squashfsNoFragment
+		for len(data) > 0 {
+			block := data[:min(len(data), testSquashfsBlockSize)]
+			if len(block) < testSquashfsBlockSize && fragments {
+				if len(fragment)+len(block) > testSquashfsBlockSize {
+					flushFragment()
+				}
+				n.fragment, n.fragOffset = uint32(len(fragmentTable)/16), uint32(len(fragment))
+				fragment = append(fragment, block...)
+				break
+			}
+			data = data[len(block):]
+			if bytes.Count(block, []byte{0}) == testSquashfsBlockSize {
+				// Sparse, nothing is stored
+				n.blockSizes = append(n.blockSizes, 0)
+				continue
+			}
+			encoded, compressed := encode(block)
+			size := uint32(len(encoded))
+			if !compressed {
+				size |= squashfsUncompressedDB
+			}
+			n.blockSizes = append(n.blockSizes, size)
+			img = append(img, encoded...)
+		}
+	}
+	flushFragment()
+
+	// Where an offset of a table lands once split in metadata blocks, relative to the table
+	blockStart := func(at int) uint64 {
+		if compress {
+			if at >= squashfsMetadataSize {
+				panic("compressed test squashfs tables must fit a metadata block")
+			}
+			return 0
+		}
+		return uint64(at / squashfsMetadataSize * (squashfsMetadataSize + 2))
+	}
+	ref := func(at int) uint64 { return blockStart(at)<<16 | uint64(at%squashfsMetadataSize) }
+
+	inodeSize := 0
+	for _, n := range nodes {
+		n.inodeAt = inodeSize
+		switch {
+		case n.entry.Dir:
+			inodeSize += 32
+		case n.entry.Target != "":
+			inodeSize += 24 + len(n.entry.Target)
+		case len(n.entry.Data) > testSquashfsBlockSize:
+			inodeSize += 56 + 4*len(n.blockSizes)
+		default:
+			inodeSize += 32 + 4*len(n.blockSizes)
+		}
+	}
+
+	var dirs []byte
+	for _, n := range nodes {
+		if !n.entry.Dir {
+			continue
+		}
+		n.dirAt = len(dirs)
+		// A header starts each run of entries whose inodes are in the same metadata block
+		for i := 0; i < len(n.children); {
+			block := blockStart(nodes[n.children[i]].inodeAt)
+			end := i
+			for end < len(n.children) && end-i < 256 && blockStart(nodes[n.children[end]].inodeAt) == block {
+				end++
+			}
+			dirs = le.AppendUint32(dirs, uint32(end-i-1))
+			dirs = le.AppendUint32(dirs, uint32(block))
+			dirs = le.AppendUint32(dirs, uint32(n.children[i]+1))
+			for _, c := range n.children[i:end] {
+				child := nodes[c]
+				kind := uint16(squashfsBasicFile)
+				switch {
+				case child.entry.Dir:
+					kind = squashfsBasicDir
+				case child.entry.Target != "":
+					kind = squashfsBasicSymlink
+				}
+				dirs = le.AppendUint16(dirs, uint16(child.inodeAt%squashfsMetadataSize))
+				dirs = le.AppendUint16(dirs, uint16(c-n.children[i]))
+				dirs = le.AppendUint16(dirs, kind)
+				dirs = le.AppendUint16(dirs, uint16(len(child.entry.Name)-1))
+				dirs = append(dirs, child.entry.Name...)
+			}
+			i = end
+		}
+		n.dirSize = len(dirs) - n.dirAt + 3
+	}
+
+	var inodes []byte
+	for i, n := range nodes {
+		header := func(kind uint16) {
+			inodes = le.AppendUint16(inodes, kind)
+			inodes = le.AppendUint16(inodes, 0o755)
+			inodes = le.AppendUint32(inodes, 0)
+			inodes = le.AppendUint32(inodes, 0)
+			inodes = le.AppendUint32(inodes, uint32(i+1))
+		}
+		switch {
+		case n.entry.Dir:
+			header(squashfsBasicDir)
+			inodes = le.AppendUint32(inodes, uint32(blockStart(n.dirAt)))
+			inodes = le.AppendUint32(inodes, 2)
+			inodes = le.AppendUint16(inodes, uint16(n.dirSize))
+			inodes = le.AppendUint16(inodes, uint16(n.dirAt%squashfsMetadataSize))
+			inodes = le.AppendUint32(inodes, uint32(n.parent+1))
+		case n.entry.Target != "":
+			header(squashfsBasicSymlink)
+			inodes = le.AppendUint32(inodes, 1)
+			inodes = le.AppendUint32(inodes, uint32(len(n.entry.Target)))
+			inodes = append(inodes, n.entry.Target...)
+		case len(n.entry.Data) > testSquashfsBlockSize:
+			header(squashfsExtFile)
+			inodes = le.AppendUint64(inodes, n.start)
+			inodes = le.AppendUint64(inodes, uint64(len(n.entry.Data)))
+			inodes = le.AppendUint64(inodes, 0)
+			inodes = le.AppendUint32(inodes, 1)
+			inodes = le.AppendUint32(inodes, n.fragment)
+			inodes = le.AppendUint32(inodes, n.fragOffset)
+			inodes = le.AppendUint32(inodes, 0xFFFFFFFF)
+		default:
+			header(squashfsBasicFile)
+			inodes = le.AppendUint32(inodes, uint32(n.start))
+			inodes = le.AppendUint32(inodes, n.fragment)
+			inodes = le.AppendUint32(inodes, n.fragOffset)
+			inodes = le.AppendUint32(inodes, uint32(len(n.entry.Data)))
+		}
+		for _, size := range n.blockSizes {
+			inodes = le.AppendUint32(inodes, size)
+		}
+	}
+
+	// metadataTable appends a table in metadata blocks and returns where it starts
+	metadataTable := func(table []byte) uint64 {
+		start := uint64(len(img))
+		for len(table) > 0 {
+			chunk := table[:min(len(table), squashfsMetadataSize)]
+			table = table[len(chunk):]
+			data, compressed := encode(chunk)
+			size := uint16(len(data))
+			if !compressed {
+				size |= squashfsUncompressed
+			}
+			img = le.AppendUint16(img, size)
+			img = append(img, data...)
+		}
+		return start
+	}
+	inodeTable := metadataTable(inodes)
+	dirTable := metadataTable(dirs)
+	fragmentEntries := metadataTable(fragmentTable)
+	fragmentIndex := uint64(len(img))
+	img = le.AppendUint64(img, fragmentEntries)
+
+	sb := img[:96]
+	le.PutUint32(sb[0:], squashfsMagic)
+	le.PutUint32(sb[4:], uint32(len(nodes)))
+	le.PutUint32(sb[12:], testSquashfsBlockSize)
+	le.PutUint32(sb[16:], uint32(len(fragmentTable)/16))
+	le.PutUint16(sb[20:], squashfsGzip)
+	le.PutUint16(sb[22:], 12)
+	le.PutUint16(sb[28:], 4)
+	le.PutUint64(sb[32:], ref(0))
+	le.PutUint64(sb[40:], uint64(len(img)))
+	le.PutUint64(sb[48:], 0xFFFFFFFFFFFFFFFF)
+	le.PutUint64(sb[56:], 0xFFFFFFFFFFFFFFFF)
+	le.PutUint64(sb[64:], inodeTable)
+	le.PutUint64(sb[72:], dirTable)
+	le.PutUint64(sb[80:], fragmentIndex)
+	le.PutUint64(sb[88:], 0xFFFFFFFFFFFFFFFF)
+	return img
+}
+
+func TestSquashfsReadFile(t *testing.T) {
+	// Not repetitive, so blocks don't compress to nothing
+	text := func(n int) string {
+		var b strings.Builder
+		for i := 0; b.Len() < n; i++ {
+			fmt.Fprintf(&b, "line %d of the file\n", i*7919%10007)
+		}
+		return b.String()[:n]
+	}
+	osRelease := "NAME=\"Kairos\"\nVERSION=\"v3.1.0\"\n"
+	large := text(2*testSquashfsBlockSize + 123)
+	sparse := strings.Repeat("\x00", testSquashfsBlockSize) + "end"
+	many := func(n int) []testSquashfsEntry {
+		var files []testSquashfsEntry
+		for i := range n {
+			files = append(files, testSquashfsEntry{Name: fmt.Sprintf("unit-%04d.service", i), Data: fmt.Sprint(i)})
+		}
+		return files
+	}
+	tree := func(manyFiles int) []testSquashfsEntry {
+		return []testSquashfsEntry{
+			{Name: "etc", Dir: true, Files: []testSquashfsEntry{
+				{Name: "os-release", Target: "../usr/lib/os-release"},
+				{Name: "hostname", Data: "kairos\n"},
+				{Name: "kairos-release", Target: "/etc/os-release"},
+				{Name: "loop", Target: "loop"},
+				{Name: "empty", Data: ""},
+			}},
+			{Name: "usr", Dir: true, Files: []testSquashfsEntry{
+				{Name: "lib", Dir: true, Files: []testSquashfsEntry{
+					{Name: "os-release", Data: osRelease},
+					{Name: "large", Data: large},
+					{Name: "sparse", Data: sparse},
+					{Name: "systemd", Dir: true, Files: many(manyFiles)},
+				}},
+			}},
+			{Name: "lib", Target: "usr/lib"},
+		}
+	}
+	lookups := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "/usr/lib/os-release", want: osRelease},
+		{path: "/etc/os-release", want: osRelease},
+		{path: "/etc/kairos-release", want: osRelease},
+		{path: "/lib/os-release", want: osRelease},
+		{path: "etc/hostname", want: "kairos\n"},
+		{path: "/etc/../etc/./hostname", want: "kairos\n"},
+		{path: "/etc/empty", want: ""},
+		{path: "/usr/lib/large", want: large},
+		{path: "/usr/lib/sparse", want: sparse},
+		{path: "/usr/lib/systemd/unit-0000.service", want: "0"},
+		{path: "/etc/missing", wantErr: true},
+		{path: "/etc/hostname/x", wantErr: true},
+		{path: "/usr/lib", wantErr: true},
+		{path: "/etc/loop", wantErr: true},
+	}
+
+	tests := []struct {
+		name      string
+		files     []testSquashfsEntry
+		compress  bool
+		fragments bool
+		// extra are lookups into the many files of the case
+		extra map[string]string
+	}{
+		{name: "gzip", files: tree(10), compress: true, fragments: true},
+		{name: "gzip without fragments", files: tree(10), compress: true},
+		// Enough entries and inodes to take several metadata blocks
+		{name: "uncompressed", files: tree(700), fragments: true, extra: map[string]string{
+			"/usr/lib/systemd/unit-0699.service": "699",
+			"/usr/lib/systemd/unit-0350.service": "350",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := openSquashfs(bytes.NewReader(buildTestSquashfs(tt.files, tt.compress, tt.fragments)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range lookups {
+				got, err := fs.ReadFile(l.path)
+				if l.wantErr {
+					if err == nil {
+						t.Errorf("ReadFile(%q) = %q, want an error", l.path, got)
+					}
+					continue
+				}
+				if err != nil || string(got) != l.want {
+					t.Errorf("ReadFile(%q) = %.40q, %v, want %.40q", l.path, got, err, l.want)
+				}
+			}
+			for path, want := range tt.extra {
+				if got, err := fs.ReadFile(path); err != nil || string(got) != want {
+					t.Errorf("ReadFile(%q) = %q, %v, want %q", path, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenSquashfs(t *testing.T) {
+	valid := buildTestSquashfs(nil, true, true)
+	tests := []struct {
+		name    string
+		patch   func(sb []byte)
+		wantErr string
+	}{
+		{name: "valid", patch: func([]byte) {}},
+		{name: "not squashfs", patch: func(sb []byte) { copy(sb, "hsqt") }, wantErr: "not a squashfs image"},
+		{name: "version 3", patch: func(sb []byte) { binary.LittleEndian.PutUint16(sb[28:], 3) }, wantErr: "unsupported squashfs version 3"},
+		{name: "xz", patch: func(sb []byte) { binary.LittleEndian.PutUint16(sb[20:], 4) }, wantErr: "compressed with xz"},
+		{name: "unknown compressor", patch: func(sb []byte) { binary.LittleEndian.PutUint16(sb[20:], 42) }, wantErr: "compressor 42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := append([]byte(nil), valid...)
+			tt.patch(img)
+			_, err := openSquashfs(bytes.NewReader(img))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("openSquashfs() = %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The kinds of targets a burn writes to. Loop devices and regular files run the whole burn without a
+// stick, to test it
+const (
+	TargetDrive = "drive"
+	TargetLoop  = "loop"
+	TargetFile  = "file"
+)
+
+// wipeSize is how much is cleared at both ends of a target, past the MBR and both GPT copies
+const wipeSize = 1024 * 1024
+
+// targetKind tells what the target at path is. Paths that don't exist are files the burn creates,
+// except device paths, which are a mistyped drive rather than a file to write
+func targetKind(path string) (string, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) && !isDevicePath(path) {
+		return TargetFile, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case info.Mode().IsRegular():
+		return TargetFile, nil
+	case runtime.GOOS == "linux" && strings.HasPrefix(filepath.Base(path), "loop"):
+		return TargetLoop, nil
+	}
+	return TargetDrive, nil
+}
+
+// isDevicePath tells if path names a device rather than a file
+func isDevicePath(path string) bool {
+	return strings.HasPrefix(path, "/dev/") || strings.HasPrefix(path, `\\.\`)
+}
+
+// rawDevicePath returns the raw device of a macOS disk, which bypasses the buffer cache, so reads right
+// after writes don't see stale sectors. Other paths are returned as they are
+func rawDevicePath(path string) string {
+	if runtime.GOOS == "darwin" && strings.HasPrefix(path, "/dev/disk") {
+		return "/dev/r" + strings.TrimPrefix(path, "/dev/")
+	}
+	return path
+}
+
+// targetSize returns the size of the target open in f, the size of a regular file or of the device
+func targetSize(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Mode().IsRegular() {
+		return info.Size(), nil
+	}
+	return deviceSize(f)
+}
+
+// createFileTarget makes sure the file at path exists with the given size, sparse where the OS allows.
+// A size of 0 keeps an existing file as it is and makes a missing one fallback bytes long
+func createFileTarget(path string, size, fallback int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if size == 0 && info.Size() > 0 {
+		return nil
+	}
+	if size == 0 {
+		size = fallback
+	}
+	if size <= 0 {
+		return fmt.Errorf("%s doesn't exist, give the size to make it with -size", path)
+	}
+	return f.Truncate(size)
+}
+
+// prepareTarget erases the partition tables of the target at path before the image is written. Drives
+// go through the tools of the OS, loop devices and files are wiped directly
+func prepareTarget(path string) error {
+	kind, err := targetKind(path)
+	if err != nil {
+		return err
+	}
+	if kind == TargetDrive {
+		return FormatDriveGPT(path)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	if err := wipePartitionTables(f); err != nil {
+		return err
+	}
+	if kind == TargetLoop {
+		// Best effort, loop devices only have partitions when set up with -P
+		_ = rereadPartitions(f)
+	}
+	return nil
+}
+
+// wipePartitionTables zeroes the start and the end of the target open in f, clearing the MBR, the GPT
+// and its backup and any filesystem signature found there
+func wipePartitionTables(f *os.File) error {
+	size, err := targetSize(f)
+	if err != nil {
+		return err
+	}
+	if size < sectorSize {
+		return errors.New("the target is empty")
+	}
+	// Whole sectors, devices refuse partial ones
+	end := size / sectorSize * sectorSize
+	zero := make([]byte, min(wipeSize, end))
+	if _, err := f.WriteAt(zero, 0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(zero, end-int64(len(zero))); err != nil {
+		return err
+	}
+	return f.Sync()
+}
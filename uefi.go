@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// fat32LayoutSlack is the free space left on the FAT32 partition, for the logs and configs of the live system
+const fat32LayoutSlack = 64 * 1024 * 1024
+
+// errNoEFILoader is returned for images a FAT32 copy can't boot, firmware looks for /EFI/BOOT on the stick
+var errNoEFILoader = errors.New("the ISO has no /EFI/BOOT loader, a copy of its files can't boot with UEFI")
+
+// BurnMode is how an image is written to the drive
+type BurnMode int
+
+const (
+	// BurnImage writes the ISO byte for byte, which boots from USB when the image is hybrid
+	BurnImage BurnMode = iota
+	// BurnFAT32 copies the files of the ISO to a FAT32 partition that UEFI firmware boots from
+	BurnFAT32
+)
+
+// WriteFAT32Layout partitions the drive at devicePath with a single FAT32 partition and copies the files
+// of the ISO to it along with extra files for its root. The volume is labeled like the ISO as live
+// systems find their media by label. It returns the end of the partition, where more partitions can go
+func WriteFAT32Layout(isoPath, devicePath string, extra []fatFile, progress func(done, total int64)) (int64, error) {
+	iso, err := os.Open(isoPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open ISO file: %w", err)
+	}
+	defer iso.Close()
+	descriptors, err := readISOVolumeDescriptors(iso, 0)
+	if err != nil {
+		return 0, err
+	}
+	d := isoBrowseTree(iso, descriptors)
+	var total, done int64
+	files, err := isoFATFiles(iso, d, d.Root(), 0, func(f *fatFile) {
+		total += f.Size
+		r := f.Content
+		f.Content = readerAtFunc(func(p []byte, off int64) (int, error) {
+			n, err := r.ReadAt(p, off)
+			if progress != nil {
+				done += int64(n)
+				progress(done, total)
+			}
+			return n, err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !hasEFILoader(files) {
+		return 0, errNoEFILoader
+	}
+	// Extra files replace those of the ISO with the same name
+	for _, e := range extra {
+		files = slices.DeleteFunc(files, func(f fatFile) bool { return strings.EqualFold(f.Name, e.Name) })
+		files = append(files, e)
+	}
+	var label string
+	for _, d := range descriptors {
+		if d.Type() == isoPrimary {
+			label = isoString(d.Raw[40:72])
+		}
+	}
+
+	devicePath = rawDevicePath(devicePath)
+	device, err := os.OpenFile(devicePath, os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open device %s: %w", devicePath, err)
+	}
+	defer device.Close()
+	diskSize, err := targetSize(device)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the size of %s: %w", devicePath, err)
+	}
+
+	start := int64(partitionAlign)
+	size := fatSizeFor(files, fat32LayoutSlack)
+	if start+size > diskSize {
+		return 0, fmt.Errorf("the files of the ISO need %d MB, the drive has %d MB", (start+size)/(1024*1024), diskSize/(1024*1024))
+	}
+	if err := writeFAT32MBR(device, diskSize, start, size); err != nil {
+		return 0, fmt.Errorf("failed to write the partition table: %w", err)
+	}
+	if err := formatFAT32(device, start, size, uint32(start/sectorSize), label, files); err != nil {
+		return 0, fmt.Errorf("failed to copy the files of the ISO: %w", err)
+	}
+	if err := device.Sync(); err != nil {
+		return 0, err
+	}
+	_ = rereadPartitions(device)
+	return start + size, nil
+}
+
+// writeFAT32MBR replaces the partition tables of the disk with an MBR holding one active FAT32 partition.
+// A GPT left by a previous image would take precedence, both of its headers are cleared
+func writeFAT32MBR(disk io.WriterAt, diskSize, start, size int64) error {
+	zero := make([]byte, partitionAlign)
+	if _, err := disk.WriteAt(zero, 0); err != nil {
+		return err
+	}
+	if _, err := disk.WriteAt(zero[:sectorSize], diskSize/sectorSize*sectorSize-sectorSize); err != nil {
+		return err
+	}
+	sector := make([]byte, sectorSize)
+	if _, err := rand.Read(sector[440:444]); err != nil {
+		return err
+	}
+	entry := sector[446:462]
+	entry[0] = 0x80
+	entry[4] = mbrTypeFAT32
+	copy(entry[1:4], []byte{0xFE, 0xFF, 0xFF})
+	copy(entry[5:8], []byte{0xFE, 0xFF, 0xFF})
+	binary.LittleEndian.PutUint32(entry[8:], uint32(start/sectorSize))
+	binary.LittleEndian.PutUint32(entry[12:], uint32(size/sectorSize))
+	sector[510], sector[511] = 0x55, 0xAA
+	_, err := disk.WriteAt(sector, 0)
+	return err
+}
+
+// isoBrowseTree returns the tree with the names a mounted image shows: Rock Ridge, else Joliet, else plain ISO9660
+func isoBrowseTree(r io.ReaderAt, descriptors []*isoVolumeDescriptor) *isoVolumeDescriptor {
+	var primary, joliet *isoVolumeDescriptor
+	for _, d := range descriptors {
+		switch {
+		case d.Type() == isoPrimary && primary == nil:
+			primary = d
+		case d.Joliet() && joliet == nil:
+			joliet = d
+		}
+	}
+	if joliet != nil && !isoHasRockRidge(r, primary) {
+		return joliet
+	}
+	return primary
+}
+
+// isoFATFiles lists the directory rec of the tree of d as FAT files reading from r. add is called for
+// each file, to count and wrap its content
+func isoFATFiles(r io.ReaderAt, d *isoVolumeDescriptor, rec isoDirRecord, depth int, add func(f *fatFile)) ([]fatFile, error) {
+	if depth > 64 {
+		return nil, errors.New("directories are nested too deep")
+	}
+	records, err := readISODirectory(r, 0, rec)
+	if err != nil {
+		return nil, err
+	}
+	var files []fatFile
+	for _, child := range records[2:] {
+		// Directories moved by Rock Ridge to keep the tree shallow are listed from where they belong
+		if len(susp(child.SystemUse)["RE"]) > 0 {
+			continue
+		}
+		name := isoRecordName(child, d.Joliet())
+		if child.Flags&isoFlagMultiExtent != 0 {
+			return nil, fmt.Errorf("%s is split in several extents", name)
+		}
+		if child.IsDir() {
+			sub, err := isoFATFiles(r, d, child, depth+1, add)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, fatFile{Name: name, Dir: true, Files: sub})
+			continue
+		}
+		f := fatFile{Name: name, Content: io.NewSectionReader(r, int64(child.Extent)*isoSectorSize, int64(child.Size)), Size: int64(child.Size)}
+		add(&f)
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// hasEFILoader tells if files hold an EFI/BOOT directory with a loader in it
+func hasEFILoader(files []fatFile) bool {
+	for _, dir := range []string{"EFI", "BOOT"} {
+		found := false
+		for _, f := range files {
+			if f.Dir && strings.EqualFold(f.Name, dir) {
+				files, found = f.Files, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, f := range files {
+		if !f.Dir && strings.HasSuffix(strings.ToUpper(f.Name), ".EFI") {
+			return true
+		}
+	}
+	return false
+}
+
+// readerAtFunc turns a function into an io.ReaderAt
+type readerAtFunc func(p []byte, off int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, off int64) (int, error) {
+	return f(p, off)
+}
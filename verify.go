@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChecksumSource is the sha256 an image is expected to have and where it came from
+type ChecksumSource struct {
+	SHA256 string
+	Origin string
+}
+
+// VerificationRecord is the remembered result of hashing an image. It stays valid as long as the
+// file keeps the same size and modification time
+type VerificationRecord struct {
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	SHA256     string    `json:"sha256"`
+	Expected   string    `json:"expected,omitempty"`
+	Origin     string    `json:"origin,omitempty"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// Matches tells if the image was checked against an expected checksum and it matched
+func (r VerificationRecord) Matches() bool {
+	return r.Expected != "" && r.Expected == r.SHA256
+}
+
+// verificationsMu guards the verification cache file
+var verificationsMu sync.Mutex
+
+// checksumFileNames are looked for next to an image, in this order, besides <image>.sha256
+var checksumFileNames = []string{"SHA256SUMS", "SHA256SUMS.txt", "sha256sums.txt", "sha256sum.txt", "CHECKSUMS"}
+
+// checksumCandidates returns the checksum files that may describe the image at path
+func checksumCandidates(path string) []string {
+	candidates := []string{path + ".sha256", path + ".sha256sum", strings.TrimSuffix(path, filepath.Ext(path)) + ".sha256"}
+	for _, name := range checksumFileNames {
+		candidates = append(candidates, filepath.Join(filepath.Dir(path), name))
+	}
+	return candidates
+}
+
+// DiscoverChecksum looks for the expected checksum of the image at path: a checksum file next to it,
+// or the published checksum if it was downloaded into the library
+func DiscoverChecksum(path string) (ChecksumSource, bool) {
+	name := filepath.Base(path)
+	for _, candidate := range checksumCandidates(path) {
+		data, err := os.ReadFile(candidate)
+		if err != nil {
+			continue
+		}
+		if sum, err := parseChecksumFile(data, name); err == nil {
+			return ChecksumSource{SHA256: sum, Origin: candidate}, true
+		}
+	}
+	// Imported images only have the checksum we computed ourselves, that proves nothing
+	if entry, ok := findLibraryEntry(path); ok && entry.SHA256 != "" && !strings.HasPrefix(entry.SourceURL, "file://") {
+		return ChecksumSource{SHA256: entry.SHA256, Origin: entry.SourceURL}, true
+	}
+	return ChecksumSource{}, false
+}
+
+// ResolveChecksum reads what the user typed: a sha256 hash, optionally as a sha256sum line or with a
+// sha256: prefix, or the path of a checksum file. An empty input falls back to DiscoverChecksum
+func ResolveChecksum(path, input string) (ChecksumSource, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		if src, ok := DiscoverChecksum(path); ok {
+			return src, nil
+		}
+		return ChecksumSource{}, errors.New("no checksum given and none found next to the image")
+	}
+	if fields := strings.Fields(input); len(fields) > 0 {
+		if hash := strings.TrimPrefix(strings.ToLower(fields[0]), "sha256:"); isSHA256(hash) {
+			return ChecksumSource{SHA256: hash, Origin: "entered by hand"}, nil
+		}
+	}
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return ChecksumSource{}, fmt.Errorf("not a sha256 hash nor a readable checksum file: %w", err)
+	}
+	sum, err := parseChecksumFile(data, filepath.Base(path))
+	if err != nil {
+		return ChecksumSource{}, fmt.Errorf("%s: %w", input, err)
+	}
+	return ChecksumSource{SHA256: sum, Origin: input}, nil
+}
+
+func verificationsPath() (string, error) {
+	dir, err := userCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "verifications.json"), nil
+}
+
+func readVerifications() map[string]VerificationRecord {
+	records := make(map[string]VerificationRecord)
+	path, err := verificationsPath()
+	if err != nil {
+		return records
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return records
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		logln("Ignoring invalid verification cache:", err)
+		return make(map[string]VerificationRecord)
+	}
+	return records
+}
+
+// CachedVerification returns the remembered result for the image at path if the file didn't change since
+func CachedVerification(path string) (VerificationRecord, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return VerificationRecord{}, false
+	}
+	verificationsMu.Lock()
+	defer verificationsMu.Unlock()
+	record, ok := readVerifications()[path]
+	if !ok || record.Size != info.Size() || !record.ModTime.Equal(info.ModTime()) {
+		return VerificationRecord{}, false
+	}
+	return record, true
+}
+
+// rememberVerification stores the result for path, dropping records of files that are gone
+func rememberVerification(path string, record VerificationRecord) error {
+	verificationsMu.Lock()
+	defer verificationsMu.Unlock()
+	records := readVerifications()
+	for p := range records {
+		if _, err := os.Stat(p); err != nil {
+			delete(records, p)
+		}
+	}
+	records[path] = record
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	cachePath, err := verificationsPath()
+	if err != nil {
+		return err
+	}
+	return writeUserFile(cachePath, data)
+}
+
+// VerifyImage compares the sha256 of the image at path with expected. The hash of an unchanged file is
+// taken from the cache, otherwise it is computed reporting progress. The result is remembered either way
+// and goes to the event stream, if any
+func VerifyImage(path string, expected ChecksumSource, progress func(done, total int64)) (VerificationRecord, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return VerificationRecord{}, err
+	}
+	events := appEvents.job("verify", path)
+	record, ok := CachedVerification(path)
+	if !ok {
+		events.Phase("hash", "computing the sha256")
+		sum, err := sha256File(path, func(done, total int64) {
+			events.Progress(done, total)
+			if progress != nil {
+				progress(done, total)
+			}
+		})
+		if err != nil {
+			events.Error(err)
+			return VerificationRecord{}, err
+		}
+		record = VerificationRecord{Size: info.Size(), ModTime: info.ModTime(), SHA256: sum}
+	}
+	record.Expected = strings.ToLower(expected.SHA256)
+	record.Origin = expected.Origin
+	record.VerifiedAt = time.Now()
+	if err := rememberVerification(path, record); err != nil {
+		logln("Error saving verification result:", err)
+	}
+	if !record.Matches() {
+		events.Verification("checksum", "mismatch", expected.Origin)
+		return record, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, record.Expected, record.SHA256)
+	}
+	events.Verification("checksum", "verified", expected.Origin)
+	return record, nil
+}
+
+// recordVerifiedDownload remembers a download that was already checked against its published checksum,
+// so it isn't hashed again before burning
+func recordVerifiedDownload(path, checksum, origin string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	checksum = strings.ToLower(checksum)
+	return rememberVerification(path, VerificationRecord{
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		SHA256:     checksum,
+		Expected:   checksum,
+		Origin:     origin,
+		VerifiedAt: time.Now(),
+	})
+}
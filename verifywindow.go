@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/diamondburned/gotk4/pkg/gio/v2"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// verifyBeforeBurn runs proceed right away if the image was already verified. Otherwise it opens the
+// verification window, which calls proceed once the image matches or the user chooses to skip the check
+func verifyBeforeBurn(parent *gtk.Window, path string, proceed func()) {
+	if record, ok := CachedVerification(path); ok && record.Matches() {
+		proceed()
+		return
+	}
+	showVerifyWindow(parent, path, proceed)
+}
+
+// showVerifyWindow lets the user check the image at path against a pasted hash or a checksum file.
+// A checksum file found next to the image is filled in and checked straight away. proceed may be nil
+// when the window is opened just to verify
+func showVerifyWindow(parent *gtk.Window, path string, proceed func()) {
+	verifyWin := gtk.NewWindow()
+	verifyWin.SetTitle("Verify ISO")
+	verifyWin.SetTransientFor(parent)
+	verifyWin.SetModal(true)
+	verifyWin.SetDefaultSize(600, -1)
+
+	vbox := gtk.NewBox(gtk.OrientationVertical, 10)
+	vbox.SetMarginTop(20)
+	vbox.SetMarginBottom(20)
+	vbox.SetMarginStart(20)
+	vbox.SetMarginEnd(20)
+
+	title := gtk.NewLabel("Verify " + filepath.Base(path))
+	title.SetHAlign(gtk.AlignStart)
+	title.SetWrap(true)
+	vbox.Append(title)
+
+	checksumEntry := gtk.NewEntry()
+	checksumEntry.SetPlaceholderText("Paste a SHA256 hash or the path of a SHA256SUMS/.sha256 file")
+	checksumEntry.SetHExpand(true)
+	chooseBtn := gtk.NewButtonWithLabel("Choose file...")
+	entryBox := gtk.NewBox(gtk.OrientationHorizontal, 5)
+	entryBox.Append(checksumEntry)
+	entryBox.Append(chooseBtn)
+	vbox.Append(entryBox)
+
+	progress := gtk.NewProgressBar()
+	progress.SetShowText(true)
+	progress.SetText("")
+	vbox.Append(progress)
+
+	statusLabel := gtk.NewLabel("")
+	statusLabel.SetHAlign(gtk.AlignStart)
+	statusLabel.SetWrap(true)
+	statusLabel.SetSelectable(true)
+	vbox.Append(statusLabel)
+
+	buttonBox := gtk.NewBox(gtk.OrientationHorizontal, 10)
+	buttonBox.SetHAlign(gtk.AlignEnd)
+	cancelBtn := gtk.NewButtonWithLabel("Cancel")
+	buttonBox.Append(cancelBtn)
+	skipBtn := gtk.NewButtonWithLabel("Burn without verifying")
+	if proceed != nil {
+		buttonBox.Append(skipBtn)
+	}
+	verifyBtn := gtk.NewButtonWithLabel("Verify")
+	verifyBtn.SetCSSClasses([]string{"suggested-action"})
+	buttonBox.Append(verifyBtn)
+	vbox.Append(buttonBox)
+
+	// known are the checksums we found ourselves, so the hash shown in the entry keeps its origin
+	known := make(map[string]ChecksumSource)
+	if record, ok := CachedVerification(path); ok && record.Expected != "" {
+		known[record.Expected] = ChecksumSource{SHA256: record.Expected, Origin: record.Origin}
+		checksumEntry.SetText(record.Expected)
+		if record.Matches() {
+			statusLabel.SetText(fmt.Sprintf("✅ Verified on %s against %s", record.VerifiedAt.Format("2006-01-02 15:04"), record.Origin))
+		} else {
+			statusLabel.SetText(fmt.Sprintf("❌ Did not match %s on %s\nSHA256: %s", record.Origin, record.VerifiedAt.Format("2006-01-02 15:04"), record.SHA256))
+		}
+	}
+
+	verifying := false
+	verify := func() {
+		if verifying {
+			return
+		}
+		expected, ok := known[checksumEntry.Text()]
+		if !ok {
+			var err error
+			if expected, err = ResolveChecksum(path, checksumEntry.Text()); err != nil {
+				statusLabel.SetText("❌ " + err.Error())
+				return
+			}
+		}
+		verifying = true
+		verifyBtn.SetSensitive(false)
+		statusLabel.SetText("Computing SHA256...")
+		go func() {
+			record, err := VerifyImage(path, expected, func(done, total int64) {
+				glib.IdleAdd(func() {
+					progress.SetFraction(float64(done) / float64(max(total, 1)))
+					progress.SetText(fmt.Sprintf("%d%%", done*100/max(total, 1)))
+				})
+			})
+			glib.IdleAdd(func() {
+				verifying = false
+				verifyBtn.SetSensitive(true)
+				progress.SetFraction(1)
+				switch {
+				case errors.Is(err, ErrChecksumMismatch):
+					statusLabel.SetText(fmt.Sprintf("❌ The image doesn't match %s\nExpected: %s\nSHA256:   %s", expected.Origin, record.Expected, record.SHA256))
+				case err != nil:
+					statusLabel.SetText("❌ " + err.Error())
+				default:
+					statusLabel.SetText("✅ The image matches " + expected.Origin)
+					if proceed != nil {
+						verifyWin.Close()
+						proceed()
+					}
+				}
+			})
+		}()
+	}
+
+	chooseBtn.ConnectClicked(func() {
+		dialog := gtk.NewFileDialog()
+		dialog.SetTitle("Select Checksum File")
+		dialog.SetModal(true)
+		dialog.SetInitialFolder(gio.NewFileForPath(filepath.Dir(path)))
+		dialog.Open(context.Background(), verifyWin, func(res gio.AsyncResulter) {
+			file, err := dialog.OpenFinish(res)
+			if err != nil || file == nil {
+				return
+			}
+			checksumEntry.SetText(file.Path())
+			verify()
+		})
+	})
+	checksumEntry.ConnectActivate(verify)
+	verifyBtn.ConnectClicked(verify)
+	cancelBtn.ConnectClicked(verifyWin.Close)
+	skipBtn.ConnectClicked(func() {
+		verifyWin.Close()
+		proceed()
+	})
+
+	verifyWin.SetChild(vbox)
+	verifyWin.SetVisible(true)
+
+	if checksumEntry.Text() == "" {
+		if src, ok := DiscoverChecksum(path); ok {
+			known[src.SHA256] = src
+			checksumEntry.SetText(src.SHA256)
+			verify()
+		}
+	}
+}